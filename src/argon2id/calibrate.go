@@ -0,0 +1,75 @@
+package argon2id
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// calibrationSamples 是每组参数测量的次数，取最短的一次，减少其他进程对测量结果的影响。
+const calibrationSamples = 2
+
+// Calibrate 在当前机器上寻找哈希时间接近 target 的参数，用于在启动时替换 DefaultParams。
+// 哈希时间大致与 内存 × 迭代次数 成正比。Argon2id 主要依靠内存抵抗 GPU 破解，所以优先增加内存：
+// 1. 从 minMemory、t=1 开始，每次把内存加倍，直到哈希时间达到 target 或者内存达到 maxMemory。
+// 2. 如果最后一次加倍超过了 target，按比例减少内存 (不低于 minMemory)。
+// 3. 如果内存达到上限后仍然低于 target，按比例增加迭代次数。
+// minMemory 本身已经超过 target 时返回 minMemory 和 t=1。并行度固定为 1。
+// 盐的长度几乎不影响哈希时间，返回的参数沿用 DefaultParams.SaltLength。
+// 参数：
+//   target time.Duration: 目标哈希时间，例如 250ms。
+//   minMemory uint32: 内存下限，单位 KiB，通常是 DefaultParams.Memory。
+//   maxMemory uint32: 内存上限，单位 KiB。
+// 返回值：
+//   Params: 选择的参数。
+//   time.Duration: 用选择的参数测量到的哈希时间。
+//   error: 参数无效时返回错误。
+func Calibrate(target time.Duration, minMemory uint32, maxMemory uint32) (Params, time.Duration, error) {
+	if target <= 0 {
+		return Params{}, 0, errors.New("calibration target must be positive")
+	}
+	if minMemory < 8 {
+		return Params{}, 0, errors.New("calibration minimum memory must be at least 8 KiB")
+	}
+	if maxMemory < minMemory {
+		return Params{}, 0, errors.New("calibration maximum memory must not be less than the minimum memory")
+	}
+
+	params := Params{Memory: minMemory, Time: 1, Parallelism: 1, SaltLength: DefaultParams.SaltLength}
+	duration := measureHashDuration(params)
+	for duration < target && params.Memory < maxMemory {
+		params.Memory = uint32(min(uint64(params.Memory)*2, uint64(maxMemory)))
+		duration = measureHashDuration(params)
+	}
+	if duration > target && params.Memory > minMemory {
+		memory := float64(params.Memory) * float64(target) / float64(duration)
+		params.Memory = max(minMemory, uint32(memory))
+		duration = measureHashDuration(params)
+	}
+	if duration < target {
+		iterations := math.Round(float64(target) / float64(duration))
+		if iterations > 1 {
+			params.Time = uint32(min(iterations, math.MaxUint32))
+			duration = measureHashDuration(params)
+		}
+	}
+	return params, duration, nil
+}
+
+// measureHashDuration 返回用 params 计算一次哈希的最短时间。
+func measureHashDuration(params Params) time.Duration {
+	salt := make([]byte, 16)
+	var shortest time.Duration
+	for i := 0; i < calibrationSamples; i++ {
+		start := time.Now()
+		argon2.IDKey([]byte("calibration"), salt, params.Time, params.Memory, params.Parallelism, 32)
+		duration := time.Since(start)
+		if i == 0 || duration < shortest {
+			shortest = duration
+		}
+	}
+	// 避免在计算比例时除以 0
+	return max(shortest, time.Nanosecond)
+}
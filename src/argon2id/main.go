@@ -6,29 +6,50 @@ import (
 	"encoding/base64"    // 用于将字节序列编码为 Base64 字符串，以便存储和传输
 	"errors"             // 用于创建和处理错误
 	"fmt"                // 用于格式化字符串
+	"math"               // 用于检查解析出的参数范围
 	"strings"            // 用于字符串操作，例如分割哈希字符串
 
 	"golang.org/x/crypto/argon2" // 导入 Argon2 加密库
 )
 
+// Params 是 Argon2id 的参数。
+type Params struct {
+	Memory      uint32 // 内存消耗 (m)，单位 KiB
+	Time        uint32 // 迭代次数 (t)
+	Parallelism uint8  // 并行度 (p)
+	SaltLength  uint32 // 随机盐的长度，单位字节
+}
+
+// 盐的长度范围，单位字节。Hash 拒绝配置在范围之外的 SaltLength，Verify 拒绝盐的长度在范围之外的哈希。
+// NIST 要求盐至少 16 字节 (默认值)，下限 8 字节是 Argon2 规范的最小值，用于兼容从其他系统导入的哈希。
+const (
+	MinSaltLength = 8
+	MaxSaltLength = 64
+)
+
+// DefaultParams 是 Hash 生成新哈希时使用的参数。
+// 启动时可以替换为 Calibrate 的结果，必须在开始处理请求之前设置。
+// 已有的哈希不受影响，Verify 使用哈希中保存的参数和盐。
+var DefaultParams = Params{Memory: 19456, Time: 2, Parallelism: 1, SaltLength: 16}
+
 // Hash 函数接收一个明文密码字符串，使用 Argon2id 算法生成一个安全的密码哈希值。
 // Argon2id 是目前推荐的密码哈希算法之一，它结合了 Argon2i 和 Argon2d 的优点，
 // 既能抵抗 GPU 破解（通过内存消耗），也能抵抗侧信道攻击。
 //
 // 工作流程:
-// 1. 生成一个随机的 16 字节盐 (salt)。盐的作用是确保即使两个用户使用相同的密码，
+// 1. 生成一个 DefaultParams.SaltLength (默认 16) 字节的随机盐 (salt)。盐的作用是确保即使两个用户使用相同的密码，
 //    他们的哈希值也是不同的，增加了彩虹表攻击的难度。
 // 2. 调用 golang.org/x/crypto/argon2.IDKey 函数，传入密码、盐和 Argon2id 参数，
 //    计算出派生的密钥 (derived key)，也就是密码的哈希结果。
 //    参数说明:
 //      - []byte(password): 明文密码的字节表示。
 //      - salt: 随机生成的盐。
-//      - time (t): 2 (迭代次数，增加计算成本)。
-//      - memory (m): 19456 (内存消耗，单位 KiB，增加内存需求)。
-//      - parallelism (p): 1 (并行度，使用的线程数)。
+//      - time (t): DefaultParams.Time，默认 2 (迭代次数，增加计算成本)。
+//      - memory (m): DefaultParams.Memory，默认 19456 (内存消耗，单位 KiB，增加内存需求)。
+//      - parallelism (p): DefaultParams.Parallelism，默认 1 (并行度，使用的线程数)。
 //      - keyLen: 32 (生成的哈希密钥长度，单位字节)。
 //    这些参数的选择影响了哈希的强度和计算所需资源，需要根据安全需求和服务器性能进行调整。
-//    这里的参数 (t=2, m=19MiB, p=1) 是一个相对适中的选择。
+//    默认参数 (t=2, m=19MiB, p=1) 是一个相对适中的选择，也可以用 Calibrate 根据服务器性能选择。
 // 3. 将算法标识、版本、参数、盐 (Base64 编码) 和派生密钥 (Base64 编码) 组合成
 //    一个标准的 Argon2 哈希字符串格式，例如：
 //    `$argon2id$v=19$m=19456,t=2,p=1$生成的盐Base64$生成的密钥Base64`
@@ -39,25 +60,46 @@ import (
 //
 // 返回值:
 //   string: 生成的 Argon2id 密码哈希字符串。
-//   error: 如果在生成随机盐时发生错误，则返回错误。
+//   error: 如果 DefaultParams.SaltLength 不在 MinSaltLength 到 MaxSaltLength 之间，
+//          或者在生成随机盐时发生错误，则返回错误。
 func Hash(password string) (string, error) {
-	// 1. 生成 16 字节的随机盐
-	salt := make([]byte, 16)
+	return HashWithParams(password, DefaultParams)
+}
+
+// HashWithParams 和 Hash 相同，但使用给定的参数而不是 DefaultParams。
+// 参数保存在生成的哈希中，Verify 总是使用哈希中的参数，所以不同参数生成的哈希可以共存
+// (例如逐步调整参数时，不同节点暂时使用不同的参数)。
+//
+// 参数:
+//   password (string): 用户提供的明文密码。
+//   params (Params): Argon2id 参数，SaltLength 必须在 MinSaltLength 到 MaxSaltLength 之间。
+//
+// 返回值:
+//   string: 生成的 Argon2id 密码哈希字符串。
+//   error: 如果参数无效，或者在生成随机盐时发生错误，则返回错误。
+func HashWithParams(password string, params Params) (string, error) {
+	if params.Time < 1 || params.Parallelism < 1 || params.Memory < 8*uint32(params.Parallelism) {
+		return "", errors.New("invalid parameters: time and parallelism must be at least 1 and memory at least 8*parallelism KiB")
+	}
+	if params.SaltLength < MinSaltLength || params.SaltLength > MaxSaltLength {
+		return "", fmt.Errorf("salt length must be between %d and %d bytes", MinSaltLength, MaxSaltLength)
+	}
+	// 1. 生成随机盐
+	salt := make([]byte, params.SaltLength)
 	_, err := rand.Read(salt)
 	if err != nil {
 		// 如果生成随机盐失败，返回错误
 		return "", err
 	}
-	// 2. 使用 Argon2id 计算派生密钥 (哈希)
-	// 参数: 时间成本 t=2, 内存成本 m=19*1024=19456 KiB, 并行度 p=1, 输出密钥长度 32 字节
-	key := argon2.IDKey([]byte(password), salt, 2, 19456, 1, 32)
+	// 2. 使用 Argon2id 计算派生密钥 (哈希)，输出密钥长度 32 字节
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Parallelism, 32)
 	// 3. 格式化为标准的 Argon2 哈希字符串
 	// 使用 RawStdEncoding 避免 Base64 编码中的 '=' 填充符
 	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
 		argon2.Version, // 使用库中定义的 Argon2 版本号 (通常是 19，即 0x13)
-		19456,          // 内存参数 m
-		2,              // 时间参数 t
-		1,              // 并行度参数 p
+		params.Memory,      // 内存参数 m
+		params.Time,        // 时间参数 t
+		params.Parallelism, // 并行度参数 p
 		base64.RawStdEncoding.EncodeToString(salt), // Base64 编码的盐
 		base64.RawStdEncoding.EncodeToString(key)) // Base64 编码的派生密钥
 	return hash, nil
@@ -71,12 +113,12 @@ func Hash(password string) (string, error) {
 // 2. 验证格式: 检查分割后的部分数量是否正确 (预期为 6 部分)，以及各部分是否符合预期格式
 //    (例如，第二部分是 "argon2id"，第三部分是 "v=19" 等)。
 // 3. 提取参数: 从第四部分提取 Argon2id 的内存 (m)、时间 (t) 和并行度 (p) 参数。
-//    注意：当前实现中，虽然提取了参数，但在后续计算 key2 时并未使用这些提取出的参数，
-//    而是硬编码了与 Hash 函数相同的参数 (t=2, m=19456, p=1)。这是一个潜在的问题，
-//    如果 Hash 函数的参数未来发生改变，这里的验证逻辑需要同步更新。
-//    更健壮的实现应该使用从哈希中提取出的 m, t, p 参数来计算 key2。
+//    DefaultParams 可能被修改 (见 Calibrate)，所以必须使用哈希中保存的参数，
+//    而不是当前的 DefaultParams。
 // 4. 解码盐和密钥: 从第五和第六部分解码 Base64 编码的盐 (salt) 和存储的派生密钥 (key1)。
-// 5. 重新计算哈希: 使用从哈希中提取的盐 (salt) 和**硬编码的参数** (t=2, m=19456, p=1)
+//    盐的长度由哈希决定，可以和当前的 DefaultParams.SaltLength 不同，但必须在
+//    MinSaltLength 到 MaxSaltLength 之间。
+// 5. 重新计算哈希: 使用从哈希中提取的盐 (salt) 和参数 (m, t, p)
 //    以及用户提供的明文密码，调用 argon2.IDKey 重新计算一个派生密钥 (key2)。
 //    输出密钥的长度与解码出的 key1 保持一致。
 // 6. 比较密钥: 使用 crypto/subtle.ConstantTimeCompare 函数在常量时间内比较
@@ -93,62 +135,130 @@ func Hash(password string) (string, error) {
 //   bool: 如果密码与哈希匹配，返回 true；否则返回 false。
 //   error: 如果哈希字符串格式无效、算法或版本不受支持，或者在解析或解码过程中发生错误，则返回错误。
 func Verify(hash string, password string) (bool, error) {
-	// 1. 分割哈希字符串
+	// 1-4. 解析哈希字符串，取出参数、盐和存储的派生密钥 (key1)
+	params, salt, key1, err := parseHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	// 5. 使用从哈希中提取的盐和参数重新计算密钥 (key2)
+	key2 := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Parallelism, uint32(len(key1)))
+
+	// 6. 使用常量时间比较两个密钥
+	// subtle.ConstantTimeCompare 返回 1 表示相等，0 表示不相等。
+	valid := subtle.ConstantTimeCompare(key1, key2)
+
+	// 如果 valid == 1，则密码匹配，返回 true, nil
+	return valid == 1, nil
+}
+
+// CheckHash 检查哈希字符串是否可以被 Verify 验证，用于校验从其他系统导入的哈希。
+// 参数必须是原来的默认参数 (m=19456,t=2,p=1)：Verify 使用哈希中保存的参数，
+// 导入参数过大的哈希会让每次验证占用过多内存或时间。盐和密钥必须是没有填充的 Base64，
+// 盐的长度必须在 MinSaltLength 到 MaxSaltLength 之间。
+//
+// 返回值:
+//   error: 哈希可以被验证时返回 nil，否则返回说明原因的错误。
+func CheckHash(hash string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return errors.New("invalid hash format: incorrect number of parts")
+	}
+	if parts[1] != "argon2id" {
+		return errors.New("invalid algorithm: expected 'argon2id'")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return fmt.Errorf("unsupported hash version: expected 'v=%d'", argon2.Version)
+	}
+	if parts[3] != "m=19456,t=2,p=1" {
+		return errors.New("unsupported hash parameters: expected 'm=19456,t=2,p=1'")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return errors.New("invalid hash format: failed to decode salt")
+	}
+	if len(salt) < MinSaltLength || len(salt) > MaxSaltLength {
+		return errors.New("invalid hash format: salt length out of range")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return errors.New("invalid hash format: failed to decode key")
+	}
+	return nil
+}
+
+// HashParams 返回哈希中保存的参数，用于监控 (例如统计还有多少哈希使用旧的参数)。
+// 返回的 SaltLength 是哈希中盐的实际长度。
+//
+// 参数:
+//   hash (string): Argon2id 密码哈希字符串。
+//
+// 返回值:
+//   Params: 哈希中保存的参数。
+//   error: 如果哈希的格式无效 (和 Verify 的检查相同)，则返回错误。
+func HashParams(hash string) (Params, error) {
+	params, _, _, err := parseHash(hash)
+	return params, err
+}
+
+// parseHash 解析 Hash 生成的哈希字符串，检查格式、算法、版本、参数范围和盐的长度。
+// Verify 和 HashParams 使用同样的检查。
+//
+// 返回值:
+//   Params: 哈希中保存的参数，SaltLength 是盐的长度。
+//   []byte: 盐。
+//   []byte: 存储的派生密钥。
+//   error: 如果哈希字符串格式无效、算法或版本不受支持，或者在解析或解码过程中发生错误，则返回错误。
+func parseHash(hash string) (Params, []byte, []byte, error) {
+	// 分割哈希字符串
 	parts := strings.Split(hash, "$")
-	// 2. 验证格式 - 期望有 6 个部分 (空字符串, "argon2id", "v=19", "m=...,t=...,p=...", salt, key)
+	// 验证格式 - 期望有 6 个部分 (空字符串, "argon2id", "v=19", "m=...,t=...,p=...", salt, key)
 	if len(parts) != 6 {
-		return false, errors.New("invalid hash format: incorrect number of parts")
+		return Params{}, nil, nil, errors.New("invalid hash format: incorrect number of parts")
 	}
 	// 验证第一部分是否为空
 	if parts[0] != "" {
-		return false, errors.New("invalid hash format: expected empty first part")
+		return Params{}, nil, nil, errors.New("invalid hash format: expected empty first part")
 	}
 	// 验证算法标识
 	if parts[1] != "argon2id" {
-		return false, errors.New("invalid algorithm: expected 'argon2id'")
+		return Params{}, nil, nil, errors.New("invalid algorithm: expected 'argon2id'")
 	}
 	// 验证版本号
 	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
-		return false, fmt.Errorf("unsupported hash version: expected 'v=%d'", argon2.Version)
-	}
-	// 3. 提取参数 (m, t, p)
-	var m uint32 // 注意：库函数使用 uint32
-	var t, p uint8 // 注意：库函数使用 uint8
-	// 注意：fmt.Sscanf 对无符号整数的支持可能不直接，这里用 %d 读取到 int32 再转换可能更安全，
-	// 或者直接解析字符串。但考虑到这里的参数值不大，直接用 %d 读取到临时变量再赋值给 uint 也可以。
-	// 更好的方法是手动解析 parts[3] 字符串。当前 Sscanf 的写法可能不够健壮。
-	var mScan int32
-	var tScan, pScan int32
+		return Params{}, nil, nil, fmt.Errorf("unsupported hash version: expected 'v=%d'", argon2.Version)
+	}
+	// 提取参数 (m, t, p)
+	// 先读取到 int64，检查范围后再转换成库函数使用的类型，避免溢出
+	var mScan, tScan, pScan int64
 	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mScan, &tScan, &pScan)
 	if err != nil {
-		return false, fmt.Errorf("invalid hash format: failed to parse parameters: %w", err)
+		return Params{}, nil, nil, fmt.Errorf("invalid hash format: failed to parse parameters: %w", err)
+	}
+	// argon2.IDKey 要求 t >= 1、p >= 1，内存至少为 8*p KiB
+	if tScan < 1 || tScan > math.MaxUint32 || pScan < 1 || pScan > math.MaxUint8 || mScan < 8*pScan || mScan > math.MaxUint32 {
+		return Params{}, nil, nil, errors.New("invalid hash format: parameters out of range")
 	}
-	m = uint32(mScan)
-	t = uint8(tScan)
-	p = uint8(pScan)
 
-	// 4. 解码盐 (salt)
+	// 解码盐 (salt)
 	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
 	if err != nil {
-		return false, fmt.Errorf("invalid hash format: failed to decode salt: %w", err)
+		return Params{}, nil, nil, fmt.Errorf("invalid hash format: failed to decode salt: %w", err)
 	}
-	// 4. 解码存储的派生密钥 (key1)
-	key1, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if len(salt) < MinSaltLength || len(salt) > MaxSaltLength {
+		return Params{}, nil, nil, errors.New("invalid hash format: salt length out of range")
+	}
+	// 解码存储的派生密钥
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
 	if err != nil {
-		return false, fmt.Errorf("invalid hash format: failed to decode key: %w", err)
+		return Params{}, nil, nil, fmt.Errorf("invalid hash format: failed to decode key: %w", err)
 	}
 
-	// 5. 使用从哈希中提取的盐和 *硬编码* 的参数重新计算密钥 (key2)
-	// !!! 重要提示: 这里硬编码了参数 (t=2, m=19456, p=1), 而不是使用从哈希中解析出的 m, t, p。
-	// 这意味着如果 Hash 函数的参数改变，这里的验证会失败。正确的做法是使用解析出的 m, t, p。
-	// 例如: key2 := argon2.IDKey([]byte(password), salt, uint32(t), m, uint8(p), uint32(len(key1)))
-	// 为了与当前 Hash 函数的行为保持一致，暂时保留硬编码。
-	key2 := argon2.IDKey([]byte(password), salt, 2, 19456, 1, uint32(len(key1)))
-
-	// 6. 使用常量时间比较两个密钥
-	// subtle.ConstantTimeCompare 返回 1 表示相等，0 表示不相等。
-	valid := subtle.ConstantTimeCompare(key1, key2)
-
-	// 如果 valid == 1，则密码匹配，返回 true, nil
-	return valid == 1, nil
+	params := Params{
+		Memory:      uint32(mScan),
+		Time:        uint32(tScan),
+		Parallelism: uint8(pScan),
+		SaltLength:  uint32(len(salt)),
+	}
+	return params, salt, key, nil
 }
@@ -1,6 +1,11 @@
 package argon2id
 
-import "testing" // 导入 Go 的测试包
+import (
+	"encoding/base64" // 导入 Base64 包，用于解码哈希中的盐
+	"strings"         // 导入字符串包，用于检查哈希中的参数
+	"testing"         // 导入 Go 的测试包
+	"time"            // 导入时间包，用于校准的目标时间
+)
 
 // Test 函数用于测试 argon2id 包中的 Hash 和 Verify 函数的功能。
 // 它执行以下步骤：
@@ -49,3 +54,258 @@ func Test(t *testing.T) {
 		t.Fatalf("Expected hash to not match")
 	}
 }
+
+// TestCheckHash 测试 CheckHash 接受 Hash 生成的哈希，拒绝格式或参数不对的哈希。
+func TestCheckHash(t *testing.T) {
+	hash, err := Hash("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckHash(hash); err != nil {
+		t.Fatalf("Expected hash to be valid: %v", err)
+	}
+
+	invalidHashes := []string{
+		"",
+		"not a hash",
+		"$argon2i$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=16$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=65536,t=3,p=4$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!!$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	}
+	for _, invalidHash := range invalidHashes {
+		if CheckHash(invalidHash) == nil {
+			t.Errorf("Expected hash %q to be invalid", invalidHash)
+		}
+	}
+}
+
+// TestVerifyUsesHashParams 测试 Verify 使用哈希中保存的参数，修改 DefaultParams 后已有的哈希仍然可以验证。
+func TestVerifyUsesHashParams(t *testing.T) {
+	defaultParams := DefaultParams
+	defer func() {
+		DefaultParams = defaultParams
+	}()
+
+	DefaultParams = Params{Memory: 1024, Time: 1, Parallelism: 1, SaltLength: 16}
+	hash, err := Hash("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(hash, "$m=1024,t=1,p=1$") {
+		t.Fatalf("Expected hash to use DefaultParams: %s", hash)
+	}
+
+	DefaultParams = defaultParams
+	valid, err := Verify(hash, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatalf("Expected hash to match")
+	}
+
+	_, err = Verify("$argon2id$v=19$m=19456,t=0,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ", "123456")
+	if err == nil {
+		t.Fatalf("Expected hash with t=0 to be invalid")
+	}
+}
+
+// TestHashSaltLength 测试 Hash 使用 DefaultParams.SaltLength 长度的盐，拒绝范围之外的盐长度，
+// Verify 和 CheckHash 检查哈希中盐的长度。
+func TestHashSaltLength(t *testing.T) {
+	defaultParams := DefaultParams
+	defer func() {
+		DefaultParams = defaultParams
+	}()
+
+	DefaultParams.SaltLength = 32
+	hash, err := Hash("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(strings.Split(hash, "$")[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != 32 {
+		t.Fatalf("Expected 32-byte salt, got %d bytes", len(salt))
+	}
+	// 修改盐的长度后已有的哈希仍然可以验证
+	DefaultParams = defaultParams
+	valid, err := Verify(hash, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatalf("Expected hash to match")
+	}
+	if err := CheckHash(hash); err != nil {
+		t.Fatalf("Expected hash to be valid: %v", err)
+	}
+
+	DefaultParams.SaltLength = MinSaltLength - 1
+	_, err = Hash("123456")
+	if err == nil {
+		t.Fatalf("Expected error for salt length below the minimum")
+	}
+	DefaultParams.SaltLength = MaxSaltLength + 1
+	_, err = Hash("123456")
+	if err == nil {
+		t.Fatalf("Expected error for salt length above the maximum")
+	}
+
+	// 4 字节的盐
+	shortSaltHash := "$argon2id$v=19$m=19456,t=2,p=1$AAAAAA$CS/AV+PQs08MhdeIrHhfmQ"
+	_, err = Verify(shortSaltHash, "123456")
+	if err == nil {
+		t.Fatalf("Expected hash with a short salt to be invalid")
+	}
+	if CheckHash(shortSaltHash) == nil {
+		t.Fatalf("Expected hash with a short salt to be invalid")
+	}
+}
+
+// TestCalibrate 测试 Calibrate 选择的参数的哈希时间接近目标 (允许 0.5 到 2 倍的误差，避免受机器负载影响)。
+// 目标很小，测试运行得足够快。
+func TestCalibrate(t *testing.T) {
+	target := 20 * time.Millisecond
+	params, _, err := Calibrate(target, 1024, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.SaltLength != DefaultParams.SaltLength {
+		t.Fatalf("Expected salt length to be kept: %+v", params)
+	}
+	if params.Memory < 1024 || params.Memory > 64*1024 {
+		t.Fatalf("Expected memory to be between the minimum and maximum: %d", params.Memory)
+	}
+	duration := measureHashDuration(params)
+	if duration < target/2 || duration > target*2 {
+		t.Fatalf("Expected hash duration to be close to %v, got %v with %+v", target, duration, params)
+	}
+
+	// 内存上限很低时增加迭代次数
+	params, _, err = Calibrate(target, 64, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Memory != 64 || params.Time <= 1 {
+		t.Fatalf("Expected memory to be capped and time to be increased: %+v", params)
+	}
+
+	_, _, err = Calibrate(0, 1024, 2048)
+	if err == nil {
+		t.Fatalf("Expected error for zero target")
+	}
+	_, _, err = Calibrate(target, 2048, 1024)
+	if err == nil {
+		t.Fatalf("Expected error for maximum memory less than minimum memory")
+	}
+}
+
+// TestVerifyAcrossParams 模拟不同节点使用不同参数的情况：用三组参数分别生成哈希并保存，
+// 然后在每一组参数作为 DefaultParams 时验证所有保存的哈希。Verify 只使用哈希中保存的参数，
+// 所以每个哈希在任何节点上都可以验证。
+func TestVerifyAcrossParams(t *testing.T) {
+	defaultParams := DefaultParams
+	defer func() {
+		DefaultParams = defaultParams
+	}()
+
+	paramSets := []Params{
+		{Memory: 1024, Time: 1, Parallelism: 1, SaltLength: 16},
+		{Memory: 2048, Time: 2, Parallelism: 2, SaltLength: 24},
+		{Memory: 512, Time: 3, Parallelism: 4, SaltLength: 8},
+	}
+
+	// 每个“节点”用自己的参数生成哈希
+	var hashes []string
+	for _, params := range paramSets {
+		DefaultParams = params
+		hash, err := Hash("123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// 每个“节点”验证所有节点生成的哈希
+	for _, nodeParams := range paramSets {
+		DefaultParams = nodeParams
+		for i, hash := range hashes {
+			valid, err := Verify(hash, "123456")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !valid {
+				t.Errorf("Expected hash generated with %+v to match on a node using %+v", paramSets[i], nodeParams)
+			}
+			valid, err = Verify(hash, "12345")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid {
+				t.Errorf("Expected hash generated with %+v to not match a wrong password on a node using %+v", paramSets[i], nodeParams)
+			}
+			params, err := HashParams(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params != paramSets[i] {
+				t.Errorf("Expected hash parameters %+v, got %+v", paramSets[i], params)
+			}
+		}
+	}
+}
+
+// TestHashParams 测试 HashParams 返回哈希中保存的参数，拒绝格式错误的哈希。
+func TestHashParams(t *testing.T) {
+	params, err := HashParams("$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Params{Memory: 19456, Time: 2, Parallelism: 1, SaltLength: 16}
+	if params != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, params)
+	}
+
+	hash, err := HashWithParams("123456", Params{Memory: 4096, Time: 3, Parallelism: 2, SaltLength: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err = HashParams(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Params{Memory: 4096, Time: 3, Parallelism: 2, SaltLength: 32}
+	if params != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, params)
+	}
+
+	invalidHashes := []string{
+		"",
+		"not a hash",
+		"$argon2i$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=16$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=19456,t=0,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=abc,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!!$CS/AV+PQs08MhdeIrHhfmQ",
+		"$argon2id$v=19$m=19456,t=2,p=1$AAAAAA$CS/AV+PQs08MhdeIrHhfmQ",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	}
+	for _, invalidHash := range invalidHashes {
+		_, err := HashParams(invalidHash)
+		if err == nil {
+			t.Errorf("Expected hash %q to be invalid", invalidHash)
+		}
+	}
+
+	// 无效的参数
+	_, err = HashWithParams("123456", Params{Memory: 1024, Time: 0, Parallelism: 1, SaltLength: 16})
+	if err == nil {
+		t.Fatalf("Expected error for zero time")
+	}
+}
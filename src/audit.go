@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionUserDelete           = "user.delete"
+	AuditActionTOTPCredentialDelete = "user.totp_credential.delete"
+	AuditActionPasswordReset        = "user.password.reset"
+	AuditActionEmailUpdate          = "user.email.update"
+)
+
+// AuditLogEntry is a row of the audit_log table.
+type AuditLogEntry struct {
+	Id        int64
+	CreatedAt time.Time
+	Actor     string
+	Action    string
+	UserId    string
+	ClientIP  string
+}
+
+// auditLogEntryJSON is the JSON representation of an AuditLogEntry.
+type auditLogEntryJSON struct {
+	Id        int64    `json:"id"`
+	CreatedAt UnixTime `json:"created_at"`
+	Actor     string   `json:"actor"`
+	Action    string   `json:"action"`
+	UserId    string   `json:"user_id"`
+	ClientIP  string   `json:"client_ip"`
+}
+
+// jsonValue returns the entry as returned by GET /audit-log, ready to be encoded
+// with timestamps in the given format.
+func (e *AuditLogEntry) jsonValue(format timeFormat) auditLogEntryJSON {
+	return auditLogEntryJSON{e.Id, newUnixTime(e.CreatedAt, format), e.Actor, e.Action, e.UserId, e.ClientIP}
+}
+
+// EncodeToJSON encodes the entry as returned by GET /audit-log.
+func (e *AuditLogEntry) EncodeToJSON(format timeFormat) string {
+	encoded, err := json.Marshal(e.jsonValue(format))
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// requestActorId identifies the request secret a request was authenticated with, without
+// storing the secret itself: the first 16 hex characters of the SHA-256 hash of its
+// Authorization header. It is empty when the server has no secret configured, since any
+// request is accepted then.
+func requestActorId(env *Environment, r *http.Request) string {
+	if len(env.secret) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// writeAuditLog records an action that has already been performed. The action isn't undone
+// if the entry can't be written, so a failure is only logged.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   r (*http.Request): The request that performed the action, used for the actor and context.
+//   action (string): One of the AuditAction* constants.
+//   userId (string): The user the action was performed on.
+//   clientIP (string): The client IP address from resolveClientIP, if any.
+func writeAuditLog(env *Environment, r *http.Request, action string, userId string, clientIP string) {
+	entry := AuditLogEntry{
+		CreatedAt: time.Unix(time.Now().Unix(), 0),
+		Actor:     requestActorId(env, r),
+		Action:    action,
+		UserId:    userId,
+		ClientIP:  clientIP,
+	}
+	err := insertAuditLogEntry(env.db, r.Context(), &entry)
+	if err != nil {
+		log.Printf("failed to write audit log entry %s for user %s: %v", action, userId, err)
+	}
+}
+
+// insertAuditLogEntry inserts an entry and sets its Id.
+func insertAuditLogEntry(db *sql.DB, ctx context.Context, entry *AuditLogEntry) error {
+	result, err := db.ExecContext(ctx, "INSERT INTO audit_log (created_at, actor, action, user_id, client_ip) VALUES (?, ?, ?, ?, ?)", entry.CreatedAt.Unix(), entry.Actor, entry.Action, entry.UserId, entry.ClientIP)
+	if err != nil {
+		return err
+	}
+	entry.Id, err = result.LastInsertId()
+	return err
+}
+
+// auditLogFilter restricts the entries returned by getAuditLogPage and getAuditLogCount.
+// Empty fields match every entry.
+type auditLogFilter struct {
+	UserId string
+	Action string
+}
+
+// where returns the WHERE clause (possibly empty) and its arguments for the filter.
+func (f auditLogFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if f.UserId != "" {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, f.UserId)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, f.Action)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// getAuditLogCount returns the number of entries matching the filter.
+func getAuditLogCount(db *sql.DB, ctx context.Context, filter auditLogFilter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM audit_log"+where, args...).Scan(&count)
+	return count, err
+}
+
+// getAuditLogPage returns a page of entries matching the filter, newest first.
+func getAuditLogPage(db *sql.DB, ctx context.Context, filter auditLogFilter, perPage int, page int) ([]AuditLogEntry, error) {
+	where, args := filter.where()
+	args = append(args, perPage, perPage*(page-1))
+	rows, err := db.QueryContext(ctx, "SELECT id, created_at, actor, action, user_id, client_ip FROM audit_log"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditLogEntry
+	for rows.Next() {
+		var entry AuditLogEntry
+		var createdAt int64
+		err = rows.Scan(&entry.Id, &createdAt, &entry.Actor, &entry.Action, &entry.UserId, &entry.ClientIP)
+		if err != nil {
+			return nil, err
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// handleGetAuditLogRequest handles GET /audit-log, listing audit log entries newest first.
+//
+// Query parameters:
+//   user_id: Only return entries for this user.
+//   action: Only return entries with this action.
+//   per_page, page: See parsePaginationQuery.
+// The response has the same pagination headers as GET /totp-credentials.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleGetAuditLogRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditLogFilter{
+		UserId: query.Get("user_id"),
+		Action: query.Get("action"),
+	}
+	perPage, page := parsePaginationQuery(query, env.paginationPerPageLimit())
+
+	total, err := retryDatabaseRead(env, r.Context(), func() (int, error) {
+		return getAuditLogCount(env.db, r.Context(), filter)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	entries, err := retryDatabaseRead(env, r.Context(), func() ([]AuditLogEntry, error) {
+		return getAuditLogPage(env.db, r.Context(), filter, perPage, page)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	w.Header().Set("X-Pagination-Total", strconv.Itoa(total))
+	w.Header().Set("X-Pagination-Total-Pages", strconv.Itoa(totalPages))
+	w.Header().Set("X-Pagination-Per-Page", strconv.Itoa(perPage))
+	w.Header().Set("Link", createPaginationLinkHeader(r.URL, page, totalPages))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	format := requestTimeFormat(env, r)
+	array := newJSONArrayWriter(w)
+	for _, entry := range entries {
+		array.Write(entry.jsonValue(format))
+	}
+	err = array.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -2,9 +2,10 @@
 package main
 
 import (
+	"context"       // Carries request-scoped deadlines and cancellation to database queries.
+	"database/sql"  // Provides the database handle used to look up second factors.
 	"encoding/json" // Provides functionality for encoding and decoding JSON data.
 	"errors"        // Provides functions to manipulate errors. Used here for checking specific error types (ErrRecordNotFound).
-	"faroe/argon2id" // Custom package likely containing Argon2id password hashing functions (Verify).
 	"io"            // Provides basic I/O primitives. Used here for reading the request body.
 	"log"           // Provides simple logging capabilities. Used for logging unexpected errors.
 	"net/http"      // Provides HTTP client and server implementations.
@@ -49,8 +50,8 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 
 	// Extract the user ID from the URL path parameters.
 	userId := params.ByName("user_id")
-	// Attempt to retrieve the user from the database using the extracted ID.
-	user, err := getUser(env.db, r.Context(), userId)
+	// Attempt to retrieve the user using the extracted ID (from env.userCache if enabled).
+	user, err := env.getCachedUser(r.Context(), userId)
 	// 4. Handle potential errors during user retrieval.
 	if errors.Is(err, ErrRecordNotFound) {
 		// If the user is not found, respond with 404 Not Found.
@@ -60,7 +61,7 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 	if err != nil {
 		// Log any other unexpected database errors and respond with 500 Internal Server Error.
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
@@ -69,7 +70,7 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 	if err != nil {
 		// Log errors during body reading and respond with 500.
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
@@ -78,15 +79,19 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 	var data struct {
 		Password *string `json:"password"` // Pointer to the password string from the request.
 		ClientIP string  `json:"client_ip"` // The client's IP address, provided in the request body (presumably by the frontend/proxy).
+		// Include2FAMethods makes a successful verification return the user's second factors
+		// instead of 204, so the client knows which one to prompt for.
+		Include2FAMethods bool `json:"include_2fa_methods"`
 	}
 	// Attempt to unmarshal the JSON body into the struct.
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		// Log JSON parsing errors and respond with 400 Bad Request (Invalid Data).
+		// Log JSON parsing errors and respond with 400 Bad Request (Malformed JSON or Invalid Data).
 		log.Println(err)
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
 		return
 	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
 
 	// Validate that the password field was actually provided in the JSON.
 	if data.Password == nil {
@@ -94,6 +99,13 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 		return
 	}
 
+	// Users without a password can't verify one. Check this before rate limiting, since no
+	// password is hashed.
+	if !userHasPassword(user.PasswordHash) {
+		writeExpectedErrorResponse(w, ExpectedErrorPasswordNotSet)
+		return
+	}
+
 	// 5. Apply Rate Limiting if ClientIP is provided.
 	if data.ClientIP != "" {
 		// Consume a token from the password hashing rate limiter for this IP.
@@ -102,20 +114,27 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 			writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // Respond with 429 Too Many Requests if limit exceeded.
 			return
 		}
+		setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
 		// Consume a token from the general login rate limiter for this IP.
 		// This limits how often *any* login-related action can be attempted per IP.
 		if !env.loginIPRateLimit.Consume(data.ClientIP) {
 			writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // Respond with 429 if limit exceeded.
 			return
 		}
+		setRateLimitHeaders(env, w, &env.loginIPRateLimit, data.ClientIP)
 	}
 
 	// 6. Verify the provided password against the stored hash using Argon2id.
-	validPassword, err := argon2id.Verify(user.PasswordHash, *data.Password)
+	// Limit how many Argon2id verifications run at once; each one allocates a lot of memory.
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	validPassword, err := env.verifyPassword(user.PasswordHash, *data.Password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		// Log errors during password verification (should be rare) and respond with 500.
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
@@ -123,7 +142,9 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 	if !validPassword {
 		// Respond with a specific error for incorrect password (400 Bad Request).
 		// Crucially, DO NOT reveal whether the user ID was valid or not here.
-		// The rate limiting applied earlier helps mitigate guessing.
+		// The rate limiting applied earlier helps mitigate guessing, and the optional
+		// failure delay slows down credential stuffing further.
+		env.delayAuthenticationFailure(r.Context())
 		writeExpectedErrorResponse(w, ExpectedErrorIncorrectPassword)
 		return
 	}
@@ -136,8 +157,205 @@ func handleVerifyUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 		// A more common pattern is simply resetting the failure count on success.
 		env.loginIPRateLimit.AddTokenIfEmpty(data.ClientIP)
 	}
+	// Record the verification for routes that require recent authentication (see reauthentication.go).
+	env.recordRecentAuthentication(r.Context(), user.Id)
+
+	if data.Include2FAMethods {
+		methods, err := getUserSecondFactorMethods(env.db, r.Context(), user.Id)
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(encodeSecondFactorMethodsToJSON(methods)))
+		return
+	}
 
 	// Respond with 204 No Content upon successful password verification.
 	// No response body is needed.
 	w.WriteHeader(http.StatusNoContent) // Use http.StatusNoContent constant for clarity.
 }
+
+// handleVerifyCredentialsRequest handles POST /verify-credentials. It works like
+// handleVerifyUserPasswordRequest, but identifies the user by their email address, so a
+// login form doesn't need a separate lookup. It responds with the user's ID.
+//
+// An unknown email address, a user without a password, and an incorrect password all return
+// ExpectedErrorIncorrectPassword, and all of them run one Argon2id verification, so neither
+// the response nor its timing reveals which email addresses have an account.
+//
+// Parameters:
+//   env (*Environment): Pointer to the application's environment.
+//   w (http.ResponseWriter): Used to write the HTTP response back to the client.
+//   r (*http.Request): Represents the incoming HTTP request.
+//   _ (httprouter.Params): Unused.
+func handleVerifyCredentialsRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	data := verifyCredentialsRequest{emailLimits: env.emailAddressLimits}
+	if !decodeAndValidateJSON(w, r, &data) {
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+
+	// Same limits as POST /users/:user_id/verify-password, applied before the lookup so that
+	// unknown email addresses are counted too.
+	if data.ClientIP != "" {
+		if !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
+			writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+			return
+		}
+		setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
+		if !env.loginIPRateLimit.Consume(data.ClientIP) {
+			writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+			return
+		}
+		setRateLimitHeaders(env, w, &env.loginIPRateLimit, data.ClientIP)
+	}
+
+	user, err := getUserFromEmail(env.db, r.Context(), *data.Email)
+	userFound := err == nil && userHasPassword(user.PasswordHash)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	passwordHash := user.PasswordHash
+	if !userFound {
+		passwordHash, err = dummyPasswordHash()
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+	}
+
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	validPassword, err := env.verifyPassword(passwordHash, *data.Password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userFound || !validPassword {
+		env.delayAuthenticationFailure(r.Context())
+		writeExpectedErrorResponse(w, ExpectedErrorIncorrectPassword)
+		return
+	}
+
+	if data.ClientIP != "" {
+		env.loginIPRateLimit.AddTokenIfEmpty(data.ClientIP)
+	}
+	env.recordRecentAuthentication(r.Context(), user.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeVerifiedCredentialsToJSON(user.Id)))
+}
+
+// verifyCredentialsRequest is the request body of POST /verify-credentials.
+type verifyCredentialsRequest struct {
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+	ClientIP string  `json:"client_ip"` // Client's IP for rate limiting.
+
+	emailLimits emailAddressLimits // Set by the handler from env.emailAddressLimits; not part of the body.
+}
+
+// validate checks that the email address is well-formed and the password is provided.
+func (data *verifyCredentialsRequest) validate() []fieldError {
+	var fieldErrors []fieldError
+	if data.Email == nil || *data.Email == "" {
+		fieldErrors = append(fieldErrors, fieldError{"email", FieldErrorRequired})
+	} else if !verifyEmailAddressInputWithLimits(*data.Email, data.emailLimits) {
+		fieldErrors = append(fieldErrors, fieldError{"email", FieldErrorInvalid})
+	}
+	fieldErrors = validateRequiredString(fieldErrors, "password", data.Password, maxPasswordLength)
+	return fieldErrors
+}
+
+// encodeVerifiedCredentialsToJSON encodes the response of POST /verify-credentials.
+func encodeVerifiedCredentialsToJSON(userId string) string {
+	data := struct {
+		UserId string `json:"user_id"`
+	}{
+		UserId: userId,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// Second factor methods returned by POST /users/:user_id/verify-password when
+// include_2fa_methods is set.
+const (
+	SecondFactorMethodTOTP        = "totp"
+	SecondFactorMethodSecurityKey = "security_key"
+)
+
+// getUserSecondFactorMethods returns the second factor methods the user has registered,
+// in a fixed order. Passkeys replace the password instead of following it, so they are not included.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user.
+//
+// Returns:
+//   ([]string): The registered methods, or an empty slice if the user has no second factor.
+//   (error): Any database error encountered during the query.
+func getUserSecondFactorMethods(db *sql.DB, ctx context.Context, userId string) ([]string, error) {
+	totpCredentialCount, secondFactorCount, err := getUserSecondFactorCounts(db, ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	methods := []string{}
+	if totpCredentialCount > 0 {
+		methods = append(methods, SecondFactorMethodTOTP)
+	}
+	if secondFactorCount > totpCredentialCount {
+		methods = append(methods, SecondFactorMethodSecurityKey)
+	}
+	return methods, nil
+}
+
+// encodeSecondFactorMethodsToJSON encodes the response body of a successful password
+// verification with include_2fa_methods set.
+//
+// Parameters:
+//   methods ([]string): The user's second factor methods, from getUserSecondFactorMethods.
+//
+// Returns:
+//   (string): {"requires_2fa": boolean, "methods": string[]}.
+func encodeSecondFactorMethodsToJSON(methods []string) string {
+	data := struct {
+		Requires2FA bool     `json:"requires_2fa"`
+		Methods     []string `json:"methods"`
+	}{
+		Requires2FA: len(methods) > 0,
+		Methods:     methods,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 客户端 IP 用于限流、审计日志和事件日志。默认和以前一样使用请求体中的 client_ip：
+// Faroe 的调用方是应用服务器，由它转发用户的 IP，连接的 IP 只是应用服务器的 IP。
+// 部署在反向代理后面、或者直接接收客户端请求时，可以改用受信任的请求头或者连接的 IP，
+// 这时请求体中的 client_ip 被忽略，不在 env.trustedClientIPHeaders 中的请求头也永远不会被读取，
+// 多个 IP 的请求头只使用受信任的代理追加的值 (见 env.trustedProxyCount)，所以客户端伪造的值不会影响限流。所有读取 client_ip 的处理函数在解析请求体后都调用 resolveClientIP。
+
+// clientIPSource 决定客户端 IP 从哪里获取。
+type clientIPSource int
+
+const (
+	// clientIPSourceBody 使用请求体中的 client_ip (默认)。
+	clientIPSourceBody clientIPSource = iota
+	// clientIPSourceHeader 按顺序使用 env.trustedClientIPHeaders 中第一个包含有效 IP 的请求头，都没有时使用连接的 IP。
+	clientIPSourceHeader
+	// clientIPSourceRemoteAddr 只使用连接的 IP (http.Request.RemoteAddr)。
+	clientIPSourceRemoteAddr
+)
+
+// parseClientIPSource 解析配置中的客户端 IP 来源："body"、"header" 或 "remote_addr"。空字符串表示默认值 "body"。
+func parseClientIPSource(s string) (clientIPSource, error) {
+	switch s {
+	case "", "body":
+		return clientIPSourceBody, nil
+	case "header":
+		return clientIPSourceHeader, nil
+	case "remote_addr":
+		return clientIPSourceRemoteAddr, nil
+	}
+	return 0, fmt.Errorf("invalid client IP source %q: must be body, header, or remote_addr", s)
+}
+
+// resolveClientIP 按 env.clientIPSource 返回请求的客户端 IP。
+// 参数：
+//   env *Environment: 应用环境，包含 clientIPSource、trustedClientIPHeaders 和 trustedProxyCount。
+//   r *http.Request: 收到的 HTTP 请求。
+//   bodyClientIP string: 请求体中的 client_ip，可能为空。
+// 返回值：
+//   string: 客户端 IP。使用请求体时可能为空，调用者和以前一样跳过按 IP 的限流。
+func resolveClientIP(env *Environment, r *http.Request, bodyClientIP string) string {
+	switch env.clientIPSource {
+	case clientIPSourceHeader:
+		for _, name := range env.trustedClientIPHeaders {
+			ip := parseClientIPHeader(r.Header.Get(name), env.trustedProxyCount)
+			if ip != "" {
+				return ip
+			}
+		}
+		return remoteAddrIP(r)
+	case clientIPSourceRemoteAddr:
+		return remoteAddrIP(r)
+	default:
+		return bodyClientIP
+	}
+}
+
+// parseClientIPHeader 返回请求头中客户端的 IP。X-Forwarded-For 这样的请求头可能包含用逗号分隔的多个 IP，
+// 每个代理在末尾追加它看到的连接 IP。左边的值由客户端发送，可以伪造，所以从右边数：
+// trustedProxyCount 是 Faroe 前面受信任的代理数量 (小于 1 时按 1 处理)，取从右边数第 trustedProxyCount 个 IP。
+// 值少于 trustedProxyCount 个时取第一个。不是有效 IP 时返回空字符串。
+func parseClientIPHeader(value string, trustedProxyCount int) string {
+	entries := strings.Split(value, ",")
+	i := len(entries) - max(trustedProxyCount, 1)
+	if i < 0 {
+		i = 0
+	}
+	ip := net.ParseIP(strings.TrimSpace(entries[i]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// remoteAddrIP 返回连接的 IP，去掉 RemoteAddr 中的端口。
+func remoteAddrIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
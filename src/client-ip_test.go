@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestResolveClientIP 测试每种来源设置下选择的客户端 IP，以及不受信任的请求头被忽略。
+func TestResolveClientIP(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("POST", "/users", nil)
+	r.RemoteAddr = "10.0.0.1:54321"
+	r.Header.Set("X-Client-IP", "203.0.113.7")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 10.0.0.2")
+
+	env := createEnvironment(nil, nil)
+
+	// 默认使用请求体，忽略请求头和连接的 IP
+	assert.Equal(t, "192.0.2.1", resolveClientIP(env, r, "192.0.2.1"))
+	assert.Equal(t, "", resolveClientIP(env, r, ""))
+
+	// 只使用连接的 IP
+	env.clientIPSource = clientIPSourceRemoteAddr
+	assert.Equal(t, "10.0.0.1", resolveClientIP(env, r, "192.0.2.1"))
+
+	// 使用受信任的请求头：按顺序使用第一个有效的请求头，X-Forwarded-For 默认取最后一个 IP
+	env.clientIPSource = clientIPSourceHeader
+	env.trustedClientIPHeaders = []string{"X-Forwarded-For", "X-Client-IP"}
+	assert.Equal(t, "10.0.0.2", resolveClientIP(env, r, "192.0.2.1"))
+	env.trustedProxyCount = 2
+	assert.Equal(t, "198.51.100.1", resolveClientIP(env, r, "192.0.2.1"))
+	env.trustedProxyCount = 0
+	env.trustedClientIPHeaders = []string{"X-Real-IP", "X-Client-IP"}
+	assert.Equal(t, "203.0.113.7", resolveClientIP(env, r, "192.0.2.1"))
+
+	// 不在允许列表中的请求头被忽略，退回连接的 IP
+	env.trustedClientIPHeaders = []string{"X-Real-IP"}
+	assert.Equal(t, "10.0.0.1", resolveClientIP(env, r, "192.0.2.1"))
+	env.trustedClientIPHeaders = nil
+	assert.Equal(t, "10.0.0.1", resolveClientIP(env, r, "192.0.2.1"))
+
+	// 无效的请求头值被忽略
+	r.Header.Set("X-Real-IP", "not an ip")
+	env.trustedClientIPHeaders = []string{"X-Real-IP", "X-Client-IP"}
+	assert.Equal(t, "203.0.113.7", resolveClientIP(env, r, ""))
+}
+
+// TestParseClientIPHeader 测试多个 IP 的请求头只使用受信任的代理追加的值，客户端伪造的最左边的值被忽略。
+func TestParseClientIPHeader(t *testing.T) {
+	t.Parallel()
+
+	// 客户端发送了伪造的 X-Forwarded-For，代理在末尾追加了真实的连接 IP
+	spoofed := "1.2.3.4, 203.0.113.7"
+	assert.Equal(t, "203.0.113.7", parseClientIPHeader(spoofed, 0))
+	assert.Equal(t, "203.0.113.7", parseClientIPHeader(spoofed, 1))
+
+	// 两层代理：第二层追加第一层的 IP，客户端的 IP 是从右边数第二个
+	assert.Equal(t, "203.0.113.7", parseClientIPHeader("1.2.3.4, 203.0.113.7, 10.0.0.2", 2))
+
+	// 值少于代理数量时取第一个
+	assert.Equal(t, "203.0.113.7", parseClientIPHeader("203.0.113.7", 2))
+
+	// 受信任的代理追加的值无效时不退回到伪造的值
+	assert.Equal(t, "", parseClientIPHeader("203.0.113.7, unknown", 1))
+	assert.Equal(t, "", parseClientIPHeader("", 1))
+}
+
+// TestParseClientIPSource 测试解析配置中的客户端 IP 来源。
+func TestParseClientIPSource(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]clientIPSource{
+		"":            clientIPSourceBody,
+		"body":        clientIPSourceBody,
+		"header":      clientIPSourceHeader,
+		"remote_addr": clientIPSourceRemoteAddr,
+	}
+	for s, expected := range testCases {
+		source, err := parseClientIPSource(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, source)
+	}
+	_, err := parseClientIPSource("forwarded")
+	assert.Error(t, err)
+}
+
+// TestClientIPRateLimit 测试限流使用 resolveClientIP 选择的 IP：
+// 只信任连接的 IP 时，伪造的请求头和请求体中的 client_ip 不能绕过按 IP 的限流。
+func TestClientIPRateLimit(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	env := createEnvironment(db, nil)
+	env.clientIPSource = clientIPSourceRemoteAddr
+	app := CreateApp(env)
+
+	// totpPreviewIPRateLimit 的容量是 5，每个请求使用不同的伪造 IP
+	key := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for i := 0; i < 6; i++ {
+		body := fmt.Sprintf(`{"key":"%s","code":"000000","client_ip":"192.0.2.%d"}`, key, i)
+		r := httptest.NewRequest("POST", "/totp/preview-verify", strings.NewReader(body))
+		r.RemoteAddr = "10.0.0.1:54321"
+		r.Header.Set("X-Client-IP", fmt.Sprintf("203.0.113.%d", i))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if i < 5 {
+			assert.Equal(t, 200, w.Code)
+		} else {
+			assert.Equal(t, 429, w.Code)
+		}
+	}
+}
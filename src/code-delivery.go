@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"faroe/ratelimit"
+)
+
+// 生成并发送验证码的端点 (创建邮箱验证请求、创建密码重置请求) 使用同一套发送限制：
+// 生成验证码前同时消耗按用户 ID 和按客户端 IP 计数的令牌。
+// 按用户计数防止同一个用户的邮箱被轰炸 (换 IP 也没用)，每个流程有自己的用户令牌桶，
+// 一个流程用完或退还令牌不影响另一个流程。
+// 按 IP 计数防止同一个客户端轮流给大量用户发送验证码，所有流程共用 IP 的令牌桶。
+// 没有提供 client_ip 时只按用户限制。
+
+// codeDeliveryFlow 是发送验证码的流程，每个流程的用户令牌桶是分开的。
+type codeDeliveryFlow string
+
+const (
+	codeDeliveryFlowEmailVerification codeDeliveryFlow = "email_verification"
+	codeDeliveryFlowPasswordReset     codeDeliveryFlow = "password_reset"
+)
+
+// codeDeliveryFlows 列出所有流程，用于重置用户的全部令牌桶。
+var codeDeliveryFlows = []codeDeliveryFlow{codeDeliveryFlowEmailVerification, codeDeliveryFlowPasswordReset}
+
+// 没有单独配置时使用的发送限制容量和令牌补充间隔。
+const (
+	defaultCodeDeliveryUserCapacity   = 3
+	defaultCodeDeliveryIPCapacity     = 10
+	defaultCodeDeliveryRefillInterval = 5 * time.Minute
+)
+
+// codeDeliveryRateLimit 组合了按用户和按 IP 的验证码发送限制。
+type codeDeliveryRateLimit struct {
+	user ratelimit.TokenBucketRateLimit // 按流程和用户 ID 计数，见 codeDeliveryUserKey
+	ip   ratelimit.TokenBucketRateLimit // 按客户端 IP 计数
+}
+
+// newCodeDeliveryRateLimit 创建验证码发送限制。
+// 参数:
+//   userCapacity int: 每个用户的令牌桶容量。
+//   ipCapacity int: 每个客户端 IP 的令牌桶容量。
+//   refillInterval time.Duration: 两个令牌桶补充一个令牌的间隔。
+func newCodeDeliveryRateLimit(userCapacity int, ipCapacity int, refillInterval time.Duration) codeDeliveryRateLimit {
+	return codeDeliveryRateLimit{
+		user: ratelimit.NewTokenBucketRateLimit(userCapacity, refillInterval),
+		ip:   ratelimit.NewTokenBucketRateLimit(ipCapacity, refillInterval),
+	}
+}
+
+// consume 在 flow 生成验证码前调用，同时消耗用户和 IP (clientIP 不为空时) 的令牌。
+// 任意一个没有令牌时返回 false，此时不会消耗另一个的令牌。
+func (l *codeDeliveryRateLimit) consume(flow codeDeliveryFlow, userId string, clientIP string) bool {
+	userKey := codeDeliveryUserKey(flow, userId)
+	// 先检查 IP，避免 IP 被限制时白白消耗用户的令牌
+	if clientIP != "" && !l.ip.Check(clientIP) {
+		return false
+	}
+	if !l.user.Consume(userKey) {
+		return false
+	}
+	if clientIP != "" && !l.ip.Consume(clientIP) {
+		// 检查之后令牌被并发的请求用完了，退还用户的令牌
+		l.user.AddTokenIfEmpty(userKey)
+		return false
+	}
+	return true
+}
+
+// refund 在 consume 之后生成验证码失败时调用，退还消耗的令牌。
+// 和其他限流器一样，只有令牌桶已经空了才会补回一个令牌。
+func (l *codeDeliveryRateLimit) refund(flow codeDeliveryFlow, userId string, clientIP string) {
+	l.refundUser(flow, userId)
+	if clientIP != "" {
+		l.ip.AddTokenIfEmpty(clientIP)
+	}
+}
+
+// refundUser 只退还用户在 flow 中的令牌，用于请求已经失效、用户需要重新发送验证码的情况。
+func (l *codeDeliveryRateLimit) refundUser(flow codeDeliveryFlow, userId string) {
+	l.user.AddTokenIfEmpty(codeDeliveryUserKey(flow, userId))
+}
+
+// resetUser 重置用户在所有流程中的令牌桶。
+func (l *codeDeliveryRateLimit) resetUser(userId string) {
+	for _, flow := range codeDeliveryFlows {
+		l.user.Reset(codeDeliveryUserKey(flow, userId))
+	}
+}
+
+// codeDeliveryUserKey 返回用户在 flow 中的令牌桶的 key。
+func codeDeliveryUserKey(flow codeDeliveryFlow, userId string) string {
+	return string(flow) + ":" + userId
+}
+
+// 创建邮箱更新请求会把验证码发送到请求中的新邮箱，所以除了按用户限制，
+// 还按目标邮箱限制，防止有人用多个用户轮流向任意地址发送邮件。
+// 用户的令牌桶容量为 1，补充间隔就是同一个用户两次创建邮箱更新请求之间的最短时间。
+
+// 没有单独配置时使用的邮箱更新请求限制。
+const (
+	defaultEmailUpdateRequestUserInterval        = time.Minute
+	defaultEmailUpdateRequestEmailCapacity       = 3
+	defaultEmailUpdateRequestEmailRefillInterval = 15 * time.Minute
+)
+
+// emailUpdateRequestRateLimit 组合了按用户和按目标邮箱的邮箱更新请求限制。
+type emailUpdateRequestRateLimit struct {
+	user  ratelimit.TokenBucketRateLimit // 按用户 ID 计数
+	email ratelimit.TokenBucketRateLimit // 按规范化后的目标邮箱计数
+}
+
+// newEmailUpdateRequestRateLimit 创建邮箱更新请求限制。
+// 参数:
+//   userInterval time.Duration: 同一个用户两次创建请求之间的最短时间。
+//   emailCapacity int: 每个目标邮箱的令牌桶容量。
+//   emailRefillInterval time.Duration: 目标邮箱的令牌桶补充一个令牌的间隔。
+func newEmailUpdateRequestRateLimit(userInterval time.Duration, emailCapacity int, emailRefillInterval time.Duration) emailUpdateRequestRateLimit {
+	return emailUpdateRequestRateLimit{
+		user:  ratelimit.NewTokenBucketRateLimit(1, userInterval),
+		email: ratelimit.NewTokenBucketRateLimit(emailCapacity, emailRefillInterval),
+	}
+}
+
+// consume 在创建邮箱更新请求前调用，同时消耗用户和目标邮箱的令牌。
+// 任意一个没有令牌时返回 false，此时不会消耗另一个的令牌。
+func (l *emailUpdateRequestRateLimit) consume(userId string, email string) bool {
+	emailKey := emailUpdateRequestRateLimitKey(email)
+	// 先检查邮箱，避免邮箱被限制时白白消耗用户的令牌
+	if !l.email.Check(emailKey) {
+		return false
+	}
+	if !l.user.Consume(userId) {
+		return false
+	}
+	if !l.email.Consume(emailKey) {
+		l.user.AddTokenIfEmpty(userId)
+		return false
+	}
+	return true
+}
+
+// refund 在 consume 之后创建请求失败时调用，退还消耗的令牌。
+func (l *emailUpdateRequestRateLimit) refund(userId string, email string) {
+	l.user.AddTokenIfEmpty(userId)
+	l.email.AddTokenIfEmpty(emailUpdateRequestRateLimitKey(email))
+}
+
+// emailUpdateRequestRateLimitKey 返回目标邮箱的限流 key。
+// 邮箱地址不区分大小写，"User@Example.com" 和 "user@example.com" 共用一个令牌桶。
+func emailUpdateRequestRateLimitKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
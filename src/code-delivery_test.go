@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCodeDeliveryRateLimit 测试验证码发送限制同时按用户和 IP 计数，每个流程的用户令牌分开计数，以及退还令牌。
+func TestCodeDeliveryRateLimit(t *testing.T) {
+	t.Parallel()
+
+	limit := newCodeDeliveryRateLimit(2, 3, time.Hour)
+	reset := codeDeliveryFlowPasswordReset
+
+	// 用户的令牌用完之后，换 IP 或者不提供 IP 都会被限制
+	assert.True(t, limit.consume(reset, "1", "a"))
+	assert.True(t, limit.consume(reset, "1", ""))
+	assert.False(t, limit.consume(reset, "1", "b"))
+	assert.False(t, limit.consume(reset, "1", ""))
+
+	// 另一个流程有自己的用户令牌
+	assert.True(t, limit.consume(codeDeliveryFlowEmailVerification, "1", ""))
+	// refundUser 只退还对应流程的令牌
+	limit.refundUser(codeDeliveryFlowEmailVerification, "1")
+	assert.False(t, limit.consume(reset, "1", ""))
+
+	// IP 的令牌用完之后，新的用户也会被限制，而且不消耗用户的令牌
+	assert.True(t, limit.consume(reset, "2", "a"))
+	assert.True(t, limit.consume(codeDeliveryFlowEmailVerification, "3", "a"))
+	assert.False(t, limit.consume(reset, "4", "a"))
+	assert.True(t, limit.consume(reset, "4", "c"))
+	assert.True(t, limit.consume(reset, "4", "c"))
+
+	// refund 退还用户和 IP 的令牌
+	limit.refund(reset, "1", "a")
+	assert.True(t, limit.consume(reset, "1", "a"))
+	assert.False(t, limit.consume(reset, "1", "d"))
+	assert.False(t, limit.consume(reset, "5", "a"))
+
+	// resetUser 重置用户在所有流程中的令牌
+	limit.resetUser("4")
+	assert.True(t, limit.consume(reset, "4", ""))
+	assert.True(t, limit.consume(reset, "4", ""))
+}
+
+// TestEmailUpdateRequestRateLimit 测试邮箱更新请求同时按用户和目标邮箱限制。
+func TestEmailUpdateRequestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	limit := newEmailUpdateRequestRateLimit(time.Hour, 2, time.Hour)
+
+	// 同一个用户在最短间隔内不能再次创建请求，换一个邮箱也不行
+	assert.True(t, limit.consume("1", "a@example.com"))
+	assert.False(t, limit.consume("1", "a@example.com"))
+	assert.False(t, limit.consume("1", "b@example.com"))
+
+	// 不同的用户向同一个邮箱发送，邮箱的令牌用完后被限制 (不区分大小写)，而且不消耗用户的令牌
+	assert.True(t, limit.consume("2", "A@Example.com"))
+	assert.False(t, limit.consume("3", "a@example.com"))
+	assert.True(t, limit.consume("3", "c@example.com"))
+
+	// refund 退还用户和邮箱的令牌
+	limit.refund("1", "a@example.com")
+	assert.True(t, limit.consume("1", "a@example.com"))
+	assert.False(t, limit.consume("4", "a@example.com"))
+}
@@ -3,8 +3,15 @@ package main
 import (
 	"crypto/rand"      // 导入用于生成加密安全的随机数的包
 	"encoding/base32" // 导入用于 Base32 编码的包
+	"fmt"             // 导入格式化包，用于返回验证码长度错误
+	"strings"         // 导入字符串包，用于去除验证码中的空白字符
+	"unicode"         // 导入 unicode 包，用于判断空白字符
 )
 
+// secureCodeLength 是 generateSecureCode 生成的验证码的长度 (5 字节经 Base32 编码后为 8 个字符)。
+// 验证用户提交的验证码时，长度不符的验证码可以直接拒绝，不需要查询数据库。
+const secureCodeLength = 8
+
 // generateSecureCode 函数生成一个安全的、短小的、便于人类阅读和输入的验证码或令牌。
 // 这种码通常用于邮箱验证、密码重置、两步验证确认等场景。
 // 返回值:
@@ -36,3 +43,114 @@ func generateSecureCode() (string, error) {
 	// 返回生成的验证码和 nil 错误
 	return code, nil
 }
+
+// 邮箱验证和密码重置的验证码格式可以分别配置 (env.emailVerificationCodeFormat 和 env.passwordResetCodeFormat)，
+// 例如通过短信发送较短的纯数字验证码，通过邮件链接发送较长的字母数字验证码。
+// 数据库中只保存验证码的 Argon2id 哈希，验证时也不区分格式，所以修改配置后之前发出的验证码仍然有效。
+
+// 可配置的验证码长度范围。验证用户提交的验证码时，超出这个范围的验证码可以直接拒绝。
+const (
+	minCodeLength = 6
+	maxCodeLength = 32
+)
+
+// codeAlphabet 是字母数字验证码使用的字符，和 generateSecureCode 相同，去掉了易混淆的 0、O、1、I。
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// codeFormat 是生成验证码的格式。零值是 generateSecureCode 的格式 (8 个字母数字字符)。
+type codeFormat struct {
+	numeric bool // 只包含数字 0-9，否则使用 codeAlphabet
+	length  int  // 验证码长度，0 时为 secureCodeLength
+	// 比较前规范化用户提交的字母数字验证码 (见 normalizeAlphanumericCode)，numeric 为 true 时忽略
+	caseInsensitive bool
+}
+
+// codeLength 返回生成的验证码的长度。
+func (f codeFormat) codeLength() int {
+	if f.length == 0 {
+		return secureCodeLength
+	}
+	return f.length
+}
+
+// generate 按照格式生成一个加密安全的随机验证码。
+// 长度不在 minCodeLength 和 maxCodeLength 之间时返回错误。
+func (f codeFormat) generate() (string, error) {
+	length := f.codeLength()
+	if length < minCodeLength || length > maxCodeLength {
+		return "", fmt.Errorf("code length must be between %d and %d, got %d", minCodeLength, maxCodeLength, length)
+	}
+	alphabet := codeAlphabet
+	if f.numeric {
+		alphabet = "0123456789"
+	}
+	// 256 不一定能被字符数整除，丢弃大于等于 limit 的字节，保证每个字符出现的概率相同
+	limit := 256 - 256%len(alphabet)
+	code := make([]byte, 0, length)
+	bytes := make([]byte, length)
+	for len(code) < length {
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range bytes {
+			if int(b) >= limit || len(code) == length {
+				continue
+			}
+			code = append(code, alphabet[int(b)%len(alphabet)])
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeCode 规范化用户提交的验证码：去掉所有空白字符 (包括中间的空格，例如 "123 456")，
+// 因为用户经常从邮件或验证器应用中复制带空格的验证码。
+// 参数:
+//   code (string): 用户提交的验证码。
+//   numeric (bool): 验证码是否只能包含数字 (TOTP 验证码)。邮箱验证码和密码重置验证码由
+//                   generateSecureCode 生成，包含字母，应传入 false。
+// 返回值:
+//   string: 去掉空白字符后的验证码。
+//   bool: 规范化后的验证码是否有效 (不为空，且 numeric 为 true 时只包含 0-9)。
+func normalizeCode(code string, numeric bool) (string, bool) {
+	code = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1 // 返回负数表示删除这个字符
+		}
+		return r
+	}, code)
+	if code == "" {
+		return "", false
+	}
+	if numeric {
+		for _, r := range code {
+			if r < '0' || r > '9' {
+				return "", false
+			}
+		}
+	}
+	return code, true
+}
+
+// normalizeAlphanumericCode 把用户提交的字母数字验证码转换为大写，并去掉分隔符 "-" 和 "_"。
+// 用户从邮件中抄写验证码时可能输入小写字母，或者按照 "ABCD-EFGH" 的形式分组。
+// 生成的验证码 (codeAlphabet) 只包含大写字母和数字，数据库中的哈希也是对生成的验证码计算的，
+// 所以规范化后的验证码可以直接比较。
+func normalizeAlphanumericCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' {
+			return -1
+		}
+		return r
+	}, code)
+	return strings.ToUpper(code)
+}
+
+// normalizeInput 按照格式的配置规范化已经经过 normalizeCode 处理的验证码。
+// 纯数字的验证码保持不变。
+func (f codeFormat) normalizeInput(code string) string {
+	if f.numeric || !f.caseInsensitive {
+		return code
+	}
+	return normalizeAlphanumericCode(code)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings" // 导入字符串包，用于检查验证码使用的字符
+	"testing" // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestNormalizeCode 测试 normalizeCode 去掉验证码中所有的空白字符，
+// 并且在 numeric 为 true 时只接受纯数字的验证码。
+func TestNormalizeCode(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Code     string
+		Numeric  bool
+		Expected string
+		Valid    bool
+	}{
+		{"123456", true, "123456", true},
+		{"123 456", true, "123456", true},
+		{" 123456\n", true, "123456", true},
+		{"\t12 34 56 ", true, "123456", true},
+		{"12345a", true, "", false},
+		{"１２３４５６", true, "", false}, // 全角数字不是 0-9
+		{"", true, "", false},
+		{"   ", true, "", false},
+
+		{"ABCD EFGH", false, "ABCDEFGH", true},
+		{" abcd2345 ", false, "abcd2345", true},
+		{"\n", false, "", false},
+	}
+	for _, testCase := range testCases {
+		code, valid := normalizeCode(testCase.Code, testCase.Numeric)
+		assert.Equal(t, testCase.Valid, valid, testCase.Code)
+		assert.Equal(t, testCase.Expected, code, testCase.Code)
+	}
+}
+
+// TestCodeFormatGenerate 测试 codeFormat 按照配置的长度和字符生成验证码，零值和 generateSecureCode 的格式相同，
+// 长度超出范围时返回错误。
+func TestCodeFormatGenerate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Format   codeFormat
+		Length   int
+		Alphabet string
+	}{
+		{codeFormat{}, secureCodeLength, codeAlphabet},
+		{codeFormat{numeric: true, length: 6}, 6, "0123456789"},
+		{codeFormat{numeric: true, length: maxCodeLength}, maxCodeLength, "0123456789"},
+		{codeFormat{length: 12}, 12, codeAlphabet},
+	}
+	for _, testCase := range testCases {
+		for i := 0; i < 20; i++ {
+			code, err := testCase.Format.generate()
+			assert.NoError(t, err)
+			assert.Len(t, code, testCase.Length)
+			for _, r := range code {
+				assert.True(t, strings.ContainsRune(testCase.Alphabet, r), code)
+			}
+		}
+	}
+
+	_, err := codeFormat{length: minCodeLength - 1}.generate()
+	assert.Error(t, err)
+	_, err = codeFormat{numeric: true, length: maxCodeLength + 1}.generate()
+	assert.Error(t, err)
+}
+
+// TestCodeFormatNormalizeInput 测试开启 caseInsensitive 后，字母数字验证码被转换为大写并去掉分隔符，
+// 纯数字的验证码和关闭时的验证码保持不变。
+func TestCodeFormatNormalizeInput(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Format   codeFormat
+		Code     string
+		Expected string
+	}{
+		{codeFormat{}, "abcd2345", "abcd2345"},
+		{codeFormat{}, "ABCD-2345", "ABCD-2345"},
+		{codeFormat{caseInsensitive: true}, "abcd2345", "ABCD2345"},
+		{codeFormat{caseInsensitive: true}, "abcd-2345", "ABCD2345"},
+		{codeFormat{caseInsensitive: true}, "Ab_Cd-23_45", "ABCD2345"},
+		{codeFormat{caseInsensitive: true, length: 12}, "abcdefgh2345", "ABCDEFGH2345"},
+		{codeFormat{numeric: true, caseInsensitive: true}, "123-456", "123-456"},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.Expected, testCase.Format.normalizeInput(testCase.Code), testCase.Code)
+	}
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
-	"database/sql" // Provides generic interface around SQL (or SQL-like) databases.
-	"time"         // Provides functionality for measuring and displaying time.
+	"context"             // Carries cancellation signals to database calls.
+	"database/sql"        // Provides generic interface around SQL (or SQL-like) databases.
+	"database/sql/driver" // Provides driver.ErrBadConn, used here to detect broken connections.
+	"errors"              // Provides functions to create errors.
+	"fmt"                 // Provides formatted I/O, used here to build pragma values.
+	"net/http"            // Provides the HTTP types used by the request timeout middleware.
+	"net/url"             // Provides URL query encoding, used here to build the data source name.
+	"regexp"              // Provides regular expressions, used here to rewrite foreign key clauses.
+	"time"                // Provides functionality for measuring and displaying time.
+
+	"modernc.org/sqlite"             // SQLite driver, used here to inspect error codes.
+	sqlite3 "modernc.org/sqlite/lib" // SQLite result code constants.
 )
 
 // cleanUpDatabase performs routine cleanup tasks on the database.
@@ -22,13 +32,18 @@ import (
 // 2. It checks for errors after the first DELETE operation. If an error occurred,
 //    it returns the error immediately.
 // 3. If the first operation was successful, it executes a similar DELETE statement
-//    on the 'password_reset_request' table, removing expired password reset requests.
-// 4. It returns any error that occurred during the second DELETE operation, or nil
-//    if both operations were successful.
+//    on the 'password_reset_request' table, removing password reset requests that were
+//    never used and expired more than expiredPasswordResetRequestRetention ago. Until then
+//    the endpoints keep returning EXPIRED_REQUEST for them. Used requests (kept for audit when
+//    env.keepUsedPasswordResetRequests is set) are removed once they were used more than
+//    usedPasswordResetRequestRetention ago.
+// 4. It then deletes expired sessions from the 'session' table. Expired sessions must
+//    already be rejected when they are read, so this only keeps the table from growing.
+// 5. It returns the first error that occurred, or nil if every operation was successful.
 //
 // Usage:
-// This function should be called periodically (e.g., on server startup or via a
-// scheduled background task) to maintain the database hygiene.
+// This function should be called periodically (e.g., on server startup) to maintain
+// the database hygiene.
 func cleanUpDatabase(db *sql.DB) error {
 	// Delete expired email verification requests.
 	_, err := db.Exec("DELETE FROM user_email_verification_request WHERE expires_at <= ?", time.Now().Unix())
@@ -37,15 +52,622 @@ func cleanUpDatabase(db *sql.DB) error {
 		return err
 	}
 
-	// Delete expired password reset requests.
-	_, err = db.Exec("DELETE FROM password_reset_request WHERE expires_at <= ?", time.Now().Unix())
+	// Delete expired password reset requests once their retention period has passed.
+	_, err = db.Exec("DELETE FROM password_reset_request WHERE expires_at <= ? AND used_at IS NULL", time.Now().Add(-expiredPasswordResetRequestRetention).Unix())
 	if err != nil {
 		// If an error occurs here, return it.
 		return err
 	}
 
-	// Return nil if both delete operations were successful.
-	// Note: The original code returned 'err' here, which would be nil if the second
-	// operation succeeded. Returning nil explicitly is slightly clearer.
+	// Delete used password reset requests once their retention period has passed.
+	_, err = db.Exec("DELETE FROM password_reset_request WHERE used_at <= ?", time.Now().Add(-usedPasswordResetRequestRetention).Unix())
+	if err != nil {
+		return err
+	}
+
+	// Delete expired sessions.
+	_, err = db.Exec("DELETE FROM session WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	// Return nil if all delete operations were successful.
+	return nil
+}
+
+// DatabaseOptions holds the connection-level SQLite settings applied when the
+// database is opened.
+//
+// Fields:
+//   JournalMode (string): Value for `PRAGMA journal_mode` (e.g. "WAL", "DELETE").
+//                         WAL lets readers proceed while a writer holds the lock.
+//                         An empty string keeps SQLite's default.
+//   BusyTimeout (time.Duration): Value for `PRAGMA busy_timeout`. Instead of failing
+//                         immediately with SQLITE_BUSY, SQLite retries for up to this
+//                         long while another connection holds the lock. Zero disables it.
+//   ForeignKeys (bool): Value for `PRAGMA foreign_keys`. SQLite ignores REFERENCES
+//                         clauses unless this is enabled on every connection.
+type DatabaseOptions struct {
+	JournalMode string
+	BusyTimeout time.Duration
+	ForeignKeys bool
+}
+
+// defaultDatabaseOptions are the settings used by the server unless overridden.
+var defaultDatabaseOptions = DatabaseOptions{
+	JournalMode: "WAL",
+	BusyTimeout: 5 * time.Second,
+	ForeignKeys: true,
+}
+
+// openDatabase opens the SQLite database at path with the given options applied.
+//
+// Parameters:
+//   path (string): Path of the SQLite database file.
+//   options (DatabaseOptions): Connection-level settings to apply.
+//
+// Returns:
+//   *sql.DB: The database connection pool.
+//   error: An error if the pool could not be created or the first connection failed.
+//
+// How it works:
+// `PRAGMA busy_timeout` and `PRAGMA foreign_keys` only apply to the connection that
+// runs them, while database/sql opens new connections on demand. Running the pragmas
+// once with db.Exec would therefore only configure a single pooled connection.
+// Instead, the pragmas are passed as `_pragma` parameters in the data source name,
+// which the sqlite driver runs on every new connection.
+func openDatabase(path string, options DatabaseOptions) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", databaseDataSourceName(path, options))
+	if err != nil {
+		return nil, err
+	}
+	// Open is lazy; ping to surface invalid paths or pragma values right away.
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// databaseDataSourceName builds the sqlite data source name for path with the
+// pragmas from options encoded as `_pragma` query parameters.
+func databaseDataSourceName(path string, options DatabaseOptions) string {
+	values := url.Values{}
+	if options.JournalMode != "" {
+		values.Add("_pragma", fmt.Sprintf("journal_mode(%s)", options.JournalMode))
+	}
+	if options.BusyTimeout > 0 {
+		values.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", options.BusyTimeout.Milliseconds()))
+	}
+	if options.ForeignKeys {
+		values.Add("_pragma", "foreign_keys(1)")
+	} else {
+		values.Add("_pragma", "foreign_keys(0)")
+	}
+	return "file:" + path + "?" + values.Encode()
+}
+
+// ErrIdGeneration is wrapped by the error insertWithGeneratedId returns when the ID
+// generator fails, so callers can tell it apart from database errors with errors.Is.
+var ErrIdGeneration = errors.New("generate id")
+
+// generateId returns a new ID from env.IDGenerator, falling back to newId (crypto/rand)
+// when it is not set. Constructors that insert records with a generated ID take it as a
+// parameter so tests can inject a failing or deterministic generator.
+func (env *Environment) generateId() (string, error) {
+	if env.IDGenerator != nil {
+		return env.IDGenerator()
+	}
+	return newId()
+}
+
+// maxIdGenerationAttempts is how many IDs insertWithGeneratedId tries before giving up.
+// IDs are random, so more than one collision in a row means something is broken
+// (e.g. a generator that keeps returning the same value) rather than bad luck.
+const maxIdGenerationAttempts = 3
+
+// insertWithGeneratedId generates an ID and inserts a record with it, generating a new
+// ID and retrying if the insert fails because the ID is already taken.
+//
+// Parameters:
+//   generateId (func() (string, error)): Generates a new ID, usually env.generateId.
+//   insert (func(id string) error): Inserts the record using the given ID as its primary key.
+//
+// Returns:
+//   string: The ID the record was inserted with.
+//   error: An error if generating an ID fails, if the insert fails for any reason
+//          other than a primary key collision, or if every attempt collided.
+//          Generator failures and repeated collisions wrap ErrIdGeneration.
+//          It never returns an empty ID with a nil error.
+func insertWithGeneratedId(generateId func() (string, error), insert func(id string) error) (string, error) {
+	for attempt := 0; attempt < maxIdGenerationAttempts; attempt++ {
+		id, err := generateId()
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrIdGeneration, err)
+		}
+		if id == "" {
+			return "", fmt.Errorf("%w: empty id", ErrIdGeneration)
+		}
+		err = insert(id)
+		if isPrimaryKeyConstraintError(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("%w: %d consecutive collisions", ErrIdGeneration, maxIdGenerationAttempts)
+}
+
+// isPrimaryKeyConstraintError reports whether err is SQLite rejecting a row because
+// its primary key is already used.
+func isPrimaryKeyConstraintError(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// isUniqueConstraintError reports whether err is SQLite rejecting a row because a
+// UNIQUE column (e.g. user.email) already has its value.
+func isUniqueConstraintError(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// maxDatabaseReadAttempts bounds how many times retryDatabaseRead runs a read,
+// including the first attempt.
+const maxDatabaseReadAttempts = 3
+
+// databaseReadRetryBackoff is the delay before the first retry; it doubles after each attempt.
+const databaseReadRetryBackoff = 25 * time.Millisecond
+
+// isRetryableDatabaseError reports whether err is a transient failure that may succeed
+// when the same read is run again: SQLite reporting the database as busy or locked
+// by another connection, or the driver discarding a broken connection.
+func isRetryableDatabaseError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes (e.g. SQLITE_BUSY_SNAPSHOT) keep the primary code in the low byte.
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// retryDatabaseRead runs read and, when env.retryDatabaseReads is set, runs it again
+// with exponential backoff (databaseReadRetryBackoff, doubling) while it fails with a
+// retryable error, up to maxDatabaseReadAttempts in total. Other errors, including
+// ErrRecordNotFound, are returned right away. Only use it for read-only operations,
+// since a write that failed midway may have partially applied.
+//
+// Parameters:
+//   env (*Environment): The application environment.
+//   ctx (context.Context): The request context. Waiting between attempts stops when it is done.
+//   read (func() (T, error)): The read-only database operation.
+//
+// Returns:
+//   T: The result of the last attempt.
+//   error: The error of the last attempt, or the context error if ctx was done while waiting.
+func retryDatabaseRead[T any](env *Environment, ctx context.Context, read func() (T, error)) (T, error) {
+	result, err := read()
+	if !env.retryDatabaseReads {
+		return result, err
+	}
+	backoff := databaseReadRetryBackoff
+	for attempt := 1; attempt < maxDatabaseReadAttempts && isRetryableDatabaseError(err); attempt++ {
+		waitErr := env.waitBeforeDatabaseReadRetry(ctx, backoff)
+		if waitErr != nil {
+			var zero T
+			return zero, waitErr
+		}
+		backoff *= 2
+		result, err = read()
+	}
+	return result, err
+}
+
+// waitBeforeDatabaseReadRetry blocks for delay or until ctx is done. Tests can replace
+// it through env.databaseReadRetryWait.
+func (env *Environment) waitBeforeDatabaseReadRetry(ctx context.Context, delay time.Duration) error {
+	if env.databaseReadRetryWait != nil {
+		return env.databaseReadRetryWait(ctx, delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// defaultDatabaseTimeout is the upper bound on database calls made while handling
+// a request when env.dbTimeout is not set.
+const defaultDatabaseTimeout = 10 * time.Second
+
+// databaseTimeout returns how long database calls made while handling a request may
+// take before they are cancelled. Zero means defaultDatabaseTimeout; a negative value
+// disables the timeout, so calls are only cancelled when the client disconnects.
+func (env *Environment) databaseTimeout() time.Duration {
+	if env.dbTimeout == 0 {
+		return defaultDatabaseTimeout
+	}
+	return env.dbTimeout
+}
+
+// withDatabaseTimeout wraps the application handler so that every request context,
+// which handlers pass to their database calls, is cancelled after env.databaseTimeout().
+// This bounds slow queries on the server side instead of letting them run to completion.
+//
+// Handlers respond to a failed database call with writeUnexpectedErrorResponse (500).
+// If the request deadline was exceeded by then, the status is rewritten to
+// 503 Service Unavailable so clients can tell an overloaded database from a bug.
+//
+// Note: While SQLite waits on a lock held by another connection (see
+// DatabaseOptions.BusyTimeout), the sqlite driver cannot interrupt it, so such calls
+// only fail once the busy timeout elapses. Waiting for a free connection from the pool
+// and running a statement are cancelled at the deadline.
+//
+// Parameters:
+//   env (*Environment): The application environment.
+//   handler (http.Handler): The handler returned by the router.
+//
+// Returns:
+//   http.Handler: The wrapped handler.
+func withDatabaseTimeout(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := env.databaseTimeout()
+		if timeout < 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(&databaseTimeoutResponseWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// databaseTimeoutResponseWriter rewrites 500 responses to 503 when the request
+// context's deadline has been exceeded. See withDatabaseTimeout.
+type databaseTimeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+}
+
+func (w *databaseTimeoutResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if statusCode == http.StatusInternalServerError && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *databaseTimeoutResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *databaseTimeoutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// migrateDatabase upgrades an existing database created by an older version of
+// schema.sql. Each migration checks whether it is needed, so it is safe to run on
+// every startup after the schema has been applied.
+//
+// Parameters:
+//   db (*sql.DB): A pointer to the active database connection pool.
+//
+// Returns:
+//   error: The first error returned by a migration, otherwise nil.
+func migrateDatabase(db *sql.DB) error {
+	err := migrateUserTOTPCredentialIds(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user totp credential ids: %w", err)
+	}
+	err = migrateUserEmailVerificationRequestCodeHashes(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user email verification request code hashes: %w", err)
+	}
+	err = migrateUserForeignKeysToCascade(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user foreign keys: %w", err)
+	}
+	err = migratePasswordResetRequestUsedAt(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate password reset request used_at: %w", err)
+	}
+	err = migrateUserEmailVerified(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user email_verified: %w", err)
+	}
+	err = migrateUserEmail(db)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user email: %w", err)
+	}
+	return nil
+}
+
+// migrateUserTOTPCredentialIds upgrades the user_totp_credential table from one
+// credential per user (user_id as the primary key) to multiple credentials per user
+// (a separate id primary key). Existing credentials use their user ID as their ID,
+// which is unique since each user had at most one credential.
+func migrateUserTOTPCredentialIds(db *sql.DB) error {
+	ctx := context.Background()
+	var hasIdColumn bool
+	err := db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM pragma_table_info('user_totp_credential') WHERE name = 'id'").Scan(&hasIdColumn)
+	if err != nil {
+		return err
+	}
+	if hasIdColumn {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Nothing references user_totp_credential, so it can be rebuilt with foreign keys enabled.
+	statements := []string{
+		"ALTER TABLE user_totp_credential RENAME TO user_totp_credential_old",
+		`CREATE TABLE user_totp_credential (
+    id TEXT NOT NULL PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    created_at INTEGER NOT NULL,
+    key BLOB NULL
+) STRICT`,
+		"INSERT INTO user_totp_credential (id, user_id, created_at, key) SELECT user_id, user_id, created_at, key FROM user_totp_credential_old",
+		"DROP TABLE user_totp_credential_old",
+		"CREATE INDEX IF NOT EXISTS user_totp_credential_user_id_index ON user_totp_credential(user_id)",
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateUserEmailVerificationRequestCodeHashes replaces the plaintext code column of
+// user_email_verification_request with code_hash. Existing requests can't be converted
+// since the codes would have to be hashed, so they are deleted instead. They expire
+// within minutes anyway, and users can request a new code.
+func migrateUserEmailVerificationRequestCodeHashes(db *sql.DB) error {
+	ctx := context.Background()
+	var hasCodeColumn bool
+	err := db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM pragma_table_info('user_email_verification_request') WHERE name = 'code'").Scan(&hasCodeColumn)
+	if err != nil {
+		return err
+	}
+	if !hasCodeColumn {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM user_email_verification_request",
+		"ALTER TABLE user_email_verification_request RENAME COLUMN code TO code_hash",
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migratePasswordResetRequestUsedAt adds the used_at column to password_reset_request.
+// Existing requests have never been used, so the column is NULL for all of them.
+func migratePasswordResetRequestUsedAt(db *sql.DB) error {
+	return addColumnIfMissing(db, "password_reset_request", "used_at", "INTEGER NULL")
+}
+
+// migrateUserEmailVerified adds the email_verified column to user.
+// Verifications were not recorded before, so existing users start out unverified.
+func migrateUserEmailVerified(db *sql.DB) error {
+	return addColumnIfMissing(db, "user", "email_verified", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// addColumnIfMissing adds a column to a table unless the table already has it.
+// table and column are trusted identifiers, never user input.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	ctx := context.Background()
+	var hasColumn bool
+	err := db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&hasColumn)
+	if err != nil {
+		return err
+	}
+	if hasColumn {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// userReferencePattern matches a `REFERENCES user(id)` clause along with any
+// existing ON DELETE action.
+var userReferencePattern = regexp.MustCompile(`(?i)(REFERENCES\s+user\s*\(\s*id\s*\))(\s+ON\s+DELETE\s+(SET\s+NULL|SET\s+DEFAULT|NO\s+ACTION|RESTRICT|CASCADE))?`)
+
+// migrateUserEmail adds the email column to user, along with a unique index that ignores
+// case in place of the column's UNIQUE constraint, which ALTER TABLE can't add.
+// Email addresses were not stored before, so existing users start out without one.
+func migrateUserEmail(db *sql.DB) error {
+	ctx := context.Background()
+	var hasEmailColumn bool
+	err := db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM pragma_table_info('user') WHERE name = 'email'").Scan(&hasEmailColumn)
+	if err != nil {
+		return err
+	}
+	if hasEmailColumn {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		"ALTER TABLE user ADD COLUMN email TEXT COLLATE NOCASE",
+		"CREATE UNIQUE INDEX user_email_index ON user(email)",
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateUserForeignKeysToCascade rebuilds every table whose foreign key to
+// user(id) does not use ON DELETE CASCADE.
+//
+// SQLite cannot alter a foreign key in place, so each table is rebuilt following
+// the procedure from https://www.sqlite.org/lang_altertable.html:
+// 1. Disable foreign keys on a dedicated connection (this cannot be done inside a transaction).
+// 2. Inside a transaction, rename the table, create it again from its original SQL
+//    with the references rewritten, copy the rows, drop the old table, and recreate its indexes.
+// 3. Run `PRAGMA foreign_key_check` before committing so no dangling rows are left behind.
+// 4. Re-enable foreign keys on the connection.
+func migrateUserForeignKeysToCascade(db *sql.DB) error {
+	ctx := context.Background()
+	tables, err := getTablesWithoutUserCascade(db, ctx)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err != nil {
+		return err
+	}
+	// Restore the setting for the connection before returning it to the pool.
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		err = rebuildTableWithUserCascade(tx, ctx, table)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to rebuild table %s: %w", table, err)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	violation := rows.Next()
+	rows.Close()
+	if violation {
+		tx.Rollback()
+		return errors.New("foreign key violation after rebuilding tables")
+	}
+	return tx.Commit()
+}
+
+// getTablesWithoutUserCascade returns the names of the tables that reference
+// user(id) with an ON DELETE action other than CASCADE.
+func getTablesWithoutUserCascade(db *sql.DB, ctx context.Context) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT m.name FROM sqlite_master AS m, pragma_foreign_key_list(m.name) AS f
+		WHERE m.type = 'table' AND f."table" = 'user' AND f.on_delete != 'CASCADE'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// rebuildTableWithUserCascade recreates a single table with ON DELETE CASCADE on its
+// references to user(id). It must run inside a transaction with foreign keys disabled.
+func rebuildTableWithUserCascade(tx *sql.Tx, ctx context.Context, table string) error {
+	var tableSQL string
+	err := tx.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&tableSQL)
+	if err != nil {
+		return err
+	}
+	// Renaming the table moves its indexes with it, so read their definitions first.
+	rows, err := tx.QueryContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table)
+	if err != nil {
+		return err
+	}
+	var indexSQLs []string
+	for rows.Next() {
+		var indexSQL string
+		err = rows.Scan(&indexSQL)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		indexSQLs = append(indexSQLs, indexSQL)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	oldTable := table + "_old"
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE "%s" RENAME TO "%s"`, table, oldTable))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, userReferencePattern.ReplaceAllString(tableSQL, "$1 ON DELETE CASCADE"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO "%s" SELECT * FROM "%s"`, table, oldTable))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE "%s"`, oldTable))
+	if err != nil {
+		return err
+	}
+	for _, indexSQL := range indexSQLs {
+		_, err = tx.ExecContext(ctx, indexSQL)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -1,9 +1,19 @@
 package main
 
 import (
-	"context"      // 导入上下文包，虽然在此测试中未显式使用 context 的超时或取消，但数据库操作函数可能需要它
-	"testing"      // 导入 Go 的测试包
-	"time"         // 导入时间包，用于处理时间相关的操作，如设置过期时间
+	"context"       // 导入上下文包，虽然在此测试中未显式使用 context 的超时或取消，但数据库操作函数可能需要它
+	"database/sql"  // 导入数据库 SQL 包，用于测试辅助函数的参数类型
+	"database/sql/driver" // 导入数据库驱动包，用于模拟可重试的连接错误
+	"errors"        // 导入错误包，用于模拟生成 ID 失败
+	"fmt"           // 导入格式化包，用于生成测试用户 ID
+	"net/http"      // 导入 HTTP 包，用于测试数据库超时中间件
+	"net/http/httptest" // 导入 HTTP 测试包
+	"path/filepath" // 导入路径包，用于在临时目录中构造数据库文件路径
+	"regexp"        // 导入正则表达式包，用于从 schema 中去掉新加的列
+	"strings"       // 导入字符串包，用于生成旧版本的 schema
+	"sync"          // 导入同步包，用于等待并发的 goroutine 结束
+	"testing"       // 导入 Go 的测试包
+	"time"          // 导入时间包，用于处理时间相关的操作，如设置过期时间
 
 	"github.com/stretchr/testify/assert" // 导入 testify 断言库，提供更丰富的断言方法
 )
@@ -44,12 +54,12 @@ func TestCleanUpDatabase(t *testing.T) {
 		t.Fatal(err) // 如果插入失败，终止测试
 	}
 
-	// 创建密码重置请求 1 (已过期)
+	// 创建密码重置请求 1 (过期超过保留期限)
 	resetRequest1 := PasswordResetRequest{
 		Id:        "1",
 		UserId:    user1.Id,
 		CreatedAt: now,
-		ExpiresAt: now.Add(-10 * time.Minute), // 过期时间设置为 10 分钟前
+		ExpiresAt: now.Add(-expiredPasswordResetRequestRetention - 10*time.Minute),
 		CodeHash:  "HASH",
 	}
 	err = insertPasswordResetRequest(db, context.Background(), &resetRequest1)
@@ -57,6 +67,19 @@ func TestCleanUpDatabase(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// 创建密码重置请求 4 (已过期，但在保留期限内，端点仍然返回 ExpectedErrorExpiredRequest)
+	resetRequest4 := PasswordResetRequest{
+		Id:        "4",
+		UserId:    user1.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(-10 * time.Minute), // 过期时间设置为 10 分钟前
+		CodeHash:  "HASH",
+	}
+	err = insertPasswordResetRequest(db, context.Background(), &resetRequest4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// 创建密码重置请求 2 (未过期)
 	resetRequest2 := PasswordResetRequest{
 		Id:        "2",
@@ -160,8 +183,8 @@ func TestCleanUpDatabase(t *testing.T) {
 	if err != nil {
 		t.Fatal(err) // 如果查询失败，终止测试
 	}
-	// 断言：预期应该只剩下 2 个未过期的密码重置请求 (resetRequest2, resetRequest3)
-	assert.Equal(t, 2, passwordResetRequestCount)
+	// 断言：预期应该剩下 2 个未过期的密码重置请求 (resetRequest2, resetRequest3) 和保留期限内的 resetRequest4
+	assert.Equal(t, 3, passwordResetRequestCount)
 
 	// 验证邮箱验证请求的数量
 	var emailVerificationRequestCount int
@@ -173,3 +196,834 @@ func TestCleanUpDatabase(t *testing.T) {
 	// 断言：预期应该只剩下 1 个未过期的邮箱验证请求 (verificationRequest1)
 	assert.Equal(t, 1, emailVerificationRequestCount)
 }
+
+// TestCleanUpDatabaseSessions 测试 cleanUpDatabase 只删除已过期的会话，未过期的会话保留。
+func TestCleanUpDatabaseSessions(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:             "1",
+		CreatedAt:      now,
+		PasswordHash:   "HASH",
+		RecoveryCode:   "12345678",
+		TOTPRegistered: false,
+	}
+	err := insertUser(db, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := []Session{
+		{Id: "1", UserId: user.Id, CreatedAt: now, ExpiresAt: now.Add(-10 * time.Minute)}, // 已过期
+		{Id: "2", UserId: user.Id, CreatedAt: now, ExpiresAt: now},                        // 刚好过期
+		{Id: "3", UserId: user.Id, CreatedAt: now, ExpiresAt: now.Add(10 * time.Minute)},  // 未过期
+	}
+	for i := range sessions {
+		err = insertSession(db, context.Background(), &sessions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = cleanUpDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sessionIds []string
+	rows, err := db.Query("SELECT id FROM session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIds = append(sessionIds, id)
+	}
+	assert.Equal(t, []string{"3"}, sessionIds)
+}
+
+// TestCleanUpDatabaseUsedPasswordResetRequests 测试 cleanUpDatabase 只删除使用时间超过保留期限的已使用密码重置请求，
+// 已使用的请求即使已经过期，在保留期限内也不会被删除。
+func TestCleanUpDatabaseUsedPasswordResetRequests(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:           "1",
+		CreatedAt:    now,
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	}
+	err := insertUser(db, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usedAts := map[string]time.Time{
+		"1": now.Add(-usedPasswordResetRequestRetention - time.Hour), // 超过保留期限
+		"2": now.Add(-usedPasswordResetRequestRetention + time.Hour), // 保留期限内
+	}
+	for requestId, usedAt := range usedAts {
+		_, err = db.Exec("INSERT INTO password_reset_request (id, user_id, created_at, expires_at, code_hash, used_at) VALUES (?, ?, ?, ?, ?, ?)", requestId, user.Id, usedAt.Unix(), usedAt.Add(10*time.Minute).Unix(), "HASH", usedAt.Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = cleanUpDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requestIds []string
+	rows, err := db.Query("SELECT id FROM password_reset_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestIds = append(requestIds, id)
+	}
+	assert.Equal(t, []string{"2"}, requestIds)
+}
+
+// TestOpenDatabase 测试 openDatabase 函数是否在每个连接上应用了 DatabaseOptions 中的 pragma。
+// 使用文件数据库而不是 ":memory:"，因为 WAL 模式只对文件数据库生效。
+func TestOpenDatabase(t *testing.T) {
+	t.Parallel()
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	err = db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "wal", journalMode)
+
+	var busyTimeout int
+	err = db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5000, busyTimeout)
+
+	var foreignKeys int
+	err = db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, foreignKeys)
+}
+
+// TestOpenDatabaseConcurrentAccess 测试在多个 goroutine 交替读写同一个数据库文件时，
+// 不会出现 SQLITE_BUSY ("database is locked") 错误。
+// WAL 模式允许读写并发，busy_timeout 让写操作在锁被占用时等待而不是立即失败。
+func TestOpenDatabaseConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	// 每个 goroutine 最多报告一个错误，缓冲区足够容纳所有错误，避免阻塞
+	errs := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		// 写 goroutine：不断插入新用户
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				user := User{
+					Id:           fmt.Sprintf("%d-%d", worker, j),
+					CreatedAt:    time.Unix(time.Now().Unix(), 0),
+					PasswordHash: "HASH",
+					RecoveryCode: "12345678",
+				}
+				err := insertUser(db, context.Background(), &user)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+		// 读 goroutine：不断统计用户数量
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				var count int
+				err := db.QueryRow("SELECT count(*) FROM user").Scan(&count)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// 验证所有写入都已成功
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM user").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, workers*iterations, count)
+}
+
+// TestSchemaUserForeignKeysCascade 检查 schema 中所有引用 user(id) 的外键是否都使用了 ON DELETE CASCADE。
+// deleteUser 只删除 user 表中的行，依赖级联删除清理子表。
+// 以后新增的子表 (例如会话、密码历史) 如果忘记加 ON DELETE CASCADE，这个测试会失败。
+func TestSchemaUserForeignKeysCascade(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	references, err := getUserForeignKeyReferences(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 确保查询本身有效，而不是因为没找到任何外键而"通过"
+	assert.NotEmpty(t, references)
+	for _, reference := range references {
+		assert.Equal(t, "CASCADE", reference.OnDelete, "%s.%s", reference.Table, reference.Column)
+	}
+}
+
+// TestMigrateDatabase 测试 migrateDatabase 能否把旧版本 schema (外键没有 ON DELETE CASCADE) 升级到新版本，
+// 同时保留已有数据和索引。
+func TestMigrateDatabase(t *testing.T) {
+	t.Parallel()
+
+	// 用去掉 ON DELETE CASCADE 的 schema 模拟旧数据库
+	legacyDB, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyDB.Close()
+	_, err = legacyDB.Exec(strings.ReplaceAll(schema, " ON DELETE CASCADE", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:           "1",
+		CreatedAt:    now,
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	}
+	err = insertUser(legacyDB, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := UserTOTPCredential{
+		Id:        "1",
+		UserId:    user.Id,
+		CreatedAt: now,
+		Key:       []byte{0x01, 0x02, 0x03},
+	}
+	err = insertUserTOTPCredential(legacyDB, &credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateDatabase(legacyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 迁移后所有外键都应该是 CASCADE
+	references, err := getUserForeignKeyReferences(legacyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reference := range references {
+		assert.Equal(t, "CASCADE", reference.OnDelete, "%s.%s", reference.Table, reference.Column)
+	}
+
+	// 已有数据应该被保留
+	result, err := getUserTOTPCredential(legacyDB, context.Background(), user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, credential, result)
+
+	// 索引应该被重建
+	var indexCount int
+	err = legacyDB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = 'password_reset_request_user_id_index'").Scan(&indexCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, indexCount)
+
+	// 再次运行不应该有任何影响
+	err = migrateDatabase(legacyDB)
+	assert.NoError(t, err)
+}
+
+// TestMigrateUserEmail 测试 migrateDatabase 给没有 email 列的旧 user 表加上 email 列，
+// 并且和新建的数据库一样，邮箱地址不区分大小写地唯一。
+func TestMigrateUserEmail(t *testing.T) {
+	t.Parallel()
+
+	legacyDB, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyDB.Close()
+	// 用没有 email 列的 schema 模拟旧数据库
+	emailColumnPattern := regexp.MustCompile(`,( --[^\n]*\n)\s*email TEXT [^\n]*\n`)
+	legacySchema := emailColumnPattern.ReplaceAllString(schema, "$1")
+	assert.NotEqual(t, schema, legacySchema)
+	_, err = legacyDB.Exec(legacySchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacyDB.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "HASH", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateDatabase(legacyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 已有的用户没有邮箱
+	email, err := getUserEmail(legacyDB, context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "", email)
+
+	_, err = legacyDB.Exec("UPDATE user SET email = ? WHERE id = ?", "Foo@example.com", "1")
+	assert.NoError(t, err)
+	_, err = legacyDB.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code, email) VALUES (?, ?, ?, ?, ?)", "2", time.Now().Unix(), "HASH", "12345678", "foo@EXAMPLE.com")
+	assert.True(t, isUniqueConstraintError(err))
+	available, err := checkEmailAvailability(legacyDB, context.Background(), "FOO@example.com")
+	assert.NoError(t, err)
+	assert.False(t, available)
+
+	// 再次运行不应该有任何影响
+	err = migrateDatabase(legacyDB)
+	assert.NoError(t, err)
+}
+
+// TestMigrateUserTOTPCredentialIds 测试 migrateDatabase 能否把旧版本的 user_totp_credential 表
+// (user_id 是主键，每个用户只能有一个凭据) 升级为带独立 id 主键的新表。
+func TestMigrateUserTOTPCredentialIds(t *testing.T) {
+	t.Parallel()
+
+	legacyDB, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyDB.Close()
+	_, err = legacyDB.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 用旧版本的表结构替换 user_totp_credential
+	_, err = legacyDB.Exec(`DROP TABLE user_totp_credential;
+CREATE TABLE user_totp_credential (
+    user_id TEXT NOT NULL PRIMARY KEY REFERENCES user(id) ON DELETE CASCADE,
+    created_at INTEGER NOT NULL,
+    key BLOB NULL
+) STRICT;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:           "1",
+		CreatedAt:    now,
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	}
+	err = insertUser(legacyDB, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacyDB.Exec("INSERT INTO user_totp_credential (user_id, created_at, key) VALUES (?, ?, ?)", user.Id, now.Unix(), []byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateDatabase(legacyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 已有凭据使用用户 ID 作为凭据 ID
+	credentials, err := getUserTOTPCredentials(legacyDB, context.Background(), user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := UserTOTPCredential{
+		Id:        user.Id,
+		UserId:    user.Id,
+		CreatedAt: now,
+		Key:       []byte{0x01, 0x02, 0x03},
+	}
+	assert.Equal(t, []UserTOTPCredential{expected}, credentials)
+
+	// 迁移后同一个用户可以注册第二个凭据
+	_, err = registerUserTOTPCredential(legacyDB, context.Background(), newId, user.Id, []byte{0x04, 0x05, 0x06}, nil)
+	assert.NoError(t, err)
+
+	// 再次运行不应该有任何影响
+	err = migrateDatabase(legacyDB)
+	assert.NoError(t, err)
+}
+
+// TestMigrateUserEmailVerificationRequestCodeHashes 测试 migrateDatabase 能否把旧版本中保存明文验证码的
+// user_email_verification_request 表升级为只保存哈希的新表。旧的请求无法转换，应被删除。
+func TestMigrateUserEmailVerificationRequestCodeHashes(t *testing.T) {
+	t.Parallel()
+
+	legacyDB, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyDB.Close()
+	_, err = legacyDB.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 用旧版本的表结构替换 user_email_verification_request
+	_, err = legacyDB.Exec(`DROP TABLE user_email_verification_request;
+CREATE TABLE user_email_verification_request (
+    user_id TEXT NOT NULL UNIQUE PRIMARY KEY REFERENCES user(id) ON DELETE CASCADE,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    code TEXT NOT NULL
+) STRICT;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:           "1",
+		CreatedAt:    now,
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	}
+	err = insertUser(legacyDB, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacyDB.Exec("INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code) VALUES (?, ?, ?, ?)", user.Id, now.Unix(), now.Add(10*time.Minute).Unix(), "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateDatabase(legacyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 明文验证码的列被替换为 code_hash，旧请求被删除
+	var columns []string
+	rows, err := legacyDB.Query("SELECT name FROM pragma_table_info('user_email_verification_request')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, column)
+	}
+	assert.Contains(t, columns, "code_hash")
+	assert.NotContains(t, columns, "code")
+	_, err = getUserEmailVerificationRequest(legacyDB, context.Background(), user.Id)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	// 迁移后可以正常创建请求
+	_, err = createUserEmailVerificationRequestWithCodeHash(legacyDB, context.Background(), user.Id, codeFormat{})
+	assert.NoError(t, err)
+
+	// 再次运行不应该有任何影响
+	err = migrateDatabase(legacyDB)
+	assert.NoError(t, err)
+}
+
+// userForeignKeyReference 描述一个引用 user(id) 的外键列。
+type userForeignKeyReference struct {
+	Table    string // 子表名
+	Column   string // 子表中引用 user(id) 的列
+	OnDelete string // ON DELETE 动作，例如 "CASCADE" 或 "NO ACTION"
+}
+
+// getUserForeignKeyReferences 是一个测试辅助函数，返回数据库中所有引用 user(id) 的外键列。
+func getUserForeignKeyReferences(db *sql.DB) ([]userForeignKeyReference, error) {
+	rows, err := db.Query(`SELECT m.name, f."from", f.on_delete FROM sqlite_master AS m, pragma_foreign_key_list(m.name) AS f
+		WHERE m.type = 'table' AND f."table" = 'user'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var references []userForeignKeyReference
+	for rows.Next() {
+		var reference userForeignKeyReference
+		err = rows.Scan(&reference.Table, &reference.Column, &reference.OnDelete)
+		if err != nil {
+			return nil, err
+		}
+		references = append(references, reference)
+	}
+	return references, rows.Err()
+}
+
+// TestWithDatabaseTimeout 测试 withDatabaseTimeout 中间件：
+// 数据库调用在超时时间到达时被取消，并且 handler 返回的 500 被改写为 503；没有超时的请求不受影响。
+// 通过占用连接池中唯一的连接来模拟一个被锁住的慢查询。
+func TestWithDatabaseTimeout(t *testing.T) {
+	t.Parallel()
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	env := createEnvironment(db, nil)
+	env.dbTimeout = 100 * time.Millisecond
+	handler := withDatabaseTimeout(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result int
+		err := db.QueryRowContext(r.Context(), "SELECT 1").Scan(&result)
+		if err != nil {
+			writeUnexpectedErrorResponse(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// 没有其他连接占用时，请求正常完成
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	// 占用唯一的连接，查询只能等待
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	elapsed := time.Since(start)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.GreaterOrEqual(t, elapsed, env.dbTimeout)
+	assert.Less(t, elapsed, time.Second)
+}
+
+// TestEnvironmentDatabaseTimeout 测试 databaseTimeout 的默认值。
+func TestEnvironmentDatabaseTimeout(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, defaultDatabaseTimeout, env.databaseTimeout())
+
+	env.dbTimeout = time.Second
+	assert.Equal(t, time.Second, env.databaseTimeout())
+}
+
+// TestRetryDatabaseRead 测试 retryDatabaseRead：可重试的错误按指数退避重试，直到成功或达到 maxDatabaseReadAttempts 次；
+// 其他错误和关闭重试时不会重试；等待期间 context 被取消时返回 context 的错误。
+func TestRetryDatabaseRead(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.retryDatabaseReads = true
+	var delays []time.Duration
+	env.databaseReadRetryWait = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+	// failingRead 在前 failures 次调用时返回 err，之后返回 1
+	failingRead := func(failures int, err error) (func() (int, error), *int) {
+		calls := 0
+		return func() (int, error) {
+			calls++
+			if calls <= failures {
+				return 0, err
+			}
+			return 1, nil
+		}, &calls
+	}
+
+	// 第一次失败，第二次成功
+	read, calls := failingRead(1, driver.ErrBadConn)
+	result, err := retryDatabaseRead(env, context.Background(), read)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, []time.Duration{databaseReadRetryBackoff}, delays)
+
+	// 一直失败时在 maxDatabaseReadAttempts 次后放弃，退避时间每次翻倍
+	delays = nil
+	read, calls = failingRead(maxDatabaseReadAttempts, driver.ErrBadConn)
+	_, err = retryDatabaseRead(env, context.Background(), read)
+	assert.ErrorIs(t, err, driver.ErrBadConn)
+	assert.Equal(t, maxDatabaseReadAttempts, *calls)
+	assert.Equal(t, []time.Duration{databaseReadRetryBackoff, 2 * databaseReadRetryBackoff}, delays)
+
+	// 不可重试的错误直接返回
+	read, calls = failingRead(1, ErrRecordNotFound)
+	_, err = retryDatabaseRead(env, context.Background(), read)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	assert.Equal(t, 1, *calls)
+
+	// 等待期间 context 被取消
+	env.databaseReadRetryWait = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	read, calls = failingRead(1, driver.ErrBadConn)
+	_, err = retryDatabaseRead(env, ctx, read)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, *calls)
+
+	// 关闭重试时只执行一次
+	env.retryDatabaseReads = false
+	read, calls = failingRead(1, driver.ErrBadConn)
+	_, err = retryDatabaseRead(env, context.Background(), read)
+	assert.ErrorIs(t, err, driver.ErrBadConn)
+	assert.Equal(t, 1, *calls)
+}
+
+// TestRetryDatabaseReadHandler 测试只读的 handler 在数据库暂时被锁住时重试：
+// 另一个连接持有排他锁，第一次查询返回 SQLITE_BUSY，锁在重试之前被释放，第二次查询成功，handler 返回 200。
+// 关闭重试时同样的情况返回 500。
+func TestRetryDatabaseReadHandler(t *testing.T) {
+	t.Parallel()
+
+	// 不使用 WAL 和 busy_timeout，这样被锁住时查询立即返回 SQLITE_BUSY
+	db, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), DatabaseOptions{JournalMode: "DELETE", ForeignKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lock 让另一个连接持有排他锁，返回释放锁的函数
+	lock := func() func() error {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return func() error {
+			defer conn.Close()
+			_, err := conn.ExecContext(context.Background(), "COMMIT")
+			return err
+		}
+	}
+
+	env := createEnvironment(db, nil)
+	env.retryDatabaseReads = true
+	retries := 0
+	var unlock func() error
+	env.databaseReadRetryWait = func(ctx context.Context, delay time.Duration) error {
+		retries++
+		return unlock()
+	}
+
+	unlock = lock()
+	w := httptest.NewRecorder()
+	handleGetTOTPCredentialsRequest(env, w, httptest.NewRequest("GET", "/totp-credentials", nil), nil)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, 1, retries)
+
+	// 关闭重试时返回 500
+	env.retryDatabaseReads = false
+	unlock = lock()
+	defer unlock()
+	w = httptest.NewRecorder()
+	handleGetTOTPCredentialsRequest(env, w, httptest.NewRequest("GET", "/totp-credentials", nil), nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	assert.Equal(t, 1, retries)
+}
+
+// TestInsertWithGeneratedId 测试 insertWithGeneratedId：
+// 生成 ID 失败时返回错误 (而不是空 ID 和 nil)；主键冲突时重新生成 ID 并最终插入成功；
+// 一直冲突时在有限次数后放弃；其他插入错误直接返回，不会重试。
+func TestInsertWithGeneratedId(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	insertUserWithId := func(id string) error {
+		_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", id, time.Now().Unix(), "hash", "12345678")
+		return err
+	}
+	// sequenceGenerator 按顺序返回给定的 ID，并记录被调用的次数
+	sequenceGenerator := func(ids ...string) (func() (string, error), *int) {
+		calls := 0
+		return func() (string, error) {
+			id := ids[calls%len(ids)]
+			calls++
+			return id, nil
+		}, &calls
+	}
+
+	// 生成 ID 失败时错误被传递出来
+	generateErr := errors.New("entropy unavailable")
+	id, err := insertWithGeneratedId(func() (string, error) {
+		return "", generateErr
+	}, insertUserWithId)
+	assert.ErrorIs(t, err, generateErr)
+	assert.ErrorIs(t, err, ErrIdGeneration)
+	assert.Equal(t, "", id)
+
+	// 返回空 ID 也视为错误
+	generator, _ := sequenceGenerator("")
+	_, err = insertWithGeneratedId(generator, insertUserWithId)
+	assert.Error(t, err)
+
+	// 第一个 ID 已被占用，重试后使用第二个 ID 插入成功
+	err = insertUserWithId("1")
+	assert.NoError(t, err)
+	generator, calls := sequenceGenerator("1", "2")
+	id, err = insertWithGeneratedId(generator, insertUserWithId)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", id)
+	assert.Equal(t, 2, *calls)
+
+	// 一直冲突时在 maxIdGenerationAttempts 次后放弃
+	generator, calls = sequenceGenerator("1")
+	_, err = insertWithGeneratedId(generator, insertUserWithId)
+	assert.ErrorIs(t, err, ErrIdGeneration)
+	assert.Equal(t, maxIdGenerationAttempts, *calls)
+
+	// 其他错误不会重试
+	insertErr := errors.New("insert failed")
+	generator, calls = sequenceGenerator("3")
+	_, err = insertWithGeneratedId(generator, func(id string) error {
+		return insertErr
+	})
+	assert.ErrorIs(t, err, insertErr)
+	assert.Equal(t, 1, *calls)
+}
+
+// TestEnvironmentGenerateId 测试未注入 ID 生成器时 generateId 使用默认的 newId。
+func TestEnvironmentGenerateId(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	id1, err := env.generateId()
+	assert.NoError(t, err)
+	id2, err := env.generateId()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id1)
+	assert.NotEqual(t, id1, id2)
+}
+
+// TestCreatedAtTruncatedToSeconds 测试创建记录的函数返回的 CreatedAt 截断到整秒，
+// 和数据库中存储的 Unix 时间戳一致，重新读取后可以直接比较，不需要 time.Unix(time.Now().Unix(), 0)。
+func TestCreatedAtTruncatedToSeconds(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	user, _, err := createUser(db, context.Background(), newId, "HASH", createUserOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, user.CreatedAt.Nanosecond())
+	storedUser, err := getUser(db, context.Background(), user.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, user.CreatedAt, storedUser.CreatedAt)
+
+	resetRequest, err := createPasswordResetRequest(db, context.Background(), newId, user.Id, "HASH", activePasswordResetRequestLimit{max: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, resetRequest.CreatedAt.Nanosecond())
+	assert.Zero(t, resetRequest.ExpiresAt.Nanosecond())
+	storedResetRequest, err := getPasswordResetRequest(db, context.Background(), resetRequest.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, resetRequest.CreatedAt, storedResetRequest.CreatedAt)
+	assert.Equal(t, resetRequest.ExpiresAt, storedResetRequest.ExpiresAt)
+
+	credential, err := registerUserTOTPCredential(db, context.Background(), newId, user.Id, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, credential.CreatedAt.Nanosecond())
+	storedCredential, err := getUserTOTPCredential(db, context.Background(), user.Id, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, credential.CreatedAt, storedCredential.CreatedAt)
+
+	verificationRequest, err := createUserEmailVerificationRequestWithCodeHash(db, context.Background(), user.Id, codeFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, verificationRequest.CreatedAt.Nanosecond())
+	storedVerificationRequest, err := getUserEmailVerificationRequest(db, context.Background(), user.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, verificationRequest.CreatedAt, storedVerificationRequest.CreatedAt)
+	assert.Equal(t, verificationRequest.ExpiresAt, storedVerificationRequest.ExpiresAt)
+
+	updateRequest, err := createEmailUpdateRequest(db, context.Background(), newId, user.Id, "user@example.com", "12345678", activeEmailUpdateRequestLimit{max: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, updateRequest.CreatedAt.Nanosecond())
+	storedUpdateRequest, err := getEmailUpdateRequest(db, context.Background(), updateRequest.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, updateRequest.CreatedAt, storedUpdateRequest.CreatedAt)
+	assert.Equal(t, updateRequest.ExpiresAt, storedUpdateRequest.ExpiresAt)
+}
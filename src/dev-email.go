@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Faroe doesn't send emails itself. Endpoints that create a code meant for an email
+// (email verification requests and password reset requests) return it to the application,
+// which delivers it. End-to-end tests and local development still need to read those codes
+// without a mail server, so in dev mode Faroe also keeps a copy of each "sent" email in memory.
+//
+// Dev mode is enabled by setting env.devEmailSink. When it is nil, nothing is captured and
+// GET /dev/emails isn't registered, so the endpoint returns 404.
+
+// defaultDevEmailSinkSize is the number of emails kept by NewDevEmailSink when size <= 0.
+const defaultDevEmailSinkSize = 100
+
+// Types of captured emails.
+const (
+	DevEmailTypeUserEmailVerification = "user_email_verification"
+	DevEmailTypePasswordReset         = "password_reset"
+)
+
+// DevEmail is an email Faroe would have sent.
+type DevEmail struct {
+	Type      string
+	UserId    string
+	Email     string // Empty if Faroe doesn't know the address.
+	Code      string
+	CreatedAt time.Time
+}
+
+// DevEmailSink keeps the most recent emails in memory. It is safe for concurrent use.
+type DevEmailSink struct {
+	mu       sync.Mutex
+	messages []DevEmail
+	size     int
+}
+
+// NewDevEmailSink creates a sink that keeps up to size emails, dropping the oldest ones.
+func NewDevEmailSink(size int) *DevEmailSink {
+	if size <= 0 {
+		size = defaultDevEmailSinkSize
+	}
+	return &DevEmailSink{size: size}
+}
+
+// Deposit adds an email to the sink.
+func (sink *DevEmailSink) Deposit(message DevEmail) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.messages = append(sink.messages, message)
+	if len(sink.messages) > sink.size {
+		sink.messages = sink.messages[len(sink.messages)-sink.size:]
+	}
+}
+
+// Messages returns the captured emails, newest first.
+func (sink *DevEmailSink) Messages() []DevEmail {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	messages := make([]DevEmail, len(sink.messages))
+	for i, message := range sink.messages {
+		messages[len(sink.messages)-1-i] = message
+	}
+	return messages
+}
+
+// depositDevEmail records an email in the dev email sink. It does nothing outside of dev mode.
+func (env *Environment) depositDevEmail(emailType string, userId string, email string, code string) {
+	if env.devEmailSink == nil {
+		return
+	}
+	env.devEmailSink.Deposit(DevEmail{
+		Type:      emailType,
+		UserId:    userId,
+		Email:     email,
+		Code:      code,
+		CreatedAt: time.Now(),
+	})
+}
+
+// handleGetDevEmailsRequest handles GET /dev/emails.
+// It returns the emails captured by env.devEmailSink, newest first.
+// The route is only registered in dev mode (see CreateApp).
+func handleGetDevEmailsRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+	if env.devEmailSink == nil {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeDevEmailsToJSON(env.devEmailSink.Messages(), requestTimeFormat(env, r))))
+}
+
+// encodeDevEmailsToJSON encodes captured emails as a JSON array, with timestamps in the given format.
+func encodeDevEmailsToJSON(messages []DevEmail, format timeFormat) string {
+	type devEmailJSON struct {
+		Type      string   `json:"type"`
+		UserId    string   `json:"user_id"`
+		Email     string   `json:"email,omitempty"`
+		Code      string   `json:"code"`
+		CreatedAt UnixTime `json:"created_at"`
+	}
+	data := make([]devEmailJSON, 0, len(messages))
+	for _, message := range messages {
+		data = append(data, devEmailJSON{
+			Type:      message.Type,
+			UserId:    message.UserId,
+			Email:     message.Email,
+			Code:      message.Code,
+			CreatedAt: newUnixTime(message.CreatedAt, format),
+		})
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
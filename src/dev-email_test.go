@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing" // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestDevEmailSink 测试 DevEmailSink 只保留最新的邮件，并按从新到旧的顺序返回。
+func TestDevEmailSink(t *testing.T) {
+	t.Parallel()
+
+	sink := NewDevEmailSink(2)
+	sink.Deposit(DevEmail{UserId: "1", Code: "11111111"})
+	sink.Deposit(DevEmail{UserId: "2", Code: "22222222"})
+	sink.Deposit(DevEmail{UserId: "3", Code: "33333333"})
+
+	messages := sink.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "3", messages[0].UserId)
+		assert.Equal(t, "2", messages[1].UserId)
+	}
+}
+
+// TestEnvironmentDepositDevEmail 测试非开发模式下 depositDevEmail 不做任何事情。
+func TestEnvironmentDepositDevEmail(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.depositDevEmail(DevEmailTypePasswordReset, "1", "", "12345678")
+
+	env.devEmailSink = NewDevEmailSink(0)
+	env.depositDevEmail(DevEmailTypePasswordReset, "1", "", "12345678")
+	messages := env.devEmailSink.Messages()
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, DevEmailTypePasswordReset, messages[0].Type)
+		assert.Equal(t, "12345678", messages[0].Code)
+	}
+}
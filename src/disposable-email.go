@@ -0,0 +1,130 @@
+// Package main contains the core logic for the Faroe application. This file implements
+// the optional blocklist of disposable/temporary email domains that is consulted when
+// an email address is registered or updated.
+package main
+
+import (
+	"bufio"   // Used for reading the blocklist line by line.
+	_ "embed" // Used for embedding the default blocklist into the binary.
+	"io"      // Provides the io.Reader interface the blocklist is parsed from.
+	"os"      // Used for opening a blocklist file.
+	"strings" // Provides functions for string manipulation.
+	"sync"    // Provides the read-write mutex guarding the domain set.
+)
+
+// ExpectedErrorDisposableEmail is returned when the domain of an email address is on
+// the disposable email blocklist (env.disposableEmailDomains).
+const ExpectedErrorDisposableEmail = "DISPOSABLE_EMAIL"
+
+// defaultDisposableEmailDomains is the blocklist used when no file is configured.
+//
+//go:embed disposable-email-domains.txt
+var defaultDisposableEmailDomains string
+
+// DisposableEmailDomainList is a set of blocked email domains. It is safe for
+// concurrent use, and Reload can be called at any time (e.g. on SIGHUP) to re-read
+// the list without restarting the server.
+type DisposableEmailDomainList struct {
+	mu      *sync.RWMutex       // Guards domains.
+	path    string              // File the list is loaded from. Empty means the embedded default list.
+	domains map[string]struct{} // Lowercased blocked domains.
+}
+
+// NewDisposableEmailDomainList creates a blocklist and loads it for the first time.
+//
+// Parameters:
+//   path (string): A file with one domain per line. If empty, the embedded default list is used.
+//
+// Returns:
+//   *DisposableEmailDomainList: The loaded blocklist.
+//   error: An error if the file could not be read.
+func NewDisposableEmailDomainList(path string) (*DisposableEmailDomainList, error) {
+	list := &DisposableEmailDomainList{
+		mu:      &sync.RWMutex{},
+		path:    path,
+		domains: map[string]struct{}{},
+	}
+	err := list.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Reload re-reads the blocklist from its source and atomically replaces the current set.
+// If reading fails, the current set is kept and the error is returned.
+func (list *DisposableEmailDomainList) Reload() error {
+	var domains map[string]struct{}
+	if list.path == "" {
+		domains = parseDisposableEmailDomains(strings.NewReader(defaultDisposableEmailDomains))
+	} else {
+		file, err := os.Open(list.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		domains = parseDisposableEmailDomains(file)
+	}
+
+	list.mu.Lock()
+	list.domains = domains
+	list.mu.Unlock()
+	return nil
+}
+
+// Contains reports whether the domain, or any of its parent domains, is on the blocklist.
+// For example, if "mailinator.com" is listed, both "mailinator.com" and
+// "eu.mailinator.com" are blocked. Matching is case-insensitive.
+func (list *DisposableEmailDomainList) Contains(domain string) bool {
+	domain = strings.ToLower(domain)
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	for domain != "" {
+		if _, ok := list.domains[domain]; ok {
+			return true
+		}
+		dotIndex := strings.Index(domain, ".")
+		if dotIndex < 0 {
+			break
+		}
+		domain = domain[dotIndex+1:]
+	}
+	return false
+}
+
+// parseDisposableEmailDomains reads one domain per line. Empty lines and lines
+// starting with '#' are ignored.
+func parseDisposableEmailDomains(r io.Reader) map[string]struct{} {
+	domains := map[string]struct{}{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.ToLower(line)] = struct{}{}
+	}
+	return domains
+}
+
+// verifyEmailNotDisposable reports whether the email address may be used, i.e. its
+// domain is not on the blocklist. If no blocklist is configured (nil), the check is
+// skipped and every address passes.
+//
+// Parameters:
+//   list (*DisposableEmailDomainList): The blocklist, usually env.disposableEmailDomains.
+//   email (string): A well-formed email address (see verifyEmailAddressInput).
+//
+// Returns:
+//   bool: true if the address is not on a blocked domain, false otherwise.
+func verifyEmailNotDisposable(list *DisposableEmailDomainList, email string) bool {
+	if list == nil {
+		return true
+	}
+	atIndex := strings.LastIndex(email, "@")
+	if atIndex < 0 {
+		return false
+	}
+	return !list.Contains(email[atIndex+1:])
+}
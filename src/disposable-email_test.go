@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"            // 导入 os 包，用于写入测试用的黑名单文件
+	"path/filepath" // 导入路径处理包
+	"testing"       // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestVerifyEmailNotDisposable 测试一次性邮箱黑名单：
+// 名单中的域名 (及其子域名) 被拒绝，名单外的域名通过，未配置名单 (nil) 时跳过检查。
+// 同时测试修改文件后调用 Reload 无需重启即可生效。
+func TestVerifyEmailNotDisposable(t *testing.T) {
+	t.Parallel()
+
+	// 写入一个小的黑名单文件
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	err := os.WriteFile(path, []byte("# 注释\n\nmailinator.com\nYopmail.com\n"), 0o600)
+	assert.NoError(t, err)
+
+	list, err := NewDisposableEmailDomainList(path)
+	assert.NoError(t, err)
+
+	// 名单中的域名被拒绝 (不区分大小写，包含子域名)
+	assert.False(t, verifyEmailNotDisposable(list, "user@mailinator.com"))
+	assert.False(t, verifyEmailNotDisposable(list, "user@MAILINATOR.com"))
+	assert.False(t, verifyEmailNotDisposable(list, "user@eu.mailinator.com"))
+	assert.False(t, verifyEmailNotDisposable(list, "user@yopmail.com"))
+	// 名单外的域名通过
+	assert.True(t, verifyEmailNotDisposable(list, "user@example.com"))
+	assert.True(t, verifyEmailNotDisposable(list, "user@notmailinator.com"))
+
+	// 未配置名单时跳过检查
+	assert.True(t, verifyEmailNotDisposable(nil, "user@mailinator.com"))
+
+	// 修改文件后重新加载
+	err = os.WriteFile(path, []byte("example.com\n"), 0o600)
+	assert.NoError(t, err)
+	err = list.Reload()
+	assert.NoError(t, err)
+	assert.True(t, verifyEmailNotDisposable(list, "user@mailinator.com"))
+	assert.False(t, verifyEmailNotDisposable(list, "user@example.com"))
+
+	// 重新加载失败时保留原来的名单
+	err = os.Remove(path)
+	assert.NoError(t, err)
+	err = list.Reload()
+	assert.Error(t, err)
+	assert.False(t, verifyEmailNotDisposable(list, "user@example.com"))
+}
+
+// TestNewDisposableEmailDomainListDefault 测试未指定文件时使用内置的默认名单。
+func TestNewDisposableEmailDomainListDefault(t *testing.T) {
+	t.Parallel()
+
+	list, err := NewDisposableEmailDomainList("")
+	assert.NoError(t, err)
+	assert.True(t, list.Contains("mailinator.com"))
+	assert.False(t, list.Contains("example.com"))
+
+	// 文件不存在时返回错误
+	_, err = NewDisposableEmailDomainList(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
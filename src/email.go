@@ -5,9 +5,11 @@ package main
 
 import (
 	"context"      // Used for managing request lifecycles and cancellation signals.
+	"crypto/subtle" // Compares update request codes in constant time.
 	"database/sql" // Provides interfaces for interacting with SQL databases.
 	"encoding/json" // Used for encoding and decoding JSON data.
 	"errors"       // Provides functions for working with errors, like error checking.
+	"faroe/argon2id" // Hashes and verifies verification codes.
 	"fmt"           // Implements formatted I/O functions.
 	"io"            // Provides basic I/O interfaces, used here for reading request bodies.
 	"log"           // Used for logging messages, typically errors or informational notes.
@@ -20,8 +22,9 @@ import (
 
 // handleCreateUserEmailVerificationRequestRequest handles API requests to initiate
 // the email verification process for a given user. It generates a new verification
-// code, stores it along with an expiration time, and sends back details about the
-// request (excluding the code itself). Rate limiting is applied per user to prevent abuse.
+// code, stores its Argon2id hash along with an expiration time, and sends back details
+// about the request including the code. This is the only time the code is available,
+// since only its hash is stored. Rate limiting is applied per user and per client IP to prevent abuse.
 //
 // Security Checks:
 // 1. Request Secret Verification: Ensures the request comes from a trusted client.
@@ -29,7 +32,8 @@ import (
 // 3. User Existence Check: Verifies the target user ID exists.
 // 4. Rate Limiting:
 //    - Checks if the user has recently tried to verify (verifyUserEmailRateLimit).
-//    - Consumes a token to limit how often verification requests can be *created* (createEmailRequestUserRateLimit).
+//    - Consumes a code delivery token for the user and, if an optional client_ip is
+//      included in the request body, for the client IP (codeDeliveryRateLimit).
 //
 // Parameters:
 //   env (*Environment): Application environment containing database connections, secrets, rate limiters, etc.
@@ -54,7 +58,7 @@ func handleCreateUserEmailVerificationRequestRequest(env *Environment, w http.Re
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err) // Log unexpected database errors.
-		writeUnexpectedErrorResponse(w) // 500 Internal Server Error.
+		writeUnexpectedErrorResponseWithDetail(env, w, err) // 500 Internal Server Error.
 		return
 	}
 	if !userExists {
@@ -70,29 +74,42 @@ func handleCreateUserEmailVerificationRequestRequest(env *Environment, w http.Re
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // 429 Too Many Requests.
 		return
 	}
-	// Consume a token from the rate limiter specific to *creating* verification requests.
-	// This prevents a single user from spamming the creation endpoint.
-	if !env.createEmailRequestUserRateLimit.Consume(userId) {
+
+	// Read the optional request body. Without a body, no client IP is used.
+	var data struct {
+		ClientIP string `json:"client_ip"`
+	}
+	err = decodeOptionalJSON(r, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	// Consume code delivery tokens for the user and the client IP (see code-delivery.go).
+	// This prevents spamming a user's inbox and a single client from sending codes to many users.
+	if !env.codeDeliveryRateLimit.consume(codeDeliveryFlowEmailVerification, userId, data.ClientIP) {
+		env.logEvent("email verification request rate limited", logStringField("user_id", userId), logIPField("client_ip", data.ClientIP))
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // 429 Too Many Requests.
 		return
 	}
 
 	// Create the actual email verification request record in the database.
-	// This generates a code and sets an expiration time.
-	verificationRequest, err := createUserEmailVerificationRequest(env.db, r.Context(), userId)
+	// This generates a code, stores its hash, and sets an expiration time.
+	verificationRequest, err := createUserEmailVerificationRequestWithCodeHash(env.db, r.Context(), userId, env.emailVerificationCodeFormat)
 	if err != nil {
 		log.Println(err) // Log errors during database insertion.
-		// If creation failed, try to refund the rate limit token consumed earlier.
-		env.createEmailRequestUserRateLimit.AddTokenIfEmpty(userId)
-		writeUnexpectedErrorResponse(w) // 500 Internal Server Error.
+		// If creation failed, refund the code delivery tokens consumed earlier.
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowEmailVerification, userId, data.ClientIP)
+		writeUnexpectedErrorResponseWithDetail(env, w, err) // 500 Internal Server Error.
 		return
 	}
+	env.depositDevEmail(DevEmailTypeUserEmailVerification, userId, "", verificationRequest.Code)
 
-	// Respond with the details of the created verification request (e.g., user ID, expiry).
-	// Note: The actual verification code is NOT sent back in the response for security.
+	// Respond with the details of the created verification request, including the code
+	// so the client can send it to the user.
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // 200 OK.
-	w.Write([]byte(verificationRequest.EncodeToJSON())) // Write JSON response body.
+	w.Write([]byte(encodeUserEmailVerificationRequestToJSON(verificationRequest, requestTimeFormat(env, r)))) // Write JSON response body.
 }
 
 // handleVerifyUserEmailRequest handles API requests to verify a user's email address
@@ -105,8 +122,9 @@ func handleCreateUserEmailVerificationRequestRequest(env *Environment, w http.Re
 // 3. User Existence Check.
 // 4. Verification Request Existence & Expiry Check.
 // 5. Code Presence Check: Ensures a code was provided in the request body.
-// 6. Rate Limiting: Consumes a token to limit verification *attempts* per user.
-// 7. Code Validation: Compares the provided code with the stored code.
+// 6. Rate Limiting: Consumes a token to limit verification *attempts* per user,
+//    and limits password hashing per IP address if a client IP is provided.
+// 7. Code Validation: Verifies the provided code against the stored Argon2id hash.
 //
 // Parameters:
 //   env (*Environment): Application environment.
@@ -130,7 +148,7 @@ func handleVerifyUserEmailRequest(env *Environment, w http.ResponseWriter, r *ht
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -142,8 +160,8 @@ func handleVerifyUserEmailRequest(env *Environment, w http.ResponseWriter, r *ht
 	verificationRequest, err := getUserEmailVerificationRequest(env.db, r.Context(), userId)
 	// If no request is found (ErrRecordNotFound)...
 	if errors.Is(err, ErrRecordNotFound) {
-		// Potentially refund a token for the *creation* rate limiter, allowing the user to try creating a new request.
-		env.createEmailRequestUserRateLimit.AddTokenIfEmpty(userId)
+		// Potentially refund a code delivery token, allowing the user to try creating a new request.
+		env.codeDeliveryRateLimit.refundUser(codeDeliveryFlowEmailVerification, userId)
 		// Respond with 403 Not Allowed, indicating no active verification process to attempt.
 		writeExpectedErrorResponse(w, ExpectedErrorNotAllowed)
 		return
@@ -151,24 +169,20 @@ func handleVerifyUserEmailRequest(env *Environment, w http.ResponseWriter, r *ht
 	// Handle other potential database errors.
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// Check if the verification request has expired.
-	// time.Now().Compare(t) returns:
-	// -1 if time.Now() is before t
-	//  0 if time.Now() is equal to t
-	// +1 if time.Now() is after t
-	if time.Now().Compare(verificationRequest.ExpiresAt) >= 0 { // If expired (now is at or after ExpiresAt)
+	if verificationRequest.IsExpired(time.Now()) {
 		// Attempt to delete the expired request from the database.
 		err = deleteUserEmailVerificationRequest(env.db, r.Context(), verificationRequest.UserId)
 		if err != nil {
 			// Log deletion error but continue to respond as if it was just expired.
 			log.Println(err)
 		}
-		// Refund the creation token and respond with 403 Not Allowed (expired).
-		env.createEmailRequestUserRateLimit.AddTokenIfEmpty(userId)
+		// Refund the code delivery token and respond with 403 Not Allowed (expired).
+		env.codeDeliveryRateLimit.refundUser(codeDeliveryFlowEmailVerification, userId)
 		writeExpectedErrorResponse(w, ExpectedErrorNotAllowed)
 		return
 	}
@@ -180,23 +194,37 @@ func handleVerifyUserEmailRequest(env *Environment, w http.ResponseWriter, r *ht
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData) // 400 Bad Request.
 		return
 	}
-	// Define a struct to unmarshal the JSON {"code": "..."}.
+	// Define a struct to unmarshal the JSON {"code": "...", "client_ip": "..."}.
 	var data struct {
-		Code *string `json:"code"` // Pointer to handle potential null/missing field.
+		Code     *string `json:"code"`      // Pointer to handle potential null/missing field.
+		ClientIP string  `json:"client_ip"` // Client's IP for rate limiting.
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
 		// JSON parsing failed.
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err)) // 400 Bad Request.
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	// 5. Check if the 'code' field was provided and is not empty once whitespace is removed.
+	if data.Code == nil {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData) // 400 Bad Request.
 		return
 	}
-	// 5. Check if the 'code' field was provided and is not empty.
-	if data.Code == nil || *data.Code == "" {
+	code, ok := normalizeCode(*data.Code, false)
+	if !ok {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData) // 400 Bad Request.
 		return
 	}
+	code = env.emailVerificationCodeFormat.normalizeInput(code)
 
-	// 6. Apply rate limiting for verification attempts.
+	// 6. Apply rate limiting before the expensive Argon2id verification, like the password reset flow.
+	if data.ClientIP != "" && !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // 429 Too Many Requests.
+		return
+	}
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
+	// Apply rate limiting for verification attempts.
 	// Consume a token. If no tokens are available, the attempt is blocked.
 	if !env.verifyUserEmailRateLimit.Consume(userId) {
 		// If rate limited, delete the current verification request to force the user
@@ -210,23 +238,34 @@ func handleVerifyUserEmailRequest(env *Environment, w http.ResponseWriter, r *ht
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests) // 429 Too Many Requests.
 		return
 	}
+	setRateLimitHeaders(env, w, &env.verifyUserEmailRateLimit, userId)
 
 	// 7. Validate the provided code against the one stored in the database.
 	// This function also typically deletes the request record upon successful validation.
-	validCode, err := validateUserEmailVerificationRequest(env.db, r.Context(), userId, *data.Code)
+	validCode, err := validateUserEmailVerificationRequest(env.db, r.Context(), userId, code)
 	if err != nil {
 		log.Println(err) // Log unexpected database errors during validation.
-		writeUnexpectedErrorResponse(w) // 500 Internal Server Error.
+		writeUnexpectedErrorResponseWithDetail(env, w, err) // 500 Internal Server Error.
 		return
 	}
 	// If the code is incorrect...
 	if !validCode {
 		// Respond with 400 Bad Request (Incorrect Code).
 		// Note: The rate limiter token was already consumed. Multiple incorrect attempts will lead to 429.
+		env.delayAuthenticationFailure(r.Context())
 		writeExpectedErrorResponse(w, ExpectedErrorIncorrectCode)
 		return
 	}
 
+	// The user proved they own the email address, so remember it as verified.
+	err = setUserEmailVerified(env.db, r.Context(), userId)
+	env.invalidateCachedUser(userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
 	// If the code was valid and validation succeeded:
 	// Reset the verification attempt rate limiter for this user, allowing them to
 	// immediately start a new verification process if needed in the future.
@@ -268,12 +307,12 @@ func handleDeleteUserEmailVerificationRequestRequest(env *Environment, w http.Re
 	// Handle other potential database errors.
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// Check if the request is already expired.
-	if time.Now().Compare(verificationRequest.ExpiresAt) >= 0 {
+	if verificationRequest.IsExpired(time.Now()) {
 		// If expired, attempt to delete it (cleanup).
 		err = deleteUserEmailVerificationRequest(env.db, r.Context(), verificationRequest.UserId)
 		if err != nil {
@@ -288,7 +327,7 @@ func handleDeleteUserEmailVerificationRequestRequest(env *Environment, w http.Re
 	err = deleteUserEmailVerificationRequest(env.db, r.Context(), verificationRequest.UserId)
 	if err != nil {
 		log.Println(err) // Log deletion error.
-		writeUnexpectedErrorResponse(w) // Respond 500 if deletion fails.
+		writeUnexpectedErrorResponseWithDetail(env, w, err) // Respond 500 if deletion fails.
 		return
 	}
 
@@ -334,12 +373,12 @@ func handleGetUserEmailVerificationRequestRequest(env *Environment, w http.Respo
 	// Handle other database errors.
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// Check if the request is expired.
-	if time.Now().Compare(verificationRequest.ExpiresAt) >= 0 {
+	if verificationRequest.IsExpired(time.Now()) {
 		// If expired, attempt to delete it (cleanup).
 		err = deleteUserEmailVerificationRequest(env.db, r.Context(), verificationRequest.UserId)
 		if err != nil {
@@ -351,13 +390,15 @@ func handleGetUserEmailVerificationRequestRequest(env *Environment, w http.Respo
 	}
 
 	// If found and not expired, respond with the request details (encoded as JSON).
+	// Only the hash of the code is stored, so the code is not included.
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // 200 OK.
-	w.Write([]byte(verificationRequest.EncodeToJSON()))
+	w.Write([]byte(verificationRequest.EncodeToJSONWithoutCode(requestTimeFormat(env, r))))
 }
 
 // getUserEmailVerificationRequest retrieves a pending email verification request
-// from the database for a specific user ID.
+// from the database for a specific user ID. Only the hash of the code is stored,
+// so the Code field of the returned request is always empty.
 //
 // Parameters:
 //   db (*sql.DB): Database connection pool.
@@ -375,9 +416,9 @@ func getUserEmailVerificationRequest(db *sql.DB, ctx context.Context, userId str
 	// Variables to store Unix timestamps retrieved from the database.
 	var createdAtUnix, expiresAtUnix int64
 	// Query the database for the verification request row matching the user ID.
-	row := db.QueryRowContext(ctx, "SELECT user_id, created_at, expires_at, code FROM user_email_verification_request WHERE user_id = ?", userId)
+	row := db.QueryRowContext(ctx, "SELECT user_id, created_at, expires_at FROM user_email_verification_request WHERE user_id = ?", userId)
 	// Scan the retrieved row columns into the verificationRequest struct fields and timestamp variables.
-	err := row.Scan(&verificationRequest.UserId, &createdAtUnix, &expiresAtUnix, &verificationRequest.Code)
+	err := row.Scan(&verificationRequest.UserId, &createdAtUnix, &expiresAtUnix)
 	// Check if the error is sql.ErrNoRows, indicating the record was not found.
 	if errors.Is(err, sql.ErrNoRows) {
 		// Return an empty request and the specific ErrRecordNotFound error.
@@ -408,11 +449,184 @@ func deleteUserEmailVerificationRequest(db *sql.DB, ctx context.Context, userId
 	return err
 }
 
+// getUserEmailVerified reports whether the user has verified their email address,
+// either with an email verification request, an email update request, or a password reset.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user.
+//
+// Returns:
+//   (bool): true if the user's email address is verified.
+//   (error): ErrRecordNotFound if the user does not exist, or any other database error.
+func getUserEmailVerified(db *sql.DB, ctx context.Context, userId string) (bool, error) {
+	var emailVerified bool
+	err := db.QueryRowContext(ctx, "SELECT email_verified FROM user WHERE id = ?", userId).Scan(&emailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrRecordNotFound
+	}
+	return emailVerified, err
+}
+
+// setUserEmailVerified marks the user's email address as verified.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user.
+//
+// Returns:
+//   (error): Any database error encountered during the update.
+func setUserEmailVerified(db *sql.DB, ctx context.Context, userId string) error {
+	_, err := db.ExecContext(ctx, "UPDATE user SET email_verified = 1 WHERE id = ?", userId)
+	return err
+}
+
+// getUserEmail returns the user's stored email address (see createUser and
+// completeEmailUpdateRequest).
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user.
+//
+// Returns:
+//   (string): The email address, or an empty string if none is stored.
+//   (error): ErrRecordNotFound if the user does not exist, or any other database error.
+func getUserEmail(db *sql.DB, ctx context.Context, userId string) (string, error) {
+	var email sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT email FROM user WHERE id = ?", userId).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrRecordNotFound
+	}
+	return email.String, err
+}
+
+// Email addresses are stored as entered, so the user sees the casing they typed, but
+// user.email is declared COLLATE NOCASE (see schema.sql): its UNIQUE constraint and
+// lookups treat "Foo@example.com" and "foo@example.com" as the same address.
+
+// ExpectedErrorEmailAlreadyUsed means another user already has the email address,
+// ignoring case.
+const ExpectedErrorEmailAlreadyUsed = "EMAIL_ALREADY_USED"
+
+// ErrEmailAlreadyUsed is returned when storing an email address fails because another
+// user already has it (see createUser and completeEmailUpdateRequest).
+var ErrEmailAlreadyUsed = errors.New("email address already used")
+
+// getUserFromEmail returns the user with the email address, ignoring case.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   email (string): The email address to look up.
+//
+// Returns:
+//   (User): The user.
+//   (error): ErrRecordNotFound if no user has the email address, or any other database error.
+func getUserFromEmail(db *sql.DB, ctx context.Context, email string) (User, error) {
+	var userId string
+	err := db.QueryRowContext(ctx, "SELECT id FROM user WHERE email = ?", email).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrRecordNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return getUser(db, ctx, userId)
+}
+
+// checkEmailAvailability reports whether no user has the email address, ignoring case.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   email (string): The email address to check.
+//
+// Returns:
+//   (bool): true if the email address can be stored on a user.
+//   (error): Any database error.
+func checkEmailAvailability(db *sql.DB, ctx context.Context, email string) (bool, error) {
+	var used bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user WHERE email = ?)", email).Scan(&used)
+	if err != nil {
+		return false, err
+	}
+	return !used, nil
+}
+
+// createUserEmailVerificationRequestWithCodeHash creates a new email verification request
+// for a user, replacing any existing one. It generates a new code and stores only its
+// Argon2id hash, mirroring how password reset codes are stored.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user to create the request for.
+//   format (codeFormat): The format of the generated code (env.emailVerificationCodeFormat).
+//
+// Returns:
+//   (UserEmailVerificationRequest): The created request. Its Code field holds the
+//                                   plaintext code, which cannot be retrieved again later.
+//   (error): Any error encountered while generating the code, hashing it, or inserting the request.
+func createUserEmailVerificationRequestWithCodeHash(db *sql.DB, ctx context.Context, userId string, format codeFormat) (UserEmailVerificationRequest, error) {
+	code, codeHash, err := generateEmailVerificationCode(ctx, format)
+	if err != nil {
+		return UserEmailVerificationRequest{}, err
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	verificationRequest := UserEmailVerificationRequest{
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(10 * time.Minute),
+		Code:      code,
+	}
+	// A user has at most one verification request, so replace any existing one.
+	_, err = db.ExecContext(ctx, `INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code_hash) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET created_at = excluded.created_at, expires_at = excluded.expires_at, code_hash = excluded.code_hash`,
+		verificationRequest.UserId, verificationRequest.CreatedAt.Unix(), verificationRequest.ExpiresAt.Unix(), codeHash)
+	if err != nil {
+		return UserEmailVerificationRequest{}, err
+	}
+	return verificationRequest, nil
+}
+
+// generateEmailVerificationCode generates an email verification code and its Argon2id hash.
+//
+// Parameters:
+//   ctx (context.Context): Request context. Hashing isn't started once it is done.
+//   format (codeFormat): The format of the generated code (env.emailVerificationCodeFormat).
+//
+// Returns:
+//   (string): The plaintext code.
+//   (string): The hash of the code, to be stored instead of the code.
+//   (error): Any error encountered while generating or hashing the code.
+func generateEmailVerificationCode(ctx context.Context, format codeFormat) (string, string, error) {
+	code, err := format.generate()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	// Argon2id can't be cancelled, so don't start it once the request context is done.
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	codeHash, err := argon2id.Hash(code)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash code: %w", err)
+	}
+	return code, codeHash, nil
+}
+
 // validateUserEmailVerificationRequest attempts to redeem an email verification request
-// by checking if the provided code matches the stored code for the user and if the
+// by checking if the provided code matches the stored code hash for the user and if the
 // request has not expired. If the code is valid and the request is not expired,
 // the corresponding record is deleted from the database.
 //
+// Codes shorter than minCodeLength or longer than maxCodeLength are rejected before touching
+// the database. Otherwise the code is verified against the stored Argon2id hash, whatever
+// format it was generated in.
+//
 // Parameters:
 //   db (*sql.DB): Database connection pool.
 //   ctx (context.Context): Request context for cancellation propagation.
@@ -422,12 +636,31 @@ func deleteUserEmailVerificationRequest(db *sql.DB, ctx context.Context, userId
 // Returns:
 //   (bool): True if the code was valid, the request was not expired, and the record
 //           was successfully deleted. False otherwise.
-//   (error): Any database error encountered during the deletion attempt.
+//   (error): Any database or hash parsing error encountered.
 func validateUserEmailVerificationRequest(db *sql.DB, ctx context.Context, userId string, code string) (bool, error) {
-	// Execute a DELETE statement that targets the specific verification request row
-	// matching the user ID, the provided code, and a non-expired timestamp.
-	// The WHERE clause `expires_at > ?` ensures we only delete non-expired requests.
-	result, err := db.ExecContext(ctx, "DELETE FROM user_email_verification_request WHERE user_id = ? AND code = ? AND expires_at > ?", userId, code, time.Now().Unix())
+	// Reject codes no format can produce early; they can never match.
+	if len(code) < minCodeLength || len(code) > maxCodeLength {
+		return false, nil
+	}
+	// Retrieve the stored hash of the non-expired request.
+	var codeHash string
+	err := db.QueryRowContext(ctx, "SELECT code_hash FROM user_email_verification_request WHERE user_id = ? AND expires_at > ?", userId, time.Now().Unix()).Scan(&codeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	validCode, err := argon2id.Verify(codeHash, code)
+	if err != nil {
+		return false, err
+	}
+	if !validCode {
+		return false, nil
+	}
+	// Delete the request only if it is still the same request.
+	// Matching on the stored hash ensures a request replaced in the meantime is not consumed.
+	result, err := db.ExecContext(ctx, "DELETE FROM user_email_verification_request WHERE user_id = ? AND code_hash = ?", userId, codeHash)
 	if err != nil {
 		// If there's a database error during execution, return false and the error.
 		return false, err
@@ -438,11 +671,594 @@ func validateUserEmailVerificationRequest(db *sql.DB, ctx context.Context, userI
 		// If there's an error getting the affected rows count, return false and the error.
 		return false, err
 	}
-	// If affected > 0, it means exactly one row was deleted, signifying that the
-	// code was correct and the request was not expired.
-	// If affected == 0, it means no matching, non-expired row was found (incorrect code or expired).
+	// If affected == 0, the request was replaced or deleted after it was read.
 	return affected > 0, nil // Return true if a row was deleted, false otherwise, and nil error.
 }
 
+// userEmailVerificationRequestJSON is the JSON representation of a UserEmailVerificationRequest.
+// Code is omitted when returning a stored request, since only the hash of its code is kept.
+type userEmailVerificationRequestJSON struct {
+	UserId    string   `json:"user_id"`
+	CreatedAt UnixTime `json:"created_at"`
+	ExpiresAt UnixTime `json:"expires_at"`
+	Code      string   `json:"code,omitempty"`
+}
+
+// encodeUserEmailVerificationRequestToJSON encodes a newly created verification request,
+// including its code, with timestamps in the given format.
+func encodeUserEmailVerificationRequestToJSON(r UserEmailVerificationRequest, format timeFormat) string {
+	encoded, err := json.Marshal(userEmailVerificationRequestJSON{r.UserId, newUnixTime(r.CreatedAt, format), newUnixTime(r.ExpiresAt, format), r.Code})
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// EncodeToJSONWithoutCode encodes the verification request as JSON without the code.
+// Used when returning a stored request, since only the hash of its code is kept.
+func (r *UserEmailVerificationRequest) EncodeToJSONWithoutCode(format timeFormat) string {
+	encoded, err := json.Marshal(userEmailVerificationRequestJSON{r.UserId, newUnixTime(r.CreatedAt, format), newUnixTime(r.ExpiresAt, format), ""})
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// encodeEmailUpdateRequestToJSON encodes a newly created email update request, including
+// its code, with timestamps in the given format.
+func encodeEmailUpdateRequestToJSON(r EmailUpdateRequest, format timeFormat) string {
+	data := struct {
+		Id        string   `json:"id"`
+		UserId    string   `json:"user_id"`
+		CreatedAt UnixTime `json:"created_at"`
+		ExpiresAt UnixTime `json:"expires_at"`
+		Email     string   `json:"email"`
+		Code      string   `json:"code"`
+	}{r.Id, r.UserId, newUnixTime(r.CreatedAt, format), newUnixTime(r.ExpiresAt, format), r.Email, r.Code}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// IsExpired reports whether the verification request has expired at now (now is at or after ExpiresAt).
+func (r *UserEmailVerificationRequest) IsExpired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// IsExpired reports whether the email update request has expired at now (now is at or after ExpiresAt).
+func (r *EmailUpdateRequest) IsExpired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
 // UserEmailVerificationRequest defines the structure for storing user email verification data.
 {{ ... }}
+
+// handleCreateUserEmailUpdateRequestRequest handles POST /users/:user_id/email-update-requests.
+// It creates a request to change the user's email address and returns it along with the code,
+// which the application sends to the new address.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+// 3. User Existence Check.
+// 4. Request Body Validation (createEmailUpdateRequestRequest): The email address is required
+//    and must be well-formed.
+// 5. Email Validation: If env.allowedEmailDomains is set, the domain must be allowed and, if
+//    env.disposableEmailDomains is set, it must not be on the blocklist, like in POST /users.
+//    No other user may have the address, ignoring case (see checkEmailAvailability).
+// 6. Rate Limiting: Consumes a token for the user and for the new address
+//    (emailUpdateRequestRateLimit), which are refunded if the request isn't created.
+// 7. Active Request Limit: At env.emailUpdateRequestLimit(), the oldest active requests are
+//    deleted, or the new request is rejected with ExpectedErrorTooManyRequests.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   params (httprouter.Params): URL parameters (contains 'user_id').
+func handleCreateUserEmailUpdateRequestRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	userId := params.ByName("user_id")
+	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userExists {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	data := createEmailUpdateRequestRequest{emailLimits: env.emailAddressLimits}
+	if !decodeAndValidateJSON(w, r, &data) {
+		return
+	}
+	email := *data.Email
+
+	if !verifyEmailDomainAllowed(env.allowedEmailDomains, email) {
+		env.logEvent("email update request rejected: email domain not allowed", logStringField("user_id", userId), logEmailField("email", email))
+		writeExpectedErrorResponse(w, ExpectedErrorEmailDomainNotAllowed)
+		return
+	}
+	if !verifyEmailNotDisposable(env.disposableEmailDomains, email) {
+		env.logEvent("email update request rejected: disposable email", logStringField("user_id", userId), logEmailField("email", email))
+		writeExpectedErrorResponse(w, ExpectedErrorDisposableEmail)
+		return
+	}
+
+	emailAvailable, err := checkEmailAvailability(env.db, r.Context(), email)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !emailAvailable {
+		writeExpectedErrorResponse(w, ExpectedErrorEmailAlreadyUsed)
+		return
+	}
+
+	// Consume the user's and the target address's tokens (see code-delivery.go).
+	if !env.emailUpdateRequestRateLimit.consume(userId, email) {
+		env.logEvent("email update request rate limited", logStringField("user_id", userId), logEmailField("email", email))
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+
+	code, err := env.emailVerificationCodeFormat.generate()
+	if err != nil {
+		log.Println(err)
+		// No request was created, so refund the tokens.
+		env.emailUpdateRequestRateLimit.refund(userId, email)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	updateRequest, err := createEmailUpdateRequest(env.db, r.Context(), env.generateId, userId, email, code, env.emailUpdateRequestLimit())
+	if errors.Is(err, ErrTooManyActiveEmailUpdateRequests) {
+		env.emailUpdateRequestRateLimit.refund(userId, email)
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		env.emailUpdateRequestRateLimit.refund(userId, email)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeEmailUpdateRequestToJSON(updateRequest, requestTimeFormat(env, r))))
+}
+
+// createEmailUpdateRequestRequest is the request body of POST /users/:user_id/email-update-requests.
+type createEmailUpdateRequestRequest struct {
+	Email *string `json:"email"` // The new email address.
+
+	emailLimits emailAddressLimits // Set by the handler from env.emailAddressLimits; not part of the body.
+}
+
+// validate checks that the email address is provided, well-formed and within data.emailLimits.
+func (data *createEmailUpdateRequestRequest) validate() []fieldError {
+	if data.Email == nil || *data.Email == "" {
+		return []fieldError{{"email", FieldErrorRequired}}
+	}
+	if !verifyEmailAddressInputWithLimits(*data.Email, data.emailLimits) {
+		return []fieldError{{"email", FieldErrorInvalid}}
+	}
+	return nil
+}
+
+// emailUpdateRequestLifetime is how long an email update request can be verified.
+const emailUpdateRequestLifetime = 10 * time.Minute
+
+// createEmailUpdateRequest inserts a new email update request for the user. In the same
+// transaction, it first enforces limit with makeRoomForEmailUpdateRequest, so concurrent
+// requests can't push the user over the limit.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   generateId (func() (string, error)): Request ID generator, usually env.generateId.
+//   userId (string): The user changing their email address.
+//   email (string): The new email address.
+//   code (string): The code sent to the new address.
+//   limit (activeEmailUpdateRequestLimit): Usually env.emailUpdateRequestLimit().
+//
+// Returns:
+//   (EmailUpdateRequest): The created request, with timestamps in whole seconds.
+//   (error): ErrTooManyActiveEmailUpdateRequests if the limit rejected the request, or any
+//            error generating the ID or accessing the database.
+func createEmailUpdateRequest(db *sql.DB, ctx context.Context, generateId func() (string, error), userId string, email string, code string, limit activeEmailUpdateRequestLimit) (EmailUpdateRequest, error) {
+	now := time.Unix(time.Now().Unix(), 0)
+	updateRequest := EmailUpdateRequest{
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailUpdateRequestLifetime),
+		Email:     email,
+		Code:      code,
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return EmailUpdateRequest{}, err
+	}
+	defer tx.Rollback()
+
+	err = makeRoomForEmailUpdateRequest(tx, ctx, userId, now, limit)
+	if err != nil {
+		return EmailUpdateRequest{}, err
+	}
+	requestId, err := insertWithGeneratedId(generateId, func(id string) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO email_update_request (id, user_id, created_at, expires_at, email, code) VALUES (?, ?, ?, ?, ?, ?)",
+			id, updateRequest.UserId, updateRequest.CreatedAt.Unix(), updateRequest.ExpiresAt.Unix(), updateRequest.Email, updateRequest.Code)
+		return err
+	})
+	if err != nil {
+		return EmailUpdateRequest{}, fmt.Errorf("failed to insert email update request: %w", err)
+	}
+	updateRequest.Id = requestId
+	return updateRequest, tx.Commit()
+}
+
+// handleVerifyEmailUpdateRequestRequest handles POST /email-update-requests/:request_id/verify.
+// It verifies the code of an email update request identified by the URL instead of the
+// request body, for clients that work with request URLs. It shares its logic with
+// POST /verify-new-email (handleUpdateEmailRequest), which is kept for compatibility.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+// 3. Update Request Existence & Expiry Check: Expired requests are deleted.
+// 4. Rate Limiting and Code Validation: See verifyEmailUpdateRequestCode.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   params (httprouter.Params): URL parameters (contains 'request_id').
+func handleVerifyEmailUpdateRequestRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	updateRequest, err := getEmailUpdateRequest(env.db, r.Context(), params.ByName("request_id"))
+	if errors.Is(err, ErrRecordNotFound) {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	// Expired requests can never be verified, so remove them like the password reset flow does.
+	if updateRequest.IsExpired(time.Now()) {
+		err = deleteEmailUpdateRequest(env.db, r.Context(), updateRequest.Id)
+		if err != nil {
+			log.Println(err)
+		}
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		Code     *string `json:"code"`
+		ClientIP string  `json:"client_ip"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	if data.Code == nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	expectedError, err := verifyEmailUpdateRequestCode(env, r.Context(), updateRequest, *data.Code, data.ClientIP)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if expectedError != "" {
+		writeExpectedErrorResponse(w, expectedError)
+		return
+	}
+	writeAuditLog(env, r, AuditActionEmailUpdate, updateRequest.UserId, data.ClientIP)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeEmailToJSON(updateRequest.Email)))
+}
+
+// handleUpdateEmailRequest handles POST /verify-new-email, which takes the update request ID
+// in the request body. Unlike POST /email-update-requests/:request_id/verify, it reports a
+// missing or expired update request as INVALID_REQUEST, as this endpoint always has.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+// 3. Update Request Existence & Expiry Check.
+// 4. Rate Limiting and Code Validation: See verifyEmailUpdateRequestCode.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleUpdateEmailRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		RequestId *string `json:"request_id"`
+		Code      *string `json:"code"`
+		ClientIP  string  `json:"client_ip"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	if data.RequestId == nil || data.Code == nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	updateRequest, err := getEmailUpdateRequest(env.db, r.Context(), *data.RequestId)
+	if errors.Is(err, ErrRecordNotFound) {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidRequest)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if updateRequest.IsExpired(time.Now()) {
+		err = deleteEmailUpdateRequest(env.db, r.Context(), updateRequest.Id)
+		if err != nil {
+			log.Println(err)
+		}
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
+		return
+	}
+
+	expectedError, err := verifyEmailUpdateRequestCode(env, r.Context(), updateRequest, *data.Code, data.ClientIP)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if expectedError != "" {
+		writeExpectedErrorResponse(w, expectedError)
+		return
+	}
+	writeAuditLog(env, r, AuditActionEmailUpdate, updateRequest.UserId, data.ClientIP)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeEmailToJSON(updateRequest.Email)))
+}
+
+// verifyEmailUpdateRequestCode verifies a code for a non-expired email update request and,
+// if it is correct, completes the request. Each request allows a limited number of attempts
+// (verifyEmailUpdateVerificationCodeLimitCounter); once they are used up the request is
+// deleted, so a leaked request ID can't be used to brute-force its code.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   ctx (context.Context): Request context.
+//   updateRequest (EmailUpdateRequest): The update request, which the caller has checked is not expired.
+//   code (string): The code submitted by the user. Whitespace is removed before comparing.
+//   clientIP (string): Optional client IP address, rate limited with passwordHashingIPRateLimit.
+//
+// Returns:
+//   (string): An expected error code (INVALID_DATA, TOO_MANY_REQUESTS, INCORRECT_CODE,
+//             INVALID_REQUEST or EMAIL_ALREADY_USED), or "" if the code was correct and the
+//             request was completed.
+//   (error): Any unexpected database error.
+func verifyEmailUpdateRequestCode(env *Environment, ctx context.Context, updateRequest EmailUpdateRequest, code string, clientIP string) (string, error) {
+	code, ok := normalizeCode(code, false)
+	if !ok {
+		return ExpectedErrorInvalidData, nil
+	}
+	code = env.emailVerificationCodeFormat.normalizeInput(code)
+	if clientIP != "" && !env.passwordHashingIPRateLimit.Consume(clientIP) {
+		return ExpectedErrorTooManyRequests, nil
+	}
+	if !env.verifyEmailUpdateVerificationCodeLimitCounter.Consume(updateRequest.Id) {
+		// Out of attempts: invalidate the request so the user has to start over.
+		err := deleteEmailUpdateRequest(env.db, ctx, updateRequest.Id)
+		if err != nil {
+			return "", err
+		}
+		return ExpectedErrorTooManyRequests, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(updateRequest.Code)) != 1 {
+		env.delayAuthenticationFailure(ctx)
+		return ExpectedErrorIncorrectCode, nil
+	}
+
+	completed, err := completeEmailUpdateRequest(env.db, ctx, updateRequest)
+	env.invalidateCachedUser(updateRequest.UserId)
+	if errors.Is(err, ErrEmailAlreadyUsed) {
+		return ExpectedErrorEmailAlreadyUsed, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// The request was deleted (e.g. verified by a concurrent request) after it was read.
+	if !completed {
+		return ExpectedErrorInvalidRequest, nil
+	}
+	env.verifyEmailUpdateVerificationCodeLimitCounter.Delete(updateRequest.Id)
+	return "", nil
+}
+
+// completeEmailUpdateRequest consumes a verified email update request. In a single transaction,
+// it stores the new email address on the user, deletes every email update request for the same
+// email address (ignoring case), since the address now belongs to the user, and deletes the user's password
+// reset requests, since they were created for the old address.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   updateRequest (EmailUpdateRequest): The verified update request.
+//
+// Returns:
+//   (bool): False if the update request no longer exists, in which case nothing is deleted.
+//   (error): ErrEmailAlreadyUsed if another user has the email address by now, in which case
+//            nothing is changed, or any other database error.
+func completeEmailUpdateRequest(db *sql.DB, ctx context.Context, updateRequest EmailUpdateRequest) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM email_update_request WHERE id = ?", updateRequest.Id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM email_update_request WHERE email = ? COLLATE NOCASE", updateRequest.Email)
+	if err != nil {
+		return false, err
+	}
+	// The code was sent to the new address, so it is verified.
+	_, err = tx.ExecContext(ctx, "UPDATE user SET email = ?, email_verified = 1 WHERE id = ?", updateRequest.Email, updateRequest.UserId)
+	if isUniqueConstraintError(err) {
+		return false, ErrEmailAlreadyUsed
+	}
+	if err != nil {
+		return false, err
+	}
+	// Used requests kept for audit are left for the cleanup worker.
+	_, err = tx.ExecContext(ctx, "DELETE FROM password_reset_request WHERE user_id = ? AND used_at IS NULL", updateRequest.UserId)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// The number of active (unexpired) email update requests per user is capped at
+// env.maxActiveEmailUpdateRequests. createEmailUpdateRequest calls makeRoomForEmailUpdateRequest
+// in the transaction that inserts a new request: by default the oldest active requests are
+// deleted, and with env.rejectEmailUpdateRequestsOverLimit the new request is rejected with
+// ExpectedErrorTooManyRequests instead. This mirrors the limit on
+// password reset requests (see activePasswordResetRequestLimit in password-reset.go).
+
+// defaultMaxActiveEmailUpdateRequests is used when env.maxActiveEmailUpdateRequests isn't set.
+const defaultMaxActiveEmailUpdateRequests = 5
+
+// ErrTooManyActiveEmailUpdateRequests means the user already has the maximum number of
+// active email update requests and the limit is configured to reject new ones.
+var ErrTooManyActiveEmailUpdateRequests = errors.New("too many active email update requests")
+
+// activeEmailUpdateRequestLimit is the per-user cap on active email update requests.
+type activeEmailUpdateRequestLimit struct {
+	max    int  // Maximum number of active requests.
+	reject bool // Reject new requests at the cap instead of deleting the oldest ones.
+}
+
+// emailUpdateRequestLimit returns the configured cap on active email update requests.
+// Values of env.maxActiveEmailUpdateRequests below 1 fall back to defaultMaxActiveEmailUpdateRequests.
+func (env *Environment) emailUpdateRequestLimit() activeEmailUpdateRequestLimit {
+	limit := activeEmailUpdateRequestLimit{
+		max:    env.maxActiveEmailUpdateRequests,
+		reject: env.rejectEmailUpdateRequestsOverLimit,
+	}
+	if limit.max < 1 {
+		limit.max = defaultMaxActiveEmailUpdateRequests
+	}
+	return limit
+}
+
+// makeRoomForEmailUpdateRequest enforces limit before a new email update request is inserted
+// for the user. Expired requests don't count towards the limit.
+//
+// Parameters:
+//   tx (*sql.Tx): The transaction that inserts the new request.
+//   ctx (context.Context): Request context.
+//   userId (string): The user creating the request.
+//   now (time.Time): The current time, used to tell active requests from expired ones.
+//   limit (activeEmailUpdateRequestLimit): Usually env.emailUpdateRequestLimit().
+//
+// Returns:
+//   (error): ErrTooManyActiveEmailUpdateRequests if the user is at the limit and limit.reject
+//            is set, or a database error. Otherwise the oldest active requests are deleted so
+//            that limit.max - 1 remain.
+func makeRoomForEmailUpdateRequest(tx *sql.Tx, ctx context.Context, userId string, now time.Time, limit activeEmailUpdateRequestLimit) error {
+	if limit.reject {
+		var activeCount int
+		err := tx.QueryRowContext(ctx, "SELECT count(*) FROM email_update_request WHERE user_id = ? AND expires_at > ?", userId, now.Unix()).Scan(&activeCount)
+		if err != nil {
+			return err
+		}
+		if activeCount >= limit.max {
+			return ErrTooManyActiveEmailUpdateRequests
+		}
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM email_update_request WHERE id IN (
+		SELECT id FROM email_update_request WHERE user_id = ? AND expires_at > ?
+		ORDER BY created_at DESC, rowid DESC LIMIT -1 OFFSET ?
+	)`, userId, now.Unix(), limit.max-1)
+	return err
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"         // 导入上下文包，数据库操作函数需要它
 	"database/sql"    // 导入数据库 SQL 包
 	"encoding/json" // 导入 JSON 编码/解码包
+	"faroe/argon2id"  // 导入 Argon2id 包，用于哈希验证码
+	"fmt"             // 导入格式化包，用于把列的值转换为字符串
+	"strings"         // 导入字符串包，用于生成过长的验证码
 	"testing"         // 导入 Go 的测试包
 	"time"            // 导入时间包
 
@@ -10,18 +14,18 @@ import (
 )
 
 // insertUserEmailVerificationRequest 是一个测试辅助函数，用于向数据库中插入一条用户邮箱验证请求记录。
-// 注意：此函数的 SQL 语句参数似乎存在问题 (占位符数量与提供的值不匹配)。
+// 与 createUserEmailVerificationRequestWithCodeHash 一样，数据库中只保存 request.Code 的 Argon2id 哈希。
 // 参数：
 //   db (*sql.DB): 数据库连接对象。
 //   request (*UserEmailVerificationRequest): 要插入的验证请求数据。
 // 返回值：
-//   error: 如果数据库操作出错，则返回错误信息，否则返回 nil。
+//   error: 如果哈希或数据库操作出错，则返回错误信息，否则返回 nil。
 func insertUserEmailVerificationRequest(db *sql.DB, request *UserEmailVerificationRequest) error {
-	// SQL 语句的 VALUES 子句有 7 个 '?' 占位符，但只提供了 6 个参数。
-	// 最后三个参数 request.CreatedAt.Unix(), request.Code, request.UserId 看起来是多余或错误的。
-	// 正确的语句可能只需要 request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), request.Code。
-	_, err := db.Exec("INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code) VALUES (?, ?, ?, ?)", request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), request.Code) // 修正后的参数列表推测
-	// 原始问题代码: _, err := db.Exec("INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code) VALUES (?, ?, ?, ?)", request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), request.Code, request.CreatedAt.Unix(), request.Code, request.UserId)
+	codeHash, err := argon2id.Hash(request.Code)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code_hash) VALUES (?, ?, ?, ?)", request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), codeHash)
 	return err
 }
 
@@ -123,6 +127,168 @@ func TestUserEmailVerificationRequestEncodeToJSON(t *testing.T) {
 	assert.Equal(t, expected, result)
 }
 
+// TestEmailRequestIsExpired 测试 UserEmailVerificationRequest 和 EmailUpdateRequest 的 IsExpired：
+// 在 ExpiresAt 之前返回 false，在 ExpiresAt 及之后返回 true。
+func TestEmailRequestIsExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	expiresAt := now.Add(10 * time.Minute)
+
+	verificationRequest := UserEmailVerificationRequest{UserId: "1", CreatedAt: now, ExpiresAt: expiresAt}
+	assert.False(t, verificationRequest.IsExpired(now))
+	assert.False(t, verificationRequest.IsExpired(expiresAt.Add(-time.Nanosecond)))
+	assert.True(t, verificationRequest.IsExpired(expiresAt))
+	assert.True(t, verificationRequest.IsExpired(expiresAt.Add(time.Second)))
+
+	updateRequest := EmailUpdateRequest{Id: "1", UserId: "1", CreatedAt: now, ExpiresAt: expiresAt}
+	assert.False(t, updateRequest.IsExpired(now))
+	assert.True(t, updateRequest.IsExpired(expiresAt))
+}
+
+// TestValidateUserEmailVerificationRequest 测试 validateUserEmailVerificationRequest 函数。
+// 长度相同但错误的验证码应被拒绝且不删除请求；长度超出可配置范围的验证码应在查询数据库之前被拒绝；
+// 正确的验证码应通过并删除请求；过期请求的正确验证码应被拒绝。
+func TestValidateUserEmailVerificationRequest(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, userId := range []string{"1", "2"} {
+		err := insertUser(db, context.Background(), &User{
+			Id:           userId,
+			CreatedAt:    now,
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := insertUserEmailVerificationRequest(db, &UserEmailVerificationRequest{
+		UserId:    "1",
+		CreatedAt: now,
+		ExpiresAt: now.Add(10 * time.Minute),
+		Code:      "12345678",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已过期的请求
+	err = insertUserEmailVerificationRequest(db, &UserEmailVerificationRequest{
+		UserId:    "2",
+		CreatedAt: now.Add(-20 * time.Minute),
+		ExpiresAt: now.Add(-10 * time.Minute),
+		Code:      "12345678",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 任何格式都不可能生成的长度的验证码在访问数据库之前就被拒绝 (这里传入 nil 数据库)
+	valid, err := validateUserEmailVerificationRequest(nil, context.Background(), "1", "12345")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	valid, err = validateUserEmailVerificationRequest(nil, context.Background(), "1", strings.Repeat("1", maxCodeLength+1))
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 长度相同但错误的验证码
+	valid, err = validateUserEmailVerificationRequest(db, context.Background(), "1", "87654321")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	_, err = getUserEmailVerificationRequest(db, context.Background(), "1")
+	assert.NoError(t, err, "an incorrect code should not delete the request")
+
+	// 过期请求的正确验证码
+	valid, err = validateUserEmailVerificationRequest(db, context.Background(), "2", "12345678")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 正确的验证码
+	valid, err = validateUserEmailVerificationRequest(db, context.Background(), "1", "12345678")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	_, err = getUserEmailVerificationRequest(db, context.Background(), "1")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	// 生成的验证码长度应与 secureCodeLength 一致
+	code, err := generateSecureCode()
+	assert.NoError(t, err)
+	assert.Len(t, code, secureCodeLength)
+}
+
+// TestCreateUserEmailVerificationRequestWithCodeHash 测试创建邮箱验证请求时数据库中只保存验证码的哈希，
+// 明文验证码只在返回值中出现，并且可以用来验证。
+func TestCreateUserEmailVerificationRequestWithCodeHash(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	err := insertUser(db, context.Background(), &User{
+		Id:           "1",
+		CreatedAt:    time.Unix(time.Now().Unix(), 0),
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verificationRequest, err := createUserEmailVerificationRequestWithCodeHash(db, context.Background(), "1", codeFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, verificationRequest.Code, secureCodeLength)
+
+	// 表中的任何一列都不应包含明文验证码
+	rows, err := db.Query("SELECT * FROM user_email_verification_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, columns, "code")
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+		err = rows.Scan(pointers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, value := range values {
+			assert.NotEqual(t, verificationRequest.Code, fmt.Sprint(value), columns[i])
+		}
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, 1, rowCount)
+
+	// 再次创建会替换原来的请求，原来的验证码失效
+	newVerificationRequest, err := createUserEmailVerificationRequestWithCodeHash(db, context.Background(), "1", codeFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newVerificationRequest.Code != verificationRequest.Code {
+		valid, err := validateUserEmailVerificationRequest(db, context.Background(), "1", verificationRequest.Code)
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+	valid, err := validateUserEmailVerificationRequest(db, context.Background(), "1", newVerificationRequest.Code)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
 // EmailJSON 是用于在测试中表示只包含 email 字段的 JSON 结构。
 type EmailJSON struct {
 	Email string `json:"email"` // 邮箱地址，对应 JSON 中的 "email" 键
@@ -147,3 +313,144 @@ type UserEmailVerificationRequestJSON struct {
 	ExpiresAtUnix int64  `json:"expires_at"` // 过期时间的 Unix 时间戳，对应 JSON 中的 "expires_at" 键
 	Code          string `json:"code"`       // 验证码，对应 JSON 中的 "code" 键
 }
+
+// TestEmailVerificationCodeFormats 测试按照不同格式生成的邮箱验证码都可以通过验证。
+func TestEmailVerificationCodeFormats(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	err := insertUser(db, context.Background(), &User{
+		Id:           "1",
+		CreatedAt:    time.Unix(time.Now().Unix(), 0),
+		PasswordHash: "HASH",
+		RecoveryCode: "12345678",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []codeFormat{{numeric: true, length: 6}, {length: 12}} {
+		verificationRequest, err := createUserEmailVerificationRequestWithCodeHash(db, context.Background(), "1", format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, verificationRequest.Code, format.length)
+		valid, err := validateUserEmailVerificationRequest(db, context.Background(), "1", verificationRequest.Code)
+		assert.NoError(t, err)
+		assert.True(t, valid, verificationRequest.Code)
+	}
+}
+
+// TestMakeRoomForEmailUpdateRequest 测试用户的有效邮箱更新请求达到上限后，
+// 默认删除最早的有效请求，配置为拒绝时返回 ErrTooManyActiveEmailUpdateRequests。
+// 已过期的请求不计入上限。
+func TestMakeRoomForEmailUpdateRequest(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(time.Now().Unix(), 0)
+
+	setup := func(t *testing.T) *sql.DB {
+		db := initializeTestDB(t)
+		err := insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    now,
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 一个已过期的请求，不计入上限
+		err = insertEmailUpdateRequest(db, context.Background(), &EmailUpdateRequest{
+			Id:        "expired",
+			UserId:    "1",
+			CreatedAt: now.Add(-20 * time.Minute),
+			Email:     "expired@example.com",
+			ExpiresAt: now.Add(-10 * time.Minute),
+			Code:      "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// createRequest 用 createEmailUpdateRequest 创建一个 ID 为 requestId 的请求，它在插入的事务中调用 makeRoomForEmailUpdateRequest
+	createRequest := func(db *sql.DB, requestId string, limit activeEmailUpdateRequestLimit) error {
+		generateId := func() (string, error) { return requestId, nil }
+		_, err := createEmailUpdateRequest(db, context.Background(), generateId, "1", requestId+"@example.com", "12345678", limit)
+		return err
+	}
+	requestIds := func(t *testing.T, db *sql.DB) []string {
+		rows, err := db.Query("SELECT id FROM email_update_request ORDER BY rowid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var result []string
+		for rows.Next() {
+			var requestId string
+			err = rows.Scan(&requestId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, requestId)
+		}
+		return result
+	}
+
+	t.Run("evict oldest", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		limit := activeEmailUpdateRequestLimit{max: 3}
+		for _, requestId := range []string{"r1", "r2", "r3"} {
+			err := createRequest(db, requestId, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, []string{"expired", "r1", "r2", "r3"}, requestIds(t, db))
+
+		// 超过上限时删除最早的有效请求，过期的请求留给 cleanUpDatabase
+		err := createRequest(db, "r4", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"expired", "r2", "r3", "r4"}, requestIds(t, db))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		limit := activeEmailUpdateRequestLimit{max: 3, reject: true}
+		for _, requestId := range []string{"r1", "r2", "r3"} {
+			err := createRequest(db, requestId, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 超过上限时拒绝新的请求，已有的请求不变
+		err := createRequest(db, "r4", limit)
+		assert.ErrorIs(t, err, ErrTooManyActiveEmailUpdateRequests)
+		assert.Equal(t, []string{"expired", "r1", "r2", "r3"}, requestIds(t, db))
+	})
+}
+
+// TestEmailUpdateRequestLimitDefault 测试没有配置上限时使用 defaultMaxActiveEmailUpdateRequests。
+func TestEmailUpdateRequestLimitDefault(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, activeEmailUpdateRequestLimit{max: defaultMaxActiveEmailUpdateRequests}, env.emailUpdateRequestLimit())
+	env.maxActiveEmailUpdateRequests = 2
+	env.rejectEmailUpdateRequestsOverLimit = true
+	assert.Equal(t, activeEmailUpdateRequestLimit{max: 2, reject: true}, env.emailUpdateRequestLimit())
+}
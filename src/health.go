@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 健康检查：GET /healthz 只要服务在运行就返回 200 (存活检查)，不访问数据库或外部服务。
+// 加上 ?checks=pwned 时额外探测 Pwned Passwords API 是否可以访问，结果只是报告出来，
+// 不会让存活检查失败：API 不可用时只有设置和重置密码会失败，重启 Faroe 也没有帮助。
+// 存活检查不需要请求密钥，所以按 IP 单独限流 (env.healthIPRateLimit，和其他端点的限流器分开)，
+// 上限宽松但有限，超过时返回 429。
+
+// defaultPwnedPasswordsAPIURL 是没有配置 env.pwnedPasswordsAPIURL 时使用的 Pwned Passwords API 地址。
+const defaultPwnedPasswordsAPIURL = "https://api.pwnedpasswords.com"
+
+// pwnedPasswordsProbeTimeout 是探测 Pwned Passwords API 的超时时间。
+const pwnedPasswordsProbeTimeout = 3 * time.Second
+
+// 外部依赖检查的结果。
+const (
+	healthCheckOk          = "ok"
+	healthCheckUnreachable = "unreachable"
+)
+
+// pwnedPasswordsURL 返回 Pwned Passwords API 的地址。
+// 未设置 env.pwnedPasswordsAPIURL 时使用 defaultPwnedPasswordsAPIURL。测试中可以指向本地的 stub 服务器。
+func (env *Environment) pwnedPasswordsURL() string {
+	if env.pwnedPasswordsAPIURL == "" {
+		return defaultPwnedPasswordsAPIURL
+	}
+	return strings.TrimSuffix(env.pwnedPasswordsAPIURL, "/")
+}
+
+// handleGetHealthRequest 处理 GET /healthz。
+// 查询参数 checks 是用逗号分隔的额外检查，目前只支持 "pwned"。额外检查会发起外部请求，
+// 所以需要验证请求密钥；不带 checks 的存活检查不需要，负载均衡器可以直接调用。
+// 没有启用密码泄露检查 (env.disablePwnedPasswordsCheck) 时跳过 pwned 检查，响应中没有 pwned_passwords 字段。
+// 请求没有请求体，客户端 IP 默认使用连接的 IP (见 resolveClientIP)。
+// 响应体：{"status": "ok", "pwned_passwords"?: "ok" | "unreachable"}
+func handleGetHealthRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	clientIP := resolveClientIP(env, r, remoteAddrIP(r))
+	if clientIP != "" && !env.healthIPRateLimit.Consume(clientIP) {
+		writeTooManyRequestsErrorResponse(w)
+		return
+	}
+	setRateLimitHeaders(env, w, &env.healthIPRateLimit, clientIP)
+
+	var checks []string
+	if query := r.URL.Query().Get("checks"); query != "" {
+		checks = strings.Split(query, ",")
+	}
+	if len(checks) > 0 && !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	response := struct {
+		Status         string `json:"status"`
+		PwnedPasswords string `json:"pwned_passwords,omitempty"`
+	}{Status: healthCheckOk}
+	for _, check := range checks {
+		switch strings.TrimSpace(check) {
+		case "pwned":
+			if !env.disablePwnedPasswordsCheck {
+				response.PwnedPasswords = probePwnedPasswordsAPI(r.Context(), env.pwnedPasswordsURL())
+			}
+		default:
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
+
+// handleGetAuthCheckRequest 处理 GET /auth/check：只验证请求密钥，通过时返回 204，否则返回 401。
+// 接入新的调用方时可以用它确认 Authorization 头配置正确，不会读写数据库或产生其他副作用。
+// 和 /healthz 不同，这个端点总是需要请求密钥 (服务器没有配置密钥时总是返回 204)。
+func handleGetAuthCheckRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// probePwnedPasswordsAPI 请求一个固定的哈希前缀 (不包含任何用户数据)，检查 Pwned Passwords API 是否可以访问。
+// 参数：
+//   ctx context.Context: 请求上下文，探测还受 pwnedPasswordsProbeTimeout 限制。
+//   baseURL string: API 地址，通常是 env.pwnedPasswordsURL()。
+// 返回值：
+//   string: 返回 200 时为 healthCheckOk，超时、连接失败或其他状态码时为 healthCheckUnreachable。
+func probePwnedPasswordsAPI(ctx context.Context, baseURL string) string {
+	ctx, cancel := context.WithTimeout(ctx, pwnedPasswordsProbeTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/range/00000", nil)
+	if err != nil {
+		log.Println(err)
+		return healthCheckUnreachable
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Printf("pwned passwords api unreachable: %v", err)
+		return healthCheckUnreachable
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Printf("pwned passwords api unreachable: status %d", response.StatusCode)
+		return healthCheckUnreachable
+	}
+	return healthCheckOk
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"faroe/argon2id"
 	"faroe/otp"
+	"faroe/ratelimit"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,10 +52,23 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"1234"}`))
+		// 不是合法 JSON 的请求体和缺少必需字段的 JSON 返回不同的错误
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"`))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorMalformedJSON)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"email":"user@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"1234"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
 
 		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"12345678"}`))
@@ -57,11 +77,129 @@ func TestEndpointResponses(t *testing.T) {
 		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
 
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"email"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 没有提供邮箱
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		responseData := assertCreatedUserResponse(t, res, false)
+		_, err = getUserEmailVerificationRequest(db, context.Background(), responseData["id"].(string))
+		assert.ErrorIs(t, err, ErrRecordNotFound)
+
+		// 提供了邮箱，应同时创建邮箱验证请求
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user1@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		responseData = assertCreatedUserResponse(t, res, true)
+		verificationRequest, err := getUserEmailVerificationRequest(db, context.Background(), responseData["id"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verificationRequestData := responseData["email_verification_request"].(map[string]any)
+		assert.Equal(t, verificationRequest.UserId, verificationRequestData["user_id"])
+		assert.Equal(t, float64(verificationRequest.ExpiresAt.Unix()), verificationRequestData["expires_at"])
+		// 响应中不包含明文验证码
+		assert.NotContains(t, verificationRequestData, "code")
+		// 邮箱地址按原样保存在用户上，响应中只包含脱敏的邮箱
+		assert.Equal(t, "u***@example.com", verificationRequestData["email"])
+		email, err := getUserEmail(db, context.Background(), responseData["id"].(string))
+		assert.NoError(t, err)
+		assert.Equal(t, "user1@example.com", email)
+		// 邮箱不区分大小写，已经被使用的邮箱不能再创建用户
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"USER1@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailAlreadyUsed)
+		// 配置了允许的邮箱域名时，其他域名应被拒绝
+		env.allowedEmailDomains = []string{"*.example.com"}
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user2@example.net"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailDomainNotAllowed)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user2@mail.example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertCreatedUserResponse(t, res, true)
+
+		// 配置了允许的邮箱域名时，不提供邮箱也应被拒绝，否则可以之后再通过邮箱更新请求绕过
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailDomainNotAllowed)
+
+		// 配置了一次性邮箱黑名单时，名单中的域名应被拒绝
+		env.allowedEmailDomains = nil
+		env.disposableEmailDomains, err = NewDisposableEmailDomainList("")
+		assert.NoError(t, err)
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user3@mailinator.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorDisposableEmail)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user3@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertCreatedUserResponse(t, res, true)
+
+		// 生成 ID 失败时返回 500，并且不会插入没有 ID 的用户
+		var userCount int
+		err = db.QueryRow("SELECT count(*) FROM user").Scan(&userCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.IDGenerator = func() (string, error) {
+			return "", errors.New("failed to generate id")
+		}
 		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertJSONResponse(t, res, userJSONKeys)
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+		var userCountAfter int
+		err = db.QueryRow("SELECT count(*) FROM user").Scan(&userCountAfter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, userCount, userCountAfter)
+
+		// 提供了邮箱时消耗验证码发送令牌，没有令牌时不创建用户
+		env.IDGenerator = nil
+		env.codeDeliveryRateLimit = newCodeDeliveryRateLimit(5, 1, time.Hour)
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user4@example.com","client_ip":"192.0.2.1"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertCreatedUserResponse(t, res, true)
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user5@example.com","client_ip":"192.0.2.1"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+		err = db.QueryRow("SELECT count(*) FROM user").Scan(&userCountAfter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, userCount+1, userCountAfter)
+		// 没有提供邮箱时不发送验证码，不受影响
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","client_ip":"192.0.2.1"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertCreatedUserResponse(t, res, false)
 	})
 
 	t.Run("get /users", func(t *testing.T) {
@@ -167,7 +305,9 @@ func TestEndpointResponses(t *testing.T) {
 
 			now := time.Unix(time.Now().Unix(), 0)
 
-			for i := 0; i < 30; i++ {
+			// 没有过滤条件，X-Pagination-Total 是整张表的用户数
+			userCount := 30
+			for i := 0; i < userCount; i++ {
 				user := User{
 					Id:             strconv.Itoa(i + 1),
 					CreatedAt:      time.Unix(now.Add(time.Duration(i*int(time.Second))).Unix(), 0),
@@ -224,7 +364,7 @@ func TestEndpointResponses(t *testing.T) {
 				res := w.Result()
 				assert.Equal(t, 200, res.StatusCode)
 
-				assert.Equal(t, "30", res.Header.Get("X-Pagination-Total"))
+				assert.Equal(t, strconv.Itoa(userCount), res.Header.Get("X-Pagination-Total"))
 				assert.Equal(t, strconv.Itoa(testCase.ExpectedTotalPages), res.Header.Get("X-Pagination-Total-Pages"))
 
 				body, err := io.ReadAll(res.Body)
@@ -244,6 +384,271 @@ func TestEndpointResponses(t *testing.T) {
 			}
 
 		})
+
+		t.Run("link header", func(t *testing.T) {
+			t.Parallel()
+			db := initializeTestDB(t)
+			defer db.Close()
+
+			now := time.Unix(time.Now().Unix(), 0)
+			for i := 0; i < 30; i++ {
+				user := User{
+					Id:           strconv.Itoa(i + 1),
+					CreatedAt:    now.Add(time.Duration(i) * time.Second),
+					PasswordHash: "HASH",
+					RecoveryCode: "CODE",
+				}
+				err := insertUser(db, context.Background(), &user)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			env := createEnvironment(db, nil)
+			app := CreateApp(env)
+
+			// 链接保留其他查询参数，第 1 页没有 prev，最后一页没有 next
+			testCases := []struct {
+				Page     string
+				Expected string
+			}{
+				{"2", `</users?page=1&per_page=10&sort_by=id>; rel="first", </users?page=1&per_page=10&sort_by=id>; rel="prev", </users?page=3&per_page=10&sort_by=id>; rel="next", </users?page=3&per_page=10&sort_by=id>; rel="last"`},
+				{"1", `</users?page=1&per_page=10&sort_by=id>; rel="first", </users?page=2&per_page=10&sort_by=id>; rel="next", </users?page=3&per_page=10&sort_by=id>; rel="last"`},
+				{"3", `</users?page=1&per_page=10&sort_by=id>; rel="first", </users?page=2&per_page=10&sort_by=id>; rel="prev", </users?page=3&per_page=10&sort_by=id>; rel="last"`},
+			}
+			for _, testCase := range testCases {
+				r := httptest.NewRequest("GET", "/users?sort_by=id&per_page=10&page="+testCase.Page, nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				res := w.Result()
+				assert.Equal(t, 200, res.StatusCode)
+				assert.Equal(t, testCase.Expected, res.Header.Get("Link"), testCase.Page)
+			}
+		})
+
+		t.Run("per_page limit", func(t *testing.T) {
+			t.Parallel()
+			db := initializeTestDB(t)
+			defer db.Close()
+
+			now := time.Unix(time.Now().Unix(), 0)
+			for i := 0; i < 8; i++ {
+				user := User{
+					Id:           strconv.Itoa(i + 1),
+					CreatedAt:    now.Add(time.Duration(i) * time.Second),
+					PasswordHash: "HASH",
+					RecoveryCode: "CODE",
+				}
+				err := insertUser(db, context.Background(), &user)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			env := createEnvironment(db, nil)
+			env.maxPaginationPerPage = 5
+			app := CreateApp(env)
+
+			// 超过最大值的 per_page 被限制为 env.maxPaginationPerPage，响应头返回实际使用的值
+			r := httptest.NewRequest("GET", "/users?per_page=1000000", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			assert.Equal(t, "5", res.Header.Get("X-Pagination-Per-Page"))
+			assert.Equal(t, "2", res.Header.Get("X-Pagination-Total-Pages"))
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result []UserJSON
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, result, 5)
+		})
+
+		t.Run("filters", func(t *testing.T) {
+			t.Parallel()
+			db := initializeTestDB(t)
+			defer db.Close()
+
+			// 12 个用户，ID 为奇数的用户已验证邮箱，ID 是 3 的倍数的用户注册了 TOTP
+			now := time.Unix(time.Now().Unix(), 0)
+			for i := 1; i <= 12; i++ {
+				user := User{
+					Id:           fmt.Sprintf("%02d", i),
+					CreatedAt:    now.Add(time.Duration(i) * time.Second),
+					PasswordHash: "HASH",
+					RecoveryCode: "CODE",
+				}
+				err := insertUser(db, context.Background(), &user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i%2 == 1 {
+					err = setUserEmailVerified(db, context.Background(), user.Id)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if i%3 == 0 {
+					err = insertUserTOTPCredential(db, &UserTOTPCredential{
+						Id:        user.Id,
+						UserId:    user.Id,
+						CreatedAt: now,
+						Key:       []byte("12345678901234567890"),
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			env := createEnvironment(db, nil)
+			app := CreateApp(env)
+
+			// X-Pagination-Total 是过滤后的数量，和 GET /users?count_only=true 相同，各页拼起来正好是匹配的用户
+			testCases := []struct {
+				Query       string
+				ExpectedIds []string
+			}{
+				{"email_verified=true", []string{"01", "03", "05", "07", "09", "11"}},
+				{"totp_registered=true", []string{"03", "06", "09", "12"}},
+				{"email_verified=false&totp_registered=true", []string{"06", "12"}},
+				{"email_verified=true&created_after=" + strconv.FormatInt(now.Add(4*time.Second).Unix(), 10), []string{"05", "07", "09", "11"}},
+				{"totp_registered=false&created_before=" + strconv.FormatInt(now.Add(5*time.Second).Unix(), 10), []string{"01", "02", "04"}},
+			}
+			for _, testCase := range testCases {
+				r := httptest.NewRequest("GET", "/users?count_only=true&"+testCase.Query, nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				res := w.Result()
+				assert.Equal(t, 200, res.StatusCode)
+				body, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.JSONEq(t, fmt.Sprintf(`{"count":%d}`, len(testCase.ExpectedIds)), string(body), testCase.Query)
+
+				ids := []string{}
+				for page := 1; page <= 3; page++ {
+					r = httptest.NewRequest("GET", fmt.Sprintf("/users?%s&per_page=2&page=%d", testCase.Query, page), nil)
+					w = httptest.NewRecorder()
+					app.ServeHTTP(w, r)
+					res = w.Result()
+					assert.Equal(t, 200, res.StatusCode)
+					assert.Equal(t, strconv.Itoa(len(testCase.ExpectedIds)), res.Header.Get("X-Pagination-Total"), testCase.Query)
+					assert.Equal(t, strconv.Itoa((len(testCase.ExpectedIds)+1)/2), res.Header.Get("X-Pagination-Total-Pages"), testCase.Query)
+					body, err = io.ReadAll(res.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var result []UserJSON
+					err = json.Unmarshal(body, &result)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, user := range result {
+						ids = append(ids, user.Id)
+						assert.Equal(t, strings.Contains("03 06 09 12", user.Id), user.TOTPRegistered, testCase.Query)
+					}
+				}
+				assert.Equal(t, testCase.ExpectedIds, ids, testCase.Query)
+			}
+		})
+	})
+
+	t.Run("get /users?email", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/users?email=user%40example.com")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user, _, err := createUser(db, context.Background(), newId, "HASH1", createUserOptions{
+			email:                     "User@example.com",
+			emailVerificationCode:     "CODE",
+			emailVerificationCodeHash: "CODE_HASH",
+			consumeCodeDelivery:       func(userId string) bool { return true },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected UserJSON
+		err = json.Unmarshal([]byte(user.EncodeToJSON()), &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		// 保存的邮箱、大小写不同的邮箱和前后有空格的邮箱都能找到用户
+		for _, email := range []string{"User@example.com", "user@EXAMPLE.com", " user@example.com "} {
+			r := httptest.NewRequest("GET", "/users?email="+url.QueryEscape(email), nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode, email)
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result UserJSON
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, expected, result, email)
+		}
+
+		r := httptest.NewRequest("GET", "/users?email=unknown%40example.com", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 404, "NOT_FOUND")
+
+		// 没有 email 参数时仍然返回用户列表
+		r = httptest.NewRequest("GET", "/users", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []UserJSON
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []UserJSON{expected}, result)
+	})
+
+	t.Run("get /users?email rate limit", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		env := createEnvironment(db, nil)
+		env.userEmailLookupIPRateLimit = ratelimit.NewTokenBucketRateLimit(2, time.Hour)
+		app := CreateApp(env)
+
+		// 按请求的 IP 限流，找不到用户的请求也消耗令牌
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("GET", "/users?email=unknown%40example.com", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertErrorResponse(t, w.Result(), 404, "NOT_FOUND")
+		}
+		r := httptest.NewRequest("GET", "/users?email=unknown%40example.com", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 429, ExpectedErrorTooManyRequests)
 	})
 
 	t.Run("get /users/userid", func(t *testing.T) {
@@ -297,11 +702,9 @@ func TestEndpointResponses(t *testing.T) {
 		assert.Equal(t, expected, result)
 	})
 
-	t.Run("delete /users/userid", func(t *testing.T) {
+	t.Run("get /users/userid with body", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "DELETE", "/users/1")
-
 		db := initializeTestDB(t)
 		defer db.Close()
 
@@ -317,26 +720,42 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		// 默认忽略 GET 请求的请求体
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("DELETE", "/users/2", nil)
+		r := httptest.NewRequest("GET", "/users/1", strings.NewReader(`{"ignored":true}`))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assert.Equal(t, 200, res.StatusCode)
+		var result UserJSON
+		err = json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "1", result.Id)
 
-		r = httptest.NewRequest("DELETE", "/users/1", nil)
+		// 配置拒绝后返回 INVALID_DATA
+		env.rejectGETRequestBodies = true
+		r = httptest.NewRequest("GET", "/users/1", strings.NewReader(`{"ignored":true}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assert.Equal(t, 204, res.StatusCode)
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 空的请求体不受影响
+		r = httptest.NewRequest("GET", "/users/1", strings.NewReader(""))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
 	})
 
-	t.Run("post /users/userid/update-password", func(t *testing.T) {
+	t.Run("delete /users/userid", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/update-password")
+		testAuthentication(t, "DELETE", "/users/1")
 
 		db := initializeTestDB(t)
 		defer db.Close()
@@ -344,7 +763,7 @@ func TestEndpointResponses(t *testing.T) {
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      time.Unix(time.Now().Unix(), 0),
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			PasswordHash:   "HASH1",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
@@ -356,45 +775,2738 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/update-password", nil)
+		r := httptest.NewRequest("DELETE", "/users/2", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		data := `{"password":"invalid","new_password":"1234"}`
-		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		r = httptest.NewRequest("DELETE", "/users/1", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
-
+		assert.Equal(t, 204, res.StatusCode)
+	})
+
+	t.Run("post /user-imports", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/user-imports")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "HASH1",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		passwordHash, err := argon2id.Hash("super_secure_password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.IDGenerator = newSequenceIdGenerator("imported")
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/user-imports", strings.NewReader(`[]`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 第 6 行的邮箱和第 1 行重复 (不区分大小写)
+		data := fmt.Sprintf(`[
+			{"id":"2","email":"User2@example.com","password_hash":%[1]q,"created_at":1728783738},
+			{"id":"1","password_hash":%[1]q},
+			{"id":"3","password_hash":"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+			{"password_hash":%[1]q},
+			{"id":"2","password_hash":%[1]q},
+			{"id":"4","email":"user2@EXAMPLE.com","password_hash":%[1]q},
+			{"id":"5","email":"email","password_hash":%[1]q}
+		]`, passwordHash)
+		r = httptest.NewRequest("POST", "/user-imports", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []struct {
+			User  map[string]any `json:"user"`
+			Error string         `json:"error"`
+		}
+		err = json.Unmarshal(body, &results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, results, 7) {
+			assert.Equal(t, "2", results[0].User["id"])
+			assert.Equal(t, float64(1728783738), results[0].User["created_at"])
+			assert.Equal(t, ExpectedErrorUserAlreadyExists, results[1].Error)
+			assert.Nil(t, results[1].User)
+			assert.Equal(t, ExpectedErrorInvalidPasswordHash, results[2].Error)
+			assert.Equal(t, "imported1", results[3].User["id"])
+			assert.Equal(t, ExpectedErrorUserAlreadyExists, results[4].Error)
+			assert.Equal(t, ExpectedErrorEmailAlreadyUsed, results[5].Error)
+			assert.Nil(t, results[5].User)
+			assert.Equal(t, ExpectedErrorInvalidData, results[6].Error)
+		}
+
+		// 有效的行已经导入，并且可以用原来的密码验证
+		for _, userId := range []string{"2", "imported1"} {
+			user, err := getUser(db, context.Background(), userId)
+			assert.NoError(t, err)
+			valid, err := env.verifyPassword(user.PasswordHash, "super_secure_password")
+			assert.NoError(t, err)
+			assert.True(t, valid)
+		}
+		// 重复的行没有覆盖已有的用户
+		user, err := getUser(db, context.Background(), "1")
+		assert.NoError(t, err)
+		assert.Equal(t, "HASH1", user.PasswordHash)
+		for _, userId := range []string{"3", "4", "5"} {
+			exists, err := checkUserExists(db, context.Background(), userId)
+			assert.NoError(t, err)
+			assert.False(t, exists, userId)
+		}
+		// 邮箱按原样保存
+		email, err := getUserEmail(db, context.Background(), "2")
+		assert.NoError(t, err)
+		assert.Equal(t, "User2@example.com", email)
+
+		// 后面的批次失败时，仍然返回已经提交的批次的结果，没有导入的行返回 UNKNOWN_ERROR
+		env.IDGenerator = func() (string, error) {
+			return "", errors.New("entropy unavailable")
+		}
+		rows := make([]string, bulkImportBatchSize+1)
+		for i := 0; i < bulkImportBatchSize; i++ {
+			rows[i] = fmt.Sprintf(`{"id":"batch%d","password_hash":%q}`, i, passwordHash)
+		}
+		rows[bulkImportBatchSize] = fmt.Sprintf(`{"password_hash":%q}`, passwordHash)
+		r = httptest.NewRequest("POST", "/user-imports", strings.NewReader("["+strings.Join(rows, ",")+"]"))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err = io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = nil
+		err = json.Unmarshal(body, &results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, results, bulkImportBatchSize+1) {
+			assert.Equal(t, "batch0", results[0].User["id"])
+			assert.Equal(t, "UNKNOWN_ERROR", results[bulkImportBatchSize].Error)
+		}
+		exists, err := checkUserExists(db, context.Background(), "batch0")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("post /users concurrency limit", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+		// 每个新连接都会打开一个新的空内存数据库，并发请求必须共用同一个连接
+		db.SetMaxOpenConns(1)
+
+		env := createEnvironment(db, nil)
+		env.passwordHashingConcurrencyLimit = ratelimit.NewConcurrencyLimit(1, 0, 0)
+		app := CreateApp(env)
+
+		// 唯一的名额被占用时，需要哈希密码的请求返回 429
+		env.passwordHashingConcurrencyLimit.Acquire("")
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+
+		env.passwordHashingConcurrencyLimit.Release("")
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+
+		// 并发的请求在等待时间内排队执行，全部成功
+		env.passwordHashingConcurrencyLimit = ratelimit.NewConcurrencyLimit(2, 0, 10*time.Second)
+		var wg sync.WaitGroup
+		statuses := make([]int, 6)
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				statuses[i] = w.Result().StatusCode
+			}(i)
+		}
+		wg.Wait()
+		for _, status := range statuses {
+			assert.Equal(t, 200, status)
+		}
+	})
+
+	t.Run("post /users after create hook", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		var output bytes.Buffer
+		env := createEnvironment(db, nil)
+		env.logger = log.New(&output, "", 0)
+		app := CreateApp(env)
+
+		createUser := func() (*http.Response, string) {
+			var hookUserId string
+			env.afterUserCreate = func(ctx context.Context, user User) error {
+				hookUserId = user.Id
+				// 钩子运行时用户已经写入数据库
+				exists, err := checkUserExists(db, ctx, user.Id)
+				assert.NoError(t, err)
+				assert.True(t, exists)
+				return nil
+			}
+			r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result(), hookUserId
+		}
+
+		// 钩子成功时用户保留
+		res, userId := createUser()
+		responseData := assertCreatedUserResponse(t, res, false)
+		assert.Equal(t, userId, responseData["id"])
+		exists, err := checkUserExists(db, context.Background(), userId)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		// 钩子出错且配置了回滚时，请求失败，用户被删除
+		env.rollBackUserOnHookError = true
+		var hookUserId string
+		env.afterUserCreate = func(ctx context.Context, user User) error {
+			hookUserId = user.Id
+			return errors.New("onboarding failed")
+		}
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+		assert.NotEmpty(t, hookUserId)
+		exists, err = checkUserExists(db, context.Background(), hookUserId)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		assert.Contains(t, output.String(), `error="onboarding failed"`)
+
+		// 钩子出错但只记录日志时，请求成功，用户保留
+		output.Reset()
+		env.rollBackUserOnHookError = false
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		responseData = assertCreatedUserResponse(t, res, false)
+		assert.Equal(t, hookUserId, responseData["id"])
+		exists, err = checkUserExists(db, context.Background(), hookUserId)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Contains(t, output.String(), "after user create hook failed")
+		assert.Contains(t, output.String(), fmt.Sprintf(`user_id="%s"`, hookUserId))
+	})
+
+	t.Run("post /users invite", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/invites")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		createInvite := func() string {
+			r := httptest.NewRequest("POST", "/invites", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			var invite struct {
+				Code string `json:"code"`
+			}
+			err := json.NewDecoder(res.Body).Decode(&invite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, invite.Code, 16)
+			return invite.Code
+		}
+		createUser := func(body string) *http.Response {
+			r := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
+
+		// 没有开启邀请模式时不需要邀请码
+		res := createUser(`{"password":"super_secure_password"}`)
+		assertCreatedUserResponse(t, res, false)
+
+		env.requireInvite = true
+		res = createUser(`{"password":"super_secure_password"}`)
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidInvite)
+		res = createUser(`{"password":"super_secure_password","invite_code":"AAAAAAAAAAAAAAAA"}`)
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidInvite)
+
+		// 有效的邀请码可以创建用户，之后邀请码被用掉
+		code := createInvite()
+		res = createUser(fmt.Sprintf(`{"password":"super_secure_password","invite_code":%q}`, code))
+		responseData := assertCreatedUserResponse(t, res, false)
+		var inviteUserId string
+		err := db.QueryRow("SELECT user_id FROM invite WHERE code_hash = ? AND used_at IS NOT NULL", hashInviteCode(code)).Scan(&inviteUserId)
+		assert.NoError(t, err)
+		assert.Equal(t, responseData["id"], inviteUserId)
+
+		res = createUser(fmt.Sprintf(`{"password":"super_secure_password","invite_code":%q}`, code))
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidInvite)
+
+		// 用户创建后被回滚时邀请码可以再次使用
+		code = createInvite()
+		env.rollBackUserOnHookError = true
+		env.afterUserCreate = func(ctx context.Context, user User) error {
+			return errors.New("onboarding failed")
+		}
+		res = createUser(fmt.Sprintf(`{"password":"super_secure_password","invite_code":%q}`, code))
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+		env.afterUserCreate = nil
+		res = createUser(fmt.Sprintf(`{"password":"super_secure_password","invite_code":%q}`, code))
+		assertCreatedUserResponse(t, res, false)
+	})
+
+	t.Run("post /users/userid/update-password", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/update-password")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/update-password", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		data := `{"password":"invalid","new_password":"1234"}`
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
+
 		data = `{"password":"invalid","new_password":"12345678"}`
 		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
+		assertErrorResponse(t, res, 400, ExpectedErrorWeakPassword)
+
+		data = `{"password":"invalid","new_password":"super_super_secure_password"}`
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectPassword)
+
+		data = `{"password":"super_secure_password","new_password":"super_super_secure_password"}`
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+	})
+
+	t.Run("request body field errors", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		assertFieldErrors := func(path string, data string, expected []fieldError) {
+			r := httptest.NewRequest("POST", path, strings.NewReader(data))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 400, res.StatusCode)
+			errorCode, fieldErrors := decodeFieldErrors(t, res.Body)
+			assert.Equal(t, ExpectedErrorInvalidData, errorCode)
+			assert.Equal(t, expected, fieldErrors, data)
+		}
+
+		longPassword := strings.Repeat("a", 128)
+
+		assertFieldErrors("/users", `{"email":"user@example.com"}`, []fieldError{{"password", FieldErrorRequired}})
+		assertFieldErrors("/users", `{"password":"`+longPassword+`"}`, []fieldError{{"password", FieldErrorTooLong}})
+		assertFieldErrors("/users", `{"password":"super_secure_password","email":"email"}`, []fieldError{{"email", FieldErrorInvalid}})
+
+		assertFieldErrors("/users/1/update-password", `{}`, []fieldError{{"password", FieldErrorRequired}, {"new_password", FieldErrorRequired}})
+		assertFieldErrors("/users/1/update-password", `{"password":"super_secure_password","new_password":"`+longPassword+`"}`, []fieldError{{"new_password", FieldErrorTooLong}})
+
+		// 格式正确的请求体通过校验
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertCreatedUserResponse(t, res, false)
+
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(`{"password":"invalid_password","new_password":"super_super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectPassword)
+	})
+	t.Run("post /totp/preview-verify", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/totp/preview-verify")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		previewVerify := func(body string) *http.Response {
+			r := httptest.NewRequest("POST", "/totp/preview-verify", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
+		assertValid := func(res *http.Response, expected bool) {
+			t.Helper()
+			assert.Equal(t, 200, res.StatusCode)
+			var data struct {
+				Valid *bool `json:"valid"`
+			}
+			err := json.NewDecoder(res.Body).Decode(&data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.NotNil(t, data.Valid) {
+				assert.Equal(t, expected, *data.Valid)
+			}
+		}
+
+		key := make([]byte, 20)
+		rand.Read(key)
+		encodedKey := base32.StdEncoding.EncodeToString(key)
+
+		// 正确的验证码
+		code := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		assertValid(previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s"}`, encodedKey, code)), true)
+		// Base64 编码的密钥也可以
+		assertValid(previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s"}`, base64.StdEncoding.EncodeToString(key), code)), true)
+
+		// 错误的验证码：选一个不等于前后几个时间窗口的验证码的值
+		validCodes := map[string]bool{}
+		for i := -3; i <= 3; i++ {
+			validCodes[otp.GenerateTOTP(time.Now().Add(time.Duration(i)*30*time.Second), key, 30*time.Second, 6)] = true
+		}
+		wrongCode := "000000"
+		for i := 1; validCodes[wrongCode]; i++ {
+			wrongCode = fmt.Sprintf("%06d", i)
+		}
+		assertValid(previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s"}`, encodedKey, wrongCode)), false)
+
+		// 格式错误的密钥和缺少的字段
+		assertErrorResponse(t, previewVerify(fmt.Sprintf(`{"key":"not a key","code":"%s"}`, code)), 400, ExpectedErrorInvalidData)
+		assertErrorResponse(t, previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s"}`, base32.StdEncoding.EncodeToString(key[:10]), code)), 400, ExpectedErrorInvalidData)
+		assertErrorResponse(t, previewVerify(fmt.Sprintf(`{"code":"%s"}`, code)), 400, ExpectedErrorInvalidData)
+		assertErrorResponse(t, previewVerify(fmt.Sprintf(`{"key":"%s"}`, encodedKey)), 400, ExpectedErrorInvalidData)
+
+		// 按 IP 限流
+		for i := 0; i < 5; i++ {
+			assertValid(previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s","client_ip":"127.0.0.1"}`, encodedKey, wrongCode)), false)
+		}
+		assertErrorResponse(t, previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s","client_ip":"127.0.0.1"}`, encodedKey, code)), 429, ExpectedErrorTooManyRequests)
+		assertValid(previewVerify(fmt.Sprintf(`{"key":"%s","code":"%s","client_ip":"127.0.0.2"}`, encodedKey, code)), true)
+
+		// 没有保存任何数据
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM user_totp_credential").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("post /users/userid/totp-setup", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/totp-setup")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/totp-setup", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		// 还没有生成密钥时不能省略 key
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(`{"code":"123456"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		r = httptest.NewRequest("POST", "/users/1/totp-setup", strings.NewReader(`{"issuer":"Example App","account_name":"user@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var setup struct {
+			Key       string `json:"key"`
+			URI       string `json:"uri"`
+			ExpiresAt int64  `json:"expires_at"`
+		}
+		err = json.Unmarshal(body, &setup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(setup.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, key, 20)
+		assert.Greater(t, setup.ExpiresAt, time.Now().Unix())
+		uri, err := url.Parse(setup.URI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "otpauth", uri.Scheme)
+		assert.Equal(t, "totp", uri.Host)
+		assert.Equal(t, "/Example App:user@example.com", uri.Path)
+		assert.Equal(t, setup.Key, uri.Query().Get("secret"))
+		assert.Equal(t, "Example App", uri.Query().Get("issuer"))
+
+		// 生成密钥不会创建凭据
+		_, err = getUserTOTPCredential(db, context.Background(), "1", nil)
+		assert.ErrorIs(t, err, ErrRecordNotFound)
+
+		// 验证码错误时密钥仍然保留
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(`{"code":"000000"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		if otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6) != "000000" {
+			assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+		}
+
+		// 用生成的密钥计算的验证码可以完成注册
+		totp := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(fmt.Sprintf(`{"code":"%s"}`, totp)))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		credential, err := getUserTOTPCredential(db, context.Background(), "1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, key, credential.Key)
+
+		// 密钥只能使用一次
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(fmt.Sprintf(`{"code":"%s"}`, totp)))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+	})
+
+	t.Run("post /users/userid/register-totp", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/register-totp")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/register-totp", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		data := `{"key": "moM4ZtcDvWQQIA==", "code": "123456"}`
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwes", "code": "123456"}`
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwe$=", "code": "123456"}`
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwes=", "code": "123456"}`
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		key := make([]byte, 20)
+		_, err = rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totp := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base64.StdEncoding.EncodeToString(key), totp)
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, userTOTPCredentialJSONKeys)
+
+		key = make([]byte, 20)
+		_, err = rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totp = otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base64.StdEncoding.EncodeToString(key), totp)
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, userTOTPCredentialJSONKeys)
+
+		// 也可以使用 Base32 编码的密钥注册
+		key = make([]byte, 20)
+		_, err = rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totp = otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base32.StdEncoding.EncodeToString(key), totp)
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, userTOTPCredentialJSONKeys)
+
+		data = `{"key": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJ1", "code": "123456"}`
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 生成 ID 失败时返回 500，并且不会插入没有 ID 的凭据
+		env.IDGenerator = func() (string, error) {
+			return "", errors.New("failed to generate id")
+		}
+		totp = otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base64.StdEncoding.EncodeToString(key), totp)
+		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+		credentials, err := getUserTOTPCredentials(db, context.Background(), user1.Id, nil)
+		assert.NoError(t, err)
+		assert.Len(t, credentials, 3)
+	})
+
+	t.Run("get /user/userid/totp-credential", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/users/1/totp-credential")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user2 := User{
+			Id:             "2",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		credential1 := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       make([]byte, 20),
+		}
+		err = insertUserTOTPCredential(db, &credential1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("GET", "/users/3/totp-credential", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("GET", "/users/2/totp-credential", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("GET", "/users/1/totp-credential", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result UserTOTPCredentialJSON
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected UserTOTPCredentialJSON
+		err = json.Unmarshal([]byte(credential1.EncodeToJSON(timeFormatUnix)), &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, result)
+	})
+
+	t.Run("get /totp-credentials", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/totp-credentials")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		for i := 1; i <= 3; i++ {
+			user := User{
+				Id:             strconv.Itoa(i),
+				CreatedAt:      now,
+				PasswordHash:   "HASH",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 3 个用户共 5 个凭据，用户 1 有 3 个
+		for i, userId := range []string{"1", "2", "1", "3", "1"} {
+			credential := UserTOTPCredential{
+				Id:        strconv.Itoa(i + 1),
+				UserId:    userId,
+				CreatedAt: time.Unix(now.Add(time.Duration(i)*time.Second).Unix(), 0),
+				Key:       []byte("12345678901234567890"),
+			}
+			err := insertUserTOTPCredential(db, &credential)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		testCases := []struct {
+			Query              string
+			ExpectedIds        []string
+			ExpectedUserIds    []string
+			ExpectedTotalPages int
+		}{
+			{"", []string{"1", "2", "3", "4", "5"}, []string{"1", "2", "1", "3", "1"}, 1},
+			{"sort_order=descending", []string{"5", "4", "3", "2", "1"}, []string{"1", "3", "1", "2", "1"}, 1},
+			{"per_page=2&page=1", []string{"1", "2"}, []string{"1", "2"}, 3},
+			{"per_page=2&page=3", []string{"5"}, []string{"1"}, 3},
+			{"per_page=2&page=4", []string{}, []string{}, 3},
+		}
+		for _, testCase := range testCases {
+			r := httptest.NewRequest("GET", "/totp-credentials?"+testCase.Query, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			assert.Equal(t, "5", res.Header.Get("X-Pagination-Total"))
+			assert.Equal(t, strconv.Itoa(testCase.ExpectedTotalPages), res.Header.Get("X-Pagination-Total-Pages"), testCase.Query)
+			assert.NotEmpty(t, res.Header.Get("Link"))
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 每个凭据只有 id、user_id 和 created_at，不包含密钥
+			var result []map[string]any
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			userIds := []string{}
+			for _, item := range result {
+				assert.Len(t, item, len(totpCredentialAuditJSONKeys))
+				for _, key := range totpCredentialAuditJSONKeys {
+					assert.Contains(t, item, key)
+				}
+				ids = append(ids, item["id"].(string))
+				userIds = append(userIds, item["user_id"].(string))
+			}
+			assert.Equal(t, testCase.ExpectedIds, ids, testCase.Query)
+			assert.Equal(t, testCase.ExpectedUserIds, userIds, testCase.Query)
+			assert.NotContains(t, string(body), base64.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+		}
+
+		// 超过最大值的 per_page 被限制为 env.maxPaginationPerPage
+		env.maxPaginationPerPage = 2
+		r := httptest.NewRequest("GET", "/totp-credentials?per_page=1000000", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "2", res.Header.Get("X-Pagination-Per-Page"))
+		assert.Equal(t, "3", res.Header.Get("X-Pagination-Total-Pages"))
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []map[string]any
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, result, 2)
+	})
+
+	t.Run("delete /users/userid/totp-credential", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "DELETE", "/users/1/totp-credential")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user2 := User{
+			Id:             "2",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		credential1 := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       make([]byte, 20),
+		}
+		err = insertUserTOTPCredential(db, &credential1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("DELETE", "/users/3/totp-credential", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("DELETE", "/users/2/totp-credential", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("DELETE", "/users/1/totp-credential", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+	})
+
+	t.Run("post /totp-credentials/bulk-delete", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/totp-credentials/bulk-delete")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2", "3"} {
+			user := User{
+				Id:             userId,
+				CreatedAt:      now,
+				PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 用户 1 有两个凭据，用户 2 有一个，用户 3 没有
+		for i, userId := range []string{"1", "1", "2"} {
+			credential := UserTOTPCredential{
+				Id:        strconv.Itoa(i + 1),
+				UserId:    userId,
+				CreatedAt: now,
+				Key:       make([]byte, 20),
+			}
+			err := insertUserTOTPCredential(db, &credential)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/totp-credentials/bulk-delete", strings.NewReader(`{"user_ids":[]}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorInvalidData)
+
+		r = httptest.NewRequest("POST", "/totp-credentials/bulk-delete", strings.NewReader(`{"user_ids":["1","3","4","2","1"]}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []struct {
+			UserId  string `json:"user_id"`
+			Deleted bool   `json:"deleted"`
+		}
+		err = json.Unmarshal(body, &results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, results, 5) {
+			assert.Equal(t, "1", results[0].UserId)
+			assert.True(t, results[0].Deleted)
+			assert.Equal(t, "3", results[1].UserId)
+			assert.False(t, results[1].Deleted)
+			assert.Equal(t, "4", results[2].UserId)
+			assert.False(t, results[2].Deleted)
+			assert.Equal(t, "2", results[3].UserId)
+			assert.True(t, results[3].Deleted)
+			// 重复的用户 ID 第二次没有可以删除的凭据
+			assert.Equal(t, "1", results[4].UserId)
+			assert.False(t, results[4].Deleted)
+		}
+
+		count, err := getTOTPCredentialCount(db, context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		// 只有删除了凭据的用户有审计日志
+		entries, err := getAuditLogPage(db, context.Background(), auditLogFilter{Action: AuditActionTOTPCredentialDelete}, 10, 1)
+		assert.NoError(t, err)
+		var auditedUserIds []string
+		for _, entry := range entries {
+			auditedUserIds = append(auditedUserIds, entry.UserId)
+		}
+		assert.ElementsMatch(t, []string{"1", "2"}, auditedUserIds)
+	})
+
+	t.Run("post /users/userid/verify-2fa/totp", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/verify-2fa/totp")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user2 := User{
+			Id:             "2",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key1 := make([]byte, 20)
+		rand.Read(key1)
+		credential1 := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key1,
+		}
+		err = insertUserTOTPCredential(db, &credential1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key2 := make([]byte, 20)
+		rand.Read(key2)
+		credential2 := UserTOTPCredential{
+			Id:        "2",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key2,
+		}
+		err = insertUserTOTPCredential(db, &credential2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/3/verify-2fa/totp", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/2/verify-2fa/totp", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorSecondFactorNotRegistered)
+
+		data := `{"code":"123456"}`
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		// 90 秒前的验证码超出了允许的时钟偏差，应被拒绝
+		totp := otp.GenerateTOTP(time.Now().Add(-90*time.Second), key2, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"code":"%s"}`, totp)
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		// 只有第二个凭据匹配的验证码也应通过
+		totp = otp.GenerateTOTP(time.Now(), key2, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"code":"%s"}`, totp)
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+
+		totp = otp.GenerateTOTP(time.Now(), key1, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"code":"%s"}`, totp)
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+
+		// 去掉空白字符后必须是纯数字
+		data = `{"code":"12345a"}`
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		data = `{"code":"   "}`
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 验证码前后和中间的空白字符会被去掉
+		totp = otp.GenerateTOTP(time.Now(), key1, 30*time.Second, 6)
+		data = fmt.Sprintf(`{"code":" %s %s "}`, totp[:3], totp[3:])
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+	})
+
+	t.Run("post /users/userid/verify-2fa/totp forward-only", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := make([]byte, 20)
+		rand.Read(key)
+		credential := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key,
+		}
+		err = insertUserTOTPCredential(db, &credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 允许 30 秒的偏差，所以上一个时间步长的验证码一定在范围内；不接受未来的验证码
+		env := createEnvironment(db, nil)
+		env.totpClockSkew = 30 * time.Second
+		env.totpRejectFutureCodes = true
+		app := CreateApp(env)
+
+		data := fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now().Add(30*time.Second), key, 30*time.Second, 6))
+		r := httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		data = fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now().Add(-30*time.Second), key, 30*time.Second, 6))
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+
+		data = fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6))
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+	})
+
+	t.Run("post /users/userid/verify-2fa/totp lockout", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := make([]byte, 20)
+		rand.Read(key)
+		credential := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key,
+		}
+		err = insertUserTOTPCredential(db, &credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 每个令牌桶只有 1 个令牌并且很快过期，耗尽 2 次后锁定 100 毫秒
+		env := createEnvironment(db, nil)
+		env.totpUserRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(1, 10*time.Millisecond)
+		env.totpUserLockout = ratelimit.NewLockout(2, time.Minute, 100*time.Millisecond)
+		app := CreateApp(env)
+
+		incorrectData := `{"code":"000000"}`
+		if otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6) == "000000" {
+			incorrectData = `{"code":"111111"}`
+		}
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(incorrectData))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+			// 等待令牌桶过期，模拟攻击者每次都等到限制恢复后再继续尝试
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		// 被锁定后即使验证码正确也会被拒绝
+		data := fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6))
+		r := httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorAccountLocked)
+
+		// 冷却结束后解除锁定
+		time.Sleep(100 * time.Millisecond)
+		data = fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6))
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+	})
+
+	t.Run("post /users/userid/verify-2fa/totp retry-after", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := make([]byte, 20)
+		rand.Read(key)
+		credential := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key,
+		}
+		err = insertUserTOTPCredential(db, &credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 每个令牌桶只有 1 个令牌，3 秒后过期
+		env := createEnvironment(db, nil)
+		env.totpRetryAfter = true
+		env.totpUserRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(1, 3*time.Second)
+		env.totpUserLockout = ratelimit.NewLockout(100, time.Minute, time.Minute)
+		app := CreateApp(env)
+
+		incorrectData := `{"code":"000000"}`
+		if otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6) == "000000" {
+			incorrectData = `{"code":"111111"}`
+		}
+		verify := func() (*http.Response, int) {
+			r := httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(incorrectData))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+			return res, retryAfter
+		}
+
+		res, _ := verify()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+		assert.Empty(t, res.Header.Get("Retry-After"))
+
+		// 令牌用完后返回 429，Retry-After 是到令牌桶过期的秒数
+		res, first := verify()
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+		assert.GreaterOrEqual(t, first, 1)
+		assert.LessOrEqual(t, first, 3)
+
+		time.Sleep(1100 * time.Millisecond)
+		res, second := verify()
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+		assert.Less(t, second, first)
+
+		// 锁定时返回 429 ACCOUNT_LOCKED，Retry-After 是锁定的剩余秒数
+		env.totpUserLockout = ratelimit.NewLockout(1, time.Minute, time.Minute)
+		env.totpUserLockout.RecordExhaustion("1")
+		res, retryAfter := verify()
+		assertErrorResponse(t, res, 429, ExpectedErrorAccountLocked)
+		assert.Greater(t, retryAfter, 55)
+		assert.LessOrEqual(t, retryAfter, 60)
+	})
+
+	t.Run("post /users/userid/verify-2fa/totp encrypted key", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.totpKeyEncryptionKeys = []TOTPKeyEncryptionKey{{Id: "1", Secret: []byte("secret")}}
+		app := CreateApp(env)
+
+		// 注册密钥
+		key := make([]byte, 20)
+		rand.Read(key)
+		encodedKey := base64.StdEncoding.EncodeToString(key)
+		totp := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
+		r := httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(fmt.Sprintf(`{"key":"%s","code":"%s"}`, encodedKey, totp)))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Result().StatusCode)
+
+		// 数据库中存储的是密文
+		var storedKey []byte
+		err = db.QueryRow("SELECT key FROM user_totp_credential WHERE user_id = ?", "1").Scan(&storedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, strings.HasPrefix(string(storedKey), "$totpenc$id=1$"))
+		assert.NotContains(t, string(storedKey), string(key))
+
+		// 验证时解密，正确的验证码可以通过验证
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(fmt.Sprintf(`{"code":"%s"}`, totp)))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Result().StatusCode)
+
+		// 配置了错误的密钥时返回 500，不会把密文当作 TOTP 密钥使用
+		wrongEnv := createEnvironment(db, nil)
+		wrongEnv.totpKeyEncryptionKeys = []TOTPKeyEncryptionKey{{Id: "1", Secret: []byte("wrong")}}
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(fmt.Sprintf(`{"code":"%s"}`, totp)))
+		w = httptest.NewRecorder()
+		CreateApp(wrongEnv).ServeHTTP(w, r)
+		assert.Equal(t, 500, w.Result().StatusCode)
+	})
+
+	t.Run("post /users/userid/reset-rate-limits", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/reset-rate-limits")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := make([]byte, 20)
+		rand.Read(key)
+		credential := UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Key:       key,
+		}
+		err = insertUserTOTPCredential(db, &credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/reset-rate-limits", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		// 锁定用户 (createEnvironment 中的阈值是 3 次)，并耗尽其 TOTP 速率限制 (5 个令牌)
+		for i := 0; i < 3; i++ {
+			env.totpUserLockout.RecordExhaustion(user1.Id)
+		}
+		for i := 0; i < 5; i++ {
+			env.totpUserRateLimit.Consume(user1.Id)
+		}
+		data := fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6))
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorAccountLocked)
+
+		r = httptest.NewRequest("POST", "/users/1/reset-rate-limits", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+
+		// 重置后用户可以立即通过验证
+		data = fmt.Sprintf(`{"code":"%s"}`, otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6))
+		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, stepUpTokenJSONKeys)
+	})
+
+	t.Run("post /step-up-tokens/verify", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/step-up-tokens/verify")
+
+		env := createEnvironment(nil, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/step-up-tokens/verify", strings.NewReader(`{}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 有效的令牌
+		token := createStepUpToken(env.tokenSigningKey(), "1", time.Now().Add(5*time.Minute))
+		data := fmt.Sprintf(`{"token":"%s"}`, token)
+		r = httptest.NewRequest("POST", "/step-up-tokens/verify", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, verifiedStepUpTokenJSONKeys)
+
+		// 过期的令牌
+		token = createStepUpToken(env.tokenSigningKey(), "1", time.Now().Add(-time.Second))
+		data = fmt.Sprintf(`{"token":"%s"}`, token)
+		r = httptest.NewRequest("POST", "/step-up-tokens/verify", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidToken)
+
+		// 用其他密钥签名的令牌
+		token = createStepUpToken([]byte("other_key"), "1", time.Now().Add(5*time.Minute))
+		data = fmt.Sprintf(`{"token":"%s"}`, token)
+		r = httptest.NewRequest("POST", "/step-up-tokens/verify", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidToken)
+	})
+
+	t.Run("post /users/userid/regenerate-recovery-code", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/regenerate-recovery-code")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/regenerate-recovery-code", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/1/regenerate-recovery-code", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, recoveryCodeJSONKeys)
+	})
+
+	t.Run("post /users/userid/reset-2fa", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/reset-2fa")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/reset-2fa", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		data := `{"recovery_code":"87654321"}`
+		r = httptest.NewRequest("POST", "/users/1/reset-2fa", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		data = `{"recovery_code":"12345678"}`
+		r = httptest.NewRequest("POST", "/users/1/reset-2fa", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, recoveryCodeJSONKeys)
+	})
+
+	t.Run("post /users/userid/verify-recovery-code", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/verify-recovery-code")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.recoveryCodeCount = 4
+		app := CreateApp(env)
+
+		// 生成一组一次性恢复码
+		r := httptest.NewRequest("POST", "/users/1/regenerate-recovery-code", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, result.RecoveryCodes, 4)
+
+		r = httptest.NewRequest("POST", "/users/2/verify-recovery-code", strings.NewReader(`{"recovery_code":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 旧的单个恢复码不是一次性恢复码
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		type verificationResult struct {
+			RecoveryCode           string `json:"recovery_code"`
+			TOTPRegistered         bool   `json:"totp_registered"`
+			SecondFactorsRemaining int    `json:"second_factors_remaining"`
+		}
+		verifyRecoveryCode := func(code string) verificationResult {
+			data := fmt.Sprintf(`{"recovery_code":"%s"}`, code)
+			r := httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(data))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			var verification verificationResult
+			err := json.NewDecoder(res.Body).Decode(&verification)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return verification
+		}
+
+		// 使用两个不同的恢复码，一次性恢复码不会被代替，响应中没有新的恢复码
+		for _, code := range []string{result.RecoveryCodes[0], result.RecoveryCodes[2]} {
+			verification := verifyRecoveryCode(code)
+			assert.Empty(t, verification.RecoveryCode)
+			// 没有注册 TOTP 的用户没有剩余的第二因素
+			assert.False(t, verification.TOTPRegistered)
+			assert.Equal(t, 0, verification.SecondFactorsRemaining)
+		}
+
+		// 已经使用的恢复码再次使用会失败
+		data := fmt.Sprintf(`{"recovery_code":"%s"}`, result.RecoveryCodes[0])
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		// 注册了 TOTP 的用户的模型中包含剩余的恢复码个数，重新生成后恢复
+		err = insertUserTOTPCredential(db, &UserTOTPCredential{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: time.Now(),
+			Key:       make([]byte, 20),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRecoveryCodesRemaining := func(expected float64) {
+			r := httptest.NewRequest("GET", "/users/1", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var user map[string]any
+			err = json.Unmarshal(body, &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, expected, user["recovery_codes_remaining"])
+		}
+		// 剩余的恢复码个数随着使用减少
+		assertRecoveryCodesRemaining(2)
+
+		verification := verifyRecoveryCode(result.RecoveryCodes[1])
+		assert.Empty(t, verification.RecoveryCode)
+		assert.True(t, verification.TOTPRegistered)
+		assert.Equal(t, 1, verification.SecondFactorsRemaining)
+		assertRecoveryCodesRemaining(1)
+
+		r = httptest.NewRequest("POST", "/users/1/regenerate-recovery-code", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assertRecoveryCodesRemaining(4)
+	})
+
+	t.Run("post /users/userid/verify-recovery-code single code", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 没有设置 env.recoveryCodeCount 时使用用户的单个恢复码
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"87654321"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		// 使用后返回代替它的新恢复码
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		var verification struct {
+			RecoveryCode           string `json:"recovery_code"`
+			TOTPRegistered         bool   `json:"totp_registered"`
+			SecondFactorsRemaining int    `json:"second_factors_remaining"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&verification)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, verification.RecoveryCode, secureCodeLength)
+		assert.NotEqual(t, "12345678", verification.RecoveryCode)
+		assert.False(t, verification.TOTPRegistered)
+		assert.Equal(t, 0, verification.SecondFactorsRemaining)
+		user, err := getUser(db, context.Background(), "1")
+		assert.NoError(t, err)
+		assert.Equal(t, verification.RecoveryCode, user.RecoveryCode)
+
+		// 旧的恢复码不能再次使用
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+	})
+
+	t.Run("post /users/userid/verify-recovery-code hashing limits", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user := User{
+			Id:           "1",
+			CreatedAt:    time.Unix(time.Now().Unix(), 0),
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = regenerateUserRecoveryCodes(db, context.Background(), newId, user.Id, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.recoveryCodeCount = 4
+		env.passwordHashingIPRateLimit = ratelimit.NewTokenBucketRateLimit(2, time.Hour)
+		env.passwordHashingConcurrencyLimit = ratelimit.NewConcurrencyLimit(1, 0, 0)
+		app := CreateApp(env)
+
+		// 哈希名额被占用时，开始 Argon2id 比较之前返回 429
+		env.passwordHashingConcurrencyLimit.Acquire("")
+		r := httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"AAAAAAAA"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 429, ExpectedErrorTooManyRequests)
+		env.passwordHashingConcurrencyLimit.Release("")
+
+		// 提供了 client_ip 时和验证密码共用按 IP 的哈希限流
+		for i := 0; i < 2; i++ {
+			r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"AAAAAAAA","client_ip":"192.0.2.1"}`))
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertErrorResponse(t, w.Result(), 400, ExpectedErrorIncorrectCode)
+		}
+		r = httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(`{"recovery_code":"AAAAAAAA","client_ip":"192.0.2.1"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 429, ExpectedErrorTooManyRequests)
+	})
+
+	t.Run("post /users/userid/verify-password failure delay", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.FailureDelay = DurationRange{Min: 500 * time.Millisecond, Max: 600 * time.Millisecond}
+		app := CreateApp(env)
+
+		// 密码错误时至少等待 FailureDelay.Min
+		start := time.Now()
+		r := httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"invalid_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorIncorrectPassword)
+		assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+		// 密码正确时不等待
+		start = time.Now()
+		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("post /users/userid/verify-password", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/verify-password")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/verify-password", strings.NewReader(`{"password":"12345678"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectPassword)
+
+		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+	})
+
+	t.Run("post /users/userid/verify-password include_2fa_methods", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		// 用户 1 没有第二因素，用户 2 注册了 TOTP 和安全密钥
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2"} {
+			user := User{
+				Id:             userId,
+				CreatedAt:      now,
+				PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := insertUserTOTPCredential(db, &UserTOTPCredential{
+			Id:        "1",
+			UserId:    "2",
+			CreatedAt: now,
+			Key:       []byte{0x01, 0x02, 0x03},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO security_key (id, user_id, name, created_at, cose_algorithm_id) VALUES (?, ?, ?, ?, ?)", "1", "2", "YubiKey", now.Unix(), -7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		verifyPassword := func(userId string, body string) (int, map[string]interface{}) {
+			r := httptest.NewRequest("POST", "/users/"+userId+"/verify-password", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			if res.StatusCode != 200 {
+				return res.StatusCode, nil
+			}
+			var result map[string]interface{}
+			err := json.NewDecoder(res.Body).Decode(&result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res.StatusCode, result
+		}
+
+		// 默认仍然返回 204
+		status, _ := verifyPassword("2", `{"password":"super_secure_password"}`)
+		assert.Equal(t, 204, status)
+
+		status, result := verifyPassword("1", `{"password":"super_secure_password","include_2fa_methods":true}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, map[string]interface{}{"requires_2fa": false, "methods": []interface{}{}}, result)
+
+		status, result = verifyPassword("2", `{"password":"super_secure_password","include_2fa_methods":true}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, map[string]interface{}{"requires_2fa": true, "methods": []interface{}{"totp", "security_key"}}, result)
+
+		// 密码错误时不返回第二因素
+		status, _ = verifyPassword("2", `{"password":"incorrect_password","include_2fa_methods":true}`)
+		assert.Equal(t, 400, status)
+	})
+
+	t.Run("post /users/userid/verify-password passwordless user", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		// 没有密码的用户 password_hash 为空
+		user := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorPasswordNotSet)
+
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(`{"password":"super_secure_password","new_password":"another_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorPasswordNotSet)
+	})
+
+	t.Run("post /verify-credentials", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/verify-credentials")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		// 一个有密码的用户和一个没有密码的用户，都保存了邮箱
+		createUserWithEmail := func(passwordHash string, email string) User {
+			user, _, err := createUser(db, context.Background(), newId, passwordHash, createUserOptions{
+				email:                     email,
+				emailVerificationCode:     "CODE",
+				emailVerificationCodeHash: "CODE_HASH",
+				consumeCodeDelivery:       func(userId string) bool { return true },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return user
+		}
+		user := createUserWithEmail("$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ", "User@example.com")
+		createUserWithEmail("", "passwordless@example.com")
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		// 正确的邮箱和密码返回用户 ID，邮箱不区分大小写
+		for _, email := range []string{"User@example.com", "user@example.com"} {
+			r := httptest.NewRequest("POST", "/verify-credentials", strings.NewReader(`{"email":"`+email+`","password":"super_secure_password"}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode, email)
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.JSONEq(t, `{"user_id":"`+user.Id+`"}`, string(body), email)
+		}
+
+		// 密码错误、邮箱不存在和用户没有密码都返回同样的错误
+		for _, data := range []string{
+			`{"email":"user@example.com","password":"invalid_password"}`,
+			`{"email":"unknown@example.com","password":"super_secure_password"}`,
+			`{"email":"passwordless@example.com","password":"super_secure_password"}`,
+		} {
+			r := httptest.NewRequest("POST", "/verify-credentials", strings.NewReader(data))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertErrorResponse(t, w.Result(), 400, ExpectedErrorIncorrectPassword)
+		}
+
+		r := httptest.NewRequest("POST", "/verify-credentials", strings.NewReader(`{"email":"invalid","password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorInvalidData)
+
+		r = httptest.NewRequest("POST", "/verify-credentials", strings.NewReader(`{"email":"user@example.com"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorInvalidData)
+	})
+
+	t.Run("post /verify-credentials rate limit", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		// 不存在的邮箱也会消耗登录限流的令牌
+		var res *http.Response
+		for i := 0; i < 6; i++ {
+			r := httptest.NewRequest("POST", "/verify-credentials", strings.NewReader(`{"email":"unknown@example.com","password":"super_secure_password","client_ip":"192.0.2.1"}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res = w.Result()
+		}
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+	})
+
+	t.Run("post /users/userid/email-verification-request", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "POST", "/users/1/email-verification-request")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user1 := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/email-verification-request", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/1/email-verification-request", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+
+		r = httptest.NewRequest("POST", "/users/1/email-verification-request", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+	})
+
+	t.Run("get /audit-log", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/audit-log")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2"} {
+			user := User{
+				Id:             userId,
+				CreatedAt:      now,
+				PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		credential := UserTOTPCredential{
+			Id:        "1",
+			UserId:    "1",
+			CreatedAt: now,
+			Key:       []byte("12345678901234567890"),
+		}
+		err := insertUserTOTPCredential(db, &credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secret := []byte("hello")
+		env := createEnvironment(db, secret)
+		app := CreateApp(env)
+		actor := requestActorId(env, &http.Request{Header: http.Header{"Authorization": {string(secret)}}})
+		assert.Len(t, actor, 16)
+		assert.NotContains(t, actor, string(secret))
+
+		getAuditLog := func(query string) []map[string]any {
+			r := httptest.NewRequest("GET", "/audit-log?"+query, nil)
+			r.Header.Set("Authorization", string(secret))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result []map[string]any
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result
+		}
+		assert.Empty(t, getAuditLog(""))
+
+		// 关闭 2FA 只写入一条记录
+		r := httptest.NewRequest("DELETE", "/users/1/totp-credential", nil)
+		r.Header.Set("Authorization", string(secret))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+
+		entries := getAuditLog("")
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, AuditActionTOTPCredentialDelete, entries[0]["action"])
+			assert.Equal(t, "1", entries[0]["user_id"])
+			assert.Equal(t, actor, entries[0]["actor"])
+			assert.Equal(t, "", entries[0]["client_ip"])
+			assert.GreaterOrEqual(t, entries[0]["created_at"], float64(now.Unix()))
+		}
+
+		// 删除用户只写入一条记录，用户删除后记录仍然保留
+		r = httptest.NewRequest("DELETE", "/users/2", nil)
+		r.Header.Set("Authorization", string(secret))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+
+		entries = getAuditLog("action=" + AuditActionUserDelete)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, AuditActionUserDelete, entries[0]["action"])
+			assert.Equal(t, "2", entries[0]["user_id"])
+			assert.Equal(t, actor, entries[0]["actor"])
+		}
+
+		// 失败的操作不写入记录
+		r = httptest.NewRequest("DELETE", "/users/2", nil)
+		r.Header.Set("Authorization", string(secret))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 404, w.Result().StatusCode)
+
+		// 按用户过滤，最新的记录在前，分页
+		entries = getAuditLog("user_id=1")
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, AuditActionTOTPCredentialDelete, entries[0]["action"])
+		}
+		entries = getAuditLog("")
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, AuditActionUserDelete, entries[0]["action"])
+			assert.Equal(t, AuditActionTOTPCredentialDelete, entries[1]["action"])
+		}
+		entries = getAuditLog("per_page=1&page=2")
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, AuditActionTOTPCredentialDelete, entries[0]["action"])
+		}
+		assert.Empty(t, getAuditLog("user_id=1&action="+AuditActionUserDelete))
+	})
+
+	t.Run("maintenance mode", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/maintenance")
+		testAuthentication(t, "POST", "/maintenance")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		user := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.IDGenerator = newSequenceIdGenerator("u")
+		app := CreateApp(env)
+
+		setMaintenanceMode := func(enabled bool) {
+			data := fmt.Sprintf(`{"enabled":%t}`, enabled)
+			r := httptest.NewRequest("POST", "/maintenance", strings.NewReader(data))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.JSONEq(t, data, string(body))
+		}
+
+		// 默认关闭
+		r := httptest.NewRequest("GET", "/maintenance", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, `{"enabled":false}`, string(body))
+
+		// 开启后拒绝写请求，读请求仍然可用
+		setMaintenanceMode(true)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 503, ExpectedErrorMaintenance)
+
+		r = httptest.NewRequest("DELETE", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 503, ExpectedErrorMaintenance)
+		_, err = getUser(db, context.Background(), "1")
+		assert.NoError(t, err)
+
+		// 只验证密码或第二因素的 POST 请求仍然可用
+		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+
+		r = httptest.NewRequest("GET", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+
+		r = httptest.NewRequest("GET", "/", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+
+		// 关闭后恢复正常
+		setMaintenanceMode(false)
+
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+	})
+
+	t.Run("head requests", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("HEAD", "/", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, 0, w.Body.Len())
+
+		// HEAD 的状态码和响应头与 GET 相同，但没有响应体
+		r = httptest.NewRequest("GET", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		getRes := w.Result()
+		r = httptest.NewRequest("HEAD", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		assert.Equal(t, getRes.Header, res.Header)
+		assert.Equal(t, 0, w.Body.Len())
+
+		r = httptest.NewRequest("HEAD", "/users/2", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, 0, w.Body.Len())
+
+		// HEAD 请求同样需要验证密钥
+		env.secret = []byte("hello")
+		r = httptest.NewRequest("HEAD", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 401, res.StatusCode)
+		assert.Equal(t, 0, w.Body.Len())
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		t.Parallel()
+
+		env := createEnvironment(nil, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("PUT", "/users", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 405, ExpectedErrorMethodNotAllowed)
+		assert.Equal(t, "POST, GET, DELETE", res.Header.Get("Allow"))
+
+		r = httptest.NewRequest("POST", "/users/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 405, ExpectedErrorMethodNotAllowed)
+		assert.Equal(t, "GET, DELETE", res.Header.Get("Allow"))
+
+		// 路径不存在时仍然返回 404
+		r = httptest.NewRequest("PUT", "/unknown", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assert.Equal(t, "", res.Header.Get("Allow"))
+	})
+
+	t.Run("get /routes", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/routes")
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		app := CreateApp(createEnvironment(db, nil))
+
+		r := httptest.NewRequest("GET", "/routes", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var routes []Route
+		err = json.Unmarshal(body, &routes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedRoutes, routes)
+	})
+
+	t.Run("get /healthz", func(t *testing.T) {
+		t.Parallel()
+
+		var probedPaths []string
+		var probedPathsMu sync.Mutex
+		reachableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probedPathsMu.Lock()
+			probedPaths = append(probedPaths, r.URL.Path)
+			probedPathsMu.Unlock()
+			w.Write([]byte("0005AD76BD555C1D6D771DE417A4B87E4B4:10\n"))
+		}))
+		defer reachableServer.Close()
+		// 关闭后的服务器地址无法连接
+		unreachableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		unreachableServer.Close()
+
+		env := createEnvironment(nil, []byte("hello"))
+		app := CreateApp(env)
+
+		// 存活检查不需要请求密钥，也不探测外部服务
+		env.pwnedPasswordsAPIURL = reachableServer.URL
+		r := httptest.NewRequest("GET", "/healthz", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+		assert.Empty(t, probedPaths)
+
+		// 额外检查需要请求密钥
+		r = httptest.NewRequest("GET", "/healthz?checks=pwned", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 401, "NOT_AUTHENTICATED")
 
-		data = `{"password":"invalid","new_password":"super_super_secure_password"}`
-		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		r = httptest.NewRequest("GET", "/healthz?checks=pwned", nil)
+		r.Header.Set("Authorization", "hello")
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectPassword)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"status":"ok","pwned_passwords":"ok"}`, w.Body.String())
+		assert.Equal(t, []string{"/range/00000"}, probedPaths)
 
-		data = `{"password":"super_secure_password","new_password":"super_super_secure_password"}`
-		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		// API 无法访问时仍然返回 200
+		env.pwnedPasswordsAPIURL = unreachableServer.URL
+		r = httptest.NewRequest("GET", "/healthz?checks=pwned", nil)
+		r.Header.Set("Authorization", "hello")
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"status":"ok","pwned_passwords":"unreachable"}`, w.Body.String())
+
+		// 没有启用密码泄露检查时跳过
+		env.disablePwnedPasswordsCheck = true
+		r = httptest.NewRequest("GET", "/healthz?checks=pwned", nil)
+		r.Header.Set("Authorization", "hello")
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+
+		r = httptest.NewRequest("GET", "/healthz?checks=unknown", nil)
+		r.Header.Set("Authorization", "hello")
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+	})
+
+	t.Run("get /healthz rate limit", func(t *testing.T) {
+		t.Parallel()
+
+		env := createEnvironment(nil, nil)
+		env.healthIPRateLimit = ratelimit.NewTokenBucketRateLimit(10, time.Hour)
+		app := CreateApp(env)
+
+		// 同一个 IP 连续请求，超过容量后返回 429
+		for i := 0; i < 10; i++ {
+			r := httptest.NewRequest("GET", "/healthz", nil)
+			r.RemoteAddr = "1.1.1.1:1234"
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assert.Equal(t, 200, w.Result().StatusCode)
+		}
+		r := httptest.NewRequest("GET", "/healthz", nil)
+		r.RemoteAddr = "1.1.1.1:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+
+		// 其他 IP 不受影响
+		r = httptest.NewRequest("GET", "/healthz", nil)
+		r.RemoteAddr = "2.2.2.2:1234"
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+	})
+
+	t.Run("get /auth/check", func(t *testing.T) {
+		t.Parallel()
+
+		// 配置了密钥时，缺少 Authorization 头返回 401
+		testAuthentication(t, "GET", "/auth/check")
+
+		env := createEnvironment(nil, []byte("hello"))
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("Authorization", "hello")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 204, res.StatusCode)
+		assert.Empty(t, w.Body.String())
+
+		r = httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("Authorization", "wrong")
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 401, "NOT_AUTHENTICATED")
+
+		// 没有配置密钥时总是通过
+		app = CreateApp(createEnvironment(nil, nil))
+		r = httptest.NewRequest("GET", "/auth/check", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assert.Equal(t, 204, res.StatusCode)
 	})
 
-	t.Run("post /users/userid/register-totp", func(t *testing.T) {
+	t.Run("get /metrics", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/register-totp")
+		testAuthentication(t, "GET", "/metrics")
+
+		env := createEnvironment(nil, nil)
+		app := CreateApp(env)
+
+		env.passwordHashingIPRateLimit.Consume("0.0.0.0")
+		env.passwordHashingIPRateLimit.Consume("0.0.0.1")
+		env.totpUserRateLimit.Consume("1")
+
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(body), "# TYPE faroe_rate_limiter_keys gauge\n")
+		assert.Contains(t, string(body), "faroe_rate_limiter_keys{limiter=\"password_hashing_ip\"} 2\n")
+		assert.Contains(t, string(body), "faroe_rate_limiter_keys{limiter=\"totp_user\"} 1\n")
+		assert.Contains(t, string(body), "faroe_rate_limiter_keys{limiter=\"login_ip\"} 0\n")
+	})
+
+	t.Run("get /dev/emails", func(t *testing.T) {
+		t.Parallel()
 
 		db := initializeTestDB(t)
 		defer db.Close()
@@ -402,7 +3514,7 @@ func TestEndpointResponses(t *testing.T) {
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      time.Unix(time.Now().Unix(), 0),
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			PasswordHash:   "HASH1",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
@@ -411,79 +3523,79 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		// 非开发模式下不注册该端点
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/register-totp", nil)
+		r := httptest.NewRequest("GET", "/dev/emails", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		data := `{"key": "moM4ZtcDvWQQIA==", "code": "123456"}`
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		// 开发模式下返回创建验证请求时捕获的邮件
+		env = createEnvironment(db, nil)
+		env.devEmailSink = NewDevEmailSink(10)
+		app = CreateApp(env)
+
+		r = httptest.NewRequest("GET", "/dev/emails", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, "[]", string(body))
 
-		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwes", "code": "123456"}`
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		r = httptest.NewRequest("POST", "/users/1/email-verification-request", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+		assert.Equal(t, 200, res.StatusCode)
 
-		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwe$=", "code": "123456"}`
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user@example.com"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+		assert.Equal(t, 200, res.StatusCode)
 
-		data = `{"key": "j1dCsnrWOnKAfyMxShUPZ9AUwes=", "code": "123456"}`
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
+		r = httptest.NewRequest("GET", "/dev/emails", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
-
-		key := make([]byte, 20)
-		_, err = rand.Read(key)
+		assert.Equal(t, 200, res.StatusCode)
+		body, err = io.ReadAll(res.Body)
 		if err != nil {
 			t.Fatal(err)
 		}
-		totp := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
-		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base64.StdEncoding.EncodeToString(key), totp)
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, userTOTPCredentialJSONKeys)
-
-		key = make([]byte, 20)
-		_, err = rand.Read(key)
+		var result []map[string]any
+		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Fatal(err)
 		}
-		totp = otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
-		data = fmt.Sprintf(`{"key":"%s", "code":"%s"}`, base64.StdEncoding.EncodeToString(key), totp)
-		r = httptest.NewRequest("POST", "/users/1/register-totp", strings.NewReader(data))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, userTOTPCredentialJSONKeys)
+		if assert.Len(t, result, 2) {
+			// 最新的邮件在前面
+			assert.Equal(t, DevEmailTypeUserEmailVerification, result[0]["type"])
+			assert.Equal(t, "user@example.com", result[0]["email"])
+			assert.Equal(t, DevEmailTypeUserEmailVerification, result[1]["type"])
+			assert.Equal(t, "1", result[1]["user_id"])
+			assert.NotContains(t, result[1], "email")
+			assert.NotEmpty(t, result[1]["code"])
+		}
 	})
 
-	t.Run("get /user/userid/totp-credential", func(t *testing.T) {
+	t.Run("get /users/userid/email-verification-request", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "GET", "/users/1/totp-credential")
+		testAuthentication(t, "GET", "/users/1/email-verification-request")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
+
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      now,
@@ -495,6 +3607,7 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+
 		user2 := User{
 			Id:             "2",
 			CreatedAt:      now,
@@ -507,12 +3620,36 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		credential1 := UserTOTPCredential{
+		user3 := User{
+			Id:             "3",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest1 := UserEmailVerificationRequest{
 			UserId:    user1.Id,
 			CreatedAt: now,
-			Key:       make([]byte, 20),
+			Code:      "12345678",
+			ExpiresAt: now.Add(10 * time.Minute),
 		}
-		err = insertUserTOTPCredential(db, &credential1)
+		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest2 := UserEmailVerificationRequest{
+			UserId:    user2.Id,
+			CreatedAt: now,
+			Code:      "12345678",
+			ExpiresAt: now.Add(-10 * time.Minute),
+		}
+		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -520,19 +3657,25 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("GET", "/users/3/totp-credential", nil)
+		r := httptest.NewRequest("GET", "/users/4/email-verification-request", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("GET", "/users/2/totp-credential", nil)
+		r = httptest.NewRequest("GET", "/users/3/email-verification-request", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("GET", "/users/1/totp-credential", nil)
+		r = httptest.NewRequest("GET", "/users/2/email-verification-request", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("GET", "/users/1/email-verification-request", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
@@ -541,28 +3684,31 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var result UserTOTPCredentialJSON
+		var result UserEmailVerificationRequestJSON
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Fatal(err)
 		}
-		var expected UserTOTPCredentialJSON
-		err = json.Unmarshal([]byte(credential1.EncodeToJSON()), &expected)
+		var expected UserEmailVerificationRequestJSON
+		err = json.Unmarshal([]byte(verificationRequest1.EncodeToJSON()), &expected)
 		if err != nil {
 			t.Fatal(err)
 		}
+		// 数据库中只保存了验证码的哈希，所以响应中不包含验证码
+		expected.Code = ""
 		assert.Equal(t, expected, result)
 	})
 
-	t.Run("delete /users/userid/totp-credential", func(t *testing.T) {
+	t.Run("delete /users/userid/email-verification-request", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "DELETE", "/users/1/totp-credential")
+		testAuthentication(t, "DELETE", "/users/1/email-verification-request")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
+
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      now,
@@ -587,12 +3733,36 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		credential1 := UserTOTPCredential{
+		user3 := User{
+			Id:             "3",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest1 := UserEmailVerificationRequest{
 			UserId:    user1.Id,
 			CreatedAt: now,
-			Key:       make([]byte, 20),
+			Code:      "12345678",
+			ExpiresAt: now.Add(10 * time.Minute),
 		}
-		err = insertUserTOTPCredential(db, &credential1)
+		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest2 := UserEmailVerificationRequest{
+			UserId:    user2.Id,
+			CreatedAt: now,
+			Code:      "12345678",
+			ExpiresAt: now.Add(-10 * time.Minute),
+		}
+		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -600,34 +3770,41 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("DELETE", "/users/3/totp-credential", nil)
+		r := httptest.NewRequest("DELETE", "/users/4/email-verification-request", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("DELETE", "/users/2/totp-credential", nil)
+		r = httptest.NewRequest("DELETE", "/users/3/email-verification-request", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("DELETE", "/users/1/totp-credential", nil)
+		r = httptest.NewRequest("DELETE", "/users/2/email-verification-request", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("DELETE", "/users/1/email-verification-request", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assert.Equal(t, 204, res.StatusCode)
 	})
 
-	t.Run("post /users/userid/verify-2fa/totp", func(t *testing.T) {
+	t.Run("post /users/userid/verify-email", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/verify-2fa/totp")
+		testAuthentication(t, "POST", "/users/1/verify-email")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
+
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      now,
@@ -652,14 +3829,36 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		key := make([]byte, 20)
-		rand.Read(key)
-		credential1 := UserTOTPCredential{
+		user3 := User{
+			Id:             "3",
+			CreatedAt:      now,
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest1 := UserEmailVerificationRequest{
 			UserId:    user1.Id,
 			CreatedAt: now,
-			Key:       key,
+			Code:      "12345678",
+			ExpiresAt: now.Add(10 * time.Minute),
 		}
-		err = insertUserTOTPCredential(db, &credential1)
+		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationRequest2 := UserEmailVerificationRequest{
+			UserId:    user2.Id,
+			CreatedAt: now,
+			Code:      "12345678",
+			ExpiresAt: now.Add(-10 * time.Minute),
+		}
+		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -667,43 +3866,57 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/3/verify-2fa/totp", nil)
+		r := httptest.NewRequest("POST", "/users/4/verify-email", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("POST", "/users/2/verify-2fa/totp", nil)
+		r = httptest.NewRequest("POST", "/users/3/verify-email", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorNotAllowed)
 
-		data := `{"code":"123456"}`
-		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		r = httptest.NewRequest("POST", "/users/2/verify-email", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorNotAllowed)
+
+		data := `{"code":"87654321"}`
+		r = httptest.NewRequest("POST", "/users/1/verify-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
 
-		totp := otp.GenerateTOTP(time.Now(), key, 30*time.Second, 6)
-		data = fmt.Sprintf(`{"code":"%s"}`, totp)
-		r = httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(data))
+		// 验证码前后和中间的空白字符会被去掉
+		data = `{"code":" 1234 5678\n"}`
+		r = httptest.NewRequest("POST", "/users/1/verify-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assert.Equal(t, 204, res.StatusCode)
+
+		// 验证成功后用户的邮箱被标记为已验证
+		emailVerified, err := getUserEmailVerified(db, context.Background(), user1.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, emailVerified)
 	})
 
-	t.Run("post /users/userid/regenerate-recovery-code", func(t *testing.T) {
+	t.Run("post /users/userid/email-update-requests", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/regenerate-recovery-code")
+		testAuthentication(t, "POST", "/users/1/email-update-requests")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
+
 		user1 := User{
 			Id:             "1",
 			CreatedAt:      now,
@@ -719,76 +3932,228 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/regenerate-recovery-code", nil)
+		data := `{"email":"email"}`
+		r := httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(data))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		data = `{"email":"user2@example.com"}`
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, emailUpdateRequestJSONKeys)
+
+		// 缺少邮箱
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 用户不存在
+		r = httptest.NewRequest("POST", "/users/2/email-update-requests", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("POST", "/users/1/regenerate-recovery-code", nil)
+		// 其他用户已经使用的邮箱 (不区分大小写)
+		_, err = db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code, email) VALUES (?, ?, ?, ?, ?)", "3", now.Unix(), "HASH", "12345678", "User3@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"user3@EXAMPLE.com"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertJSONResponse(t, res, recoveryCodeJSONKeys)
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailAlreadyUsed)
 	})
 
-	t.Run("post /users/userid/reset-2fa", func(t *testing.T) {
+	t.Run("post /users/userid/email-update-requests email domains", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/reset-2fa")
-
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
-		user1 := User{
-			Id:             "1",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err := insertUser(db, context.Background(), &user1)
+		err := insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    now,
+			PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode: "12345678",
+		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		env := createEnvironment(db, nil)
+		// 这里只测试邮箱域名，不限制同一个用户连续创建请求
+		env.emailUpdateRequestRateLimit = emailUpdateRequestRateLimit{
+			user:  ratelimit.NewTokenBucketRateLimit(5, time.Minute),
+			email: ratelimit.NewTokenBucketRateLimit(5, time.Minute),
+		}
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/reset-2fa", nil)
+		// 和创建用户一样，配置了允许的邮箱域名时其他域名应被拒绝
+		env.allowedEmailDomains = []string{"*.example.com"}
+		r := httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"user1@example.net"}`))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailDomainNotAllowed)
 
-		data := `{"recovery_code":"87654321"}`
-		r = httptest.NewRequest("POST", "/users/1/reset-2fa", strings.NewReader(data))
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"user1@mail.example.com"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+		assertJSONResponse(t, res, emailUpdateRequestJSONKeys)
 
-		data = `{"recovery_code":"12345678"}`
-		r = httptest.NewRequest("POST", "/users/1/reset-2fa", strings.NewReader(data))
+		// 配置了一次性邮箱黑名单时，不能把邮箱改为名单中的域名
+		env.allowedEmailDomains = nil
+		env.disposableEmailDomains, err = NewDisposableEmailDomainList("")
+		assert.NoError(t, err)
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"user1@mailinator.com"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertJSONResponse(t, res, recoveryCodeJSONKeys)
+		assertErrorResponse(t, res, 400, ExpectedErrorDisposableEmail)
+
+		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"user1@example.net"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, emailUpdateRequestJSONKeys)
 	})
 
-	t.Run("post /users/userid/verify-password", func(t *testing.T) {
+	t.Run("post /users/userid/email-update-requests rate limit", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/verify-password")
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2", "3"} {
+			err := insertUser(db, context.Background(), &User{
+				Id:           userId,
+				CreatedAt:    now,
+				PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode: "12345678",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		env := createEnvironment(db, nil)
+		// 每个用户每分钟一个请求，每个邮箱每分钟两个请求
+		env.emailUpdateRequestRateLimit = newEmailUpdateRequestRateLimit(time.Minute, 2, time.Minute)
+		app := CreateApp(env)
+
+		createRequest := func(userId string, email string) *http.Response {
+			r := httptest.NewRequest("POST", "/users/"+userId+"/email-update-requests", strings.NewReader(`{"email":"`+email+`"}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
+
+		// 同一个用户连续创建请求，换一个邮箱也被限制
+		assertJSONResponse(t, createRequest("1", "target@example.com"), emailUpdateRequestJSONKeys)
+		assertErrorResponse(t, createRequest("1", "other@example.com"), 429, ExpectedErrorTooManyRequests)
+
+		// 不同的用户向同一个邮箱创建请求 (邮箱不区分大小写)
+		assertJSONResponse(t, createRequest("2", "Target@Example.com"), emailUpdateRequestJSONKeys)
+		assertErrorResponse(t, createRequest("3", "target@example.com"), 429, ExpectedErrorTooManyRequests)
+
+		// 被邮箱限制拒绝时没有消耗用户的令牌
+		assertJSONResponse(t, createRequest("3", "other@example.com"), emailUpdateRequestJSONKeys)
+
+		// 被拒绝的请求没有创建记录
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM email_update_request").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("post /users/userid/email-update-requests active limit", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		err := insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    now,
+			PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		env.emailUpdateRequestRateLimit = emailUpdateRequestRateLimit{
+			user:  ratelimit.NewTokenBucketRateLimit(10, time.Minute),
+			email: ratelimit.NewTokenBucketRateLimit(10, time.Minute),
+		}
+		env.maxActiveEmailUpdateRequests = 2
+		app := CreateApp(env)
+
+		createRequest := func(email string) *http.Response {
+			r := httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(`{"email":"`+email+`"}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
+		emails := func() []string {
+			rows, err := db.Query("SELECT email FROM email_update_request ORDER BY rowid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var result []string
+			for rows.Next() {
+				var email string
+				err = rows.Scan(&email)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result = append(result, email)
+			}
+			return result
+		}
+
+		// 默认删除最早的有效请求
+		for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+			assertJSONResponse(t, createRequest(email), emailUpdateRequestJSONKeys)
+		}
+		assert.Equal(t, []string{"b@example.com", "c@example.com"}, emails())
+
+		// 配置为拒绝时返回 TOO_MANY_REQUESTS，已有的请求不变
+		env.rejectEmailUpdateRequestsOverLimit = true
+		assertErrorResponse(t, createRequest("d@example.com"), 429, ExpectedErrorTooManyRequests)
+		assert.Equal(t, []string{"b@example.com", "c@example.com"}, emails())
+	})
+
+	t.Run("get /users/userid/email-update-requests", func(t *testing.T) {
+		t.Parallel()
+
+		testAuthentication(t, "GET", "/users/1/email-update-requests")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
+		now := time.Unix(time.Now().Unix(), 0)
+
 		user1 := User{
 			Id:             "1",
-			CreatedAt:      time.Unix(time.Now().Unix(), 0),
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			CreatedAt:      now,
+			PasswordHash:   "HASH",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
@@ -797,44 +4162,120 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		user2 := User{
+			Id:             "2",
+			CreatedAt:      now,
+			PasswordHash:   "HASH",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err = insertUser(db, context.Background(), &user2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updateRequest1 := EmailUpdateRequest{
+			Id:        "1",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Email:     "user1b@example.com",
+			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
+		}
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updateRequest2 := EmailUpdateRequest{
+			Id:        "2",
+			UserId:    user1.Id,
+			CreatedAt: now,
+			Email:     "user1c@example.com",
+			ExpiresAt: now.Add(-10 * time.Minute),
+			Code:      "12345678",
+		}
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updateRequest3 := EmailUpdateRequest{
+			Id:        "3",
+			UserId:    user2.Id,
+			CreatedAt: now,
+			Email:     "user2b@example.com",
+			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
+		}
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/verify-password", strings.NewReader(`{"password":"12345678"}`))
+		r := httptest.NewRequest("GET", "/users/3/email-update-requests", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"12345678"}`))
+		r = httptest.NewRequest("GET", "/users/1/email-update-requests", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectPassword)
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []EmailUpdateRequestJSON
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		r = httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assert.Equal(t, 204, res.StatusCode)
+		var expected1 EmailUpdateRequestJSON
+		err = json.Unmarshal([]byte(updateRequest1.EncodeToJSON()), &expected1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []EmailUpdateRequestJSON{expected1}, result)
 	})
 
-	t.Run("post /users/userid/email-verification-request", func(t *testing.T) {
+	t.Run("delete /users/userid/email-update-requests", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/email-verification-request")
+		testAuthentication(t, "DELETE", "/users/1/email-update-requests")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
-		user1 := User{
+		now := time.Unix(time.Now().Unix(), 0)
+
+		user := User{
 			Id:             "1",
-			CreatedAt:      time.Unix(time.Now().Unix(), 0),
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			CreatedAt:      now,
+			PasswordHash:   "HASH",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user1)
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updateRequest := EmailUpdateRequest{
+			Id:        "1",
+			UserId:    user.Id,
+			CreatedAt: now,
+			Email:     "user1b@example.com",
+			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
+		}
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -842,89 +4283,63 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/email-verification-request", nil)
+		r := httptest.NewRequest("DELETE", "/users/2/email-update-requests", nil)
 		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
-
-		r = httptest.NewRequest("POST", "/users/1/email-verification-request", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("POST", "/users/1/email-verification-request", nil)
+		r = httptest.NewRequest("DELETE", "/users/1/email-update-requests", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+		assert.Equal(t, 204, res.StatusCode)
 	})
 
-	t.Run("get /users/userid/email-verification-request", func(t *testing.T) {
+	t.Run("get /email-update-requests/requestid", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "GET", "/users/1/email-verification-request")
+		testAuthentication(t, "GET", "/email-update-requests/1")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user1 := User{
+		user := User{
 			Id:             "1",
 			CreatedAt:      now,
 			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user1)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user2 := User{
-			Id:             "2",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user2)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user3 := User{
-			Id:             "3",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user3)
+		err := insertUser(db, context.Background(), &user)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest1 := UserEmailVerificationRequest{
-			UserId:    user1.Id,
+		updateRequest1 := EmailUpdateRequest{
+			Id:        "1",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest2 := UserEmailVerificationRequest{
-			UserId:    user2.Id,
+		updateRequest2 := EmailUpdateRequest{
+			Id:        "2",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1c@example.com",
 			ExpiresAt: now.Add(-10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -932,25 +4347,19 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("GET", "/users/4/email-verification-request", nil)
+		r := httptest.NewRequest("GET", "/email-update-requests/3", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("GET", "/users/3/email-verification-request", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
-
-		r = httptest.NewRequest("GET", "/users/2/email-verification-request", nil)
+		r = httptest.NewRequest("GET", "/email-update-requests/2", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("GET", "/users/1/email-verification-request", nil)
+		r = httptest.NewRequest("GET", "/email-update-requests/1", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
@@ -959,83 +4368,63 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var result UserEmailVerificationRequestJSON
+		var result EmailUpdateRequestJSON
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Fatal(err)
 		}
-		var expected UserEmailVerificationRequestJSON
-		err = json.Unmarshal([]byte(verificationRequest1.EncodeToJSON()), &expected)
+		var expected EmailUpdateRequestJSON
+		err = json.Unmarshal([]byte(updateRequest1.EncodeToJSON()), &expected)
 		if err != nil {
 			t.Fatal(err)
 		}
 		assert.Equal(t, expected, result)
 	})
 
-	t.Run("delete /users/userid/email-verification-request", func(t *testing.T) {
+	t.Run("delete /email-update-requests/requestid", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "DELETE", "/users/1/email-verification-request")
+		testAuthentication(t, "DELETE", "/email-update-requests/1")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user1 := User{
+		user := User{
 			Id:             "1",
 			CreatedAt:      now,
 			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user1)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user2 := User{
-			Id:             "2",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user2)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user3 := User{
-			Id:             "3",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user3)
+		err := insertUser(db, context.Background(), &user)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest1 := UserEmailVerificationRequest{
-			UserId:    user1.Id,
+		updateRequest1 := EmailUpdateRequest{
+			Id:        "1",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest2 := UserEmailVerificationRequest{
-			UserId:    user2.Id,
+		updateRequest2 := EmailUpdateRequest{
+			Id:        "2",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1c@example.com",
 			ExpiresAt: now.Add(-10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1043,95 +4432,69 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("DELETE", "/users/4/email-verification-request", nil)
+		r := httptest.NewRequest("DELETE", "/email-update-requests/3", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("DELETE", "/users/3/email-verification-request", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
-
-		r = httptest.NewRequest("DELETE", "/users/2/email-verification-request", nil)
+		r = httptest.NewRequest("DELETE", "/email-update-requests/2", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("DELETE", "/users/1/email-verification-request", nil)
+		r = httptest.NewRequest("DELETE", "/email-update-requests/1", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assert.Equal(t, 204, res.StatusCode)
 	})
 
-	t.Run("post /users/userid/verify-email", func(t *testing.T) {
+	t.Run("post /verify-new-email", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/verify-email")
+		testAuthentication(t, "POST", "/verify-new-email")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user1 := User{
+		user := User{
 			Id:             "1",
 			CreatedAt:      now,
 			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user1)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user2 := User{
-			Id:             "2",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user2)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user3 := User{
-			Id:             "3",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err = insertUser(db, context.Background(), &user3)
+		err := insertUser(db, context.Background(), &user)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest1 := UserEmailVerificationRequest{
-			UserId:    user1.Id,
+		updateRequest1 := EmailUpdateRequest{
+			Id:        "1",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest1)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		verificationRequest2 := UserEmailVerificationRequest{
-			UserId:    user2.Id,
+		updateRequest2 := EmailUpdateRequest{
+			Id:        "2",
+			UserId:    user.Id,
 			CreatedAt: now,
-			Code:      "12345678",
+			Email:     "user1c@example.com",
 			ExpiresAt: now.Add(-10 * time.Minute),
+			Code:      "12345678",
 		}
-		err = insertUserEmailVerificationRequest(db, &verificationRequest2)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1139,116 +4502,73 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/4/verify-email", nil)
+		data := `{"request_id":"3","code":"123445678"}`
+		r := httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
-
-		r = httptest.NewRequest("POST", "/users/3/verify-email", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorNotAllowed)
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidRequest)
 
-		r = httptest.NewRequest("POST", "/users/2/verify-email", nil)
+		data = `{"request_id":"2","code":"123445678"}`
+		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorNotAllowed)
+		assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
 
-		data := `{"code":"87654321"}`
-		r = httptest.NewRequest("POST", "/users/1/verify-email", strings.NewReader(data))
+		data = `{"request_id":"1","code":"87654321"}`
+		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
 
-		data = `{"code":"12345678"}`
-		r = httptest.NewRequest("POST", "/users/1/verify-email", strings.NewReader(data))
+		data = `{"request_id":"1","code":"12345678"}`
+		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assert.Equal(t, 204, res.StatusCode)
-	})
-
-	t.Run("post /users/userid/email-update-requests", func(t *testing.T) {
-		t.Parallel()
-
-		testAuthentication(t, "POST", "/users/1/email-update-requests")
-
-		db := initializeTestDB(t)
-		defer db.Close()
-
-		now := time.Unix(time.Now().Unix(), 0)
-
-		user1 := User{
-			Id:             "1",
-			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err := insertUser(db, context.Background(), &user1)
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		env := createEnvironment(db, nil)
-		app := CreateApp(env)
-
-		data := `{"email":"email"}`
-		r := httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(data))
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res := w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
-
-		data = `{"email":"user2@example.com"}`
-		r = httptest.NewRequest("POST", "/users/1/email-update-requests", strings.NewReader(data))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, emailUpdateRequestJSONKeys)
+		var result EmailJSON
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected EmailJSON
+		err = json.Unmarshal([]byte(encodeEmailToJSON(updateRequest1.Email)), &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, result)
 	})
 
-	t.Run("get /users/userid/email-update-requests", func(t *testing.T) {
+	t.Run("post /verify-new-email attempt limit", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "GET", "/users/1/email-update-requests")
-
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user1 := User{
+		user := User{
 			Id:             "1",
 			CreatedAt:      now,
-			PasswordHash:   "HASH",
-			RecoveryCode:   "12345678",
-			TOTPRegistered: false,
-		}
-		err := insertUser(db, context.Background(), &user1)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		user2 := User{
-			Id:             "2",
-			CreatedAt:      now,
-			PasswordHash:   "HASH",
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err = insertUser(db, context.Background(), &user2)
+		err := insertUser(db, context.Background(), &user)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		updateRequest1 := EmailUpdateRequest{
 			Id:        "1",
-			UserId:    user1.Id,
+			UserId:    user.Id,
 			CreatedAt: now,
 			Email:     "user1b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
@@ -1258,29 +4578,15 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-
 		updateRequest2 := EmailUpdateRequest{
 			Id:        "2",
-			UserId:    user1.Id,
+			UserId:    user.Id,
 			CreatedAt: now,
 			Email:     "user1c@example.com",
-			ExpiresAt: now.Add(-10 * time.Minute),
-			Code:      "12345678",
-		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		updateRequest3 := EmailUpdateRequest{
-			Id:        "3",
-			UserId:    user2.Id,
-			CreatedAt: now,
-			Email:     "user2b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
 			Code:      "12345678",
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest3)
+		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1288,40 +4594,39 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("GET", "/users/3/email-update-requests", nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
-
-		r = httptest.NewRequest("GET", "/users/1/email-update-requests", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assert.Equal(t, 200, res.StatusCode)
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			t.Fatal(err)
+		verify := func(requestId string, code string) *http.Response {
+			data := fmt.Sprintf(`{"request_id":%q,"code":%q}`, requestId, code)
+			r := httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
 		}
-		var result []EmailUpdateRequestJSON
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			t.Fatal(err)
+
+		// 用完 5 次尝试后，请求被删除，正确的验证码也不能再使用
+		for i := 0; i < 5; i++ {
+			assertErrorResponse(t, verify("1", "87654321"), 400, ExpectedErrorIncorrectCode)
 		}
+		assertErrorResponse(t, verify("1", "12345678"), 429, ExpectedErrorTooManyRequests)
+		_, err = getEmailUpdateRequest(db, context.Background(), "1")
+		assert.ErrorIs(t, err, ErrRecordNotFound)
+		assertErrorResponse(t, verify("1", "12345678"), 400, ExpectedErrorInvalidRequest)
 
-		var expected1 EmailUpdateRequestJSON
-		err = json.Unmarshal([]byte(updateRequest1.EncodeToJSON()), &expected1)
+		// 在次数限制内输入正确的验证码仍然可以成功
+		for i := 0; i < 4; i++ {
+			assertErrorResponse(t, verify("2", "87654321"), 400, ExpectedErrorIncorrectCode)
+		}
+		res := verify("2", "12345678")
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
 		if err != nil {
 			t.Fatal(err)
 		}
-		assert.Equal(t, []EmailUpdateRequestJSON{expected1}, result)
+		assert.JSONEq(t, encodeEmailToJSON("user1c@example.com"), string(body))
 	})
 
-	t.Run("delete /users/userid/email-update-requests", func(t *testing.T) {
+	t.Run("post /verify-new-email client ip rate limit", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "DELETE", "/users/1/email-update-requests")
-
 		db := initializeTestDB(t)
 		defer db.Close()
 
@@ -1330,7 +4635,7 @@ func TestEndpointResponses(t *testing.T) {
 		user := User{
 			Id:             "1",
 			CreatedAt:      now,
-			PasswordHash:   "HASH",
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
@@ -1338,7 +4643,6 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-
 		updateRequest := EmailUpdateRequest{
 			Id:        "1",
 			UserId:    user.Id,
@@ -1355,23 +4659,26 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("DELETE", "/users/2/email-update-requests", nil)
+		// 同一个 IP 已经用完了密码哈希速率限制
+		for i := 0; i < 5; i++ {
+			env.passwordHashingIPRateLimit.Consume("0.0.0.0")
+		}
+		data := `{"request_id":"1","code":"12345678","client_ip":"0.0.0.0"}`
+		r := httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
 
-		r = httptest.NewRequest("DELETE", "/users/1/email-update-requests", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assert.Equal(t, 204, res.StatusCode)
+		// 请求没有被删除
+		_, err = getEmailUpdateRequest(db, context.Background(), "1")
+		assert.NoError(t, err)
 	})
 
-	t.Run("get /email-update-requests/requestid", func(t *testing.T) {
+	t.Run("post /email-update-requests/requestid/verify", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "GET", "/email-update-requests/1")
+		testAuthentication(t, "POST", "/email-update-requests/1/verify")
 
 		db := initializeTestDB(t)
 		defer db.Close()
@@ -1390,48 +4697,54 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		updateRequest1 := EmailUpdateRequest{
-			Id:        "1",
-			UserId:    user.Id,
-			CreatedAt: now,
-			Email:     "user1b@example.com",
-			ExpiresAt: now.Add(10 * time.Minute),
-			Code:      "12345678",
-		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		updateRequest2 := EmailUpdateRequest{
-			Id:        "2",
-			UserId:    user.Id,
-			CreatedAt: now,
-			Email:     "user1c@example.com",
-			ExpiresAt: now.Add(-10 * time.Minute),
-			Code:      "12345678",
+		updateRequests := []EmailUpdateRequest{
+			{Id: "1", UserId: user.Id, CreatedAt: now, Email: "user1b@example.com", ExpiresAt: now.Add(10 * time.Minute), Code: "12345678"},
+			{Id: "2", UserId: user.Id, CreatedAt: now, Email: "user1c@example.com", ExpiresAt: now.Add(-10 * time.Minute), Code: "12345678"},
+			// 和请求 1 的邮箱相同，请求 1 验证成功后也会被删除
+			{Id: "3", UserId: user.Id, CreatedAt: now, Email: "user1b@example.com", ExpiresAt: now.Add(10 * time.Minute), Code: "87654321"},
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
-		if err != nil {
-			t.Fatal(err)
+		for i := range updateRequests {
+			err = insertEmailUpdateRequest(db, context.Background(), &updateRequests[i])
+			if err != nil {
+				t.Fatal(err)
+			}
 		}
 
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("GET", "/email-update-requests/3", nil)
+		// 请求不存在
+		r := httptest.NewRequest("POST", "/email-update-requests/4/verify", strings.NewReader(`{"code":"12345678"}`))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assert.Equal(t, 404, res.StatusCode)
 
-		r = httptest.NewRequest("GET", "/email-update-requests/2", nil)
+		// 请求已过期，并且会被删除
+		r = httptest.NewRequest("POST", "/email-update-requests/2/verify", strings.NewReader(`{"code":"12345678"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
+		_, err = getEmailUpdateRequest(db, context.Background(), "2")
+		assert.ErrorIs(t, err, ErrRecordNotFound)
 
-		r = httptest.NewRequest("GET", "/email-update-requests/1", nil)
+		// 缺少验证码
+		r = httptest.NewRequest("POST", "/email-update-requests/1/verify", strings.NewReader(`{}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 验证码错误
+		r = httptest.NewRequest("POST", "/email-update-requests/1/verify", strings.NewReader(`{"code":"87654321"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+		// 验证码正确，返回新邮箱，并删除同一邮箱的所有更改请求
+		r = httptest.NewRequest("POST", "/email-update-requests/1/verify", strings.NewReader(`{"code":"1234 5678"}`))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
@@ -1440,63 +4753,192 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var result EmailUpdateRequestJSON
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			t.Fatal(err)
-		}
-		var expected EmailUpdateRequestJSON
-		err = json.Unmarshal([]byte(updateRequest1.EncodeToJSON()), &expected)
+		assert.JSONEq(t, encodeEmailToJSON("user1b@example.com"), string(body))
+		_, err = getEmailUpdateRequest(db, context.Background(), "1")
+		assert.ErrorIs(t, err, ErrRecordNotFound)
+		_, err = getEmailUpdateRequest(db, context.Background(), "3")
+		assert.ErrorIs(t, err, ErrRecordNotFound)
+		count, err := getAuditLogCount(db, context.Background(), auditLogFilter{UserId: user.Id, Action: AuditActionEmailUpdate})
 		if err != nil {
 			t.Fatal(err)
 		}
-		assert.Equal(t, expected, result)
+		assert.Equal(t, 1, count)
+
+		// 已经使用过的请求不能再次验证
+		r = httptest.NewRequest("POST", "/email-update-requests/1/verify", strings.NewReader(`{"code":"12345678"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assert.Equal(t, 404, res.StatusCode)
 	})
 
-	t.Run("delete /email-update-requests/requestid", func(t *testing.T) {
+	t.Run("post /users/userid/password-reset-requests", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "DELETE", "/email-update-requests/1")
+		testAuthentication(t, "POST", "/users/1/password-reset-requests")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user := User{
+		user1 := User{
 			Id:             "1",
 			CreatedAt:      now,
 			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user)
+		err := insertUser(db, context.Background(), &user1)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		updateRequest1 := EmailUpdateRequest{
-			Id:        "1",
-			UserId:    user.Id,
-			CreatedAt: now,
-			Email:     "user1b@example.com",
-			ExpiresAt: now.Add(10 * time.Minute),
-			Code:      "12345678",
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("POST", "/users/2/password-reset-requests", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", strings.NewReader((`{}`)))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", strings.NewReader(`{"client_ip":"0.0.0.0"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", strings.NewReader(`{"client_ip":`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorMalformedJSON)
+
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", strings.NewReader(`{"client_ip":1}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorInvalidData)
+
+		// 生成 ID 失败时返回 500，而不是创建一个没有 ID 的请求
+		env.IDGenerator = func() (string, error) {
+			return "", errors.New("failed to generate id")
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
-		if err != nil {
-			t.Fatal(err)
+		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+	})
+
+	t.Run("code delivery rate limit", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2", "3", "4"} {
+			user := User{
+				Id:             userId,
+				CreatedAt:      now,
+				PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
 		}
 
-		updateRequest2 := EmailUpdateRequest{
-			Id:        "2",
-			UserId:    user.Id,
-			CreatedAt: now,
-			Email:     "user1c@example.com",
-			ExpiresAt: now.Add(-10 * time.Minute),
-			Code:      "12345678",
+		env := createEnvironment(db, nil)
+		env.codeDeliveryRateLimit = newCodeDeliveryRateLimit(2, 2, time.Hour)
+		app := CreateApp(env)
+
+		createCode := func(path string, clientIP string) *http.Response {
+			body := fmt.Sprintf(`{"client_ip":%q}`, clientIP)
+			r := httptest.NewRequest("POST", path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
+
+		// 用户的令牌用完之后换一个新的 IP 也会被限制，两个端点的用户令牌分开计数
+		res := createCode("/users/1/email-verification-request", "1.1.1.1")
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+		res = createCode("/users/1/password-reset-requests", "2.2.2.2")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		res = createCode("/users/1/password-reset-requests", "3.3.3.3")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		res = createCode("/users/1/password-reset-requests", "8.8.8.8")
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+		res = createCode("/users/1/email-verification-request", "8.8.8.8")
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+		res = createCode("/users/1/email-verification-request", "9.9.9.9")
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+
+		// 同一个 IP 的令牌用完之后，给新的用户发送验证码也会被限制
+		res = createCode("/users/2/password-reset-requests", "4.4.4.4")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		res = createCode("/users/3/email-verification-request", "4.4.4.4")
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+		res = createCode("/users/4/password-reset-requests", "4.4.4.4")
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+		res = createCode("/users/4/email-verification-request", "4.4.4.4")
+		assertErrorResponse(t, res, 429, ExpectedErrorTooManyRequests)
+
+		// IP 被限制时不会消耗用户的令牌
+		res = createCode("/users/4/password-reset-requests", "5.5.5.5")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		res = createCode("/users/4/email-verification-request", "6.6.6.6")
+		assertJSONResponse(t, res, userEmailVerificationRequestJSONKeys)
+
+		// 生成失败时退还令牌
+		env.IDGenerator = func() (string, error) {
+			return "", errors.New("failed to generate id")
+		}
+		res = createCode("/users/2/password-reset-requests", "7.7.7.7")
+		assertErrorResponse(t, res, 500, "UNKNOWN_ERROR")
+		env.IDGenerator = nil
+		res = createCode("/users/2/password-reset-requests", "7.7.7.7")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+	})
+
+	t.Run("password reset requires verified email", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		// 用户 1 的邮箱已验证，用户 2 的邮箱没有验证
+		now := time.Unix(time.Now().Unix(), 0)
+		for _, userId := range []string{"1", "2"} {
+			user := User{
+				Id:             userId,
+				CreatedAt:      now,
+				PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+				RecoveryCode:   "12345678",
+				TOTPRegistered: false,
+			}
+			err := insertUser(db, context.Background(), &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := setUserEmailVerified(db, context.Background(), "1")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1504,29 +4946,28 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("DELETE", "/email-update-requests/3", nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res := w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		createPasswordResetRequest := func(userId string) *http.Response {
+			r := httptest.NewRequest("POST", "/users/"+userId+"/password-reset-requests", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
 
-		r = httptest.NewRequest("DELETE", "/email-update-requests/2", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		// 默认不检查邮箱是否已验证
+		res := createPasswordResetRequest("2")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
 
-		r = httptest.NewRequest("DELETE", "/email-update-requests/1", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assert.Equal(t, 204, res.StatusCode)
+		env.requireVerifiedEmailForPasswordReset = true
+		res = createPasswordResetRequest("1")
+		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		res = createPasswordResetRequest("2")
+		assertErrorResponse(t, res, 400, ExpectedErrorEmailNotVerified)
 	})
 
-	t.Run("post /verify-new-email", func(t *testing.T) {
+	t.Run("get /password-reset-requests/requestid", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/verify-new-email")
+		testAuthentication(t, "POST", "/password-reset-requests/1")
 
 		db := initializeTestDB(t)
 		defer db.Close()
@@ -1536,7 +4977,7 @@ func TestEndpointResponses(t *testing.T) {
 		user := User{
 			Id:             "1",
 			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			PasswordHash:   "HASH",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
@@ -1545,28 +4986,26 @@ func TestEndpointResponses(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		updateRequest1 := EmailUpdateRequest{
+		resetRequest1 := PasswordResetRequest{
 			Id:        "1",
 			UserId:    user.Id,
 			CreatedAt: now,
-			Email:     "user1b@example.com",
 			ExpiresAt: now.Add(10 * time.Minute),
-			Code:      "12345678",
+			CodeHash:  "HASH",
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest1)
+		err = insertPasswordResetRequest(db, context.Background(), &resetRequest1)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		updateRequest2 := EmailUpdateRequest{
+		resetRequest2 := PasswordResetRequest{
 			Id:        "2",
 			UserId:    user.Id,
 			CreatedAt: now,
-			Email:     "user1c@example.com",
 			ExpiresAt: now.Add(-10 * time.Minute),
-			Code:      "12345678",
+			CodeHash:  "HASH",
 		}
-		err = insertEmailUpdateRequest(db, context.Background(), &updateRequest2)
+		err = insertPasswordResetRequest(db, context.Background(), &resetRequest2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1574,29 +5013,20 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		data := `{"request_id":"3","code":"123445678"}`
-		r := httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
+		r := httptest.NewRequest("GET", "/password-reset-requests/3", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidRequest)
-
-		data = `{"request_id":"2","code":"123445678"}`
-		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidRequest)
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		data = `{"request_id":"1","code":"87654321"}`
-		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
+		// 已过期的请求
+		r = httptest.NewRequest("GET", "/password-reset-requests/2", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		data = `{"request_id":"1","code":"12345678"}`
-		r = httptest.NewRequest("POST", "/verify-new-email", strings.NewReader(data))
+		r = httptest.NewRequest("GET", "/password-reset-requests/1", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
@@ -1605,67 +5035,100 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var result EmailJSON
+		var result PasswordResetRequestJSON
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Fatal(err)
 		}
-		var expected EmailJSON
-		err = json.Unmarshal([]byte(encodeEmailToJSON(updateRequest1.Email)), &expected)
+		var expected PasswordResetRequestJSON
+		err = json.Unmarshal([]byte(resetRequest1.EncodeToJSON(timeFormatUnix)), &expected)
 		if err != nil {
 			t.Fatal(err)
 		}
 		assert.Equal(t, expected, result)
 	})
 
-	t.Run("post /users/userid/password-reset-requests", func(t *testing.T) {
+	t.Run("post /password-reset-requests/requestid/extend", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/users/1/password-reset-requests")
+		testAuthentication(t, "POST", "/password-reset-requests/1/extend")
 
 		db := initializeTestDB(t)
 		defer db.Close()
 
 		now := time.Unix(time.Now().Unix(), 0)
 
-		user1 := User{
+		user := User{
 			Id:             "1",
 			CreatedAt:      now,
-			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			PasswordHash:   "HASH",
 			RecoveryCode:   "12345678",
 			TOTPRegistered: false,
 		}
-		err := insertUser(db, context.Background(), &user1)
+		err := insertUser(db, context.Background(), &user)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		resetRequests := []PasswordResetRequest{
+			{Id: "1", UserId: user.Id, CreatedAt: now, ExpiresAt: now.Add(10 * time.Minute), CodeHash: "HASH"},
+			{Id: "2", UserId: user.Id, CreatedAt: now.Add(-20 * time.Minute), ExpiresAt: now.Add(-10 * time.Minute), CodeHash: "HASH"},
+		}
+		for i := range resetRequests {
+			err = insertPasswordResetRequest(db, context.Background(), &resetRequests[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 每次延长 5 分钟，总有效期最多 20 分钟
 		env := createEnvironment(db, nil)
+		env.passwordResetRequestExtension = 5 * time.Minute
+		env.passwordResetRequestMaxLifetime = 20 * time.Minute
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("POST", "/users/2/password-reset-requests", nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res := w.Result()
+		extend := func(requestId string) *http.Response {
+			r := httptest.NewRequest("POST", "/password-reset-requests/"+requestId+"/extend", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			return w.Result()
+		}
+
+		res := extend("3")
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", nil)
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		// 已过期的请求不能延长
+		res = extend("2")
+		assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
 
-		r = httptest.NewRequest("POST", "/users/1/password-reset-requests", strings.NewReader((`{}`)))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertJSONResponse(t, res, passwordResetRequestWithCodeJSONKeys)
+		// 延长后返回新的过期时间，数据库中的过期时间也被更新
+		for _, expected := range []time.Time{now.Add(15 * time.Minute), now.Add(20 * time.Minute)} {
+			res = extend("1")
+			assert.Equal(t, 200, res.StatusCode)
+			var result PasswordResetRequestJSON
+			err = json.NewDecoder(res.Body).Decode(&result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "1", result.Id)
+			assert.Equal(t, expected.Unix(), result.ExpiresAtUnix)
+			resetRequest, err := getPasswordResetRequest(db, context.Background(), "1")
+			assert.NoError(t, err)
+			assert.Equal(t, expected, resetRequest.ExpiresAt)
+		}
+
+		// 超过最长总有效期时拒绝，过期时间不变
+		res = extend("1")
+		assertErrorResponse(t, res, 400, ExpectedErrorExtensionLimitReached)
+		resetRequest, err := getPasswordResetRequest(db, context.Background(), "1")
+		assert.NoError(t, err)
+		assert.Equal(t, now.Add(20*time.Minute), resetRequest.ExpiresAt)
 	})
 
-	t.Run("get /password-reset-requests/requestid", func(t *testing.T) {
+	t.Run("get /password-reset-requests/requestid/user", func(t *testing.T) {
 		t.Parallel()
 
-		testAuthentication(t, "POST", "/password-reset-requests/1")
+		testAuthentication(t, "GET", "/password-reset-requests/1/user")
 
 		db := initializeTestDB(t)
 		defer db.Close()
@@ -1711,19 +5174,22 @@ func TestEndpointResponses(t *testing.T) {
 		env := createEnvironment(db, nil)
 		app := CreateApp(env)
 
-		r := httptest.NewRequest("GET", "/password-reset-requests/3", nil)
+		r := httptest.NewRequest("GET", "/password-reset-requests/3/user", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
-		r = httptest.NewRequest("GET", "/password-reset-requests/2", nil)
+		// 已过期的请求返回 404 并被删除
+		r = httptest.NewRequest("GET", "/password-reset-requests/2/user", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		_, err = getPasswordResetRequest(db, context.Background(), resetRequest2.Id)
+		assert.ErrorIs(t, err, ErrRecordNotFound)
 
-		r = httptest.NewRequest("GET", "/password-reset-requests/1", nil)
+		r = httptest.NewRequest("GET", "/password-reset-requests/1/user", nil)
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
@@ -1732,13 +5198,13 @@ func TestEndpointResponses(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var result PasswordResetRequestJSON
+		var result UserJSON
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Fatal(err)
 		}
-		var expected PasswordResetRequestJSON
-		err = json.Unmarshal([]byte(resetRequest1.EncodeToJSON()), &expected)
+		var expected UserJSON
+		err = json.Unmarshal([]byte(user.EncodeToJSON()), &expected)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1908,7 +5374,7 @@ func TestEndpointResponses(t *testing.T) {
 		}
 
 		var expected1 PasswordResetRequestJSON
-		err = json.Unmarshal([]byte(resetRequest1.EncodeToJSON()), &expected1)
+		err = json.Unmarshal([]byte(resetRequest1.EncodeToJSON(timeFormatUnix)), &expected1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2021,12 +5487,13 @@ func TestEndpointResponses(t *testing.T) {
 		res := w.Result()
 		assertErrorResponse(t, res, 404, "NOT_FOUND")
 
+		// 已过期的请求
 		data = `{"code":"123445678"}`
 		r = httptest.NewRequest("POST", "/password-reset-requests/2/verify-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
 		res = w.Result()
-		assertErrorResponse(t, res, 404, "NOT_FOUND")
+		assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
 
 		data = `{"code":"87654321"}`
 		r = httptest.NewRequest("POST", "/password-reset-requests/1/verify-email", strings.NewReader(data))
@@ -2035,7 +5502,8 @@ func TestEndpointResponses(t *testing.T) {
 		res = w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
 
-		data = `{"code":"12345678"}`
+		// 验证码前后和中间的空白字符会被去掉
+		data = `{"code":"\t1234 5678 "}`
 		r = httptest.NewRequest("POST", "/password-reset-requests/1/verify-email", strings.NewReader(data))
 		w = httptest.NewRecorder()
 		app.ServeHTTP(w, r)
@@ -2043,6 +5511,57 @@ func TestEndpointResponses(t *testing.T) {
 		assert.Equal(t, 204, res.StatusCode)
 	})
 
+	t.Run("password reset code format", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		user := User{
+			Id:             "1",
+			CreatedAt:      time.Unix(time.Now().Unix(), 0),
+			PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		// 按照配置的格式生成的验证码都可以通过验证
+		for _, format := range []codeFormat{{numeric: true, length: 6}, {length: 12}} {
+			env.passwordResetCodeFormat = format
+
+			r := httptest.NewRequest("POST", "/users/1/password-reset-requests", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res := w.Result()
+			assert.Equal(t, 200, res.StatusCode)
+			var resetRequest struct {
+				Id   string `json:"id"`
+				Code string `json:"code"`
+			}
+			err = json.NewDecoder(res.Body).Decode(&resetRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, resetRequest.Code, format.length)
+			if format.numeric {
+				assert.Regexp(t, "^[0-9]+$", resetRequest.Code)
+			}
+
+			data := fmt.Sprintf(`{"code":%q}`, resetRequest.Code)
+			r = httptest.NewRequest("POST", "/password-reset-requests/"+resetRequest.Id+"/verify-email", strings.NewReader(data))
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assert.Equal(t, 204, w.Result().StatusCode)
+		}
+	})
+
 	t.Run("/reset-password", func(t *testing.T) {
 		t.Parallel()
 
@@ -2099,12 +5618,17 @@ func TestEndpointResponses(t *testing.T) {
 		res := w.Result()
 		assertErrorResponse(t, res, 400, ExpectedErrorInvalidRequest)
 
-		data = `{"request_id":"2","password":"123445678"}`
-		r = httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
-		w = httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		res = w.Result()
-		assertErrorResponse(t, res, 400, ExpectedErrorInvalidRequest)
+		// 已过期的请求不会被删除，再次提交仍然返回 ExpectedErrorExpiredRequest
+		for i := 0; i < 2; i++ {
+			data = `{"request_id":"2","password":"123445678"}`
+			r = httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			res = w.Result()
+			assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
+		}
+		_, err = getPasswordResetRequest(db, context.Background(), "2")
+		assert.NoError(t, err)
 
 		data = `{"request_id":"1","password":"123445678"}`
 		r = httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
@@ -2120,6 +5644,122 @@ func TestEndpointResponses(t *testing.T) {
 		res = w.Result()
 		assert.Equal(t, 204, res.StatusCode)
 	})
+
+	t.Run("expired password reset request delete failure", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+
+		user := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "HASH",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resetRequest := PasswordResetRequest{
+			Id:        "1",
+			UserId:    user.Id,
+			CreatedAt: now.Add(-20 * time.Minute),
+			ExpiresAt: now.Add(-10 * time.Minute),
+			CodeHash:  "HASH",
+		}
+		err = insertPasswordResetRequest(db, context.Background(), &resetRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 让删除过期请求失败：之前部分端点在这种情况下返回 500，而不是按过期处理
+		_, err = db.Exec("CREATE TRIGGER fail_password_reset_request_delete BEFORE DELETE ON password_reset_request BEGIN SELECT RAISE(ABORT, 'delete failed'); END")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("GET", "/password-reset-requests/1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		r = httptest.NewRequest("DELETE", "/password-reset-requests/1", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 404, "NOT_FOUND")
+
+		data := `{"request_id":"1","password":"super_secure_password"}`
+		r = httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorExpiredRequest)
+	})
+
+	t.Run("/reset-password passwordless user", func(t *testing.T) {
+		t.Parallel()
+
+		db := initializeTestDB(t)
+		defer db.Close()
+
+		now := time.Unix(time.Now().Unix(), 0)
+
+		user := User{
+			Id:             "1",
+			CreatedAt:      now,
+			PasswordHash:   "",
+			RecoveryCode:   "12345678",
+			TOTPRegistered: false,
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env := createEnvironment(db, nil)
+		app := CreateApp(env)
+
+		// 不能为没有密码的用户创建密码重置请求
+		r := httptest.NewRequest("POST", "/users/1/password-reset-requests", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorPasswordNotSet)
+
+		// 已经存在的请求也不能用来设置密码
+		resetRequest := PasswordResetRequest{
+			Id:        "1",
+			UserId:    user.Id,
+			CreatedAt: now,
+			ExpiresAt: now.Add(10 * time.Minute),
+			CodeHash:  "HASH",
+		}
+		err = insertPasswordResetRequest(db, context.Background(), &resetRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := `{"request_id":"1","password":"super_secure_password"}`
+		r = httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res = w.Result()
+		assertErrorResponse(t, res, 400, ExpectedErrorPasswordNotSet)
+
+		updatedUser, err := getUser(db, context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", updatedUser.PasswordHash)
+	})
 }
 
 func TestApp(t *testing.T) {
@@ -2309,7 +5949,7 @@ func TestApp(t *testing.T) {
 	w = httptest.NewRecorder()
 	app.ServeHTTP(w, r)
 	res = w.Result()
-	assert.Equal(t, 204, res.StatusCode, "POST /users/[user_id]/verify-2fa/totp status code")
+	assert.Equal(t, 200, res.StatusCode, "POST /users/[user_id]/verify-2fa/totp status code")
 
 	// Reset 2FA credentials
 	url = fmt.Sprintf("/users/%s/reset-2fa", user.Id)
@@ -2398,12 +6038,47 @@ func assertJSONResponse(t *testing.T, res *http.Response, jsonKeys []string) {
 	}
 }
 
+// assertCreatedUserResponse 检查 POST /users 的响应：包含用户模型的所有字段，email_verified 为 false，
+// requires_verification 和 email_verification_request 是否存在取决于是否提供了邮箱。
+// 邮箱验证请求中应包含验证码。返回解码后的响应。
+func assertCreatedUserResponse(t *testing.T, res *http.Response, emailProvided bool) map[string]any {
+	assert.Equal(t, 200, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseData map[string]any
+	err = json.Unmarshal(body, &responseData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range userJSONKeys {
+		assert.Contains(t, responseData, key)
+	}
+	assert.Equal(t, false, responseData["email_verified"])
+	assert.Equal(t, emailProvided, responseData["requires_verification"])
+	if !emailProvided {
+		assert.NotContains(t, responseData, "email_verification_request")
+		return responseData
+	}
+	verificationRequestData, ok := responseData["email_verification_request"].(map[string]any)
+	if !assert.True(t, ok) {
+		t.FailNow()
+	}
+	assert.Equal(t, responseData["id"], verificationRequestData["user_id"])
+	assert.Contains(t, verificationRequestData, "code")
+	return responseData
+}
+
 var userJSONKeys = []string{"id", "created_at", "totp_registered", "recovery_code"}
 var userTOTPCredentialJSONKeys = []string{"user_id", "created_at", "key"}
+var totpCredentialAuditJSONKeys = []string{"id", "user_id", "created_at"}
 var recoveryCodeJSONKeys = []string{"recovery_code"}
 var userEmailVerificationRequestJSONKeys = []string{"user_id", "created_at", "expires_at", "code"}
 var emailUpdateRequestJSONKeys = []string{"id", "user_id", "created_at", "email", "expires_at", "code"}
 var passwordResetRequestWithCodeJSONKeys = []string{"id", "user_id", "created_at", "expires_at", "code"}
+var stepUpTokenJSONKeys = []string{"step_up_token", "expires_at"}
+var verifiedStepUpTokenJSONKeys = []string{"user_id", "expires_at"}
 
 func testAuthentication(t *testing.T, method string, url string) {
 	env := createEnvironment(nil, []byte("hello"))
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// When env.requireInvite is set, POST /users only creates a user if the request includes
+// an unused invite code minted with POST /invites, e.g. for a closed beta. Each code can
+// create a single user. Only the SHA-256 hash of a code is stored, so a code is only
+// available in the response of POST /invites.
+//
+// An invite is claimed (marked as used) before the password is hashed, so concurrent
+// requests can't both use it, and released again if the user ends up not being created.
+
+// ExpectedErrorInvalidInvite means the invite code is missing, doesn't exist, or has
+// already been used.
+const ExpectedErrorInvalidInvite = "INVALID_INVITE"
+
+// inviteCodeFormat is the format of invite codes: 16 alphanumeric characters (80 bits),
+// since invites don't expire and aren't rate limited per code.
+var inviteCodeFormat = codeFormat{length: 16}
+
+// Invite is a row of the invite table. Code is only set when the invite is created.
+type Invite struct {
+	Id        string
+	CreatedAt time.Time
+	Code      string
+}
+
+// EncodeToJSON encodes the invite as returned by POST /invites, including its code.
+func (i *Invite) EncodeToJSON(format timeFormat) string {
+	encoded, err := json.Marshal(struct {
+		Id        string   `json:"id"`
+		CreatedAt UnixTime `json:"created_at"`
+		Code      string   `json:"code"`
+	}{i.Id, newUnixTime(i.CreatedAt, format), i.Code})
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// handleCreateInviteRequest handles POST /invites.
+// It mints a single-use invite code for POST /users. Invites can be created whether or
+// not env.requireInvite is set, so codes can be handed out before invite mode is turned on.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Accept Header Verification (JSON).
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleCreateInviteRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	invite, err := createInvite(env.db, r.Context(), env.generateId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(invite.EncodeToJSON(requestTimeFormat(env, r))))
+}
+
+// hashInviteCode returns the hex-encoded SHA-256 hash of an invite code, as stored in
+// the invite table. Codes have enough entropy that a slow hash isn't needed.
+func hashInviteCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// createInvite generates an invite code and inserts the invite.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   generateId (func() (string, error)): Generates the invite ID, usually env.generateId.
+//
+// Returns:
+//   Invite: The created invite, including its code.
+//   error: An error if generating the code or ID, or inserting the invite, failed.
+func createInvite(db *sql.DB, ctx context.Context, generateId func() (string, error)) (Invite, error) {
+	code, err := inviteCodeFormat.generate()
+	if err != nil {
+		return Invite{}, err
+	}
+	invite := Invite{
+		CreatedAt: time.Unix(time.Now().Unix(), 0),
+		Code:      code,
+	}
+	inviteId, err := insertWithGeneratedId(generateId, func(id string) error {
+		_, err := db.ExecContext(ctx, "INSERT INTO invite (id, code_hash, created_at) VALUES (?, ?, ?)", id, hashInviteCode(code), invite.CreatedAt.Unix())
+		return err
+	})
+	if err != nil {
+		return Invite{}, fmt.Errorf("failed to insert invite: %w", err)
+	}
+	invite.Id = inviteId
+	return invite, nil
+}
+
+// claimInvite marks an unused invite as used. Only one request can claim an invite.
+// The invite must be released with releaseInvite if the user isn't created. createUser
+// assigns it to the new user with setInviteUser.
+//
+// Returns:
+//   string: The ID of the claimed invite.
+//   error: ErrRecordNotFound if no unused invite has the code, or a database error.
+func claimInvite(db *sql.DB, ctx context.Context, code string) (string, error) {
+	var inviteId string
+	err := db.QueryRowContext(ctx, "UPDATE invite SET used_at = ? WHERE code_hash = ? AND used_at IS NULL RETURNING id", time.Now().Unix(), hashInviteCode(code)).Scan(&inviteId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrRecordNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return inviteId, nil
+}
+
+// releaseInvite makes a claimed invite usable again. An invite assigned to a user is only
+// released if the user no longer exists, i.e. the user was deleted again because
+// env.afterUserCreate failed (see runAfterUserCreateHook).
+func releaseInvite(db *sql.DB, ctx context.Context, inviteId string) error {
+	_, err := db.ExecContext(ctx, "UPDATE invite SET used_at = NULL, user_id = NULL WHERE id = ? AND (user_id IS NULL OR user_id NOT IN (SELECT id FROM user))", inviteId)
+	return err
+}
+
+// setInviteUser records the user that was created with a claimed invite, in the
+// transaction that inserts the user (see createUser).
+func setInviteUser(tx *sql.Tx, ctx context.Context, inviteId string, userId string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE invite SET user_id = ? WHERE id = ?", userId, inviteId)
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"         // 导入 bytes 包，用于缓冲每个记录的编码结果
+	"encoding/json" // 导入 JSON 编码包
+	"io"            // 导入 io 包
+)
+
+// jsonArrayWriter 把列表端点的记录逐个编码为 JSON 数组写入响应，不需要先拼接整个数组。
+// 每个记录由 json.Encoder 编码 (字符串会被正确转义)，方括号和逗号由 jsonArrayWriter 负责。
+// 用法:
+//
+//	array := newJSONArrayWriter(w)
+//	for _, entry := range entries {
+//		array.Write(entry.jsonValue())
+//	}
+//	array.Close()
+//
+// 写入失败后 Write 和 Close 不再写入任何内容，并返回第一个错误。
+type jsonArrayWriter struct {
+	w       io.Writer
+	buf     bytes.Buffer
+	encoder *json.Encoder
+	count   int   // 已经写入的记录个数
+	err     error // 第一个编码或写入错误
+}
+
+// newJSONArrayWriter 创建一个写入 w 的 jsonArrayWriter。
+func newJSONArrayWriter(w io.Writer) *jsonArrayWriter {
+	array := &jsonArrayWriter{w: w}
+	array.encoder = json.NewEncoder(&array.buf)
+	return array
+}
+
+// Write 编码一个记录并写入数组。第一个记录前写入 "["，之后的记录前写入 ","。
+// 编码失败时不写入任何内容。
+func (a *jsonArrayWriter) Write(v any) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.buf.Reset()
+	if a.count == 0 {
+		a.buf.WriteByte('[')
+	} else {
+		a.buf.WriteByte(',')
+	}
+	a.err = a.encoder.Encode(v)
+	if a.err != nil {
+		return a.err
+	}
+	// json.Encoder 在每个值后面加一个换行符，去掉它让输出和 json.Marshal 相同
+	encoded := bytes.TrimSuffix(a.buf.Bytes(), []byte("\n"))
+	_, a.err = a.w.Write(encoded)
+	a.count++
+	return a.err
+}
+
+// Close 结束数组。没有写入任何记录时写入 "[]"。
+func (a *jsonArrayWriter) Close() error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.count == 0 {
+		_, a.err = a.w.Write([]byte("[]"))
+	} else {
+		_, a.err = a.w.Write([]byte("]"))
+	}
+	return a.err
+}
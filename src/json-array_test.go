@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"         // 导入 bytes 包
+	"encoding/json" // 导入 JSON 编码包
+	"errors"        // 导入错误包
+	"testing"       // 导入 Go 的测试包
+	"time"          // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestJSONArrayWriter 测试 jsonArrayWriter 在没有记录、一个记录和多个记录时都输出有效的 JSON 数组，
+// 并且字符串中的特殊字符被正确转义 (和 json.Marshal 一样转义 HTML 字符)。
+func TestJSONArrayWriter(t *testing.T) {
+	t.Parallel()
+
+	entries := []AuditLogEntry{
+		{Id: 1, CreatedAt: time.Unix(100, 0), Actor: "actor", Action: AuditActionUserDelete, UserId: "1", ClientIP: "1.1.1.1"},
+		{Id: 2, CreatedAt: time.Unix(200, 0), Actor: "a\"b\\c", Action: AuditActionPasswordReset, UserId: "<2>\n", ClientIP: "&"},
+		{Id: 3, CreatedAt: time.Unix(300, 0), Actor: "用户", Action: AuditActionEmailUpdate, UserId: "\u0000", ClientIP: ""},
+	}
+	testCases := []struct {
+		Entries  []AuditLogEntry
+		Expected string
+	}{
+		{nil, `[]`},
+		{entries[:1], `[{"id":1,"created_at":100,"actor":"actor","action":"user.delete","user_id":"1","client_ip":"1.1.1.1"}]`},
+		{entries, `[{"id":1,"created_at":100,"actor":"actor","action":"user.delete","user_id":"1","client_ip":"1.1.1.1"},` +
+			`{"id":2,"created_at":200,"actor":"a\"b\\c","action":"user.password.reset","user_id":"\u003c2\u003e\n","client_ip":"\u0026"},` +
+			`{"id":3,"created_at":300,"actor":"用户","action":"user.email.update","user_id":"\u0000","client_ip":""}]`},
+	}
+	for _, testCase := range testCases {
+		var buf bytes.Buffer
+		array := newJSONArrayWriter(&buf)
+		for _, entry := range testCase.Entries {
+			assert.NoError(t, array.Write(entry.jsonValue(timeFormatUnix)))
+		}
+		assert.NoError(t, array.Close())
+		assert.True(t, json.Valid(buf.Bytes()), buf.String())
+		assert.Equal(t, testCase.Expected, buf.String())
+
+		var decoded []auditLogEntryJSON
+		err := json.Unmarshal(buf.Bytes(), &decoded)
+		assert.NoError(t, err)
+		if assert.Len(t, decoded, len(testCase.Entries)) {
+			for i, entry := range testCase.Entries {
+				assert.Equal(t, entry.jsonValue(timeFormatUnix), decoded[i])
+				// 和单个记录的编码相同
+				assert.Contains(t, buf.String(), entry.EncodeToJSON(timeFormatUnix))
+			}
+		}
+	}
+}
+
+// TestJSONArrayWriterError 测试编码失败后不再写入任何内容，并返回第一个错误。
+func TestJSONArrayWriterError(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	array := newJSONArrayWriter(&buf)
+	assert.NoError(t, array.Write(map[string]int{"a": 1}))
+	err := array.Write(func() {})
+	assert.Error(t, err)
+	assert.Equal(t, err, array.Write(map[string]int{"b": 2}))
+	assert.Equal(t, err, array.Close())
+	assert.Equal(t, `[{"a":1}`, buf.String())
+
+	array = newJSONArrayWriter(failingWriter{})
+	assert.Error(t, array.Write(1))
+	assert.Error(t, array.Close())
+}
+
+// failingWriter 是每次写入都失败的 io.Writer。
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 列表端点默认返回 JSON 数组，分页信息在 X-Pagination-Total、X-Pagination-Total-Pages 和
+// X-Pagination-Per-Page 响应头中。部分客户端更喜欢把分页信息放在响应体中，所以可以通过 env.listEnvelope
+// 或者 Accept 请求头中 application/json 的 envelope 参数 (例如 "application/json; envelope=true")
+// 选择信封格式:
+//
+//	{"data": [...], "pagination": {"page": 1, "per_page": 20, "total": 42, "total_pages": 3}}
+//
+// 使用信封格式时不返回 X-Pagination-* 响应头，Link 头保持不变。
+// 这里不修改每个列表端点，而是由 withListEnvelope 改写带有 X-Pagination-Total 头的响应。
+
+// listEnvelopeParameter 是 Accept 头中选择信封格式的媒体类型参数。
+const listEnvelopeParameter = "envelope"
+
+// listEnvelope 是信封格式的响应体。
+type listEnvelope struct {
+	Data       json.RawMessage `json:"data"`
+	Pagination listPagination  `json:"pagination"`
+}
+
+// listPagination 是信封格式中的分页信息，和 X-Pagination-* 响应头的值相同。
+type listPagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// requestListEnvelope 返回请求是否使用信封格式：Accept 头中 application/json 的 envelope 参数
+// 是有效的布尔值 ("true" 或 "false") 时使用它，否则使用 env.listEnvelope。
+func requestListEnvelope(env *Environment, r *http.Request) bool {
+	accept, ok := r.Header["Accept"]
+	if !ok {
+		return env.listEnvelope
+	}
+	for _, entry := range strings.Split(accept[0], ",") { // 只处理第一个 Accept 值，和 verifyJSONAcceptHeader 相同
+		parts := strings.Split(entry, ";")
+		if strings.TrimSpace(parts[0]) != "application/json" {
+			continue
+		}
+		for _, parameter := range parts[1:] {
+			key, value, _ := strings.Cut(parameter, "=")
+			if !strings.EqualFold(strings.TrimSpace(key), listEnvelopeParameter) {
+				continue
+			}
+			enabled, err := strconv.ParseBool(strings.Trim(strings.TrimSpace(value), `"`))
+			if err == nil {
+				return enabled
+			}
+		}
+	}
+	return env.listEnvelope
+}
+
+// withListEnvelope 包装应用的 handler，请求使用信封格式时缓存分页列表的响应，
+// 把数组和分页信息写入信封后再写入。不使用信封格式时直接调用 handler。
+// 参数：
+//   env *Environment: 应用环境，包含默认的 listEnvelope。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+func withListEnvelope(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requestListEnvelope(env, r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		_, page := parsePaginationQuery(r.URL.Query(), env.paginationPerPageLimit())
+		writer := &listEnvelopeResponseWriter{ResponseWriter: w, page: page}
+		handler.ServeHTTP(writer, r)
+		writer.flush()
+	})
+}
+
+// listEnvelopeResponseWriter 缓存带有 X-Pagination-Total 头的 200 JSON 响应，在 flush 中写入信封。
+// 其他响应直接写入。见 withListEnvelope。
+type listEnvelopeResponseWriter struct {
+	http.ResponseWriter
+	page        int // 请求的页码 (已经过规范化)
+	wroteHeader bool
+	buffering   bool // 响应是分页列表，响应头和响应体在 flush 中写入
+	body        bytes.Buffer
+}
+
+func (w *listEnvelopeResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if statusCode == http.StatusOK && strings.HasPrefix(header.Get("Content-Type"), "application/json") && header.Get("X-Pagination-Total") != "" {
+		w.buffering = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *listEnvelopeResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// flush 写入缓存的分页列表。响应体不是 JSON 数组或者分页头无效时，原样写入响应头和响应体。
+func (w *listEnvelopeResponseWriter) flush() {
+	if !w.buffering {
+		return
+	}
+	body := w.body.Bytes()
+	if encoded, ok := w.encodeEnvelope(body); ok {
+		header := w.Header()
+		header.Del("X-Pagination-Total")
+		header.Del("X-Pagination-Total-Pages")
+		header.Del("X-Pagination-Per-Page")
+		body = encoded
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	w.ResponseWriter.Write(body)
+}
+
+// encodeEnvelope 把数组 body 和分页头编码为信封格式。第二个返回值表示是否成功。
+func (w *listEnvelopeResponseWriter) encodeEnvelope(body []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' || !json.Valid(trimmed) {
+		return nil, false
+	}
+	header := w.Header()
+	pagination := listPagination{Page: w.page}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"X-Pagination-Total", &pagination.Total},
+		{"X-Pagination-Total-Pages", &pagination.TotalPages},
+		{"X-Pagination-Per-Page", &pagination.PerPage},
+	} {
+		value, err := strconv.Atoi(header.Get(field.name))
+		if err != nil {
+			return nil, false
+		}
+		*field.value = value
+	}
+	encoded, err := json.Marshal(listEnvelope{Data: trimmed, Pagination: pagination})
+	if err != nil {
+		return nil, false
+	}
+	return encoded, true
+}
+
+// Unwrap 让 http.ResponseController 可以访问底层的 ResponseWriter。
+func (w *listEnvelopeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"           // 导入上下文包
+	"encoding/json"     // 导入 JSON 编码/解码包
+	"io"                // 导入 io 包
+	"net/http"          // 导入 HTTP 包
+	"net/http/httptest" // 导入 HTTP 测试包
+	"strconv"           // 导入字符串转换包
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestRequestListEnvelope 测试 Accept 头中的 envelope 参数优先于 env.listEnvelope，无效的值被忽略。
+func TestRequestListEnvelope(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Accept   string
+		Default  bool
+		Expected bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{"application/json", false, false},
+		{"application/json", true, true},
+		{"application/json; envelope=true", false, true},
+		{"application/json;envelope=1", false, true},
+		{`application/json; Envelope="true"`, false, true},
+		{"application/json; envelope=false", true, false},
+		{"application/json; envelope=yes", false, false},
+		{"application/json; envelope=yes", true, true},
+		{"text/plain; envelope=true, application/json", false, false},
+		{"*/*; envelope=true", false, false},
+		{"text/plain, application/json; q=0.9; envelope=true", false, true},
+	}
+	for _, testCase := range testCases {
+		env := createEnvironment(nil, nil)
+		env.listEnvelope = testCase.Default
+		r := httptest.NewRequest("GET", "/users", nil)
+		if testCase.Accept != "" {
+			r.Header.Set("Accept", testCase.Accept)
+		}
+		assert.Equal(t, testCase.Expected, requestListEnvelope(env, r), testCase.Accept)
+	}
+}
+
+// TestWithListEnvelope 测试信封格式只改写带有分页头的 200 JSON 数组响应，其他响应保持不变。
+func TestWithListEnvelope(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.listEnvelope = true
+	handler := withListEnvelope(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			w.Header().Set("X-Pagination-Total", "3")
+			w.Header().Set("X-Pagination-Total-Pages", "2")
+			w.Header().Set("X-Pagination-Per-Page", "2")
+			w.Header().Set("Link", `</list?page=1>; rel="first"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"3"}]`))
+		case "/object":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"1"}`))
+		case "/invalid":
+			w.Header().Set("X-Pagination-Total", "many")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[]`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"NOT_FOUND"}`))
+		}
+	}))
+	serve := func(target string) (*http.Response, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(body)
+	}
+
+	res, body := serve("/list?page=2&per_page=2")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, `{"data":[{"id":"3"}],"pagination":{"page":2,"per_page":2,"total":3,"total_pages":2}}`, body)
+	assert.Empty(t, res.Header.Get("X-Pagination-Total"))
+	assert.Empty(t, res.Header.Get("X-Pagination-Total-Pages"))
+	assert.Empty(t, res.Header.Get("X-Pagination-Per-Page"))
+	assert.Equal(t, `</list?page=1>; rel="first"`, res.Header.Get("Link"))
+
+	res, body = serve("/object")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, `{"id":"1"}`, body)
+
+	res, body = serve("/invalid")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, `[]`, body)
+	assert.Equal(t, "many", res.Header.Get("X-Pagination-Total"))
+
+	res, body = serve("/missing")
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, `{"error":"NOT_FOUND"}`, body)
+}
+
+// TestListEnvelopeGetUsers 测试 GET /users 默认返回数组和分页头，使用信封格式时返回相同的用户和分页信息。
+func TestListEnvelopeGetUsers(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	for i := 1; i <= 3; i++ {
+		user := User{
+			Id:           strconv.Itoa(i),
+			CreatedAt:    now.Add(time.Duration(i) * time.Second),
+			PasswordHash: "HASH",
+			RecoveryCode: "CODE",
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env := createEnvironment(db, nil)
+	app := CreateApp(env)
+	getUsers := func(accept string) *http.Response {
+		r := httptest.NewRequest("GET", "/users?per_page=2&page=2", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := getUsers("")
+	assert.Equal(t, 200, res.StatusCode)
+	var users []json.RawMessage
+	err := json.NewDecoder(res.Body).Decode(&users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, users, 1)
+	pagination := listPagination{Page: 2}
+	pagination.Total, _ = strconv.Atoi(res.Header.Get("X-Pagination-Total"))
+	pagination.TotalPages, _ = strconv.Atoi(res.Header.Get("X-Pagination-Total-Pages"))
+	pagination.PerPage, _ = strconv.Atoi(res.Header.Get("X-Pagination-Per-Page"))
+	assert.Equal(t, listPagination{Page: 2, PerPage: 2, Total: 3, TotalPages: 2}, pagination)
+
+	for _, enable := range []func(){
+		func() {}, // Accept 参数
+		func() { env.listEnvelope = true },
+	} {
+		enable()
+		accept := "application/json; envelope=true"
+		if env.listEnvelope {
+			accept = ""
+		}
+		res = getUsers(accept)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Empty(t, res.Header.Get("X-Pagination-Total"))
+		var envelope struct {
+			Data       []json.RawMessage `json:"data"`
+			Pagination listPagination    `json:"pagination"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, users, envelope.Data)
+		assert.Equal(t, pagination, envelope.Pagination)
+	}
+}
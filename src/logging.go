@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"   // 导入 HMAC 包，用于对 IP 地址做带密钥的哈希
+	"crypto/sha256" // 导入 SHA-256，作为 HMAC 的哈希函数
+	"encoding/hex"  // 导入十六进制编码包
+	"log"           // 导入日志包
+	"net/netip"     // 导入 IP 地址解析包，用于截断 IP 地址
+	"strconv"       // 导入字符串转换包，用于给字段值加引号
+	"strings"       // 导入字符串包
+)
+
+// 日志中的邮箱地址和客户端 IP 属于个人信息。为了隐私和合规，
+// 它们只能通过 logEmailField / logIPField 写入日志，由 env.logEvent 根据配置统一脱敏，
+// 各个 handler 不需要自己决定怎么处理。
+//
+// 默认脱敏，原样记录需要明确开启。相关的 Environment 配置：
+//   - env.logRawEmails: 为 true 时原样记录邮箱地址，否则替换为 "u***@example.com" 的形式。
+//   - env.loggedIPMode: IP 地址的记录方式，见 LogIPMode。零值是 LogIPTruncate。
+//   - env.logger: 日志输出目标，未设置时使用 log.Default()。
+
+// LogIPMode 决定客户端 IP 地址在日志中的记录方式。
+type LogIPMode int
+
+const (
+	// LogIPTruncate 只记录 IP 地址所在的网段：IPv4 保留前 24 位，IPv6 保留前 48 位 (默认)。
+	LogIPTruncate LogIPMode = iota
+	// LogIPHash 记录 IP 地址的 HMAC-SHA256 哈希 (使用 env.tokenSigningKey())。
+	// 同一个 IP 的哈希值相同，所以仍然可以关联同一来源的多条日志。
+	LogIPHash
+	// LogIPRaw 原样记录 IP 地址。
+	LogIPRaw
+)
+
+// logFieldKind 表示日志字段的类型，决定 logEvent 如何脱敏。
+type logFieldKind int
+
+const (
+	logFieldString logFieldKind = iota
+	logFieldEmail
+	logFieldIP
+)
+
+// logField 是结构化日志中的一个 key=value 字段。
+type logField struct {
+	key   string
+	value string
+	kind  logFieldKind
+}
+
+// logStringField 创建一个普通的日志字段，值会原样记录。不要用它记录邮箱地址或 IP 地址。
+func logStringField(key string, value string) logField {
+	return logField{key: key, value: value, kind: logFieldString}
+}
+
+// logEmailField 创建一个邮箱地址字段，除非设置了 env.logRawEmails，否则脱敏。
+func logEmailField(key string, email string) logField {
+	return logField{key: key, value: email, kind: logFieldEmail}
+}
+
+// logIPField 创建一个客户端 IP 字段，根据 env.loggedIPMode 脱敏。
+func logIPField(key string, ip string) logField {
+	return logField{key: key, value: ip, kind: logFieldIP}
+}
+
+// logEvent 写入一条结构化日志，格式为 `message key="value" key="value"`。
+// 邮箱地址和 IP 字段在写入前按照 Environment 的配置统一脱敏。
+// 参数：
+//   message string: 日志消息。
+//   fields ...logField: 日志字段。
+func (env *Environment) logEvent(message string, fields ...logField) {
+	var builder strings.Builder
+	builder.WriteString(message)
+	for _, field := range fields {
+		value := field.value
+		switch field.kind {
+		case logFieldEmail:
+			if !env.logRawEmails {
+				value = maskEmailAddress(value)
+			}
+		case logFieldIP:
+			value = env.formatLoggedIP(value)
+		}
+		builder.WriteString(" ")
+		builder.WriteString(field.key)
+		builder.WriteString("=")
+		builder.WriteString(strconv.Quote(value))
+	}
+
+	logger := env.logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Println(builder.String())
+}
+
+// formatLoggedIP 按照 env.loggedIPMode 处理要写入日志的 IP 地址。
+func (env *Environment) formatLoggedIP(ip string) string {
+	switch env.loggedIPMode {
+	case LogIPRaw:
+		return ip
+	case LogIPHash:
+		mac := hmac.New(sha256.New, env.tokenSigningKey())
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	default:
+		return truncateIPAddress(ip)
+	}
+}
+
+// maskEmailAddress 只保留邮箱地址本地部分的第一个字符和完整的域名，
+// 例如 "user@example.com" 变成 "u***@example.com"。不是合法邮箱地址的值整个被替换为 "***"。
+func maskEmailAddress(email string) string {
+	atIndex := strings.LastIndex(email, "@")
+	if atIndex < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[atIndex:]
+}
+
+// truncateIPAddress 把 IP 地址截断到所在的网段，IPv4 保留前 24 位，IPv6 保留前 48 位，
+// 例如 "203.0.113.42" 变成 "203.0.113.0/24"。无法解析的值整个被替换为 "***"，以免原样泄露。
+func truncateIPAddress(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "***"
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "***"
+	}
+	return prefix.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"   // 导入 bytes 包，用于捕获日志输出
+	"log"     // 导入日志包
+	"testing" // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestLogEventMasking 测试默认脱敏：日志中只包含脱敏后的邮箱和 IP，从不出现原始值。
+// 只有明确开启时才原样记录。
+func TestLogEventMasking(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	env := createEnvironment(nil, []byte("secret"))
+	env.logger = log.New(&output, "", 0)
+
+	env.logEvent("event", logEmailField("email", "user@example.com"), logIPField("client_ip", "203.0.113.42"), logStringField("user_id", "1"))
+	assert.Equal(t, "event email=\"u***@example.com\" client_ip=\"203.0.113.0/24\" user_id=\"1\"\n", output.String())
+
+	// 哈希模式
+	output.Reset()
+	env.loggedIPMode = LogIPHash
+	env.logEvent("event", logIPField("client_ip", "203.0.113.42"))
+	entry := output.String()
+	assert.NotContains(t, entry, "203.0.113")
+	assert.Len(t, entry, len("event client_ip=\"\"\n")+16)
+	// 同一个 IP 的哈希值相同
+	output.Reset()
+	env.logEvent("event", logIPField("client_ip", "203.0.113.42"))
+	assert.Equal(t, entry, output.String())
+
+	// 明确开启后原样记录
+	output.Reset()
+	env.logRawEmails = true
+	env.loggedIPMode = LogIPRaw
+	env.logEvent("event", logEmailField("email", "user@example.com"), logIPField("client_ip", "203.0.113.42"))
+	assert.Equal(t, "event email=\"user@example.com\" client_ip=\"203.0.113.42\"\n", output.String())
+}
+
+// TestMaskEmailAddress 测试 maskEmailAddress 函数。
+func TestMaskEmailAddress(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "u***@example.com", maskEmailAddress("user@example.com"))
+	assert.Equal(t, "a***@example.com", maskEmailAddress("a@example.com"))
+	assert.Equal(t, "***", maskEmailAddress("@example.com"))
+	assert.Equal(t, "***", maskEmailAddress("not an email"))
+}
+
+// TestTruncateIPAddress 测试 truncateIPAddress 函数。
+func TestTruncateIPAddress(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "203.0.113.0/24", truncateIPAddress("203.0.113.42"))
+	assert.Equal(t, "203.0.113.0/24", truncateIPAddress("::ffff:203.0.113.42"))
+	assert.Equal(t, "2001:db8:1::/48", truncateIPAddress("2001:db8:1:2::1"))
+	assert.Equal(t, "***", truncateIPAddress("invalid"))
+}
@@ -30,12 +30,46 @@
 //    - `:user_id`, `:request_id` 这种是路径参数，意味着客户端请求时需要在这里填入具体的用户 ID 或请求 ID。
 //    - 每个路径后面跟着的处理函数名 (e.g., handleCreateUserRequest) 实际上是在其他 Go 文件 (如 user.go, auth.go 等) 中定义的，
 //      这里只是把它们“挂载”到对应的 URL 上。
-// 3. 返回配置好的 Handler: 最后，`router.Handler()` 方法会生成一个标准的 http.Handler，包含了所有注册好的路由规则。
+// 3. 返回配置好的 Handler: 第 1、2 步在 createRouter 中完成。最后，`router.Handler()` 方法会生成一个标准的 http.Handler，包含了所有注册好的路由规则。
+//    它外面再包一层 withDatabaseTimeout，给数据库调用加上服务端的超时上限，
+//    然后是 withMaintenanceMode，维护模式下拒绝会修改数据的请求，
+//    最外层的 withRequestBodyLimit 在读取请求体之前拒绝过大的请求。
+//    withHeadRequests 让所有 GET 路由同时响应 HEAD 请求。
+//    withListEnvelope 按配置或 Accept 头把分页列表和分页信息一起放进响应体。
+//    withDisabledRoutes 让 env.routeConfig 中被关闭的路由返回 404，部署可以只开放需要的端点。
+//    withReauthentication 让 env.reauthenticationRoutes 中的敏感路由要求用户近期验证过密码或第二因素。
+//    最内层的 withJSONErrorResponses 把路由器返回的纯文本 404 和 405 改写为 JSON 错误响应。
 func CreateApp(env *Environment) http.Handler {
+	router := createRouter(env)
+
+	// 所有路由规则都注册完毕后 (见 createRouter)，调用 router.Handler() 生成最终的 http.Handler 并返回。
+	// 这个返回的 Handler 就可以交给 Go 的 HTTP 服务器去运行了。
+	// withDatabaseTimeout 给每个请求的 context 加上超时，handler 传给数据库调用的 context 超时后查询会被取消 (见 db.go)。
+	// withRequestTimeout 给整个请求加上 env.requestTimeout 的时间预算，超时后返回 503 TIMEOUT (见 request-timeout.go)，放在 withDatabaseTimeout 里面。
+	// withMaintenanceMode 在维护模式下拒绝会修改数据的请求 (503，见 maintenance.go)。
+	// withRequestBodyLimit 在处理函数读取请求体之前拒绝过大的请求体 (413，见 request.go)。
+	// withGETRequestBodies 丢弃 GET 请求的请求体，或者按配置拒绝带有请求体的 GET 请求 (见 request.go)，放在 withRequestBodyLimit 里面。
+	// withHeadRequests 用对应的 GET 处理函数响应 HEAD 请求，并丢弃响应体 (见 request.go)。
+	// withListEnvelope 在请求选择信封格式时改写分页列表的响应 (见 list-envelope.go)，放在 withHeadRequests 里面，HEAD 请求的响应头和 GET 相同。
+	// withDisabledRoutes 对被 env.routeConfig 关闭的路由返回 404 (见 routes.go)，放在 withHeadRequests 里面，HEAD 请求按 GET 路由判断。
+	// withReauthentication 要求 env.reauthenticationRoutes 中的路由的用户近期验证过密码或第二因素 (见 reauthentication.go)，放在 withDisabledRoutes 里面，被关闭的路由仍然返回 404。
+	// withJSONErrorResponses 保证没有匹配到路由时 (404、405) 也返回 JSON 错误响应体 (见 routes.go)。
+	return withRequestBodyLimit(env, withGETRequestBodies(env, withMaintenanceMode(env, withDatabaseTimeout(env, withRequestTimeout(env, withHeadRequests(withListEnvelope(env, withDisabledRoutes(env, router.Routes(), withReauthentication(env, router.Routes(), withJSONErrorResponses(router.Handler()))))))))))
+}
+
+// createRouter 创建自定义路由器并注册所有 API 端点，CreateApp 再给它生成的 handler 包上中间件。
+// 单独拆出来是为了让测试可以通过 createRouter(env).Routes() 检查注册了哪些路由。
+func createRouter(env *Environment) *Router {
 	// 初始化自定义路由，传入环境配置和默认处理函数
-	router := NewRouter(env, func(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var router *Router
+	router = NewRouter(env, func(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		// 这个是默认的处理函数，当没有其他路由规则匹配时会执行
-		// 这里的示例是直接返回 404 Not Found 错误
+		// 路径存在但没有注册请求的方法时，返回 405 Method Not Allowed，Allow 头列出支持的方法 (见 routes.go)，
+		// 不包括被 env.routeConfig 关闭的路由
+		if methods := allowedMethods(env.enabledRoutes(router.Routes()), r.URL.Path); len(methods) > 0 {
+			writeMethodNotAllowedErrorResponse(w, methods)
+			return
+		}
 		// 实际应用中，这里可能还会做一些基础的请求验证
 		// // 比如检查请求是否携带了正确的 API 密钥
 		// if !verifyRequestSecret(env.secret, r) {
@@ -67,10 +101,23 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleCreateUserRequest 函数处理（定义在别处）。
 	router.Handle("POST", "/users", handleCreateUserRequest)
 
+	// POST /user-imports: 用已有的 Argon2id 密码哈希和邮箱批量创建用户，用于从其他系统迁移。
+	// 每一行单独验证和插入，响应中按顺序返回每一行的结果。
+	// 不放在 /users 下面，因为 httprouter 不允许静态段和 /users/:user_id 并存 (注册时会 panic)。
+	// 由 handleBulkImportUsersRequest 函数处理 (见 user-import.go)。
+	router.Handle("POST", "/user-imports", handleBulkImportUsersRequest)
+
+	// POST /invites: 生成一个一次性的邀请码。设置了 env.requireInvite 时 POST /users 需要邀请码。
+	// 由 handleCreateInviteRequest 函数处理 (见 invite.go)。
+	router.Handle("POST", "/invites", handleCreateInviteRequest)
+
 	// GET /users: 获取用户列表。
 	// 这个接口可能需要管理员权限或特殊的访问密钥才能调用。
-	// 由 handleGetUsersRequest 函数处理。
-	router.Handle("GET", "/users", handleGetUsersRequest)
+	// 带 email 查询参数时改为获取使用该邮箱的用户 (邮箱不区分大小写，按 IP 限流)，给只知道邮箱的后台工具使用。
+	// 带 count_only=true 时只返回符合过滤条件的用户数量，不返回用户本身。
+	// httprouter 不允许 /users/by-email、/users/count 这样的静态段和 /users/:user_id 并存，所以用查询参数。
+	// 由 handleGetUsersRouteRequest 函数处理。
+	router.Handle("GET", "/users", handleGetUsersRouteRequest)
 
 	// DELETE /users: 批量删除用户。
 	// 同样，通常需要管理员权限。
@@ -94,6 +141,11 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleVerifyUserPasswordRequest 函数处理。
 	router.Handle("POST", "/users/:user_id/verify-password", handleVerifyUserPasswordRequest)
 
+	// POST /verify-credentials: 用邮箱和密码验证用户，成功时返回用户 ID。
+	// 登录表单只有邮箱时使用，不需要先查询用户 ID。
+	// 由 handleVerifyCredentialsRequest 函数处理。
+	router.Handle("POST", "/verify-credentials", handleVerifyCredentialsRequest)
+
 	// POST /users/:user_id/update-password: 更新用户的密码。
 	// 可能需要提供旧密码，或者一个有效的密码重置凭证。
 	// 由 handleUpdateUserPasswordRequest 函数处理。
@@ -118,6 +170,10 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleGetPasswordResetRequestRequest 函数处理。
 	router.Handle("GET", "/password-reset-requests/:request_id", handleGetPasswordResetRequestRequest)
 
+	// GET /password-reset-requests/:request_id/user: 获取密码重置请求所属的用户，方便重置页面显示用户信息。
+	// 由 handleGetPasswordResetRequestUserRequest 函数处理。
+	router.Handle("GET", "/password-reset-requests/:request_id/user", handleGetPasswordResetRequestUserRequest)
+
 	// DELETE /password-reset-requests/:request_id: 删除（或作废）一个具体的密码重置请求。
 	// 由 handleDeletePasswordResetRequestRequest 函数处理。
 	router.Handle("DELETE", "/password-reset-requests/:request_id", handleDeletePasswordResetRequestRequest)
@@ -127,11 +183,19 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleVerifyPasswordResetRequestEmailRequest 函数处理。
 	router.Handle("POST", "/password-reset-requests/:request_id/verify-email", handleVerifyPasswordResetRequestEmailRequest)
 
+	// POST /password-reset-requests/:request_id/extend: 延长密码重置请求的有效期，不超过配置的最长总有效期。
+	// 由 handleExtendPasswordResetRequestRequest 函数处理。
+	router.Handle("POST", "/password-reset-requests/:request_id/extend", handleExtendPasswordResetRequestRequest)
+
 	// POST /reset-password: 使用一个有效的密码重置凭证（比如验证码或 token）来设置新密码。
 	// 这是密码重置流程的最后一步。
 	// 由 handleResetPasswordRequest 函数处理。
 	router.Handle("POST", "/reset-password", handleResetPasswordRequest)
 
+	// POST /password-change-tokens/verify: 验证密码更改通知中的“不是我本人操作”令牌，返回对应的用户和更改时间。
+	// 由 handleVerifyPasswordChangeTokenRequest 函数处理 (见 password-change-notification.go)。
+	router.Handle("POST", "/password-change-tokens/verify", handleVerifyPasswordChangeTokenRequest)
+
 	// --- 两步验证 (2FA) 相关的 API 端点 ---
 	// 这些接口处理基于时间的一次性密码 (TOTP) 的注册、验证和管理
 
@@ -140,6 +204,15 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleRegisterTOTPRequest 函数处理。
 	router.Handle("POST", "/users/:user_id/register-totp", handleRegisterTOTPRequest)
 
+	// POST /users/:user_id/totp-setup: 由服务端生成 TOTP 密钥，返回 Base32 密钥和 otpauth:// URI。
+	// 密钥暂存在内存中，之后调用 register-totp (不提供 key) 用验证码确认。
+	// 由 handleCreateTOTPSetupRequest 函数处理 (见 totp-setup.go)。
+	router.Handle("POST", "/users/:user_id/totp-setup", handleCreateTOTPSetupRequest)
+
+	// POST /totp/preview-verify: 注册之前确认验证码和给定的密钥匹配，不需要用户，也不保存任何数据。
+	// 由 handlePreviewVerifyTOTPRequest 函数处理 (见 totp-setup.go)。
+	router.Handle("POST", "/totp/preview-verify", handlePreviewVerifyTOTPRequest)
+
 	// GET /users/:user_id/totp-credential: 获取用户已注册的 TOTP 凭证信息。
 	// 比如用来在设置页面显示“两步验证已启用”。
 	// 由 handleGetUserTOTPCredentialRequest 函数处理。
@@ -149,11 +222,24 @@ func CreateApp(env *Environment) http.Handler {
 	// 由 handleDeleteUserTOTPCredentialRequest 函数处理。
 	router.Handle("DELETE", "/users/:user_id/totp-credential", handleDeleteUserTOTPCredentialRequest)
 
+	// GET /totp-credentials: 分页列出所有用户的 TOTP 凭据 (不含密钥)，用于安全审计。
+	// 由 handleGetTOTPCredentialsRequest 函数处理。
+	router.Handle("GET", "/totp-credentials", handleGetTOTPCredentialsRequest)
+
+	// POST /totp-credentials/bulk-delete: 删除多个用户的 TOTP 凭据，例如身份验证器应用被攻破后强制用户重新注册。
+	// 响应中按顺序返回每个用户的结果。
+	// 由 handleBulkDeleteTOTPCredentialsRequest 函数处理 (见 totp-bulk-delete.go)。
+	router.Handle("POST", "/totp-credentials/bulk-delete", handleBulkDeleteTOTPCredentialsRequest)
+
 	// POST /users/:user_id/verify-2fa/totp: 验证用户输入的 TOTP 动态验证码是否正确。
-	// 在登录或其他需要增强安全性的操作时使用。
+	// 在登录或其他需要增强安全性的操作时使用。验证成功后返回一个短期的 step-up 令牌。
 	// 由 handleVerifyTOTPRequest 函数处理。
 	router.Handle("POST", "/users/:user_id/verify-2fa/totp", handleVerifyTOTPRequest)
 
+	// POST /step-up-tokens/verify: 验证 verify-2fa/totp 返回的 step-up 令牌是否有效 (签名正确且未过期)。
+	// 由 handleVerifyStepUpTokenRequest 函数处理 (见 step-up-token.go)。
+	router.Handle("POST", "/step-up-tokens/verify", handleVerifyStepUpTokenRequest)
+
 	// POST /users/:user_id/reset-2fa: 重置用户的两步验证设置。
 	// 可能是管理员操作，或者是用户通过备用码等方式发起的恢复流程。
 	// 由 handleResetUser2FARequest 函数处理。
@@ -161,8 +247,19 @@ func CreateApp(env *Environment) http.Handler {
 
 	// POST /users/:user_id/regenerate-recovery-code: 为用户生成新的备用恢复码。
 	// 当用户丢失了 TOTP 设备时，可以用恢复码登录并重置 2FA。
-	// 由 handleRegenerateUserRecoveryCodeRequest 函数处理。
-	router.Handle("POST", "/users/:user_id/regenerate-recovery-code", handleRegenerateUserRecoveryCodeRequest)
+	// 设置 env.recoveryCodeCount 后改为生成一组一次性恢复码。
+	// 由 handleRegenerateUserRecoveryCodesRequest 函数处理 (见 recovery-code.go)。
+	router.Handle("POST", "/users/:user_id/regenerate-recovery-code", handleRegenerateUserRecoveryCodesRequest)
+
+	// POST /users/:user_id/verify-recovery-code: 验证并使用用户的恢复码。
+	// 设置 env.recoveryCodeCount 时使用一个一次性恢复码，否则使用单个恢复码并返回代替它的新恢复码。
+	// 由 handleVerifyUserRecoveryCodeRequest 函数处理 (见 recovery-code.go)。
+	router.Handle("POST", "/users/:user_id/verify-recovery-code", handleVerifyUserRecoveryCodeRequest)
+
+	// POST /users/:user_id/reset-rate-limits: 清除用户的速率限制和锁定状态 (例如 TOTP 锁定)。
+	// 供客服帮助被锁定的正常用户使用，不需要重启服务器。
+	// 由 handleResetUserRateLimitsRequest 函数处理 (见 user.go)。
+	router.Handle("POST", "/users/:user_id/reset-rate-limits", handleResetUserRateLimitsRequest)
 
 	// --- 邮箱验证和更新相关的 API 端点 ---
 	// 这些接口处理用户注册邮箱的验证，以及后续修改邮箱地址的流程
@@ -209,11 +306,46 @@ func CreateApp(env *Environment) http.Handler {
 
 	// POST /verify-new-email: 使用发送到 *新* 邮箱的验证码或 token 来完成邮箱地址的更改。
 	// 这是邮箱更改流程的最后一步，确认新邮箱有效并完成更新。
+	// 和 /email-update-requests/:request_id/verify 共用验证逻辑，每个请求最多尝试 5 次。
 	// 由 handleUpdateEmailRequest 函数处理。
 	router.Handle("POST", "/verify-new-email", handleUpdateEmailRequest)
 
+	// POST /email-update-requests/:request_id/verify: 和 /verify-new-email 相同，但通过 URL 指定邮箱更改请求。
+	// 由 handleVerifyEmailUpdateRequestRequest 函数处理。
+	router.Handle("POST", "/email-update-requests/:request_id/verify", handleVerifyEmailUpdateRequestRequest)
 
-	// 所有路由规则都注册完毕后，调用 router.Handler() 生成最终的 http.Handler 并返回。
-	// 这个返回的 Handler 就可以交给 Go 的 HTTP 服务器去运行了。
-	return router.Handler()
+
+	// GET /audit-log: 分页查询审计日志 (删除用户、关闭 2FA、重置密码、更改邮箱等破坏性操作的记录)，
+	// 可以按 user_id 和 action 过滤。由 handleGetAuditLogRequest 函数处理 (见 audit.go)。
+	router.Handle("GET", "/audit-log", handleGetAuditLogRequest)
+
+	// GET /maintenance: 查询维护模式 (只读模式) 是否开启。
+	// POST /maintenance: 开启或关闭维护模式，不需要重启服务。维护模式下这个端点本身仍然可用。
+	// 由 handleGetMaintenanceRequest 和 handleUpdateMaintenanceRequest 函数处理 (见 maintenance.go)。
+	router.Handle("GET", "/maintenance", handleGetMaintenanceRequest)
+	router.Handle("POST", "/maintenance", handleUpdateMaintenanceRequest)
+
+	// GET /healthz: 存活检查。?checks=pwned 时额外报告 Pwned Passwords API 是否可以访问 (见 health.go)。
+	router.Handle("GET", "/healthz", handleGetHealthRequest)
+
+	// GET /auth/check: 只验证请求密钥 (204 或 401)，方便接入时确认 Authorization 头配置正确 (见 health.go)。
+	router.Handle("GET", "/auth/check", handleGetAuthCheckRequest)
+
+	// GET /metrics: 以 Prometheus 文本格式返回监控指标，目前是每个限流器记录的 key 数量。
+	// 由 handleGetMetricsRequest 函数处理 (见 metrics.go)。
+	router.Handle("GET", "/metrics", handleGetMetricsRequest)
+
+	// GET /routes: 列出已注册的所有路由 (方法和路径)，方便运维确认部署的版本提供了哪些端点。
+	// 被 env.routeConfig 关闭的路由不会列出。
+	// 处理函数需要访问 router 本身，所以用闭包注册 (见 routes.go)。
+	router.Handle("GET", "/routes", func(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handleGetRoutesRequest(env, env.enabledRoutes(router.Routes()), w, r)
+	})
+
+	// 开发模式: 获取 Faroe 本应发送的邮件 (验证码)，只在设置了 env.devEmailSink 时注册 (见 dev-email.go)
+	if env.devEmailSink != nil {
+		router.Handle("GET", "/dev/emails", handleGetDevEmailsRequest)
+	}
+
+	return router
 }
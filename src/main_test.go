@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql" // 导入数据库 SQL 包，用于数据库操作
 	"faroe/ratelimit" // 导入项目内部的 ratelimit 包，用于配置速率限制器
+	"strconv"      // 导入字符串转换包，用于生成顺序 ID
+	"sync"         // 导入同步包，用于保护顺序 ID 生成器的计数器
 	"testing"      // 导入 Go 的测试包
 	"time"         // 导入时间包，用于设置时间间隔
 )
@@ -18,8 +20,9 @@ import (
 //   *sql.DB: 初始化成功并应用了 schema 的内存数据库连接。
 //            如果初始化或执行 schema 失败，则会调用 t.Fatal() 中止测试。
 func initializeTestDB(t *testing.T) *sql.DB {
-	// 使用 "sqlite" 驱动和 ":memory:" 数据源名称来创建内存数据库
-	db, err := sql.Open("sqlite", ":memory:")
+	// 使用 "sqlite" 驱动创建内存数据库，并和生产环境一样开启外键约束，
+	// 以便 ON DELETE CASCADE 在测试中同样生效
+	db, err := sql.Open("sqlite", "file::memory:?_pragma=foreign_keys(1)")
 	if err != nil {
 		// 如果打开数据库失败，记录致命错误并终止测试
 		t.Fatal(err)
@@ -65,11 +68,32 @@ func createEnvironment(db *sql.DB, secret []byte) *Environment {
 		verifyPasswordResetCodeLimitCounter:           ratelimit.NewLimitCounter(5),                   // 验证密码重置码次数限制 (计数器)
 		totpUserRateLimit:                             ratelimit.NewExpiringTokenBucketRateLimit(5, 15*time.Minute), // TOTP 用户速率限制 (过期型令牌桶)
 		recoveryCodeUserRateLimit:                     ratelimit.NewExpiringTokenBucketRateLimit(5, 15*time.Minute), // 恢复码用户速率限制 (过期型令牌桶)
+		totpUserLockout:                               ratelimit.NewLockout(3, 24*time.Hour, time.Hour),               // TOTP 用户锁定 (24 小时内耗尽 3 次后锁定 1 小时)
+		totpPreviewIPRateLimit:                        ratelimit.NewTokenBucketRateLimit(5, 10*time.Second),          // TOTP 预览验证 IP 速率限制 (补充型令牌桶)
+		healthIPRateLimit:                             ratelimit.NewTokenBucketRateLimit(100, 100*time.Millisecond),  // 健康检查 IP 速率限制 (补充型令牌桶)
+		userEmailLookupIPRateLimit:                    ratelimit.NewTokenBucketRateLimit(20, 10*time.Second),         // 按邮箱查询用户 IP 速率限制 (补充型令牌桶)
+		codeDeliveryRateLimit:                         newCodeDeliveryRateLimit(5, 5, 5*time.Minute),                  // 验证码发送限制 (每个用户和每个 IP 各 5 个令牌)
+		emailUpdateRequestRateLimit:                   newEmailUpdateRequestRateLimit(time.Second, 5, 5*time.Minute),  // 邮箱更新请求限制 (每个用户间隔 1 秒，每个邮箱 5 个令牌)
+		pwnedPasswords:                                newPwnedPasswordsClient(defaultPwnedPasswordsAPIURL, defaultPwnedPasswordsMaxConcurrentRequests, defaultPwnedPasswordsCacheTTL), // Pwned Passwords API 客户端
 	}
 	// 返回配置好的测试环境实例
 	return env
 }
 
+// newSequenceIdGenerator 返回一个按顺序生成 "<prefix>1"、"<prefix>2"... 的 ID 生成器。
+// 把它赋值给 env.IDGenerator 后，创建的记录的 ID 是可预测的，测试可以直接断言。
+// 它是并发安全的。
+func newSequenceIdGenerator(prefix string) func() (string, error) {
+	var mu sync.Mutex
+	count := 0
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		return prefix + strconv.Itoa(count), nil
+	}
+}
+
 // ErrorJSON 结构体用于在集成测试中解析 API 返回的 JSON 格式错误响应。
 // 当测试需要验证 API 是否按预期返回了特定的错误信息时，可以将响应体 unmarshal 到这个结构体中，
 // 然后检查 Error 字段的值。
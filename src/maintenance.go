@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 维护模式 (只读模式)：在迁移数据库或处理事故时，运维人员可以拒绝所有会修改数据的请求，
+// 同时保持读取请求可用。维护模式保存在 env.MaintenanceMode (atomic.Bool) 中，
+// 通过 POST /maintenance 切换，不需要重启服务。
+
+// ExpectedErrorMaintenance 表示服务处于维护模式，拒绝了会修改数据的请求 (503)。
+const ExpectedErrorMaintenance = "MAINTENANCE"
+
+// maintenancePath 是切换维护模式的端点。它本身是 POST 请求，维护模式下也必须可用，否则无法关闭维护模式。
+const maintenancePath = "/maintenance"
+
+// maintenanceReadOnlyRoutes 是维护模式下仍然可用的 POST 路由。它们只验证用户的密码或第二因素，不修改用户数据，
+// 所以维护期间用户仍然可以登录。验证成功时可能写入 user_recent_authentication (见 reauthentication.go)，
+// 写入失败只记录日志，不影响验证结果。
+var maintenanceReadOnlyRoutes = []Route{
+	{"POST", "/users/:user_id/verify-password"},
+	{"POST", "/users/:user_id/verify-2fa/totp"},
+	{"POST", "/verify-credentials"},
+}
+
+// withMaintenanceMode 包装应用的 handler，维护模式下拒绝 GET、HEAD、OPTIONS 和 maintenanceReadOnlyRoutes 以外的请求。
+// 参数：
+//   env *Environment: 应用环境，提供 MaintenanceMode。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+func withMaintenanceMode(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if env.MaintenanceMode.Load() && r.URL.Path != maintenancePath {
+			_, readOnly := matchRoute(maintenanceReadOnlyRoutes, r.Method, r.URL.Path)
+			switch {
+			case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions, readOnly:
+			default:
+				writeMaintenanceErrorResponse(w)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// writeMaintenanceErrorResponse 返回 503 和 ExpectedErrorMaintenance 错误。
+func writeMaintenanceErrorResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, ExpectedErrorMaintenance)))
+}
+
+// handleGetMaintenanceRequest 处理 GET /maintenance，返回维护模式是否开启。
+func handleGetMaintenanceRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeMaintenanceModeToJSON(env.MaintenanceMode.Load())))
+}
+
+// handleUpdateMaintenanceRequest 处理 POST /maintenance，开启或关闭维护模式。
+// 请求体：{"enabled": boolean}。响应体和 GET /maintenance 相同。
+func handleUpdateMaintenanceRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		Enabled *bool `json:"enabled"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if data.Enabled == nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	env.MaintenanceMode.Store(*data.Enabled)
+	env.logEvent("maintenance mode updated", logStringField("enabled", strconv.FormatBool(*data.Enabled)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeMaintenanceModeToJSON(*data.Enabled)))
+}
+
+// encodeMaintenanceModeToJSON 编码 /maintenance 的响应体。
+func encodeMaintenanceModeToJSON(enabled bool) string {
+	return fmt.Sprintf(`{"enabled":%t}`, enabled)
+}
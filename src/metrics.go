@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 限流器都把每个 key 的状态保存在内存中的 map 里，只有过期、重置或 Clear 时才会删除。
+// GET /metrics 以 Prometheus 文本格式导出每个限流器当前记录的 key 数量 (gauge)，
+// 运维人员可以据此监控这些 map 占用的内存。
+
+// rateLimiterSize 是导出的一个限流器的名称和当前记录的 key 数量。
+type rateLimiterSize struct {
+	name string
+	size int
+}
+
+// rateLimiterSizes 返回 env 中所有限流器当前记录的 key 数量。
+func (env *Environment) rateLimiterSizes() []rateLimiterSize {
+	return []rateLimiterSize{
+		{"password_hashing_ip", env.passwordHashingIPRateLimit.Size()},
+		{"login_ip", env.loginIPRateLimit.Size()},
+		{"create_email_request_user", env.createEmailRequestUserRateLimit.Size()},
+		{"verify_user_email", env.verifyUserEmailRateLimit.Size()},
+		{"verify_email_update_verification_code", env.verifyEmailUpdateVerificationCodeLimitCounter.Size()},
+		{"create_password_reset_ip", env.createPasswordResetIPRateLimit.Size()},
+		{"verify_password_reset_code", env.verifyPasswordResetCodeLimitCounter.Size()},
+		{"totp_user", env.totpUserRateLimit.Size()},
+		{"totp_preview_ip", env.totpPreviewIPRateLimit.Size()},
+		{"totp_user_lockout", env.totpUserLockout.Size()},
+		{"recovery_code_user", env.recoveryCodeUserRateLimit.Size()},
+		{"code_delivery_user", env.codeDeliveryRateLimit.user.Size()},
+		{"code_delivery_ip", env.codeDeliveryRateLimit.ip.Size()},
+		{"email_update_request_user", env.emailUpdateRequestRateLimit.user.Size()},
+		{"email_update_request_email", env.emailUpdateRequestRateLimit.email.Size()},
+		{"health_ip", env.healthIPRateLimit.Size()},
+		{"user_email_lookup_ip", env.userEmailLookupIPRateLimit.Size()},
+	}
+}
+
+// handleGetMetricsRequest 处理 GET /metrics，以 Prometheus 文本格式返回监控指标。
+// 需要和其他端点一样验证请求密钥。
+func handleGetMetricsRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeRateLimiterSizesToPrometheusText(env.rateLimiterSizes())))
+}
+
+// encodeRateLimiterSizesToPrometheusText 把限流器的 key 数量编码为 Prometheus 文本格式的 gauge。
+func encodeRateLimiterSizesToPrometheusText(sizes []rateLimiterSize) string {
+	var builder strings.Builder
+	builder.WriteString("# HELP faroe_rate_limiter_keys Number of keys tracked by a rate limiter.\n")
+	builder.WriteString("# TYPE faroe_rate_limiter_keys gauge\n")
+	for _, limiter := range sizes {
+		builder.WriteString(fmt.Sprintf("faroe_rate_limiter_keys{limiter=%q} %d\n", limiter.name, limiter.size))
+	}
+	return builder.String()
+}
@@ -61,16 +61,21 @@ func VerifyTOTP(now time.Time, key []byte, interval time.Duration, digits int, o
 	return valid
 }
 
-// VerifyTOTPWithGracePeriod 函数验证用户提供的 TOTP 是否在当前时间步长或其前后一个步长 (宽限期) 内有效。
+// MaxGracePeriod 是 VerifyTOTPWithGracePeriod 和 VerifyTOTPWithWindow 接受的最大宽限期。
+// 更大的宽限期会被限制为 MaxGracePeriod，所以配置错误时也不会接受几分钟以前的验证码，
+// 每次验证最多检查前后各 MaxGracePeriod / interval + 1 个时间步长。
+const MaxGracePeriod = 2 * time.Minute
+
+// VerifyTOTPWithGracePeriod 函数验证用户提供的 TOTP 是否在 [now - gracePeriod, now + gracePeriod] 时间范围内的某个时间步长有效。
 // 这允许一定的时钟漂移或网络延迟。
 //
 // 工作流程:
-// 1. 计算前一个时间步长 (now - gracePeriod) 的计数器，并生成对应的 OTP 进行比较。
-// 2. 如果不匹配，计算当前时间步长 (now) 的计数器 (如果与前一个不同)，并生成对应的 OTP 进行比较。
-// 3. 如果仍不匹配，计算后一个时间步长 (now + gracePeriod) 的计数器 (如果与前两个都不同)，并生成对应的 OTP 进行比较。
-// 4. 只要在任何一个允许的时间步长内匹配成功，即返回 true。
-// 5. 所有步长都验证失败，则返回 false。
-// 注意: 这里 gracePeriod 通常应设置为等于 interval，以检查前一个、当前和下一个时间窗口。
+// 1. 计算 now - gracePeriod 和 now + gracePeriod 所在的时间步长计数器，得到允许的计数器范围。
+// 2. 依次生成范围内每一个计数器对应的 OTP，并与用户提供的 OTP 进行常量时间比较。
+//    即使已经匹配也会比较完所有计数器，避免响应时间暴露匹配的是哪一个步长。
+// 3. 只要在任何一个允许的时间步长内匹配成功，即返回 true；否则返回 false。
+// 注意: 只检查宽限期覆盖到的时间步长，不会多检查。例如 interval 为 30 秒、gracePeriod 为 10 秒时，
+// 最多检查 2 个步长，90 秒前生成的验证码一定会被拒绝。gracePeriod 为负数时视为 0，超过 MaxGracePeriod 时视为 MaxGracePeriod。
 //
 // 参数:
 //   now (time.Time):       当前时间。
@@ -78,41 +83,49 @@ func VerifyTOTP(now time.Time, key []byte, interval time.Duration, digits int, o
 //   interval (time.Duration): 时间间隔。
 //   digits (int):          OTP 的位数。
 //   otp (string):          用户提供的待验证的 OTP 字符串。
-//   gracePeriod (time.Duration): 允许的时间宽限期 (通常等于 interval)。
+//   gracePeriod (time.Duration): 允许的最大时钟偏差。
 //
 // 返回值:
 //   bool: 如果 OTP 在宽限期内有效，返回 true；否则返回 false。
 func VerifyTOTPWithGracePeriod(now time.Time, key []byte, interval time.Duration, digits int, otp string, gracePeriod time.Duration) bool {
-	// 1. 检查前一个时间步长
-	counter1 := uint64(now.Add(-1*gracePeriod).Unix()) / uint64(interval.Seconds())
-	generated1 := GenerateHOTP(key, counter1, digits)
-	valid1 := subtle.ConstantTimeCompare([]byte(generated1), []byte(otp)) == 1
-	if valid1 {
-		return true
-	}
+	return VerifyTOTPWithWindow(now, key, interval, digits, otp, gracePeriod, gracePeriod)
+}
 
-	// 2. 检查当前时间步长 (如果与前一个不同)
-	counter2 := uint64(now.Unix()) / uint64(interval.Seconds())
-	if counter2 != counter1 {
-		generated2 := GenerateHOTP(key, counter2, digits)
-		valid2 := subtle.ConstantTimeCompare([]byte(generated2), []byte(otp)) == 1
-		if valid2 {
-			return true
-		}
+// VerifyTOTPWithWindow 函数验证用户提供的 TOTP 是否在 [now - pastGracePeriod, now + futureGracePeriod] 时间范围内的某个时间步长有效。
+// 与 VerifyTOTPWithGracePeriod 相同，只是前后的宽限期可以不同。
+// 例如 futureGracePeriod 为 0 时只接受当前和之前的时间步长，不接受未来的验证码，缩小了重放的时间窗口。
+// 宽限期为负数时视为 0，超过 MaxGracePeriod 时视为 MaxGracePeriod。
+//
+// 参数:
+//   now (time.Time):       当前时间。
+//   key ([]byte):          共享密钥。
+//   interval (time.Duration): 时间间隔。
+//   digits (int):          OTP 的位数。
+//   otp (string):          用户提供的待验证的 OTP 字符串。
+//   pastGracePeriod (time.Duration): 允许的时钟落后的最大时间 (接受多久以前的验证码)。
+//   futureGracePeriod (time.Duration): 允许的时钟超前的最大时间 (接受多久以后的验证码)。
+//
+// 返回值:
+//   bool: 如果 OTP 在时间范围内有效，返回 true；否则返回 false。
+func VerifyTOTPWithWindow(now time.Time, key []byte, interval time.Duration, digits int, otp string, pastGracePeriod time.Duration, futureGracePeriod time.Duration) bool {
+	if len(otp) != digits {
+		return false
 	}
-
-	// 3. 检查后一个时间步长 (如果与前两个都不同)
-	counter3 := uint64(now.Add(gracePeriod).Unix()) / uint64(interval.Seconds())
-	if counter3 != counter1 && counter3 != counter2 {
-		generated3 := GenerateHOTP(key, counter3, digits)
-		valid3 := subtle.ConstantTimeCompare([]byte(generated3), []byte(otp)) == 1
-		if valid3 {
-			return true
+	pastGracePeriod = min(max(pastGracePeriod, 0), MaxGracePeriod)
+	futureGracePeriod = min(max(futureGracePeriod, 0), MaxGracePeriod)
+	// 1. 计算允许的计数器范围
+	from := uint64(now.Add(-1*pastGracePeriod).Unix()) / uint64(interval.Seconds())
+	to := uint64(now.Add(futureGracePeriod).Unix()) / uint64(interval.Seconds())
+
+	// 2. 比较范围内的每一个时间步长
+	valid := false
+	for counter := from; counter <= to; counter++ {
+		generated := GenerateHOTP(key, counter, digits)
+		if subtle.ConstantTimeCompare([]byte(generated), []byte(otp)) == 1 {
+			valid = true
 		}
 	}
-
-	// 4. 所有步长都验证失败
-	return false
+	return valid
 }
 
 // GenerateHOTP 函数根据 RFC 4226 生成一个基于 HMAC 的一次性密码 (HOTP)。
@@ -3,6 +3,7 @@ package otp
 import (
 	"fmt"
 	"testing" // 导入 Go 的测试包
+	"time"
 )
 
 // TestGenerateHOTP 测试 GenerateHOTP 函数的正确性。
@@ -119,3 +120,125 @@ func TestVerifyHOTP(t *testing.T) {
 		})
 	}
 }
+
+// TestVerifyTOTPWithGracePeriod 测试 VerifyTOTPWithGracePeriod 在时钟偏差边界上的行为。
+// 当前时间取在一个时间步长开始后 10 秒，宽限期也是 10 秒，
+// 所以允许的时间范围正好从当前步长的开始到当前步长内的 20 秒，边界外一秒的验证码属于相邻步长，应被拒绝。
+func TestVerifyTOTPWithGracePeriod(t *testing.T) {
+	key := make([]byte, 20)
+	for i := 0; i < len(key); i++ {
+		key[i] = 0xff
+	}
+	interval := 30 * time.Second
+	gracePeriod := 10 * time.Second
+	now := time.Unix(1000*30+10, 0)
+
+	tests := []struct {
+		name     string
+		at       time.Time // 生成验证码的时间
+		expected bool
+	}{
+		{"current", now, true},
+		{"past edge", now.Add(-gracePeriod), true},
+		{"just beyond past edge", now.Add(-gracePeriod - time.Second), false},
+		{"future edge", now.Add(gracePeriod), true},
+		{"just beyond future edge", now.Add(gracePeriod + 10*time.Second), false},
+		{"90 seconds old", now.Add(-90 * time.Second), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			otp := GenerateTOTP(test.at, key, interval, 6)
+			result := VerifyTOTPWithGracePeriod(now, key, interval, 6, otp, gracePeriod)
+			if result != test.expected {
+				t.Errorf("got %t, expected %t", result, test.expected)
+			}
+		})
+	}
+
+	// 宽限期比时间间隔大时，范围内的每一个步长都应该被检查，范围外的不应该
+	gracePeriod = 60 * time.Second
+	for i := -2; i <= 2; i++ {
+		otp := GenerateTOTP(now.Add(time.Duration(i)*interval), key, interval, 6)
+		if !VerifyTOTPWithGracePeriod(now, key, interval, 6, otp, gracePeriod) {
+			t.Errorf("expected code from step %d to be valid", i)
+		}
+	}
+	otp := GenerateTOTP(now.Add(-3*interval), key, interval, 6)
+	if VerifyTOTPWithGracePeriod(now, key, interval, 6, otp, gracePeriod) {
+		t.Error("expected code from step -3 to be invalid")
+	}
+}
+
+// TestVerifyTOTPWithWindow 测试不接受未来验证码 (futureGracePeriod 为 0) 时，
+// 下一个时间步长的验证码被拒绝，当前和上一个时间步长的验证码仍然有效。
+func TestVerifyTOTPWithWindow(t *testing.T) {
+	key := make([]byte, 20)
+	for i := 0; i < len(key); i++ {
+		key[i] = 0xff
+	}
+	interval := 30 * time.Second
+	now := time.Unix(1000*30+10, 0)
+
+	tests := []struct {
+		name     string
+		at       time.Time // 生成验证码的时间
+		expected bool
+	}{
+		{"previous step", now.Add(-interval), true},
+		{"current step", now, true},
+		{"next step", now.Add(interval), false},
+		{"two steps ago", now.Add(-2 * interval), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			otp := GenerateTOTP(test.at, key, interval, 6)
+			result := VerifyTOTPWithWindow(now, key, interval, 6, otp, interval, 0)
+			if result != test.expected {
+				t.Errorf("got %t, expected %t", result, test.expected)
+			}
+		})
+	}
+
+	// 前后宽限期相同时与 VerifyTOTPWithGracePeriod 一致
+	otp := GenerateTOTP(now.Add(interval), key, interval, 6)
+	if !VerifyTOTPWithWindow(now, key, interval, 6, otp, interval, interval) {
+		t.Error("expected code from next step to be valid with a symmetric window")
+	}
+}
+
+// TestVerifyTOTPMaxGracePeriod 测试超过 MaxGracePeriod 的宽限期被限制为 MaxGracePeriod：
+// 边界上的验证码有效，边界外一个时间步长的验证码被拒绝。
+func TestVerifyTOTPMaxGracePeriod(t *testing.T) {
+	key := make([]byte, 20)
+	for i := 0; i < len(key); i++ {
+		key[i] = 0xff
+	}
+	interval := 30 * time.Second
+	gracePeriod := time.Hour
+	now := time.Unix(1000*30+10, 0)
+
+	tests := []struct {
+		name     string
+		at       time.Time // 生成验证码的时间
+		expected bool
+	}{
+		{"past edge", now.Add(-MaxGracePeriod), true},
+		{"just beyond past edge", now.Add(-MaxGracePeriod - interval), false},
+		{"future edge", now.Add(MaxGracePeriod), true},
+		{"just beyond future edge", now.Add(MaxGracePeriod + interval), false},
+		{"ten minutes old", now.Add(-10 * time.Minute), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			otp := GenerateTOTP(test.at, key, interval, 6)
+			result := VerifyTOTPWithGracePeriod(now, key, interval, 6, otp, gracePeriod)
+			if result != test.expected {
+				t.Errorf("got %t, expected %t", result, test.expected)
+			}
+			result = VerifyTOTPWithWindow(now, key, interval, 6, otp, gracePeriod, gracePeriod)
+			if result != test.expected {
+				t.Errorf("window: got %t, expected %t", result, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A password change the user didn't make is a sign of account takeover, so the user should be
+// told about every change. Faroe doesn't send emails, so when env.onPasswordChange is
+// set it is called after each successful POST /users/:user_id/update-password and
+// POST /reset-password with a PasswordChangeNotification. The application delivers it to the
+// user's verified email address, e.g. by sending an email or forwarding the JSON payload to a webhook.
+//
+// With env.passwordChangeRevertTokens, the notification also includes a signed token for a
+// "this wasn't me" link. The application checks it with POST /password-change-tokens/verify
+// and then locks the account or reverts the change as it sees fit. Like step-up tokens, these
+// tokens aren't stored and can't be revoked before they expire.
+
+// Methods of PasswordChangeNotification.
+const (
+	PasswordChangeMethodUpdate = "update"
+	PasswordChangeMethodReset  = "reset"
+)
+
+// passwordChangeTokenLifetime is how long a password change token can be verified. It is long
+// enough for the user to read the notification email.
+const passwordChangeTokenLifetime = 7 * 24 * time.Hour
+
+// passwordChangeTokenPayloadPrefix separates password change tokens from other tokens signed
+// with the same key (see stepUpTokenPayloadPrefix).
+const passwordChangeTokenPayloadPrefix = "password_change"
+
+// PasswordChangeNotification is passed to env.onPasswordChange after a user's password changes.
+type PasswordChangeNotification struct {
+	UserId        string
+	Method        string    // PasswordChangeMethodUpdate or PasswordChangeMethodReset.
+	ChangedAt     time.Time // Whole seconds, like the timestamps in the token.
+	ClientIP      string    // The client IP sent with the request, or an empty string.
+	EmailVerified bool      // Whether the user has a verified email address to notify.
+	// RevertToken is the "this wasn't me" token, or empty if env.passwordChangeRevertTokens isn't set.
+	RevertToken          string
+	RevertTokenExpiresAt time.Time
+}
+
+// EncodeToJSON encodes the notification, e.g. for a webhook payload. revert_token and
+// revert_token_expires_at are omitted without a token.
+func (n *PasswordChangeNotification) EncodeToJSON() string {
+	data := struct {
+		UserId               string `json:"user_id"`
+		Method               string `json:"method"`
+		ChangedAt            int64  `json:"changed_at"`
+		ClientIP             string `json:"client_ip"`
+		EmailVerified        bool   `json:"email_verified"`
+		RevertToken          string `json:"revert_token,omitempty"`
+		RevertTokenExpiresAt int64  `json:"revert_token_expires_at,omitempty"`
+	}{
+		UserId:        n.UserId,
+		Method:        n.Method,
+		ChangedAt:     n.ChangedAt.Unix(),
+		ClientIP:      n.ClientIP,
+		EmailVerified: n.EmailVerified,
+	}
+	if n.RevertToken != "" {
+		data.RevertToken = n.RevertToken
+		data.RevertTokenExpiresAt = n.RevertTokenExpiresAt.Unix()
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// notifyPasswordChange calls env.onPasswordChange, if set, after the user's password was changed.
+// The password has already changed, so errors are only logged and the request still succeeds.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   ctx (context.Context): Request context, passed on to the hook.
+//   userId (string): The user whose password changed.
+//   method (string): PasswordChangeMethodUpdate or PasswordChangeMethodReset.
+//   clientIP (string): The resolved client IP of the request, or an empty string.
+func notifyPasswordChange(env *Environment, ctx context.Context, userId string, method string, clientIP string) {
+	if env.onPasswordChange == nil {
+		return
+	}
+	emailVerified, err := getUserEmailVerified(env.db, ctx, userId)
+	if err != nil {
+		// Still notify; the application can look the user up itself.
+		log.Println(err)
+	}
+	notification := PasswordChangeNotification{
+		UserId:        userId,
+		Method:        method,
+		ChangedAt:     time.Unix(time.Now().Unix(), 0),
+		ClientIP:      clientIP,
+		EmailVerified: emailVerified,
+	}
+	if env.passwordChangeRevertTokens {
+		notification.RevertTokenExpiresAt = notification.ChangedAt.Add(passwordChangeTokenLifetime)
+		notification.RevertToken = createPasswordChangeToken(env.tokenSigningKey(), userId, notification.ChangedAt, notification.RevertTokenExpiresAt)
+	}
+	err = env.onPasswordChange(ctx, notification)
+	if err != nil {
+		env.logEvent("password change notification failed", logStringField("user_id", userId), logStringField("error", err.Error()))
+	}
+}
+
+// createPasswordChangeToken signs a "this wasn't me" token for a password change.
+// The payload is "password_change:<changed at>:<expires at>:<user ID>", with Unix timestamps.
+// The user ID is last, so it may contain any character.
+func createPasswordChangeToken(key []byte, userId string, changedAt time.Time, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%s:%d:%d:%s", passwordChangeTokenPayloadPrefix, changedAt.Unix(), expiresAt.Unix(), userId)
+	return createSignedToken(key, payload)
+}
+
+// verifyPasswordChangeToken verifies a token created by createPasswordChangeToken.
+//
+// Returns:
+//   string: The user ID.
+//   time.Time: When the password was changed.
+//   bool: Whether the signature and format are valid and the token hasn't expired at now.
+func verifyPasswordChangeToken(key []byte, token string, now time.Time) (string, time.Time, bool) {
+	payload, ok := verifySignedToken(key, token)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(payload, ":", 4)
+	if len(parts) != 4 || parts[0] != passwordChangeTokenPayloadPrefix {
+		return "", time.Time{}, false
+	}
+	changedAtUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expiresAtUnix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	if !now.Before(time.Unix(expiresAtUnix, 0)) {
+		return "", time.Time{}, false
+	}
+	return parts[3], time.Unix(changedAtUnix, 0), true
+}
+
+// handleVerifyPasswordChangeTokenRequest handles POST /password-change-tokens/verify.
+// It returns the user and time of the password change the token was issued for:
+//
+//	{"user_id": string, "changed_at": number}
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+// 3. Token signature and expiration check.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleVerifyPasswordChangeTokenRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		Token *string `json:"token"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if data.Token == nil || *data.Token == "" {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	userId, changedAt, valid := verifyPasswordChangeToken(env.tokenSigningKey(), *data.Token, time.Now())
+	if !valid {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidToken)
+		return
+	}
+
+	encoded, err := json.Marshal(struct {
+		UserId    string   `json:"user_id"`
+		ChangedAt UnixTime `json:"changed_at"`
+	}{userId, newUnixTime(changedAt, requestTimeFormat(env, r))})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"           // 导入 context 包，用于插入测试数据和 hook 的参数
+	"encoding/json"     // 导入 JSON 包，用于解析响应
+	"io"                // 导入 io 包，用于读取响应体
+	"net/http/httptest" // 导入 httptest 包，用于创建模拟的 HTTP 请求和响应
+	"strconv"           // 导入 strconv 包，用于拼接期望的 JSON
+	"strings"           // 导入 strings 包，用于创建请求体
+	"sync"              // 导入 sync 包，保护 hook 收到的通知
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestPasswordChangeNotification 测试通过 update-password 和 reset-password 更改密码后
+// 都会调用 env.onPasswordChange，通知中包含用户、方式、时间和客户端 IP，
+// 设置了 env.passwordChangeRevertTokens 时还包含可以用 POST /password-change-tokens/verify 验证的令牌。
+func TestPasswordChangeNotification(t *testing.T) {
+	t.Parallel()
+
+	// setup 创建一个密码为 super_secure_password、邮箱已验证的用户，返回记录通知的环境
+	setup := func(t *testing.T) (*Environment, func() []PasswordChangeNotification) {
+		db := initializeTestDB(t)
+		t.Cleanup(func() { db.Close() })
+
+		err := insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    time.Unix(time.Now().Unix(), 0),
+			PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = setUserEmailVerified(db, context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var notifications []PasswordChangeNotification
+		env := createEnvironment(db, nil)
+		env.passwordChangeRevertTokens = true
+		env.onPasswordChange = func(ctx context.Context, notification PasswordChangeNotification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			notifications = append(notifications, notification)
+			return nil
+		}
+		return env, func() []PasswordChangeNotification {
+			mu.Lock()
+			defer mu.Unlock()
+			return notifications
+		}
+	}
+	assertNotification := func(t *testing.T, notification PasswordChangeNotification, method string, start time.Time) {
+		assert.Equal(t, "1", notification.UserId)
+		assert.Equal(t, method, notification.Method)
+		assert.Equal(t, "192.0.2.1", notification.ClientIP)
+		assert.True(t, notification.EmailVerified)
+		assert.WithinDuration(t, start, notification.ChangedAt, 2*time.Second)
+		assert.Equal(t, notification.ChangedAt.Add(passwordChangeTokenLifetime), notification.RevertTokenExpiresAt)
+		assert.NotEmpty(t, notification.RevertToken)
+
+		// JSON 负载和通知的字段一致
+		var payload map[string]any
+		err := json.Unmarshal([]byte(notification.EncodeToJSON()), &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, map[string]any{
+			"user_id":                 "1",
+			"method":                  method,
+			"changed_at":              float64(notification.ChangedAt.Unix()),
+			"client_ip":               "192.0.2.1",
+			"email_verified":          true,
+			"revert_token":            notification.RevertToken,
+			"revert_token_expires_at": float64(notification.RevertTokenExpiresAt.Unix()),
+		}, payload)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		t.Parallel()
+
+		env, notifications := setup(t)
+		app := CreateApp(env)
+
+		// 密码错误时不通知
+		data := `{"password":"invalid","new_password":"super_super_secure_password","client_ip":"192.0.2.1"}`
+		r := httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorIncorrectPassword)
+		assert.Empty(t, notifications())
+
+		start := time.Now()
+		data = `{"password":"super_secure_password","new_password":"super_super_secure_password","client_ip":"192.0.2.1"}`
+		r = httptest.NewRequest("POST", "/users/1/update-password", strings.NewReader(data))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+		if !assert.Len(t, notifications(), 1) {
+			return
+		}
+		notification := notifications()[0]
+		assertNotification(t, notification, PasswordChangeMethodUpdate, start)
+
+		// 通知中的令牌可以验证
+		r = httptest.NewRequest("POST", "/password-change-tokens/verify", strings.NewReader(`{"token":"`+notification.RevertToken+`"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 200, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, `{"user_id":"1","changed_at":`+strconv.FormatInt(notification.ChangedAt.Unix(), 10)+`}`, string(body))
+
+		r = httptest.NewRequest("POST", "/password-change-tokens/verify", strings.NewReader(`{"token":"invalid"}`))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 400, ExpectedErrorInvalidToken)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		t.Parallel()
+
+		env, notifications := setup(t)
+		app := CreateApp(env)
+
+		now := time.Unix(time.Now().Unix(), 0)
+		err := insertPasswordResetRequest(env.db, context.Background(), &PasswordResetRequest{
+			Id:        "1",
+			UserId:    "1",
+			CreatedAt: now,
+			ExpiresAt: now.Add(10 * time.Minute),
+			CodeHash:  "HASH",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		data := `{"request_id":"1","password":"super_super_secure_password","client_ip":"192.0.2.1"}`
+		r := httptest.NewRequest("POST", "/reset-password", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+		if !assert.Len(t, notifications(), 1) {
+			return
+		}
+		assertNotification(t, notifications()[0], PasswordChangeMethodReset, start)
+	})
+}
+
+// TestPasswordChangeToken 测试 createPasswordChangeToken 和 verifyPasswordChangeToken：
+// 有效的令牌返回用户和更改时间，过期、签名错误或其他类型的令牌无效。
+func TestPasswordChangeToken(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("key")
+	changedAt := time.Unix(1700000000, 0)
+	expiresAt := changedAt.Add(time.Hour)
+	token := createPasswordChangeToken(key, "user:1", changedAt, expiresAt)
+
+	userId, tokenChangedAt, valid := verifyPasswordChangeToken(key, token, changedAt)
+	assert.True(t, valid)
+	assert.Equal(t, "user:1", userId)
+	assert.Equal(t, changedAt, tokenChangedAt)
+
+	_, _, valid = verifyPasswordChangeToken(key, token, expiresAt)
+	assert.False(t, valid)
+
+	_, _, valid = verifyPasswordChangeToken([]byte("other_key"), token, changedAt)
+	assert.False(t, valid)
+
+	// step-up 令牌不能当作密码更改令牌使用
+	_, _, valid = verifyPasswordChangeToken(key, createStepUpToken(key, "user:1", expiresAt), changedAt)
+	assert.False(t, valid)
+}
@@ -15,6 +15,90 @@ import (
 	"github.com/julienschmidt/httprouter" // 高性能的 HTTP 请求路由器
 )
 
+// ExpectedErrorExpiredRequest 表示密码重置请求或邮箱更新请求存在，但已经过期。
+// 与请求 ID 不存在的错误区分开，客户端可以提示用户"链接已过期，请重新发起"。
+//
+// 所有通过 ID 访问的密码重置请求和邮箱更新请求使用同一个约定。已过期的请求在被访问时删除，然后：
+//   - 读取请求的端点 (GET /password-reset-requests/:request_id、.../user、GET /email-update-requests/:request_id)
+//     和删除请求的端点把过期的请求当作不存在，返回 404。
+//   - 使用请求的端点 (验证码验证、重置密码、延长) 返回 ExpectedErrorExpiredRequest。
+//     请求 ID 不存在时返回端点原来的错误：ID 在 URL 中时返回 404，在请求体中时返回 ExpectedErrorInvalidRequest。
+const ExpectedErrorExpiredRequest = "EXPIRED_REQUEST"
+
+// ExpectedErrorEmailNotVerified 表示设置了 env.requireVerifiedEmailForPasswordReset，但用户的邮箱还没有验证，
+// 不能创建密码重置请求。
+const ExpectedErrorEmailNotVerified = "EMAIL_NOT_VERIFIED"
+
+// 默认情况下，密码重置成功后删除使用的请求。设置 env.keepUsedPasswordResetRequests 后改为把请求标记为
+// 已使用 (used_at)，方便运维人员审计。已使用的请求对所有端点都不可见，也不能再次使用。
+
+// usedPasswordResetRequestRetention 是 cleanUpDatabase 删除已使用的密码重置请求之前保留它们的时间。
+const usedPasswordResetRequestRetention = 90 * 24 * time.Hour
+
+// expiredPasswordResetRequestRetention 是 cleanUpDatabase 删除已过期的密码重置请求之前保留它们的时间。
+// 端点不会删除已过期的请求，所以在这段时间内使用请求的端点总是返回 ExpectedErrorExpiredRequest，
+// 而不是第一次返回 ExpectedErrorExpiredRequest、之后因为请求已被删除而返回 ExpectedErrorInvalidRequest。
+const expiredPasswordResetRequestRetention = 24 * time.Hour
+
+// 每个用户同时有效 (没有过期、没有使用) 的密码重置请求数量有上限 (env.maxActivePasswordResetRequests)。
+// 达到上限时默认删除最早的有效请求，设置 env.rejectPasswordResetRequestsOverLimit 后改为拒绝新的请求
+// (ExpectedErrorTooManyRequests)。
+
+// defaultMaxActivePasswordResetRequests 是没有配置 env.maxActivePasswordResetRequests 时的上限。
+const defaultMaxActivePasswordResetRequests = 5
+
+// ErrTooManyActivePasswordResetRequests 表示用户的有效密码重置请求已经达到上限，并且配置为拒绝新的请求。
+var ErrTooManyActivePasswordResetRequests = errors.New("too many active password reset requests")
+
+// activePasswordResetRequestLimit 是每个用户有效的密码重置请求数量的上限，见 env.passwordResetRequestLimit。
+type activePasswordResetRequestLimit struct {
+	max    int  // 有效请求的最大数量
+	reject bool // 达到上限时拒绝新的请求，而不是删除最早的请求
+}
+
+// passwordResetRequestLimit 返回配置的有效密码重置请求上限。
+// env.maxActivePasswordResetRequests 小于 1 时使用 defaultMaxActivePasswordResetRequests。
+func (env *Environment) passwordResetRequestLimit() activePasswordResetRequestLimit {
+	limit := activePasswordResetRequestLimit{
+		max:    env.maxActivePasswordResetRequests,
+		reject: env.rejectPasswordResetRequestsOverLimit,
+	}
+	if limit.max < 1 {
+		limit.max = defaultMaxActivePasswordResetRequests
+	}
+	return limit
+}
+
+// 用户正在完成重置流程时 (例如已经验证了邮箱，正在输入 2FA 验证码)，可以用
+// POST /password-reset-requests/:request_id/extend 延长请求的有效期，而不是重新发起请求。
+// 每次延长 env.passwordResetRequestExtension，但请求的总有效期 (从创建到过期) 不能超过
+// env.passwordResetRequestMaxLifetime，超过时返回 ExpectedErrorExtensionLimitReached。
+
+// 没有配置时的延长时间和最长总有效期。
+const (
+	defaultPasswordResetRequestExtension   = 5 * time.Minute
+	defaultPasswordResetRequestMaxLifetime = time.Hour
+)
+
+// ExpectedErrorExtensionLimitReached 表示延长后请求的总有效期会超过 env.passwordResetRequestMaxLifetime。
+const ExpectedErrorExtensionLimitReached = "EXTENSION_LIMIT_REACHED"
+
+// passwordResetRequestExtensionDuration 返回每次延长的时间。未设置 (零值或负数) 时使用 defaultPasswordResetRequestExtension。
+func (env *Environment) passwordResetRequestExtensionDuration() time.Duration {
+	if env.passwordResetRequestExtension <= 0 {
+		return defaultPasswordResetRequestExtension
+	}
+	return env.passwordResetRequestExtension
+}
+
+// passwordResetRequestMaxLifetimeDuration 返回请求的最长总有效期。未设置 (零值或负数) 时使用 defaultPasswordResetRequestMaxLifetime。
+func (env *Environment) passwordResetRequestMaxLifetimeDuration() time.Duration {
+	if env.passwordResetRequestMaxLifetime <= 0 {
+		return defaultPasswordResetRequestMaxLifetime
+	}
+	return env.passwordResetRequestMaxLifetime
+}
+
 // handleCreateUserPasswordResetRequestRequest 处理创建用户密码重置请求的 API 调用。
 // 它首先验证请求的合法性，然后为用户生成一个安全的重置代码，并将代码的哈希值存储到数据库中，
 // 最后将包含原始代码（用于发送给用户）和请求详情的 JSON 返回给调用者。
@@ -22,12 +106,14 @@ import (
 // 安全检查:
 // 1. Request Secret Verification: 验证请求头中的共享密钥。
 // 2. Content-Type & Accept Header Verification: 确保是 JSON 请求和响应。
-// 3. User Existence Check: 验证目标用户是否存在。
-// 4. Rate Limiting (可选, 基于 ClientIP):
-//    - 限制密码哈希相关的操作频率 (passwordHashingIPRateLimit)。
-//    - 限制创建密码重置请求的频率 (createPasswordResetIPRateLimit)。
-// 5. Expired Request Cleanup: 在创建新请求前，删除该用户已过期的旧请求。
-// 6. Secure Code Generation: 使用 crypto/rand 生成安全的验证码。
+// 3. User Existence Check: 验证目标用户是否存在，没有密码的用户返回 ExpectedErrorPasswordNotSet。
+//    设置了 env.requireVerifiedEmailForPasswordReset 时，邮箱没有验证的用户返回 ExpectedErrorEmailNotVerified。
+// 4. Rate Limiting:
+//    - 提供了 ClientIP 时，限制密码哈希相关的操作频率 (passwordHashingIPRateLimit)。
+//    - 消耗用户和 ClientIP (如果提供) 的验证码发送令牌 (codeDeliveryRateLimit)，生成失败时退还。
+// 5. Expired Request Cleanup: 在创建新请求前，删除该用户过期超过 expiredPasswordResetRequestRetention 的旧请求。
+//    有效请求达到 env.passwordResetRequestLimit() 的上限时，删除最早的有效请求或者返回 ExpectedErrorTooManyRequests。
+// 6. Secure Code Generation: 使用 crypto/rand 按照 env.passwordResetCodeFormat 生成安全的验证码。
 // 7. Code Hashing: 使用 Argon2id 对验证码进行哈希，只存储哈希值，不存储明文验证码。
 //
 // 参数:
@@ -55,89 +141,113 @@ func handleCreateUserPasswordResetRequestRequest(env *Environment, w http.Respon
 	// 从 URL 获取用户 ID
 	userId := params.ByName("user_id")
 	// 4. 检查用户是否存在
-	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	user, err := getUser(env.db, r.Context(), userId)
+	if errors.Is(err, ErrRecordNotFound) {
+		writeNotFoundErrorResponse(w) // 用户不存在，返回 404
+		return
+	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
-	if !userExists {
-		writeNotFoundErrorResponse(w) // 用户不存在，返回 404
+	// 没有密码的用户 (例如只使用 passkey 登录) 不能重置密码
+	if !userHasPassword(user.PasswordHash) {
+		writeExpectedErrorResponse(w, ExpectedErrorPasswordNotSet)
 		return
 	}
+	// 不向没有验证过的邮箱发送验证码
+	if env.requireVerifiedEmailForPasswordReset {
+		emailVerified, err := getUserEmailVerified(env.db, r.Context(), userId)
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		if !emailVerified {
+			writeExpectedErrorResponse(w, ExpectedErrorEmailNotVerified)
+			return
+		}
+	}
 
-	// 尝试读取请求体，以获取可选的 client_ip 用于速率限制
-	body, err := io.ReadAll(r.Body)
+	// 5. 读取可选的请求体以获取 client_ip，没有请求体时所有字段保持零值
+	var data struct {
+		ClientIP string `json:"client_ip"` // 从 JSON 中获取客户端 IP
+	}
+	err = decodeOptionalJSON(r, &data)
 	if err != nil {
-		// 读取请求体失败，通常是无效数据
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		// 读取请求体失败或 JSON 解析失败
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
 		return
 	}
-	// 5. 如果请求体不为空，尝试解析 client_ip 并应用速率限制
-	if len(body) > 0 {
-		var data struct {
-			ClientIP string `json:"client_ip"` // 从 JSON 中获取客户端 IP
-		}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
 
-		err = json.Unmarshal(body, &data)
-		if err != nil {
-			// JSON 解析失败
-			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-			return
-		}
-
-		// 如果提供了 ClientIP，则进行速率限制检查
-		if data.ClientIP != "" {
-			// 检查密码哈希相关的速率限制
-			if !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
-				writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
-				return
-			}
-			// 检查创建密码重置请求的速率限制
-			if !env.createPasswordResetIPRateLimit.Consume(data.ClientIP) {
-				writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
-				return
-			}
-		}
+	// 如果提供了 ClientIP，检查密码哈希相关的速率限制
+	if data.ClientIP != "" && !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
+	// 消耗用户和 ClientIP 的验证码发送令牌 (见 code-delivery.go)
+	if !env.codeDeliveryRateLimit.consume(codeDeliveryFlowPasswordReset, userId, data.ClientIP) {
+		env.logEvent("password reset request rate limited", logStringField("user_id", userId), logIPField("client_ip", data.ClientIP))
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
 	}
 
-	// 6. 删除该用户已过期的密码重置请求
+	// 6. 删除该用户过期超过保留期限的密码重置请求
 	err = deleteExpiredUserPasswordResetRequests(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP) // 没有生成验证码，退还令牌
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
-	// 7. 生成一个安全、随机的验证码
-	code, err := generateSecureCode()
+	// 7. 按照 env.passwordResetCodeFormat 生成一个安全、随机的验证码
+	code, err := env.passwordResetCodeFormat.generate()
 	if err != nil {
 		log.Println(err) // 记录生成验证码时的错误
-		writeUnexpectedErrorResponse(w)
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
-	// 8. 使用 Argon2id 对验证码进行哈希处理
+	// 8. 使用 Argon2id 对验证码进行哈希处理 (请求的时间预算已经用完时不开始哈希)
+	if requestBudgetExceeded(r) {
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP)
+		writeRequestTimeoutErrorResponse(w)
+		return
+	}
 	codeHash, err := argon2id.Hash(code)
 	if err != nil {
 		log.Println(err) // 记录哈希处理时的错误
-		writeUnexpectedErrorResponse(w)
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// 9. 在数据库中创建密码重置请求记录，存储用户ID和验证码哈希
-	resetRequest, err := createPasswordResetRequest(env.db, r.Context(), userId, codeHash)
+	resetRequest, err := createPasswordResetRequest(env.db, r.Context(), env.generateId, userId, codeHash, env.passwordResetRequestLimit())
+	if errors.Is(err, ErrTooManyActivePasswordResetRequests) {
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP)
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
 	if err != nil {
 		log.Println(err) // 记录数据库插入错误
-		writeUnexpectedErrorResponse(w)
+		env.codeDeliveryRateLimit.refund(codeDeliveryFlowPasswordReset, userId, data.ClientIP)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	// 开发模式下保存一份要发送的邮件 (见 dev-email.go)
+	env.depositDevEmail(DevEmailTypePasswordReset, userId, "", code)
 
 	// 10. 成功响应：返回状态码 200 和包含请求详情及 *原始验证码* 的 JSON
 	// 注意：这里返回原始验证码 code 是为了让调用方（例如后端服务）能够将其发送给用户（通过邮件等方式）
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // 使用常量 http.StatusOK 更清晰
-	w.Write([]byte(resetRequest.EncodeToJSONWithCode(code))) // 使用带 code 的编码方法
+	w.Write([]byte(resetRequest.EncodeToJSONWithCode(code, requestTimeFormat(env, r)))) // 使用带 code 的编码方法
 }
 
 // handleGetPasswordResetRequestRequest 处理获取特定密码重置请求详情的 API 调用。
@@ -147,7 +257,7 @@ func handleCreateUserPasswordResetRequestRequest(env *Environment, w http.Respon
 // 1. Request Secret Verification.
 // 2. Accept Header Verification (JSON).
 // 3. Request Existence Check.
-// 4. Expiry Check: 如果请求已过期，则将其删除并返回 404。
+// 4. Expiry Check: 如果请求已过期，则返回 404 (见 ExpectedErrorExpiredRequest)。
 //
 // 参数:
 //   env (*Environment): 应用环境。
@@ -178,29 +288,57 @@ func handleGetPasswordResetRequestRequest(env *Environment, w http.ResponseWrite
 	if err != nil {
 		// 其他数据库错误
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 4. 检查请求是否已过期
-	// time.Now().Compare(t) 返回: -1 (now < t), 0 (now == t), 1 (now > t)
-	if time.Now().Compare(resetRequest.ExpiresAt) >= 0 { // 如果当前时间晚于或等于过期时间
-		// 尝试删除已过期的请求
-		err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
-		if err != nil {
-			// 记录删除错误，但仍然按过期处理
-			log.Println(err)
-			// 注意：这里原代码返回了 UnexpectedError，但逻辑上应该返回 404，因为请求已失效
-			// writeUnexpectedErrorResponse(w)
-			// return
-		}
-		// 返回 404 Not Found，表示请求无效（已过期）
+	if resetRequest.IsExpired(time.Now()) {
+		// 读取请求的端点把过期的请求当作不存在
 		writeNotFoundErrorResponse(w)
 		return
 	}
 	// 5. 成功响应：返回请求详情（不包含验证码）
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // 200 OK
-	w.Write([]byte(resetRequest.EncodeToJSON()))
+	w.Write([]byte(resetRequest.EncodeToJSON(requestTimeFormat(env, r))))
+}
+
+// handleGetPasswordResetRequestUserRequest 处理 GET /password-reset-requests/:request_id/user 请求，
+// 返回密码重置请求所属用户的模型，让重置页面不需要再调用 GET /users/:user_id 就能显示用户信息。
+// 和 GET /password-reset-requests/:request_id 一样，已过期的请求被删除后返回 404。
+func handleGetPasswordResetRequestUserRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// 1. 验证请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Accept 头
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// 3. 获取密码重置请求和所属的用户
+	resetRequestId := params.ByName("request_id")
+	resetRequest, user, err := getPasswordResetRequestAndUser(env.db, r.Context(), resetRequestId)
+	if errors.Is(err, ErrRecordNotFound) {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	// 4. 已过期的请求按不存在处理
+	if resetRequest.IsExpired(time.Now()) {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeUserToJSON(user, requestTimeFormat(env, r))))
 }
 
 // handleVerifyPasswordResetRequestEmailRequest 处理验证密码重置代码的 API 调用。
@@ -211,7 +349,7 @@ func handleGetPasswordResetRequestRequest(env *Environment, w http.ResponseWrite
 // 1. Request Secret Verification.
 // 2. Content-Type Header Verification (JSON).
 // 3. Request Existence Check.
-// 4. Expiry Check.
+// 4. Expiry Check: 已过期的请求返回 ExpectedErrorExpiredRequest。
 // 5. Code Presence Check: 确保请求体中包含 'code'。
 // 6. Rate Limiting (可选, 基于 ClientIP): 限制密码哈希相关的操作频率。
 // 7. Attempt Limiting: 限制对 *同一个* 重置请求 ID 的验证尝试次数 (verifyPasswordResetCodeLimitCounter)。
@@ -245,20 +383,12 @@ func handleVerifyPasswordResetRequestEmailRequest(env *Environment, w http.Respo
 	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 4. 检查请求是否已过期
-	if time.Now().Compare(resetRequest.ExpiresAt) >= 0 {
-		// 尝试删除已过期的请求
-		err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
-		if err != nil {
-			log.Println(err)
-			// 同样，这里原代码返回 UnexpectedError，改为返回 404 更合理
-			// writeUnexpectedErrorResponse(w)
-			// return
-		}
-		writeNotFoundErrorResponse(w)
+	if resetRequest.IsExpired(time.Now()) {
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
 		return
 	}
 
@@ -276,20 +406,28 @@ func handleVerifyPasswordResetRequestEmailRequest(env *Environment, w http.Respo
 	err = json.Unmarshal(body, &data)
 	if err != nil {
 		// JSON 解析失败
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	// 5. 检查验证码是否提供，去掉空白字符后不能为空
+	if data.Code == nil {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
 		return
 	}
-	// 5. 检查验证码是否提供且不为空
-	if data.Code == nil || *data.Code == "" {
+	code, ok := normalizeCode(*data.Code, false)
+	if !ok {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
 		return
 	}
+	code = env.passwordResetCodeFormat.normalizeInput(code)
 
 	// 6. 应用基于 IP 的密码哈希速率限制（如果提供了 IP）
 	if data.ClientIP != "" && !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
 		return
 	}
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
 
 	// 7. 应用基于请求 ID 的验证尝试次数限制
 	// consume 方法会减少计数器的值，如果减到 0 以下则返回 false
@@ -299,7 +437,7 @@ func handleVerifyPasswordResetRequestEmailRequest(env *Environment, w http.Respo
 		if err != nil {
 			// 记录删除错误，但仍然按超限处理
 			log.Println(err)
-			writeUnexpectedErrorResponse(w)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
 			return
 		}
 		// 返回请求过多错误
@@ -308,17 +446,18 @@ func handleVerifyPasswordResetRequestEmailRequest(env *Environment, w http.Respo
 	}
 
 	// 8. 使用 Argon2id 验证提供的代码是否与存储的哈希匹配
-	validCode, err := argon2id.Verify(resetRequest.CodeHash, *data.Code)
+	validCode, err := argon2id.Verify(resetRequest.CodeHash, code)
 	if err != nil {
 		// 验证过程中发生内部错误
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// 如果验证码不正确
 	if !validCode {
 		// 返回密码不正确（这里复用了密码错误，也可以定义专门的验证码错误）
+		env.delayAuthenticationFailure(r.Context())
 		writeExpectedErrorResponse(w, ExpectedErrorIncorrectPassword)
 		return
 	}
@@ -344,7 +483,7 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	var data struct {
@@ -354,9 +493,10 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
 		return
 	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
 
 	if data.RequestId == nil {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
@@ -367,24 +507,22 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 		return
 	}
 
-	resetRequest, err := getPasswordResetRequest(env.db, r.Context(), *data.RequestId)
+	resetRequest, user, err := getPasswordResetRequestAndUser(env.db, r.Context(), *data.RequestId)
 	if errors.Is(err, ErrRecordNotFound) {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidRequest)
 		return
 	}
 	if err != nil {
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// If now is or after expiration
-	if time.Now().Compare(resetRequest.ExpiresAt) >= 0 {
-		err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
-		if err != nil {
-			log.Println(err)
-			writeUnexpectedErrorResponse(w)
-			return
-		}
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidRequest)
+	if resetRequest.IsExpired(time.Now()) {
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
+		return
+	}
+	if !userHasPassword(user.PasswordHash) {
+		writeExpectedErrorResponse(w, ExpectedErrorPasswordNotSet)
 		return
 	}
 
@@ -393,10 +531,10 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
 		return
 	}
-	strongPassword, err := verifyPasswordStrength(password)
+	strongPassword, err := env.verifyPasswordStrength(r.Context(), password)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !strongPassword {
@@ -408,23 +546,35 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
 		return
 	}
-	passwordHash, err := argon2id.Hash(password)
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	passwordHash, err := env.hashPassword(password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
-	validResetRequest, err := resetUserPasswordWithPasswordResetRequest(env.db, r.Context(), resetRequest.Id, passwordHash)
+	validResetRequest, err := resetUserPasswordWithPasswordResetRequest(env.db, r.Context(), resetRequest.Id, passwordHash, env.keepUsedPasswordResetRequests, env.revokeSessionsOnPasswordChange)
+	env.invalidateCachedUser(resetRequest.UserId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !validResetRequest {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidRequest)
 		return
 	}
+	writeAuditLog(env, r, AuditActionPasswordReset, resetRequest.UserId, data.ClientIP)
+	if env.revokeSessionsOnPasswordChange {
+		env.logSessionsRevoked(resetRequest.UserId, "password_reset")
+	}
+	// 通知用户密码已经更改 (见 password-change-notification.go)
+	notifyPasswordChange(env, r.Context(), resetRequest.UserId, PasswordChangeMethodReset, data.ClientIP)
 
 	w.WriteHeader(204)
 }
@@ -450,7 +600,8 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 // 1. Request Secret Verification.
 // 2. Content-Type Header Verification (JSON).
 // 3. Request Existence Check (根据 Request ID)。
-// 4. Expiry Check (再次检查，以防万一)。
+// 4. Expiry Check (再次检查，以防万一): 已过期的请求返回 ExpectedErrorExpiredRequest。
+//    没有密码的用户返回 ExpectedErrorPasswordNotSet。
 // 5. New Password Presence & Constraint Check.
 // 6. New Password Strength Check.
 // 7. Rate Limiting (可选, 基于 ClientIP): 限制密码哈希操作。
@@ -487,9 +638,10 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
 		return
 	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
 	// 检查必需的字段是否提供
 	if data.RequestId == nil || *data.RequestId == "" || data.Password == nil {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
@@ -497,26 +649,26 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 	}
 
 	// 3. 再次获取密码重置请求，确保它仍然存在且有效
-	resetRequest, err := getPasswordResetRequest(env.db, r.Context(), *data.RequestId)
+	resetRequest, user, err := getPasswordResetRequestAndUser(env.db, r.Context(), *data.RequestId)
 	if errors.Is(err, ErrRecordNotFound) {
-		// 如果找不到请求（可能已被删除或过期），返回不允许操作
-		writeExpectedErrorResponse(w, ExpectedErrorNotAllowed)
+		// 找不到请求 (ID 不存在，或者已经被使用或删除)
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidRequest)
 		return
 	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 4. 再次检查是否过期
-	if time.Now().Compare(resetRequest.ExpiresAt) >= 0 {
-		// 尝试删除
-		err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
-		if err != nil {
-			log.Println(err)
-		}
-		// 返回不允许操作
-		writeExpectedErrorResponse(w, ExpectedErrorNotAllowed)
+	if resetRequest.IsExpired(time.Now()) {
+		// 返回请求已过期
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
+		return
+	}
+	// 请求创建之后用户可能已经变成没有密码的用户，不允许通过重置流程设置密码
+	if !userHasPassword(user.PasswordHash) {
+		writeExpectedErrorResponse(w, ExpectedErrorPasswordNotSet)
 		return
 	}
 
@@ -527,10 +679,10 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 	}
 
 	// 6. 检查新密码强度
-	strongPassword, err := verifyPasswordStrength(*data.Password)
+	strongPassword, err := env.verifyPasswordStrength(r.Context(), *data.Password)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !strongPassword {
@@ -543,21 +695,28 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
 		return
 	}
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
 
-	// 哈希新密码
-	passwordHash, err := argon2id.Hash(*data.Password)
+	// 哈希新密码，同时进行的哈希数量受 passwordHashingConcurrencyLimit 限制
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	passwordHash, err := env.hashPassword(*data.Password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// 8. 在数据库中执行密码重置操作
-	// 这个函数应该原子地更新用户密码并删除重置请求
-	ok, err := resetUserPasswordWithPasswordResetRequest(env.db, r.Context(), *data.RequestId, passwordHash)
+	// 这个函数原子地更新用户密码并删除重置请求 (或者在 keepUsedPasswordResetRequests 时标记为已使用)
+	ok, err := resetUserPasswordWithPasswordResetRequest(env.db, r.Context(), *data.RequestId, passwordHash, env.keepUsedPasswordResetRequests, env.revokeSessionsOnPasswordChange)
+	// 无论是否成功都使缓存的用户失效 (见 user-cache.go)
+	env.invalidateCachedUser(resetRequest.UserId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 如果 resetUserPassword... 返回 false，说明重置由于某种原因失败（例如请求已被使用或删除）
@@ -567,7 +726,13 @@ func handleResetPasswordRequest(env *Environment, w http.ResponseWriter, r *http
 		return
 	}
 
-	// 密码重置成功
+	// 密码重置成功，写入审计日志
+	writeAuditLog(env, r, AuditActionPasswordReset, resetRequest.UserId, data.ClientIP)
+	if env.revokeSessionsOnPasswordChange {
+		env.logSessionsRevoked(resetRequest.UserId, "password_reset")
+	}
+	// 通知用户密码已经更改 (见 password-change-notification.go)
+	notifyPasswordChange(env, r.Context(), resetRequest.UserId, PasswordChangeMethodReset, data.ClientIP)
 	// 响应 204 No Content
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -590,16 +755,14 @@ func handleDeletePasswordResetRequestRequest(env *Environment, w http.ResponseWr
 	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// If now is or after expiration
-	if time.Now().Compare(resetRequest.ExpiresAt) >= 0 {
+	if resetRequest.IsExpired(time.Now()) {
 		err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
 		if err != nil {
 			log.Println(err)
-			writeUnexpectedErrorResponse(w)
-			return
 		}
 		writeNotFoundErrorResponse(w)
 		return
@@ -608,13 +771,83 @@ func handleDeletePasswordResetRequestRequest(env *Environment, w http.ResponseWr
 	err = deletePasswordResetRequest(env.db, r.Context(), resetRequest.Id)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	w.WriteHeader(204)
 }
 
+// handleExtendPasswordResetRequestRequest 处理 POST /password-reset-requests/:request_id/extend，
+// 把请求的过期时间推迟 env.passwordResetRequestExtensionDuration()，返回更新后的请求。
+//
+// 安全检查:
+// 1. Request Secret Verification.
+// 2. Accept Header Verification (JSON).
+// 3. Request Existence Check.
+// 4. Expiry Check: 已过期的请求不能延长，返回 ExpectedErrorExpiredRequest。
+// 5. Lifetime Check: 延长后总有效期超过 env.passwordResetRequestMaxLifetimeDuration() 时返回 ExpectedErrorExtensionLimitReached。
+//
+// 参数:
+//   env (*Environment): 应用环境。
+//   w (http.ResponseWriter): HTTP 响应写入器。
+//   r (*http.Request): 收到的 HTTP 请求。
+//   params (httprouter.Params): URL 参数，包含 'request_id'。
+func handleExtendPasswordResetRequestRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// 1. 验证请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Accept 头
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// 3. 获取密码重置请求
+	resetRequest, err := getPasswordResetRequest(env.db, r.Context(), params.ByName("request_id"))
+	if errors.Is(err, ErrRecordNotFound) {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	// 4. 已过期的请求不能延长
+	now := time.Now()
+	if resetRequest.IsExpired(now) {
+		writeExpectedErrorResponse(w, ExpectedErrorExpiredRequest)
+		return
+	}
+	// 5. 检查延长后的总有效期
+	maxLifetime := env.passwordResetRequestMaxLifetimeDuration()
+	expiresAt := resetRequest.ExpiresAt.Add(env.passwordResetRequestExtensionDuration())
+	if expiresAt.Sub(resetRequest.CreatedAt) > maxLifetime {
+		writeExpectedErrorResponse(w, ExpectedErrorExtensionLimitReached)
+		return
+	}
+
+	// 更新时再检查一次，请求在这期间被使用或删除时返回 404
+	extended, err := extendPasswordResetRequest(env.db, r.Context(), resetRequest.Id, resetRequest.ExpiresAt, expiresAt, now)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !extended {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+	resetRequest.ExpiresAt = expiresAt
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(resetRequest.EncodeToJSON(requestTimeFormat(env, r))))
+}
+
 func handleGetUserPasswordResetRequestsRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	if !verifyRequestSecret(env.secret, r) {
 		writeNotAuthenticatedErrorResponse(w)
@@ -629,7 +862,7 @@ func handleGetUserPasswordResetRequestsRequest(env *Environment, w http.Response
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -640,31 +873,28 @@ func handleGetUserPasswordResetRequestsRequest(env *Environment, w http.Response
 	err = deleteExpiredUserPasswordResetRequests(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	resetRequest, err := getUserPasswordResetRequests(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
+	format := requestTimeFormat(env, r)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	if len(resetRequest) == 0 {
-		w.Write([]byte("[]"))
-		return
+	array := newJSONArrayWriter(w)
+	for _, request := range resetRequest {
+		array.Write(request.jsonValue(format))
 	}
-	w.Write([]byte("["))
-	for i, user := range resetRequest {
-		w.Write([]byte(user.EncodeToJSON()))
-		if i != len(resetRequest)-1 {
-			w.Write([]byte(","))
-		}
+	err = array.Close()
+	if err != nil {
+		log.Println(err)
 	}
-	w.Write([]byte("]"))
 }
 
 func handleDeleteUserPasswordResetRequestsRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -681,7 +911,7 @@ func handleDeleteUserPasswordResetRequestsRequest(env *Environment, w http.Respo
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -692,7 +922,7 @@ func handleDeleteUserPasswordResetRequestsRequest(env *Environment, w http.Respo
 	err = deleteUserPasswordResetRequests(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	w.WriteHeader(204)
@@ -700,42 +930,115 @@ func handleDeleteUserPasswordResetRequestsRequest(env *Environment, w http.Respo
 
 // createPasswordResetRequest 在数据库中创建一个新的密码重置请求记录。
 // 它生成一个唯一的请求 ID (UUID)，设置创建时间和过期时间（通常是当前时间 + 一个固定的有效期），
-// 然后调用 insertPasswordResetRequest 将记录插入数据库。
+// 然后将记录插入数据库。
+// 用户有效的请求数量达到 limit.max 时，limit.reject 为 true 则返回 ErrTooManyActivePasswordResetRequests
+// (见 insertPasswordResetRequestWithinLimit)，否则在插入之前的同一个事务中删除最早的有效请求
+// (见 makeRoomForPasswordResetRequest)，使插入后正好有 limit.max 个。
 //
 // 参数:
 //   db (*sql.DB): 数据库连接池。
 //   ctx (context.Context): 请求上下文。
+//   generateId (func() (string, error)): 请求 ID 生成器，通常是 env.generateId。
 //   userId (string): 请求密码重置的用户的 ID。
 //   codeHash (string): 使用 Argon2id 哈希过的验证码。
+//   limit (activePasswordResetRequestLimit): 有效请求的上限，通常是 env.passwordResetRequestLimit()。
 //
 // 返回值:
 //   PasswordResetRequest: 创建成功的密码重置请求对象。
-//   error: 如果生成 UUID 或插入数据库时发生错误，则返回错误。
-func createPasswordResetRequest(db *sql.DB, ctx context.Context, userId string, codeHash string) (PasswordResetRequest, error) {
-	// 生成一个新的 UUID 作为请求 ID
-	requestId, err := newId()
+//   error: 如果达到上限并且配置为拒绝 (ErrTooManyActivePasswordResetRequests)，
+//          或者生成 UUID 或访问数据库时发生错误，则返回错误。
+func createPasswordResetRequest(db *sql.DB, ctx context.Context, generateId func() (string, error), userId string, codeHash string, limit activePasswordResetRequestLimit) (PasswordResetRequest, error) {
+	// 获取当前时间，截断到整秒，这样返回的请求和数据库中存储的 Unix 时间戳一致
+	now := time.Unix(time.Now().Unix(), 0)
+	// 删除最早的请求和插入在同一个事务中进行，并发请求不会超过上限
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return PasswordResetRequest{}, fmt.Errorf("failed to create password reset request id: %w", err)
+		return PasswordResetRequest{}, err
+	}
+	defer tx.Rollback() // Commit 成功后 Rollback 不做任何事
+	if !limit.reject {
+		err = makeRoomForPasswordResetRequest(tx, ctx, userId, now, limit)
+		if err != nil {
+			return PasswordResetRequest{}, err
+		}
 	}
-	// 获取当前时间
-	now := time.Now()
 	// 创建 PasswordResetRequest 结构体实例
 	request := PasswordResetRequest{
-		Id:        requestId,                     // 请求的唯一 ID
 		UserId:    userId,                        // 关联的用户 ID
 		CreatedAt: now,                         // 创建时间
 		ExpiresAt: now.Add(time.Minute * 15), // 过期时间（例如，15分钟后）
 		CodeHash:  codeHash,                    // 验证码的 Argon2id 哈希值
 	}
-	// 将请求记录插入数据库
-	err = insertPasswordResetRequest(db, ctx, &request)
+	// 生成请求 ID 并将请求记录插入数据库，ID 冲突时会重新生成 (见 db.go 中的 insertWithGeneratedId)
+	requestId, err := insertWithGeneratedId(generateId, func(id string) error {
+		return insertPasswordResetRequestWithinLimit(tx, ctx, id, &request, limit)
+	})
+	if errors.Is(err, ErrTooManyActivePasswordResetRequests) {
+		return PasswordResetRequest{}, err
+	}
 	if err != nil {
 		return PasswordResetRequest{}, fmt.Errorf("failed to insert password reset request: %w", err)
 	}
+	err = tx.Commit()
+	if err != nil {
+		return PasswordResetRequest{}, err
+	}
+	request.Id = requestId
 	// 返回创建的请求对象
 	return request, nil
 }
 
+// makeRoomForPasswordResetRequest 在插入新的密码重置请求之前删除用户最早的有效请求，只保留 limit.max - 1 个。
+// 过期或已使用的请求不计入上限。事务的第一条语句就是写操作，所以一开始就取得写锁，
+// 并发的事务按 busy_timeout 等待，不会在读之后升级为写锁时失败。
+//
+// 参数:
+//   tx (*sql.Tx): 插入新请求的事务。
+//   ctx (context.Context): 请求上下文。
+//   userId (string): 请求密码重置的用户的 ID。
+//   now (time.Time): 当前时间，用于区分有效和过期的请求。
+//   limit (activePasswordResetRequestLimit): 有效请求的上限。
+//
+// 返回值:
+//   error: 访问数据库时发生错误则返回该错误。
+func makeRoomForPasswordResetRequest(tx *sql.Tx, ctx context.Context, userId string, now time.Time, limit activePasswordResetRequestLimit) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM password_reset_request WHERE id IN (
+		SELECT id FROM password_reset_request WHERE user_id = ? AND expires_at > ? AND used_at IS NULL
+		ORDER BY created_at DESC, rowid DESC LIMIT -1 OFFSET ?
+	)`, userId, now.Unix(), limit.max-1)
+	return err
+}
+
+// insertPasswordResetRequestWithinLimit 在事务 tx 中插入 ID 为 id 的密码重置请求。
+// limit.reject 为 true 时，检查上限和插入是同一条 INSERT ... SELECT ... WHERE 语句：
+// 如果先用 SELECT 计数再 INSERT，事务要在读之后把读锁升级为写锁，WAL 模式下另一个连接已经提交了写入时
+// 会立即返回 SQLITE_BUSY，busy_timeout 也不会重试。
+//
+// 返回值:
+//   error: 用户的有效请求已经达到 limit.max 并且 limit.reject 为 true 时返回 ErrTooManyActivePasswordResetRequests，
+//          访问数据库时发生错误则返回该错误。
+func insertPasswordResetRequestWithinLimit(tx *sql.Tx, ctx context.Context, id string, request *PasswordResetRequest, limit activePasswordResetRequestLimit) error {
+	if !limit.reject {
+		_, err := tx.ExecContext(ctx, "INSERT INTO password_reset_request(id, user_id, created_at, expires_at, code_hash) VALUES(?, ?, ?, ?, ?)", id, request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), request.CodeHash)
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `INSERT INTO password_reset_request(id, user_id, created_at, expires_at, code_hash)
+SELECT ?, ?, ?, ?, ? WHERE (
+	SELECT count(*) FROM password_reset_request WHERE user_id = ? AND expires_at > ? AND used_at IS NULL
+) < ?`, id, request.UserId, request.CreatedAt.Unix(), request.ExpiresAt.Unix(), request.CodeHash, request.UserId, request.CreatedAt.Unix(), limit.max)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTooManyActivePasswordResetRequests
+	}
+	return nil
+}
+
 // insertPasswordResetRequest 将一个 PasswordResetRequest 对象插入到数据库的 user_password_reset_request 表中。
 //
 // 参数:
@@ -751,6 +1054,7 @@ func insertPasswordResetRequest(db *sql.DB, ctx context.Context, request *Passwo
 }
 
 // getPasswordResetRequest 根据请求 ID 从数据库中检索单个密码重置请求记录。
+// 已使用的请求 (见 resetUserPasswordWithPasswordResetRequest) 视为不存在。
 // 如果找不到记录，它会返回 ErrRecordNotFound 错误。
 //
 // 参数:
@@ -766,7 +1070,7 @@ func getPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string)
 	var createdAt int64
 	var expiresAt int64
 	// 查询数据库
-	err := db.QueryRowContext(ctx, "SELECT id, user_id, created_at, expires_at, code_hash FROM user_password_reset_request WHERE id = ?", requestId).Scan(&request.Id, &request.UserId, &createdAt, &expiresAt, &request.CodeHash)
+	err := db.QueryRowContext(ctx, "SELECT id, user_id, created_at, expires_at, code_hash FROM user_password_reset_request WHERE id = ? AND used_at IS NULL", requestId).Scan(&request.Id, &request.UserId, &createdAt, &expiresAt, &request.CodeHash)
 	if err != nil {
 		// 如果是没找到记录的错误，返回特定的 ErrRecordNotFound
 		if errors.Is(err, sql.ErrNoRows) {
@@ -781,6 +1085,30 @@ func getPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string)
 	return request, nil
 }
 
+// getPasswordResetRequestAndUser 获取密码重置请求和它所属的用户。
+// 不检查请求是否过期，调用者需要自己检查。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   requestId (string): 密码重置请求的 ID。
+//
+// 返回值:
+//   PasswordResetRequest: 密码重置请求。
+//   User: 请求所属的用户。
+//   error: 请求或用户不存在时返回 ErrRecordNotFound，其他数据库错误原样返回。
+func getPasswordResetRequestAndUser(db *sql.DB, ctx context.Context, requestId string) (PasswordResetRequest, User, error) {
+	resetRequest, err := getPasswordResetRequest(db, ctx, requestId)
+	if err != nil {
+		return PasswordResetRequest{}, User{}, err
+	}
+	user, err := getUser(db, ctx, resetRequest.UserId)
+	if err != nil {
+		return PasswordResetRequest{}, User{}, err
+	}
+	return resetRequest, user, nil
+}
+
 // getUserPasswordResetRequests 根据用户 ID 从数据库中检索该用户的所有未过期的密码重置请求记录。
 // 注意：此函数查询的是所有请求，包括已过期的。在 API 层面 (`handleGetUserPasswordResetRequestsRequest`) 通常只返回未过期的，或者这里可以增加 `expires_at > ?` 条件。
 // 目前实现是获取所有记录。
@@ -795,7 +1123,7 @@ func getPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string)
 //   error: 如果查询或扫描数据时发生错误，则返回错误。
 func getUserPasswordResetRequests(db *sql.DB, ctx context.Context, userId string) ([]PasswordResetRequest, error) {
 	// 查询该用户的所有密码重置请求
-	rows, err := db.QueryContext(ctx, "SELECT id, user_id, created_at, expires_at, code_hash FROM user_password_reset_request WHERE user_id = ?", userId)
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, created_at, expires_at, code_hash FROM user_password_reset_request WHERE user_id = ? AND used_at IS NULL", userId)
 	if err != nil {
 		return nil, err
 	}
@@ -828,13 +1156,36 @@ func getUserPasswordResetRequests(db *sql.DB, ctx context.Context, userId string
 	return requests, nil
 }
 
-func resetUserPasswordWithPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string, passwordHash string) (bool, error) {
+// resetUserPasswordWithPasswordResetRequest 在一个事务中使用未过期、未使用的密码重置请求更新用户的密码，
+// 并使该用户的所有密码重置请求失效。
+// keepUsed 为 false 时删除这些请求。keepUsed 为 true 时 (env.keepUsedPasswordResetRequests) 把使用的请求
+// 标记为已使用 (used_at) 并保留，用于审计，其他未使用的请求仍然删除。已使用的请求不能再次使用，
+// 也不会被 getPasswordResetRequest 等函数返回，cleanUpDatabase 在 usedPasswordResetRequestRetention 之后删除它们。
+// revokeSessions 为 true 时 (env.revokeSessionsOnPasswordChange) 在同一个事务中删除用户的所有会话。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   requestId (string): 密码重置请求的 ID。
+//   passwordHash (string): 新密码的哈希。
+//   keepUsed (bool): 是否保留已使用的请求。
+//   revokeSessions (bool): 是否删除用户的所有会话。
+//
+// 返回值:
+//   bool: 请求不存在、已过期或已使用时返回 false。
+//   error: 数据库操作失败时返回错误。
+func resetUserPasswordWithPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string, passwordHash string, keepUsed bool, revokeSessions bool) (bool, error) {
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return false, err
 	}
+	now := time.Now().Unix()
 	var userId string
-	err = tx.QueryRow("DELETE FROM password_reset_request WHERE id = ? AND expires_at > ? RETURNING user_id", requestId, time.Now().Unix()).Scan(&userId)
+	if keepUsed {
+		err = tx.QueryRow("UPDATE password_reset_request SET used_at = ? WHERE id = ? AND expires_at > ? AND used_at IS NULL RETURNING user_id", now, requestId, now).Scan(&userId)
+	} else {
+		err = tx.QueryRow("DELETE FROM password_reset_request WHERE id = ? AND expires_at > ? AND used_at IS NULL RETURNING user_id", requestId, now).Scan(&userId)
+	}
 	if errors.Is(err, sql.ErrNoRows) {
 		err = tx.Commit()
 		if err != nil {
@@ -847,32 +1198,60 @@ func resetUserPasswordWithPasswordResetRequest(db *sql.DB, ctx context.Context,
 		tx.Rollback()
 		return false, err
 	}
-	_, err = tx.Exec("DELETE FROM password_reset_request WHERE user_id = ?", userId)
+	_, err = tx.Exec("DELETE FROM password_reset_request WHERE user_id = ? AND used_at IS NULL", userId)
 	if err != nil {
 		tx.Rollback()
 		return false, err
 	}
-	_, err = tx.Exec("UPDATE user SET password_hash = ? WHERE id = ?", passwordHash, userId)
+	// 验证码发送到了用户的邮箱，所以同时把邮箱标记为已验证
+	_, err = tx.Exec("UPDATE user SET password_hash = ?, email_verified = 1 WHERE id = ?", passwordHash, userId)
 	if err != nil {
 		tx.Rollback()
 		return false, err
 	}
+	if revokeSessions {
+		_, err = deleteUserSessions(tx, userId)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
 	tx.Commit()
 	return true, nil
 }
 
+// extendPasswordResetRequest 把请求的过期时间从 previousExpiresAt 更新为 expiresAt。
+// 只更新没有使用、没有过期、并且过期时间仍然是 previousExpiresAt 的请求，
+// 所以同时延长同一个请求的多个调用只有一个会成功，不会超过最长总有效期。
+//
+// 返回值:
+//   bool: 请求被更新时返回 true。
+//   error: 数据库操作失败时返回错误。
+func extendPasswordResetRequest(db *sql.DB, ctx context.Context, requestId string, previousExpiresAt time.Time, expiresAt time.Time, now time.Time) (bool, error) {
+	result, err := db.ExecContext(ctx, "UPDATE password_reset_request SET expires_at = ? WHERE id = ? AND expires_at = ? AND expires_at > ? AND used_at IS NULL", expiresAt.Unix(), requestId, previousExpiresAt.Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
 func deletePasswordResetRequest(db *sql.DB, ctx context.Context, requestId string) error {
 	_, err := db.ExecContext(ctx, "DELETE FROM password_reset_request WHERE id = ?", requestId)
 	return err
 }
 
 func deleteExpiredUserPasswordResetRequests(db *sql.DB, ctx context.Context, userId string) error {
-	_, err := db.ExecContext(ctx, "DELETE FROM password_reset_request WHERE user_id = ? AND expires_at <= ?", userId, time.Now().Unix())
+	_, err := db.ExecContext(ctx, "DELETE FROM password_reset_request WHERE user_id = ? AND expires_at <= ? AND used_at IS NULL", userId, time.Now().Add(-expiredPasswordResetRequestRetention).Unix())
 	return err
 }
 
 func deleteUserPasswordResetRequests(db *sql.DB, ctx context.Context, userId string) error {
-	_, err := db.ExecContext(ctx, "DELETE FROM password_reset_request WHERE user_id = ?", userId)
+	// 保留已使用的请求，它们只用于审计
+	_, err := db.ExecContext(ctx, "DELETE FROM password_reset_request WHERE user_id = ? AND used_at IS NULL", userId)
 	return err
 }
 
@@ -884,12 +1263,39 @@ type PasswordResetRequest struct {
 	CodeHash  string
 }
 
-func (r *PasswordResetRequest) EncodeToJSON() string {
-	encoded := fmt.Sprintf("{\"id\":\"%s\",\"user_id\":\"%s\",\"created_at\":%d,\"expires_at\":%d}", r.Id, r.UserId, r.CreatedAt.Unix(), r.ExpiresAt.Unix())
-	return encoded
+// IsExpired 返回请求在 now 时是否已经过期 (now 等于或晚于 ExpiresAt)。
+func (r *PasswordResetRequest) IsExpired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// passwordResetRequestJSON 是 PasswordResetRequest 在 API 中的 JSON 表示 (不包含验证码哈希)。
+type passwordResetRequestJSON struct {
+	Id        string   `json:"id"`
+	UserId    string   `json:"user_id"`
+	CreatedAt UnixTime `json:"created_at"`
+	ExpiresAt UnixTime `json:"expires_at"`
 }
 
-func (r *PasswordResetRequest) EncodeToJSONWithCode(code string) string {
-	encoded := fmt.Sprintf("{\"id\":\"%s\",\"user_id\":\"%s\",\"created_at\":%d,\"expires_at\":%d,\"code\":\"%s\"}", r.Id, r.UserId, r.CreatedAt.Unix(), r.ExpiresAt.Unix(), code)
-	return encoded
+// jsonValue 返回用于编码的 JSON 表示，时间戳按 format 编码。
+func (r *PasswordResetRequest) jsonValue(format timeFormat) passwordResetRequestJSON {
+	return passwordResetRequestJSON{r.Id, r.UserId, newUnixTime(r.CreatedAt, format), newUnixTime(r.ExpiresAt, format)}
+}
+
+func (r *PasswordResetRequest) EncodeToJSON(format timeFormat) string {
+	encoded, err := json.Marshal(r.jsonValue(format))
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+func (r *PasswordResetRequest) EncodeToJSONWithCode(code string, format timeFormat) string {
+	encoded, err := json.Marshal(struct {
+		passwordResetRequestJSON
+		Code string `json:"code"`
+	}{r.jsonValue(format), code})
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"         // 导入 context 包
+	"database/sql"    // 导入数据库 SQL 包
 	"encoding/json" // 导入 JSON 编码/解码包
+	"path/filepath"   // 导入路径包，用于在临时目录中构造数据库文件路径
+	"sync"            // 导入同步包，用于等待并发的 goroutine 结束
 	"testing"         // 导入 Go 的测试包
 	"time"            // 导入时间包
 
@@ -15,7 +19,7 @@ import (
 // 测试步骤：
 // 1. 创建一个 PasswordResetRequest 实例。
 // 2. 定义预期的 JSON 输出结构 (PasswordResetRequestJSON)，只包含上述四个字段。
-// 3. 调用 request.EncodeToJSON() 获取 JSON 字符串。
+// 3. 调用 request.EncodeToJSON(timeFormatUnix) 获取 JSON 字符串。
 // 4. 将 JSON 字符串解码回 PasswordResetRequestJSON 结构体。
 // 5. 断言解码后的结构体与预期结构体相等。
 func TestPasswordResetRequestEncodeToJSON(t *testing.T) {
@@ -44,13 +48,27 @@ func TestPasswordResetRequestEncodeToJSON(t *testing.T) {
 	var result PasswordResetRequestJSON // 用于存储解码后的结果
 
 	// 调用 EncodeToJSON 方法，并将返回的 JSON 字符串解码到 result 中
-	err := json.Unmarshal([]byte(request.EncodeToJSON()), &result)
+	err := json.Unmarshal([]byte(request.EncodeToJSON(timeFormatUnix)), &result)
 	assert.NoError(t, err) // 断言解码过程没有错误
 
 	// 断言解码后的结果与预期结果完全一致
 	assert.Equal(t, expected, result)
 }
 
+// TestPasswordResetRequestIsExpired 测试 IsExpired 在 ExpiresAt 之前返回 false，在 ExpiresAt 及之后返回 true。
+func TestPasswordResetRequestIsExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	request := PasswordResetRequest{Id: "1", UserId: "1", CreatedAt: now, ExpiresAt: now.Add(10 * time.Minute)}
+
+	assert.False(t, request.IsExpired(now))
+	assert.False(t, request.IsExpired(request.ExpiresAt.Add(-time.Nanosecond)))
+	// 正好等于过期时间时已经过期
+	assert.True(t, request.IsExpired(request.ExpiresAt))
+	assert.True(t, request.IsExpired(request.ExpiresAt.Add(time.Second)))
+}
+
 // TestPasswordResetRequestEncodeToJSONWithCode 测试 PasswordResetRequest 结构体的 EncodeToJSONWithCode 方法。
 // 这个测试验证当调用 EncodeToJSONWithCode 时，是否序列化了 Id, UserId, CreatedAt (Unix 时间戳),
 // ExpiresAt (Unix 时间戳), 以及**传入的 code** 字段，同样忽略了结构体本身的 CodeHash。
@@ -59,7 +77,7 @@ func TestPasswordResetRequestEncodeToJSON(t *testing.T) {
 // 1. 创建一个 PasswordResetRequest 实例。
 // 2. 定义一个临时的 code 字符串。
 // 3. 定义预期的 JSON 输出结构 (PasswordResetRequestWithCodeJSON)，包含基本字段和传入的 code。
-// 4. 调用 request.EncodeToJSONWithCode(code) 获取 JSON 字符串。
+// 4. 调用 request.EncodeToJSONWithCode(code, timeFormatUnix) 获取 JSON 字符串。
 // 5. 将 JSON 字符串解码回 PasswordResetRequestWithCodeJSON 结构体。
 // 6. 断言解码后的结构体与预期结构体相等。
 func TestPasswordResetRequestEncodeToJSONWithCode(t *testing.T) {
@@ -90,7 +108,7 @@ func TestPasswordResetRequestEncodeToJSONWithCode(t *testing.T) {
 	var result PasswordResetRequestWithCodeJSON // 用于存储解码后的结果
 
 	// 调用 EncodeToJSONWithCode 方法，传入 code，并将返回的 JSON 字符串解码到 result 中
-	err := json.Unmarshal([]byte(request.EncodeToJSONWithCode(code)), &result)
+	err := json.Unmarshal([]byte(request.EncodeToJSONWithCode(code, timeFormatUnix)), &result)
 	assert.NoError(t, err) // 断言解码过程没有错误
 
 	// 断言解码后的结果与预期结果完全一致
@@ -117,3 +135,317 @@ type PasswordResetRequestWithCodeJSON struct {
 	ExpiresAtUnix int64  `json:"expires_at"` // 过期时间的 Unix 时间戳
 	Code          string `json:"code"`       // 明文重置代码，对应 JSON 中的 "code" 键
 }
+
+// TestResetUserPasswordWithPasswordResetRequest 测试重置密码后默认删除用户的所有请求，
+// keepUsed 为 true 时把使用的请求标记为已使用并保留，两种情况下请求都不能再次使用。
+// revokeSessions 为 true 时同时删除用户的所有会话，为 false 时会话保留。
+func TestResetUserPasswordWithPasswordResetRequest(t *testing.T) {
+	t.Parallel()
+
+	// setup 创建用户 1 和它的两个未过期的密码重置请求 "1" 和 "2"
+	setup := func(t *testing.T) *sql.DB {
+		db := initializeTestDB(t)
+		now := time.Unix(time.Now().Unix(), 0)
+		user := User{
+			Id:           "1",
+			CreatedAt:    now,
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, requestId := range []string{"1", "2"} {
+			_, err = db.Exec("INSERT INTO password_reset_request (id, user_id, created_at, expires_at, code_hash) VALUES (?, ?, ?, ?, ?)", requestId, user.Id, now.Unix(), now.Add(10*time.Minute).Unix(), "HASH")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	assertPasswordHash := func(t *testing.T, db *sql.DB, expected string) {
+		var passwordHash string
+		err := db.QueryRow("SELECT password_hash FROM user WHERE id = '1'").Scan(&passwordHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, passwordHash)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		valid, err := resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "NEW_HASH", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, valid)
+		assertPasswordHash(t, db, "NEW_HASH")
+
+		// 用户的所有请求都被删除
+		var count int
+		err = db.QueryRow("SELECT count(*) FROM password_reset_request").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, count)
+
+		valid, err = resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "ANOTHER_HASH", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, valid)
+		assertPasswordHash(t, db, "NEW_HASH")
+	})
+
+	t.Run("keep used", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		valid, err := resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "NEW_HASH", true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, valid)
+		assertPasswordHash(t, db, "NEW_HASH")
+
+		// 使用的请求被标记为已使用，其他未使用的请求被删除
+		var requestIds []string
+		rows, err := db.Query("SELECT id FROM password_reset_request WHERE used_at IS NOT NULL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var requestId string
+			err = rows.Scan(&requestId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requestIds = append(requestIds, requestId)
+		}
+		rows.Close()
+		assert.Equal(t, []string{"1"}, requestIds)
+		var count int
+		err = db.QueryRow("SELECT count(*) FROM password_reset_request WHERE used_at IS NULL").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, count)
+
+		// 已使用的请求不能再次使用
+		valid, err = resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "ANOTHER_HASH", true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, valid)
+		valid, err = resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "ANOTHER_HASH", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, valid)
+		assertPasswordHash(t, db, "NEW_HASH")
+	})
+
+	t.Run("revoke sessions", func(t *testing.T) {
+		t.Parallel()
+
+		for _, revokeSessions := range []bool{false, true} {
+			db := setup(t)
+			defer db.Close()
+
+			now := time.Now()
+			_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "2", now.Unix(), "HASH", "12345678")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, session := range []Session{
+				{Id: "1", UserId: "1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{Id: "2", UserId: "1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{Id: "3", UserId: "2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			} {
+				err = insertSession(db, context.Background(), &session)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			valid, err := resetUserPasswordWithPasswordResetRequest(db, context.Background(), "1", "NEW_HASH", false, revokeSessions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, valid)
+			assertPasswordHash(t, db, "NEW_HASH")
+
+			var count int
+			err = db.QueryRow("SELECT count(*) FROM session WHERE user_id = '1'").Scan(&count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revokeSessions {
+				assert.Equal(t, 0, count)
+			} else {
+				assert.Equal(t, 2, count)
+			}
+			// 其他用户的会话不受影响
+			err = db.QueryRow("SELECT count(*) FROM session WHERE user_id = '2'").Scan(&count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 1, count)
+		}
+	})
+}
+
+// TestCreatePasswordResetRequestLimit 测试用户的有效密码重置请求达到上限后，
+// 默认删除最早的有效请求，配置为拒绝时返回 ErrTooManyActivePasswordResetRequests。
+// 已过期的请求不计入上限。
+func TestCreatePasswordResetRequestLimit(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) *sql.DB {
+		db := initializeTestDB(t)
+		err := insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    time.Unix(time.Now().Unix(), 0),
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 一个已过期的请求，不计入上限
+		_, err = db.Exec("INSERT INTO password_reset_request (id, user_id, created_at, expires_at, code_hash) VALUES ('expired', '1', 0, 1, 'HASH')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	activeRequestIds := func(t *testing.T, db *sql.DB) []string {
+		rows, err := db.Query("SELECT id FROM password_reset_request WHERE expires_at > ? ORDER BY rowid", time.Now().Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var requestIds []string
+		for rows.Next() {
+			var requestId string
+			err = rows.Scan(&requestId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requestIds = append(requestIds, requestId)
+		}
+		return requestIds
+	}
+
+	t.Run("evict oldest", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		generateId := newSequenceIdGenerator("r")
+		limit := activePasswordResetRequestLimit{max: 3}
+		for i := 0; i < 3; i++ {
+			_, err := createPasswordResetRequest(db, context.Background(), generateId, "1", "HASH", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, []string{"r1", "r2", "r3"}, activeRequestIds(t, db))
+
+		// 超过上限时删除最早的有效请求
+		request, err := createPasswordResetRequest(db, context.Background(), generateId, "1", "HASH", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "r4", request.Id)
+		assert.Equal(t, []string{"r2", "r3", "r4"}, activeRequestIds(t, db))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+
+		db := setup(t)
+		defer db.Close()
+
+		generateId := newSequenceIdGenerator("r")
+		limit := activePasswordResetRequestLimit{max: 3, reject: true}
+		for i := 0; i < 3; i++ {
+			_, err := createPasswordResetRequest(db, context.Background(), generateId, "1", "HASH", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 超过上限时拒绝新的请求，已有的请求不变
+		_, err := createPasswordResetRequest(db, context.Background(), generateId, "1", "HASH", limit)
+		assert.ErrorIs(t, err, ErrTooManyActivePasswordResetRequests)
+		assert.Equal(t, []string{"r1", "r2", "r3"}, activeRequestIds(t, db))
+	})
+
+	t.Run("reject concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		// WAL 模式的文件数据库：先读后写的事务在其他连接提交写入后升级写锁会返回 SQLITE_BUSY
+		db, err := openDatabase(filepath.Join(t.TempDir(), "faroe.db"), defaultDatabaseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		_, err = db.Exec(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertUser(db, context.Background(), &User{
+			Id:           "1",
+			CreatedAt:    time.Unix(time.Now().Unix(), 0),
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const workers = 32
+		generateId := newSequenceIdGenerator("r")
+		limit := activePasswordResetRequestLimit{max: 10, reject: true}
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := createPasswordResetRequest(db, context.Background(), generateId, "1", "HASH", limit)
+				if err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		// 只有超过上限的请求被拒绝，没有其他错误
+		for err := range errs {
+			assert.ErrorIs(t, err, ErrTooManyActivePasswordResetRequests)
+		}
+		assert.Len(t, activeRequestIds(t, db), 10)
+	})
+}
+
+// TestPasswordResetRequestLimitDefault 测试没有配置上限时使用 defaultMaxActivePasswordResetRequests。
+func TestPasswordResetRequestLimitDefault(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, activePasswordResetRequestLimit{max: defaultMaxActivePasswordResetRequests}, env.passwordResetRequestLimit())
+	env.maxActivePasswordResetRequests = 2
+	env.rejectPasswordResetRequestsOverLimit = true
+	assert.Equal(t, activePasswordResetRequestLimit{max: 2, reject: true}, env.passwordResetRequestLimit())
+}
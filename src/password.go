@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"faroe/argon2id"
+)
+
+// A password pepper is a server-side secret mixed into every password before it is
+// hashed with Argon2id. The pepper is never stored in the database, so a leaked
+// database alone isn't enough to crack the hashes offline.
+//
+// Peppers are versioned so they can be rotated. A peppered hash is stored as
+//
+//	$pepper$id=<pepper id>$argon2id$v=19$...
+//
+// New hashes always use the first pepper in env.passwordPeppers. Older peppers must be
+// kept in the list for as long as hashes created with them exist. Hashes without the
+// "$pepper$" prefix were created before a pepper was configured and are verified as-is.
+
+// passwordPepperHashPrefix marks a password hash created with a pepper.
+const passwordPepperHashPrefix = "$pepper$id="
+
+// ErrUnknownPasswordPepper is returned when a hash was created with a pepper that is
+// no longer configured.
+var ErrUnknownPasswordPepper = errors.New("unknown password pepper")
+
+// PasswordPepper is a versioned server-side secret used when hashing passwords.
+type PasswordPepper struct {
+	// Id is stored with each hash and identifies which pepper to verify it with.
+	// It must not be empty or contain "$".
+	Id  string
+	Key []byte
+}
+
+// applyPasswordPepper returns the Argon2id input for a password: HMAC-SHA256(key, password).
+func applyPasswordPepper(key []byte, password string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// Each Argon2id hash allocates a lot of memory, so callers limit how many run at once
+// by acquiring env.passwordHashingConcurrencyLimit around hashPassword and verifyPassword.
+// The token bucket rate limits alone don't stop a burst of concurrent requests.
+
+// acquirePasswordHashing acquires a slot in env.passwordHashingConcurrencyLimit for clientIP
+// before an Argon2id hash or verification. It writes a 429 if no slot is free, or a 503 if the
+// request budget is already spent, since Argon2id can't be interrupted once started
+// (see withRequestTimeout), and returns false in both cases. When it returns true, the caller
+// must call env.passwordHashingConcurrencyLimit.Release(clientIP) once hashing is done.
+func (env *Environment) acquirePasswordHashing(w http.ResponseWriter, r *http.Request, clientIP string) bool {
+	if !env.passwordHashingConcurrencyLimit.Acquire(clientIP) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return false
+	}
+	if requestBudgetExceeded(r) {
+		env.passwordHashingConcurrencyLimit.Release(clientIP)
+		writeRequestTimeoutErrorResponse(w)
+		return false
+	}
+	return true
+}
+
+// minPasswordLength is the minimum length of a new password, in bytes.
+const minPasswordLength = 8
+
+// verifyPasswordStrength reports whether a new password may be used. Passwords shorter than
+// minPasswordLength are rejected, and unless env.disablePwnedPasswordsCheck is set, so are
+// passwords found in known data breaches, using env.pwnedPasswords (see pwned-passwords.go).
+func (env *Environment) verifyPasswordStrength(ctx context.Context, password string) (bool, error) {
+	if len(password) < minPasswordLength {
+		return false, nil
+	}
+	if env.disablePwnedPasswordsCheck {
+		return true, nil
+	}
+	pwned, err := env.pwnedPasswords.isPasswordPwned(ctx, password)
+	if err != nil {
+		return false, err
+	}
+	return !pwned, nil
+}
+
+// hashPassword hashes a password with Argon2id, applying the current pepper if one is configured.
+func (env *Environment) hashPassword(password string) (string, error) {
+	if len(env.passwordPeppers) == 0 {
+		return argon2id.Hash(password)
+	}
+	pepper := env.passwordPeppers[0]
+	if pepper.Id == "" || strings.Contains(pepper.Id, "$") {
+		return "", fmt.Errorf("invalid password pepper id %q", pepper.Id)
+	}
+	hash, err := argon2id.Hash(applyPasswordPepper(pepper.Key, password))
+	if err != nil {
+		return "", err
+	}
+	return passwordPepperHashPrefix + pepper.Id + hash, nil
+}
+
+// verifyPassword checks a password against a hash created by hashPassword.
+// Hashes created without a pepper are verified without one, even if a pepper is now configured.
+// Returns ErrUnknownPasswordPepper if the hash references a pepper that isn't configured.
+func (env *Environment) verifyPassword(hash string, password string) (bool, error) {
+	if !strings.HasPrefix(hash, passwordPepperHashPrefix) {
+		return argon2id.Verify(hash, password)
+	}
+	pepperId, argon2idHash, ok := strings.Cut(strings.TrimPrefix(hash, passwordPepperHashPrefix), "$")
+	if !ok {
+		return false, errors.New("invalid hash format: missing pepper id")
+	}
+	for _, pepper := range env.passwordPeppers {
+		if pepper.Id == pepperId {
+			return argon2id.Verify("$"+argon2idHash, applyPasswordPepper(pepper.Key, password))
+		}
+	}
+	return false, fmt.Errorf("%w: %s", ErrUnknownPasswordPepper, pepperId)
+}
+
+// The dummy hash is created on first use by dummyPasswordHash.
+var (
+	dummyPasswordHashOnce  sync.Once
+	dummyPasswordHashValue string
+	dummyPasswordHashErr   error
+)
+
+// dummyPasswordHash returns a hash of a random password, created once with the current
+// argon2id.DefaultParams. Endpoints that look up a user by something other than their ID
+// verify against it when the user doesn't exist, so the response takes as long as a real
+// verification. No password matches it in practice.
+func dummyPasswordHash() (string, error) {
+	dummyPasswordHashOnce.Do(func() {
+		password, err := generateSecureCode()
+		if err != nil {
+			dummyPasswordHashErr = err
+			return
+		}
+		dummyPasswordHashValue, dummyPasswordHashErr = argon2id.Hash(password)
+	})
+	return dummyPasswordHashValue, dummyPasswordHashErr
+}
+
+// calibratePasswordHashing replaces argon2id.DefaultParams with parameters whose hash takes
+// about target on this host (see argon2id.Calibrate), and logs the parameters it chose.
+// Memory never goes below the current default or above maxMemory (in KiB), and the
+// defaults are kept if they are already slower than target. It must be called at startup
+// before the server handles requests, since DefaultParams isn't synchronized.
+// Existing hashes keep verifying with the parameters stored in them.
+func calibratePasswordHashing(target time.Duration, maxMemory uint32) error {
+	defaultParams := argon2id.DefaultParams
+	params, duration, err := argon2id.Calibrate(target, defaultParams.Memory, maxMemory)
+	if err != nil {
+		return fmt.Errorf("failed to calibrate password hashing: %w", err)
+	}
+	if uint64(params.Memory)*uint64(params.Time) < uint64(defaultParams.Memory)*uint64(defaultParams.Time) {
+		log.Printf("password hashing calibration: default parameters m=%d,t=%d,p=%d are slower than the target %v, keeping them", defaultParams.Memory, defaultParams.Time, defaultParams.Parallelism, target)
+		return nil
+	}
+	argon2id.DefaultParams = params
+	log.Printf("password hashing calibrated: m=%d,t=%d,p=%d takes %v (target %v)", params.Memory, params.Time, params.Parallelism, duration.Round(time.Millisecond), target)
+	return nil
+}
+
+// Users without a password (e.g. accounts that only sign in with a passkey) are stored
+// with an empty password_hash. An empty hash never matches a password, so endpoints that
+// verify or reset passwords check userHasPassword first and return ExpectedErrorPasswordNotSet
+// instead of a generic failure.
+
+// ExpectedErrorPasswordNotSet is returned when a password operation is attempted on a user
+// without a password.
+const ExpectedErrorPasswordNotSet = "PASSWORD_NOT_SET"
+
+// userHasPassword reports whether a user's stored password hash represents a password.
+func userHasPassword(passwordHash string) bool {
+	return passwordHash != ""
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"  // 导入错误包，用于检查 ErrUnknownPasswordPepper
+	"strings" // 导入字符串包
+	"testing" // 导入 Go 的测试包
+
+	"faroe/argon2id"
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestEnvironmentHashPasswordWithPepper 测试使用 pepper 生成的哈希只能用同一个 pepper 验证。
+func TestEnvironmentHashPasswordWithPepper(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.passwordPeppers = []PasswordPepper{{Id: "1", Key: []byte("pepper_1")}}
+
+	hash, err := env.hashPassword("password123")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$pepper$id=1$argon2id$"))
+
+	valid, err := env.verifyPassword(hash, "password123")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = env.verifyPassword(hash, "password124")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 去掉 pepper 后，直接用 Argon2id 验证原始密码会失败
+	valid, err = argon2id.Verify(strings.TrimPrefix(hash, "$pepper$id=1"), "password123")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 相同 ID 但密钥不同的 pepper 无法验证
+	otherEnv := createEnvironment(nil, nil)
+	otherEnv.passwordPeppers = []PasswordPepper{{Id: "1", Key: []byte("pepper_2")}}
+	valid, err = otherEnv.verifyPassword(hash, "password123")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 没有配置对应 ID 的 pepper 时返回 ErrUnknownPasswordPepper
+	noPepperEnv := createEnvironment(nil, nil)
+	_, err = noPepperEnv.verifyPassword(hash, "password123")
+	assert.True(t, errors.Is(err, ErrUnknownPasswordPepper))
+
+	// ID 不能为空或包含 "$"
+	otherEnv.passwordPeppers = []PasswordPepper{{Id: "a$b", Key: []byte("pepper_2")}}
+	_, err = otherEnv.hashPassword("password123")
+	assert.Error(t, err)
+}
+
+// TestEnvironmentHashPasswordPepperRotation 测试轮换 pepper：新哈希使用第一个 pepper，
+// 用旧 pepper 和没有 pepper 生成的哈希只要旧 pepper 还在列表中就仍然可以验证。
+func TestEnvironmentHashPasswordPepperRotation(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+
+	unpepperedHash, err := env.hashPassword("password123")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(unpepperedHash, "$argon2id$"))
+
+	env.passwordPeppers = []PasswordPepper{{Id: "1", Key: []byte("pepper_1")}}
+	hash1, err := env.hashPassword("password123")
+	assert.NoError(t, err)
+
+	// 轮换：新的 pepper 放在最前面，旧的 pepper 保留用于验证
+	env.passwordPeppers = []PasswordPepper{{Id: "2", Key: []byte("pepper_2")}, {Id: "1", Key: []byte("pepper_1")}}
+	hash2, err := env.hashPassword("password123")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash2, "$pepper$id=2$"))
+
+	for _, hash := range []string{unpepperedHash, hash1, hash2} {
+		valid, err := env.verifyPassword(hash, "password123")
+		assert.NoError(t, err)
+		assert.True(t, valid, hash)
+	}
+
+	// 移除旧的 pepper 后，用它生成的哈希无法再验证
+	env.passwordPeppers = env.passwordPeppers[:1]
+	_, err = env.verifyPassword(hash1, "password123")
+	assert.True(t, errors.Is(err, ErrUnknownPasswordPepper))
+	valid, err := env.verifyPassword(hash2, "password123")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 检查密码是否泄露时使用 Pwned Passwords API 的 k-anonymity 接口：只发送密码 SHA-1 哈希的前 5 个字符，
+// 在返回的后缀列表中查找剩下的部分。
+// 每次设置或重置密码都会发起一次外部 HTTP 请求，短时间内大量注册时可能耗尽 socket 和文件描述符，
+// 所以 pwnedPasswordsClient 限制同时进行的请求数，超过的请求在超时之前排队等待。
+// 同一个前缀的查询结果会缓存一段时间，进一步减少请求数。
+
+// 没有单独配置时使用的并发请求数上限和缓存时间。
+const (
+	defaultPwnedPasswordsMaxConcurrentRequests = 10
+	defaultPwnedPasswordsCacheTTL              = time.Hour
+)
+
+// pwnedPasswordsRequestTimeout 是一次查询 (包括排队等待和 HTTP 请求) 的超时时间。
+const pwnedPasswordsRequestTimeout = 5 * time.Second
+
+// pwnedPasswordsCacheMaxSize 是缓存的前缀数量上限，超过时清空缓存。
+const pwnedPasswordsCacheMaxSize = 10_000
+
+// pwnedPasswordsClient 查询 Pwned Passwords API，限制并发请求数并缓存查询结果。
+// 它是并发安全的。
+type pwnedPasswordsClient struct {
+	baseURL    string        // API 地址，通常是 env.pwnedPasswordsURL()
+	httpClient *http.Client  // nil 时使用 http.DefaultClient
+	permits    chan struct{} // 并发请求名额，缓冲区大小即上限。nil 表示不限制
+	cacheTTL   time.Duration // 查询结果的缓存时间，小于等于 0 表示不缓存
+
+	mu    *sync.Mutex                    // 保护 cache
+	cache map[string]pwnedPasswordsRange // 哈希前缀 -> 查询结果
+}
+
+// pwnedPasswordsRange 是一个哈希前缀缓存的查询结果。
+type pwnedPasswordsRange struct {
+	body      string    // API 返回的 "后缀:次数" 列表
+	expiresAt time.Time // 缓存的过期时间
+}
+
+// newPwnedPasswordsClient 创建 Pwned Passwords API 客户端。
+// 参数:
+//   baseURL string: API 地址，例如 defaultPwnedPasswordsAPIURL。
+//   maxConcurrentRequests int: 最多同时进行多少个 HTTP 请求。小于等于 0 表示不限制。
+//   cacheTTL time.Duration: 查询结果的缓存时间。小于等于 0 表示不缓存。
+func newPwnedPasswordsClient(baseURL string, maxConcurrentRequests int, cacheTTL time.Duration) *pwnedPasswordsClient {
+	client := &pwnedPasswordsClient{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		cacheTTL: cacheTTL,
+		mu:       &sync.Mutex{},
+		cache:    map[string]pwnedPasswordsRange{},
+	}
+	if maxConcurrentRequests > 0 {
+		client.permits = make(chan struct{}, maxConcurrentRequests)
+	}
+	return client
+}
+
+// isPasswordPwned 检查密码是否出现在已知的数据泄露中。
+// 参数:
+//   ctx context.Context: 请求上下文。排队等待和 HTTP 请求还受 pwnedPasswordsRequestTimeout 限制。
+//   password string: 要检查的密码。
+// 返回值:
+//   bool: 密码出现在泄露数据中时为 true。
+//   error: 等待超时、请求失败或 API 返回非 200 状态码时返回错误。
+func (c *pwnedPasswordsClient) isPasswordPwned(ctx context.Context, password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	encoded := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := encoded[:5], encoded[5:]
+	body, err := c.fetchRange(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		// 每一行的格式为 "后缀:次数"。开启 padding 时会有次数为 0 的假数据
+		hashSuffix, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if ok && hashSuffix == suffix && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// fetchRange 返回哈希前缀的查询结果，优先使用缓存。
+// 没有空闲名额时等待，直到有名额或者超时。
+func (c *pwnedPasswordsClient) fetchRange(ctx context.Context, prefix string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.cache[prefix]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.body, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pwnedPasswordsRequestTimeout)
+	defer cancel()
+	if c.permits != nil {
+		select {
+		case c.permits <- struct{}{}:
+			defer func() { <-c.permits }()
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for a pwned passwords request slot: %w", ctx.Err())
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/range/"+prefix, nil)
+	if err != nil {
+		return "", err
+	}
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pwned passwords api returned status %d", response.StatusCode)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if c.cacheTTL > 0 {
+		c.mu.Lock()
+		if len(c.cache) >= pwnedPasswordsCacheMaxSize {
+			c.cache = make(map[string]pwnedPasswordsRange, pwnedPasswordsCacheMaxSize/2)
+		}
+		c.cache[prefix] = pwnedPasswordsRange{string(body), time.Now().Add(c.cacheTTL)}
+		c.mu.Unlock()
+	}
+	return string(body), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newPwnedPasswordsStubServer 创建一个模拟 Pwned Passwords API 的服务器。
+// 它把 pwnedPassword 当作泄露的密码，每个请求等待 delay 后返回，并记录请求总数和同时进行的请求数的最大值。
+func newPwnedPasswordsStubServer(t *testing.T, pwnedPassword string, delay time.Duration) (*httptest.Server, *atomic.Int32, *atomic.Int32) {
+	hash := sha1.Sum([]byte(pwnedPassword))
+	encoded := strings.ToUpper(hex.EncodeToString(hash[:]))
+	var calls, inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			observed := maxInFlight.Load()
+			if current <= observed || maxInFlight.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		prefix := strings.TrimPrefix(r.URL.Path, "/range/")
+		if prefix == encoded[:5] {
+			fmt.Fprintf(w, "%s:3\r\n", encoded[5:])
+		}
+		// padding 的假数据
+		fmt.Fprintf(w, "%s:0\r\n", strings.Repeat("0", 35))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls, &maxInFlight
+}
+
+// TestPwnedPasswordsClientConcurrencyLimit 测试同时检查大量密码时，同时进行的外部请求数不超过上限，
+// 超过上限的检查排队等待而不是失败。
+func TestPwnedPasswordsClientConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	server, calls, maxInFlight := newPwnedPasswordsStubServer(t, "password", 20*time.Millisecond)
+	client := newPwnedPasswordsClient(server.URL, 3, 0)
+
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pwned, err := client.isPasswordPwned(context.Background(), fmt.Sprintf("super_secure_password_%d", i))
+			if err != nil || pwned {
+				failures.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(0), failures.Load())
+	assert.Equal(t, int32(30), calls.Load())
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(3))
+	assert.Greater(t, maxInFlight.Load(), int32(0))
+}
+
+// TestPwnedPasswordsClient 测试泄露的密码被识别，同一个前缀的查询结果被缓存，
+// 没有空闲名额时等待超时返回错误。
+func TestPwnedPasswordsClient(t *testing.T) {
+	t.Parallel()
+
+	server, calls, _ := newPwnedPasswordsStubServer(t, "password", 0)
+	client := newPwnedPasswordsClient(server.URL, 1, time.Hour)
+
+	pwned, err := client.isPasswordPwned(context.Background(), "password")
+	assert.NoError(t, err)
+	assert.True(t, pwned)
+	pwned, err = client.isPasswordPwned(context.Background(), "super_secure_password")
+	assert.NoError(t, err)
+	assert.False(t, pwned)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// 第二次检查使用缓存，不发起请求
+	pwned, err = client.isPasswordPwned(context.Background(), "password")
+	assert.NoError(t, err)
+	assert.True(t, pwned)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// 名额被占用时，等待到请求的超时时间为止
+	client.permits <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.isPasswordPwned(ctx, "another_password")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	<-client.permits
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+// TestVerifyPasswordStrengthPwnedPasswordsClient 测试创建用户时使用 env.pwnedPasswords 检查密码是否泄露，
+// 设置了 env.disablePwnedPasswordsCheck 时不发起请求。
+func TestVerifyPasswordStrengthPwnedPasswordsClient(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	server, calls, _ := newPwnedPasswordsStubServer(t, "password123", 0)
+	env := createEnvironment(db, nil)
+	env.pwnedPasswords = newPwnedPasswordsClient(server.URL, 1, 0)
+	app := CreateApp(env)
+
+	createUser := func(password string) *http.Response {
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(fmt.Sprintf(`{"password":%q}`, password)))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertErrorResponse(t, createUser("password123"), 400, ExpectedErrorWeakPassword)
+	assert.Equal(t, int32(1), calls.Load())
+	assertCreatedUserResponse(t, createUser("super_secure_password"), false)
+	assert.Equal(t, int32(2), calls.Load())
+
+	env.disablePwnedPasswordsCheck = true
+	assertCreatedUserResponse(t, createUser("password123"), false)
+	assert.Equal(t, int32(2), calls.Load())
+}
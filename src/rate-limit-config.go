@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"faroe/ratelimit"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 限流器的容量和时间间隔可以通过一个 JSON 文件配置，而不是写死在代码里。
+// 文件路径由环境变量 FAROE_RATE_LIMIT_CONFIG 指定，没有设置时使用 defaultRateLimitConfig。
+// 文件中没有出现的限流器和字段保持默认值，例如：
+//
+//	{
+//	    "passwordHashingIP": {"capacity": 10, "interval": "10s"},
+//	    "loginIP": {"capacity": 5, "interval": "15m"},
+//	    "verifyPasswordResetCode": {"capacity": 5}
+//	}
+//
+// interval 使用 time.ParseDuration 的格式。补充型令牌桶每经过一个 interval 补充一个令牌，
+// 过期型令牌桶在 interval 之后重置。计数器 (verifyEmailUpdateVerificationCode、verifyPasswordResetCode)
+// 只有 capacity。配置在启动时校验，容量或间隔不是正数时返回错误，服务器不应启动。
+
+// rateLimitConfigEnvVar 是指定限流配置文件路径的环境变量。
+const rateLimitConfigEnvVar = "FAROE_RATE_LIMIT_CONFIG"
+
+// rateLimitConfig 是所有可配置的限流器的容量和间隔。JSON 字段名和 Environment 中限流器的名称对应。
+type rateLimitConfig struct {
+	PasswordHashingIP                 tokenBucketConfig  `json:"passwordHashingIP"`                 // 补充型
+	LoginIP                           tokenBucketConfig  `json:"loginIP"`                           // 过期型
+	CreateEmailRequestUser            tokenBucketConfig  `json:"createEmailRequestUser"`            // 补充型
+	VerifyUserEmail                   tokenBucketConfig  `json:"verifyUserEmail"`                   // 过期型
+	VerifyEmailUpdateVerificationCode limitCounterConfig `json:"verifyEmailUpdateVerificationCode"` // 计数器
+	CreatePasswordResetIP             tokenBucketConfig  `json:"createPasswordResetIP"`             // 补充型
+	VerifyPasswordResetCode           limitCounterConfig `json:"verifyPasswordResetCode"`           // 计数器
+	TOTPUser                          tokenBucketConfig  `json:"totpUser"`                          // 过期型
+	RecoveryCodeUser                  tokenBucketConfig  `json:"recoveryCodeUser"`                  // 过期型
+	TOTPPreviewIP                     tokenBucketConfig  `json:"totpPreviewIP"`                     // 补充型
+	HealthIP                          tokenBucketConfig  `json:"healthIP"`                          // 补充型，GET /healthz 的存活检查
+	UserEmailLookupIP                 tokenBucketConfig  `json:"userEmailLookupIP"`                 // 补充型，GET /users?email=
+}
+
+// tokenBucketConfig 是一个令牌桶限流器的容量和间隔。
+type tokenBucketConfig struct {
+	Capacity int            `json:"capacity"`
+	Interval configDuration `json:"interval"`
+}
+
+// limitCounterConfig 是一个计数器限流器的容量。
+type limitCounterConfig struct {
+	Capacity int `json:"capacity"`
+}
+
+// configDuration 是在 JSON 中写成 time.ParseDuration 格式字符串 (例如 "15m") 的时间间隔。
+type configDuration time.Duration
+
+// UnmarshalJSON 解析 "15m" 这样的字符串。
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("interval must be a duration string like \"15m\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+// defaultRateLimitConfig 返回没有配置文件时使用的默认值。
+func defaultRateLimitConfig() rateLimitConfig {
+	return rateLimitConfig{
+		PasswordHashingIP:                 tokenBucketConfig{5, configDuration(10 * time.Second)},
+		LoginIP:                           tokenBucketConfig{5, configDuration(15 * time.Minute)},
+		CreateEmailRequestUser:            tokenBucketConfig{3, configDuration(5 * time.Minute)},
+		VerifyUserEmail:                   tokenBucketConfig{5, configDuration(15 * time.Minute)},
+		VerifyEmailUpdateVerificationCode: limitCounterConfig{5},
+		CreatePasswordResetIP:             tokenBucketConfig{3, configDuration(5 * time.Minute)},
+		VerifyPasswordResetCode:           limitCounterConfig{5},
+		TOTPUser:                          tokenBucketConfig{5, configDuration(15 * time.Minute)},
+		RecoveryCodeUser:                  tokenBucketConfig{5, configDuration(15 * time.Minute)},
+		TOTPPreviewIP:                     tokenBucketConfig{5, configDuration(10 * time.Second)},
+		HealthIP:                          tokenBucketConfig{100, configDuration(100 * time.Millisecond)},
+		UserEmailLookupIP:                 tokenBucketConfig{20, configDuration(10 * time.Second)},
+	}
+}
+
+// loadRateLimitConfigFromEnv 读取 FAROE_RATE_LIMIT_CONFIG 指定的配置文件。
+// 没有设置环境变量时返回默认值。
+func loadRateLimitConfigFromEnv() (rateLimitConfig, error) {
+	path := os.Getenv(rateLimitConfigEnvVar)
+	if path == "" {
+		return defaultRateLimitConfig(), nil
+	}
+	return loadRateLimitConfig(path)
+}
+
+// loadRateLimitConfig 读取并校验 JSON 配置文件。
+// 参数：
+//   path string: 配置文件路径。
+// 返回值：
+//   rateLimitConfig: 合并了默认值的配置。
+//   error: 读取失败、JSON 无效、包含未知的字段或者校验失败时返回错误，错误信息包含文件路径。
+func loadRateLimitConfig(path string) (rateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rateLimitConfig{}, fmt.Errorf("failed to read rate limit config: %w", err)
+	}
+	config, err := parseRateLimitConfig(data)
+	if err != nil {
+		return rateLimitConfig{}, fmt.Errorf("invalid rate limit config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// parseRateLimitConfig 解析 JSON 配置并和默认值合并，然后校验。拼错的限流器名称会被当作错误，而不是静默忽略。
+func parseRateLimitConfig(data []byte) (rateLimitConfig, error) {
+	config := defaultRateLimitConfig()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	err = config.validate()
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	return config, nil
+}
+
+// validate 检查每个限流器的容量和间隔都是正数。返回的错误包含限流器和字段的名称。
+func (c rateLimitConfig) validate() error {
+	buckets := []struct {
+		name   string
+		config tokenBucketConfig
+	}{
+		{"passwordHashingIP", c.PasswordHashingIP},
+		{"loginIP", c.LoginIP},
+		{"createEmailRequestUser", c.CreateEmailRequestUser},
+		{"verifyUserEmail", c.VerifyUserEmail},
+		{"createPasswordResetIP", c.CreatePasswordResetIP},
+		{"totpUser", c.TOTPUser},
+		{"recoveryCodeUser", c.RecoveryCodeUser},
+		{"totpPreviewIP", c.TOTPPreviewIP},
+		{"healthIP", c.HealthIP},
+		{"userEmailLookupIP", c.UserEmailLookupIP},
+	}
+	var errs []error
+	for _, bucket := range buckets {
+		if bucket.config.Capacity <= 0 {
+			errs = append(errs, fmt.Errorf("%s.capacity must be positive", bucket.name))
+		}
+		// 小于 1 毫秒的间隔在限流器中会变成 0
+		if time.Duration(bucket.config.Interval) < time.Millisecond {
+			errs = append(errs, fmt.Errorf("%s.interval must be at least 1ms", bucket.name))
+		}
+	}
+	if c.VerifyEmailUpdateVerificationCode.Capacity <= 0 {
+		errs = append(errs, errors.New("verifyEmailUpdateVerificationCode.capacity must be positive"))
+	}
+	if c.VerifyPasswordResetCode.Capacity <= 0 {
+		errs = append(errs, errors.New("verifyPasswordResetCode.capacity must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// apply 按照配置创建限流器并替换 env 中对应的限流器。必须在开始处理请求之前调用，config 必须已经校验过。
+func (c rateLimitConfig) apply(env *Environment) {
+	env.passwordHashingIPRateLimit = ratelimit.NewTokenBucketRateLimit(c.PasswordHashingIP.Capacity, time.Duration(c.PasswordHashingIP.Interval))
+	env.loginIPRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(c.LoginIP.Capacity, time.Duration(c.LoginIP.Interval))
+	env.createEmailRequestUserRateLimit = ratelimit.NewTokenBucketRateLimit(c.CreateEmailRequestUser.Capacity, time.Duration(c.CreateEmailRequestUser.Interval))
+	env.verifyUserEmailRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(c.VerifyUserEmail.Capacity, time.Duration(c.VerifyUserEmail.Interval))
+	env.verifyEmailUpdateVerificationCodeLimitCounter = ratelimit.NewLimitCounter(c.VerifyEmailUpdateVerificationCode.Capacity)
+	env.createPasswordResetIPRateLimit = ratelimit.NewTokenBucketRateLimit(c.CreatePasswordResetIP.Capacity, time.Duration(c.CreatePasswordResetIP.Interval))
+	env.verifyPasswordResetCodeLimitCounter = ratelimit.NewLimitCounter(c.VerifyPasswordResetCode.Capacity)
+	env.totpUserRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(c.TOTPUser.Capacity, time.Duration(c.TOTPUser.Interval))
+	env.recoveryCodeUserRateLimit = ratelimit.NewExpiringTokenBucketRateLimit(c.RecoveryCodeUser.Capacity, time.Duration(c.RecoveryCodeUser.Interval))
+	env.totpPreviewIPRateLimit = ratelimit.NewTokenBucketRateLimit(c.TOTPPreviewIP.Capacity, time.Duration(c.TOTPPreviewIP.Interval))
+	env.healthIPRateLimit = ratelimit.NewTokenBucketRateLimit(c.HealthIP.Capacity, time.Duration(c.HealthIP.Interval))
+	env.userEmailLookupIPRateLimit = ratelimit.NewTokenBucketRateLimit(c.UserEmailLookupIP.Capacity, time.Duration(c.UserEmailLookupIP.Interval))
+}
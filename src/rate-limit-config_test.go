@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadRateLimitConfig 测试从文件加载配置：文件中的值覆盖默认值，没有出现的限流器保持默认值，
+// 创建出的限流器按照配置的容量限流。
+func TestLoadRateLimitConfig(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	err := os.WriteFile(path, []byte(`{
+		"passwordHashingIP": {"capacity": 2, "interval": "1h"},
+		"loginIP": {"capacity": 3, "interval": "30m"},
+		"totpUser": {"capacity": 1},
+		"verifyPasswordResetCode": {"capacity": 4}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadRateLimitConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tokenBucketConfig{2, configDuration(time.Hour)}, config.PasswordHashingIP)
+	assert.Equal(t, tokenBucketConfig{3, configDuration(30 * time.Minute)}, config.LoginIP)
+	// 只配置了容量时保留默认的间隔
+	assert.Equal(t, tokenBucketConfig{1, defaultRateLimitConfig().TOTPUser.Interval}, config.TOTPUser)
+	// 没有配置的限流器使用默认值
+	assert.Equal(t, defaultRateLimitConfig().CreatePasswordResetIP, config.CreatePasswordResetIP)
+
+	env := createEnvironment(nil, nil)
+	config.apply(env)
+
+	consumeAll := func(consume func(string) bool) int {
+		count := 0
+		for i := 0; i < 10 && consume("key"); i++ {
+			count++
+		}
+		return count
+	}
+	assert.Equal(t, 2, consumeAll(env.passwordHashingIPRateLimit.Consume))
+	assert.Equal(t, 3, consumeAll(env.loginIPRateLimit.Consume))
+	assert.Equal(t, 1, consumeAll(env.totpUserRateLimit.Consume))
+	assert.Equal(t, 4, consumeAll(env.verifyPasswordResetCodeLimitCounter.Consume))
+	assert.Equal(t, 3, consumeAll(env.createPasswordResetIPRateLimit.Consume))
+}
+
+// TestParseRateLimitConfigInvalid 测试无效的配置在启动时被拒绝，错误信息指出是哪个限流器的哪个字段。
+func TestParseRateLimitConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		config   string
+		expected string
+	}{
+		{`{"passwordHashingIP": {"capacity": 0}}`, "passwordHashingIP.capacity must be positive"},
+		{`{"loginIP": {"capacity": -1}}`, "loginIP.capacity must be positive"},
+		{`{"totpUser": {"interval": "-5m"}}`, "totpUser.interval must be at least 1ms"},
+		{`{"recoveryCodeUser": {"interval": "0s"}}`, "recoveryCodeUser.interval must be at least 1ms"},
+		{`{"verifyPasswordResetCode": {"capacity": 0}}`, "verifyPasswordResetCode.capacity must be positive"},
+		{`{"verifyUserEmail": {"interval": "soon"}}`, "invalid duration"},
+		{`{"verifyUserEmail": {"interval": 60}}`, "interval must be a duration string"},
+		{`{"passwordHashIP": {"capacity": 5}}`, "unknown field"},
+		{`not json`, "invalid character"},
+	}
+	for _, testCase := range testCases {
+		_, err := parseRateLimitConfig([]byte(testCase.config))
+		if assert.Error(t, err, testCase.config) {
+			assert.Contains(t, err.Error(), testCase.expected, testCase.config)
+		}
+	}
+
+	// 多个错误一起返回
+	_, err := parseRateLimitConfig([]byte(`{"loginIP": {"capacity": 0}, "totpUser": {"capacity": 0}}`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "loginIP.capacity")
+		assert.Contains(t, err.Error(), "totpUser.capacity")
+	}
+
+	// 文件不存在
+	_, err = loadRateLimitConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+// TestDefaultRateLimitConfig 测试默认配置是有效的。
+func TestDefaultRateLimitConfig(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, defaultRateLimitConfig().validate())
+	config, err := parseRateLimitConfig([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRateLimitConfig(), config)
+}
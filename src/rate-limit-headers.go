@@ -0,0 +1,67 @@
+package main
+
+import (
+	"faroe/ratelimit"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 设置了 env.exposeRateLimitState 时，使用了令牌桶限流的端点在消耗令牌成功后返回限流状态，
+// 客户端可以在被拒绝之前主动放慢请求：
+//   X-RateLimit-Limit: 桶容量。
+//   X-RateLimit-Remaining: 消耗后剩余的令牌数。
+// 一个请求经过多个限流器时 (例如同时按 IP 和用户限流)，返回剩余令牌最少的限流器的状态。
+// 默认不返回，以免泄露限流器的配置。
+
+// rateLimitStater 是可以返回某个 key 限流状态的限流器，
+// 例如 ratelimit.TokenBucketRateLimit 和 ratelimit.ExpiringTokenBucketRateLimit。
+type rateLimitStater interface {
+	State(key string) ratelimit.State
+}
+
+// setRateLimitHeaders 在消耗令牌成功后设置 X-RateLimit-Limit 和 X-RateLimit-Remaining 响应头。
+// 没有设置 env.exposeRateLimitState 或 key 为空 (请求没有提供 client_ip) 时不做任何事情。
+// 已经设置的状态剩余令牌更少时保留原来的值。
+// 参数：
+//   env *Environment: 应用环境。
+//   w http.ResponseWriter: 还没有写入响应头的 HTTP 响应写入器。
+//   limiter rateLimitStater: 刚刚消耗了令牌的限流器。
+//   key string: 消耗令牌时使用的 key。
+func setRateLimitHeaders(env *Environment, w http.ResponseWriter, limiter rateLimitStater, key string) {
+	if !env.exposeRateLimitState || key == "" {
+		return
+	}
+	state := limiter.State(key)
+	if current, err := strconv.Atoi(w.Header().Get("X-RateLimit-Remaining")); err == nil && current <= state.Remaining {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(state.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(state.Remaining))
+}
+
+// 设置了 env.totpRetryAfter 时，POST /users/:user_id/verify-2fa/totp 被限流或锁定时返回 429 和 Retry-After 头
+// (秒数，向上取整)，值来自 totpUserRateLimit 的桶过期时间或 totpUserLockout 的锁定结束时间，
+// 客户端可以据此告诉用户什么时候可以重试。默认不返回，和以前一样限流时返回 TOO_MANY_REQUESTS，锁定时返回 400 ACCOUNT_LOCKED。
+
+// retryAfterSeconds 把等待时间转换为 Retry-After 头的秒数，向上取整并且至少为 1。
+func retryAfterSeconds(retryAfter time.Duration) int64 {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// writeRetryAfterErrorResponse 返回 429、Retry-After 头和错误码 code。
+// 参数：
+//   w http.ResponseWriter: HTTP 响应写入器。
+//   code string: 错误码，例如 ExpectedErrorTooManyRequests 或 ExpectedErrorAccountLocked。
+//   retryAfter time.Duration: 客户端需要等待的时间。
+func writeRetryAfterErrorResponse(w http.ResponseWriter, code string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(retryAfter), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, code)))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base32"
+	"faroe/ratelimit"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimitHeaders 测试设置了 exposeRateLimitState 时，成功的请求返回的 X-RateLimit-Remaining 随着请求递减，
+// 没有设置时不返回限流状态。
+func TestRateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	body := fmt.Sprintf(`{"key":"%s","code":"000000","client_ip":"1.1.1.1"}`, base32.StdEncoding.EncodeToString(make([]byte, 20)))
+	previewVerify := func(app http.Handler) *http.Response {
+		r := httptest.NewRequest("POST", "/totp/preview-verify", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	env := createEnvironment(db, nil)
+	env.exposeRateLimitState = true
+	env.totpPreviewIPRateLimit = ratelimit.NewTokenBucketRateLimit(3, time.Hour)
+	app := CreateApp(env)
+	for _, expected := range []string{"2", "1", "0"} {
+		res := previewVerify(app)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "3", res.Header.Get("X-RateLimit-Limit"))
+		assert.Equal(t, expected, res.Header.Get("X-RateLimit-Remaining"))
+	}
+	// 被拒绝的请求不返回限流状态
+	res := previewVerify(app)
+	assert.Equal(t, 429, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Remaining"))
+
+	// 默认不返回
+	env = createEnvironment(db, nil)
+	app = CreateApp(env)
+	res = previewVerify(app)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Limit"))
+	assert.Empty(t, res.Header.Get("X-RateLimit-Remaining"))
+}
+
+// TestSetRateLimitHeaders 测试经过多个限流器时保留剩余令牌最少的状态，key 为空时不设置。
+func TestSetRateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.exposeRateLimitState = true
+	ipLimit := ratelimit.NewTokenBucketRateLimit(10, time.Hour)
+	userLimit := ratelimit.NewExpiringTokenBucketRateLimit(3, time.Hour)
+	ipLimit.Consume("ip")
+	userLimit.Consume("user")
+
+	w := httptest.NewRecorder()
+	setRateLimitHeaders(env, w, &ipLimit, "ip")
+	setRateLimitHeaders(env, w, &userLimit, "user")
+	assert.Equal(t, "3", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	setRateLimitHeaders(env, w, &userLimit, "user")
+	setRateLimitHeaders(env, w, &ipLimit, "ip")
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	setRateLimitHeaders(env, w, &ipLimit, "")
+	assert.Empty(t, w.Header().Get("X-RateLimit-Remaining"))
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// --- ConcurrencyLimit (并发限制) ---
+// 特点：限制同时进行的操作数量，而不是单位时间内的次数。
+// 令牌桶限制的是速率，大量请求在同一时刻到达时仍然会同时执行。
+// 对于 Argon2id 这种每次需要大量内存的操作，同时执行的数量决定了内存占用的峰值，
+// 所以需要单独限制并发数。
+
+// NewConcurrencyLimit 创建并发限制。
+// max: 全局最多同时进行多少个操作。小于等于 0 表示不限制。
+// perKeyMax: 每个 key 最多同时进行多少个操作。小于等于 0 表示不限制。
+// wait: 全局没有空闲名额时最多等待多久。超过 perKeyMax 时不等待，直接拒绝。
+func NewConcurrencyLimit(max int, perKeyMax int, wait time.Duration) ConcurrencyLimit {
+	limit := ConcurrencyLimit{
+		mu:        &sync.Mutex{},
+		storage:   map[string]int{},
+		perKeyMax: perKeyMax,
+		wait:      wait,
+	}
+	if max > 0 {
+		limit.permits = make(chan struct{}, max)
+	}
+	return limit
+}
+
+// ConcurrencyLimit 并发限制结构。
+// 零值不限制并发，可以直接使用。
+type ConcurrencyLimit struct {
+	permits   chan struct{}  // 全局名额，缓冲区大小即 max。nil 表示不限制
+	mu        *sync.Mutex    // 并发锁，保护 storage
+	storage   map[string]int // key -> 正在进行的操作数
+	perKeyMax int            // 每个 key 的并发上限
+	wait      time.Duration  // 等待全局名额的最长时间
+}
+
+// Acquire 尝试为 key 占用一个名额。
+// 成功时返回 true，调用方必须在操作结束后调用 Release(key)。
+// key 为空字符串时只检查全局名额。
+func (l *ConcurrencyLimit) Acquire(key string) bool {
+	if !l.acquireKey(key) {
+		return false
+	}
+	if l.permits == nil {
+		return true
+	}
+	// 先尝试不等待直接占用名额
+	select {
+	case l.permits <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		l.releaseKey(key)
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.permits <- struct{}{}:
+		return true
+	case <-timer.C:
+		l.releaseKey(key)
+		return false
+	}
+}
+
+// Release 释放 key 通过 Acquire 占用的名额。
+func (l *ConcurrencyLimit) Release(key string) {
+	l.releaseKey(key)
+	if l.permits != nil {
+		<-l.permits
+	}
+}
+
+// acquireKey 检查并增加 key 正在进行的操作数。
+func (l *ConcurrencyLimit) acquireKey(key string) bool {
+	if l.perKeyMax <= 0 || key == "" {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.storage[key] >= l.perKeyMax {
+		return false
+	}
+	l.storage[key]++
+	return true
+}
+
+// releaseKey 减少 key 正在进行的操作数，归零时删除记录防止 map 无限增长。
+func (l *ConcurrencyLimit) releaseKey(key string) {
+	if l.perKeyMax <= 0 || key == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.storage[key] <= 1 {
+		delete(l.storage, key)
+		return
+	}
+	l.storage[key]--
+}
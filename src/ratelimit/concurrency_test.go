@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrencyLimit 测试同时进行的操作数量从不超过全局上限。
+func TestConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	limit := NewConcurrencyLimit(3, 0, time.Second)
+
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !limit.Acquire("") {
+				t.Errorf("expected acquire to succeed within the wait time")
+				return
+			}
+			current := atomic.AddInt32(&running, 1)
+			for {
+				previous := atomic.LoadInt32(&peak)
+				if current <= previous || atomic.CompareAndSwapInt32(&peak, previous, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			limit.Release("")
+		}()
+	}
+	wg.Wait()
+
+	if peak > 3 {
+		t.Errorf("expected peak concurrency to be at most 3, got %d", peak)
+	}
+	if peak == 0 {
+		t.Errorf("expected operations to run")
+	}
+}
+
+// TestConcurrencyLimitWait 测试没有空闲名额时等待超时后拒绝，名额释放后可以再次占用。
+func TestConcurrencyLimitWait(t *testing.T) {
+	t.Parallel()
+
+	limit := NewConcurrencyLimit(1, 0, 20*time.Millisecond)
+
+	if !limit.Acquire("a") {
+		t.Errorf("expected first acquire to succeed")
+	}
+	if limit.Acquire("b") {
+		t.Errorf("expected acquire to fail while the only permit is held")
+	}
+	limit.Release("a")
+	if !limit.Acquire("b") {
+		t.Errorf("expected acquire to succeed after release")
+	}
+	limit.Release("b")
+}
+
+// TestConcurrencyLimitPerKey 测试每个 key 的并发上限，不影响其他 key。
+func TestConcurrencyLimitPerKey(t *testing.T) {
+	t.Parallel()
+
+	limit := NewConcurrencyLimit(10, 1, time.Second)
+
+	if !limit.Acquire("ip1") {
+		t.Errorf("expected first acquire for ip1 to succeed")
+	}
+	if limit.Acquire("ip1") {
+		t.Errorf("expected second acquire for ip1 to fail")
+	}
+	if !limit.Acquire("ip2") {
+		t.Errorf("expected acquire for ip2 to succeed")
+	}
+	limit.Release("ip1")
+	if !limit.Acquire("ip1") {
+		t.Errorf("expected acquire for ip1 to succeed after release")
+	}
+	limit.Release("ip1")
+	limit.Release("ip2")
+	if len(limit.storage) != 0 {
+		t.Errorf("expected storage to be empty after all releases, got %d entries", len(limit.storage))
+	}
+}
+
+// TestConcurrencyLimitZeroValue 测试零值不限制并发。
+func TestConcurrencyLimitZeroValue(t *testing.T) {
+	t.Parallel()
+
+	var limit ConcurrencyLimit
+	for i := 0; i < 100; i++ {
+		if !limit.Acquire("ip") {
+			t.Errorf("expected zero value to allow acquire")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		limit.Release("ip")
+	}
+}
@@ -96,3 +96,11 @@ func (lc *LimitCounter) Clear() {
 	lc.storage = make(map[string]int, size/2)
 	lc.mu.Unlock()       // 解锁
 }
+
+// Size 方法返回当前记录的 key 数量，用于监控 storage 占用的内存。
+// 这个方法是并发安全的。
+func (lc *LimitCounter) Size() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return len(lc.storage)
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// --- Lockout (锁定) ---
+// 特点：记录一个 key 在时间窗口内耗尽限流器的次数，达到阈值后锁定一段冷却时间。
+// 令牌桶恢复令牌后攻击者可以继续尝试，只要每次都停在限制之下就能无限期地猜下去。
+// Lockout 的记录独立于令牌桶保存，不会因为桶被重置或补充而清空，
+// 所以反复耗尽令牌桶的 key 最终会被锁定更长的时间。
+
+// NewLockout 创建锁定记录。
+// threshold: 在 window 内耗尽多少次后锁定。
+// window: 统计耗尽次数的时间窗口，从第一次耗尽开始计算。
+// cooldown: 锁定的时长。
+func NewLockout(threshold int, window time.Duration, cooldown time.Duration) Lockout {
+	lockout := Lockout{
+		mu:                   &sync.Mutex{},
+		storage:              map[string]lockoutRecord{},
+		threshold:            threshold,
+		windowMilliseconds:   window.Milliseconds(),
+		cooldownMilliseconds: cooldown.Milliseconds(),
+	}
+	return lockout
+}
+
+// Lockout 锁定记录结构。
+type Lockout struct {
+	mu                   *sync.Mutex              // 并发锁
+	storage              map[string]lockoutRecord // key -> 锁定记录
+	threshold            int                      // 锁定阈值
+	windowMilliseconds   int64                    // 时间窗口(ms)
+	cooldownMilliseconds int64                    // 锁定时长(ms)
+}
+
+// Locked 检查 key 当前是否处于锁定状态。
+func (l *Lockout) Locked(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record, ok := l.storage[key]
+	if !ok {
+		return false
+	}
+	return time.Now().UnixMilli() < record.lockedUntilUnixMilliseconds
+}
+
+// RetryAfter 返回 key 的锁定还剩多久。没有被锁定时返回 0。
+func (l *Lockout) RetryAfter(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	remaining := l.storage[key].lockedUntilUnixMilliseconds - time.Now().UnixMilli()
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(remaining) * time.Millisecond
+}
+
+// RecordExhaustion 记录 key 耗尽了一次限流器。
+// 如果这次记录使耗尽次数达到阈值，则锁定 key 并返回 true。
+func (l *Lockout) RecordExhaustion(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().UnixMilli()
+	record, ok := l.storage[key]
+	if !ok || now >= record.windowStartedAtUnixMilliseconds+l.windowMilliseconds {
+		// 首次耗尽或窗口已过期，开始新的窗口
+		record = lockoutRecord{windowStartedAtUnixMilliseconds: now}
+	}
+	record.exhaustions++
+	if record.exhaustions < l.threshold {
+		l.storage[key] = record
+		return false
+	}
+	// 达到阈值，锁定并开始新的窗口，冷却结束后重新计数
+	l.storage[key] = lockoutRecord{
+		windowStartedAtUnixMilliseconds: now,
+		lockedUntilUnixMilliseconds:     now + l.cooldownMilliseconds,
+	}
+	return true
+}
+
+// Reset 删除指定 key 的锁定记录 (包括耗尽次数)。
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	delete(l.storage, key)
+	l.mu.Unlock()
+}
+
+// Size 返回当前记录的 key 数量，用于监控 storage 占用的内存。
+func (l *Lockout) Size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.storage)
+}
+
+// Clear 清空所有 key 的记录。
+func (l *Lockout) Clear() {
+	l.mu.Lock()
+	size := len(l.storage)
+	l.storage = make(map[string]lockoutRecord, size/2)
+	l.mu.Unlock()
+}
+
+// lockoutRecord 锁定记录状态。
+type lockoutRecord struct {
+	exhaustions                     int   // 窗口内的耗尽次数
+	windowStartedAtUnixMilliseconds int64 // 窗口开始时间(ms)
+	lockedUntilUnixMilliseconds     int64 // 锁定结束时间(ms)，0 表示未锁定
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLockout 测试在窗口内耗尽达到阈值后锁定，冷却结束后解除锁定。
+func TestLockout(t *testing.T) {
+	t.Parallel()
+
+	lockout := NewLockout(3, time.Minute, 50*time.Millisecond)
+
+	if lockout.Locked("user") {
+		t.Errorf("expected user not to be locked before any exhaustion")
+	}
+	// 前两次耗尽不锁定
+	for i := 0; i < 2; i++ {
+		if lockout.RecordExhaustion("user") {
+			t.Errorf("expected exhaustion %d not to lock", i+1)
+		}
+	}
+	if lockout.Locked("user") {
+		t.Errorf("expected user not to be locked below the threshold")
+	}
+	// 第三次耗尽锁定
+	if !lockout.RecordExhaustion("user") {
+		t.Errorf("expected exhaustion 3 to lock")
+	}
+	if !lockout.Locked("user") {
+		t.Errorf("expected user to be locked")
+	}
+	// 其他 key 不受影响
+	if lockout.Locked("other") {
+		t.Errorf("expected other key not to be locked")
+	}
+
+	// 冷却结束后解除锁定，并重新开始计数
+	time.Sleep(60 * time.Millisecond)
+	if lockout.Locked("user") {
+		t.Errorf("expected lockout to lift after the cooldown")
+	}
+	if lockout.RecordExhaustion("user") {
+		t.Errorf("expected the count to restart after the cooldown")
+	}
+}
+
+// TestLockoutWindow 测试窗口过期后耗尽次数重新计算。
+func TestLockoutWindow(t *testing.T) {
+	t.Parallel()
+
+	lockout := NewLockout(2, 50*time.Millisecond, time.Minute)
+
+	lockout.RecordExhaustion("user")
+	time.Sleep(60 * time.Millisecond)
+	if lockout.RecordExhaustion("user") {
+		t.Errorf("expected exhaustions in different windows not to lock")
+	}
+	if !lockout.RecordExhaustion("user") {
+		t.Errorf("expected second exhaustion in the same window to lock")
+	}
+
+	// Reset 解除锁定
+	lockout.Reset("user")
+	if lockout.Locked("user") {
+		t.Errorf("expected reset to lift the lockout")
+	}
+}
+
+// TestLockoutRetryAfter 测试 RetryAfter 返回锁定的剩余时间，没有锁定或冷却结束后返回 0。
+func TestLockoutRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	lockout := NewLockout(1, time.Minute, 100*time.Millisecond)
+
+	if retryAfter := lockout.RetryAfter("user"); retryAfter != 0 {
+		t.Errorf("expected 0 before the lockout, got %v", retryAfter)
+	}
+	lockout.RecordExhaustion("user")
+	retryAfter := lockout.RetryAfter("user")
+	if retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("expected retry after within the cooldown, got %v", retryAfter)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if retryAfter := lockout.RetryAfter("user"); retryAfter != 0 {
+		t.Errorf("expected 0 after the cooldown, got %v", retryAfter)
+	}
+}
@@ -6,6 +6,12 @@ import (
 	"time"
 )
 
+// State 是某个 key 当前的限流状态，用于在响应头中告诉客户端还能请求多少次。
+type State struct {
+	Limit     int // 桶容量
+	Remaining int // 当前可用的令牌数
+}
+
 // --- Refilling Token Bucket (补充型令牌桶) ---
 // 特点：令牌按固定间隔自动补充，有容量上限。
 
@@ -28,6 +34,34 @@ type TokenBucketRateLimit struct {
 	storage                    map[string]refillingTokenBucket // key -> 令牌桶状态
 	max                        int                          // 最大容量
 	refillIntervalMilliseconds int64                        // 补充间隔(ms)
+	now                        func() time.Time             // 当前时间，nil 时使用 time.Now (测试中可以替换)
+}
+
+// currentTime 返回当前时间。
+func (rl *TokenBucketRateLimit) currentTime() time.Time {
+	if rl.now != nil {
+		return rl.now()
+	}
+	return time.Now()
+}
+
+// refill 返回补充令牌后的桶状态。
+// 每经过一个完整的 refillInterval 补充一个令牌。refilledAt 只推进已经计入的整数个间隔，
+// 不足一个间隔的时间保留到下次继续累计，这样不管调用得多频繁，长期的补充速率都是每个间隔一个令牌。
+// 令牌数不能超过 max，桶满时多出的整数个间隔被丢弃，但同样保留不足一个间隔的时间。
+func (rl *TokenBucketRateLimit) refill(bucket refillingTokenBucket, now time.Time) refillingTokenBucket {
+	intervals := (now.UnixMilli() - bucket.refilledAtUnixMilliseconds) / rl.refillIntervalMilliseconds
+	if intervals <= 0 {
+		return bucket
+	}
+	count := int64(bucket.count) + intervals
+	if count > int64(rl.max) {
+		count = int64(rl.max)
+	}
+	return refillingTokenBucket{
+		count:                      int(count),
+		refilledAtUnixMilliseconds: bucket.refilledAtUnixMilliseconds + intervals*rl.refillIntervalMilliseconds,
+	}
 }
 
 // Check 检查是否有可用令牌 (不消耗)。
@@ -39,12 +73,9 @@ func (rl *TokenBucketRateLimit) Check(key string) bool {
 	if !ok {
 		return true // 首次访问，总是有令牌
 	}
-	now := time.Now()
-	// 计算应补充的令牌
-	refill := int((now.UnixMilli() - bucket.refilledAtUnixMilliseconds) / rl.refillIntervalMilliseconds)
-	// 当前有效令牌数 (不超过 max)
-	count := int(math.Min(float64(bucket.count+refill), float64(rl.max)))
-	return count > 0 // 有令牌则返回 true
+	// 计算补充后的有效令牌数 (不超过 max)
+	bucket = rl.refill(bucket, rl.currentTime())
+	return bucket.count > 0 // 有令牌则返回 true
 }
 
 // Consume 尝试消耗一个令牌。
@@ -52,24 +83,37 @@ func (rl *TokenBucketRateLimit) Check(key string) bool {
 func (rl *TokenBucketRateLimit) Consume(key string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	now := time.Now()
+	now := rl.currentTime()
 	bucket, ok := rl.storage[key]
 	if !ok {
 		// 首次消耗，创建新桶 (容量 max-1)
 		rl.storage[key] = refillingTokenBucket{rl.max - 1, now.UnixMilli()}
 		return true
 	}
-	// 计算应补充和当前有效令牌数
-	refill := int((now.UnixMilli() - bucket.refilledAtUnixMilliseconds) / rl.refillIntervalMilliseconds)
-	count := int(math.Min(float64(bucket.count+refill), float64(rl.max)))
-	if count < 1 {
+	// 计算补充后的有效令牌数
+	bucket = rl.refill(bucket, now)
+	if bucket.count < 1 {
 		return false // 无可用令牌
 	}
-	// 消耗一个令牌，更新状态
-	rl.storage[key] = refillingTokenBucket{count - 1, now.UnixMilli()}
+	// 消耗一个令牌，更新状态。refilledAt 保留 refill 计算出的补充边界，
+	// 不设为 now，否则不足一个间隔的时间会被丢弃，实际补充速率会低于配置的速率。
+	bucket.count--
+	rl.storage[key] = bucket
 	return true
 }
 
+// State 返回 key 补充后的令牌数 (不消耗)。没有记录的 key 有 max 个令牌。
+func (rl *TokenBucketRateLimit) State(key string) State {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	bucket, ok := rl.storage[key]
+	if !ok {
+		return State{Limit: rl.max, Remaining: rl.max}
+	}
+	bucket = rl.refill(bucket, rl.currentTime())
+	return State{Limit: rl.max, Remaining: bucket.count}
+}
+
 // AddTokenIfEmpty 如果桶为空，则添加一个令牌。
 // 用于特殊场景，允许空桶后进行一次操作。
 func (rl *TokenBucketRateLimit) AddTokenIfEmpty(key string) {
@@ -79,13 +123,12 @@ func (rl *TokenBucketRateLimit) AddTokenIfEmpty(key string) {
 	if !ok {
 		return // key 不存在
 	}
-	now := time.Now()
 	// 计算当前有效令牌数
-	refill := int((now.UnixMilli() - bucket.refilledAtUnixMilliseconds) / rl.refillIntervalMilliseconds)
-	count := int(math.Min(float64(bucket.count+refill), float64(rl.max)))
-	if count < 1 {
-		// 桶空，添加一个令牌
-		rl.storage[key] = refillingTokenBucket{1, now.UnixMilli()}
+	bucket = rl.refill(bucket, rl.currentTime())
+	if bucket.count < 1 {
+		// 桶空，添加一个令牌。补充边界保持不变，已经累计的不足一个间隔的时间不会被丢弃
+		bucket.count = 1
+		rl.storage[key] = bucket
 	}
 }
 
@@ -105,10 +148,17 @@ func (rl *TokenBucketRateLimit) Clear() {
 	rl.mu.Unlock()
 }
 
+// Size 返回当前记录的 key 数量，用于监控 storage 占用的内存。
+func (rl *TokenBucketRateLimit) Size() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.storage)
+}
+
 // refillingTokenBucket 补充型令牌桶状态。
 type refillingTokenBucket struct {
 	count                      int   // 当前令牌数
-	refilledAtUnixMilliseconds int64 // 上次记录时间(ms)
+	refilledAtUnixMilliseconds int64 // 已计入的最后一个补充间隔的结束时间(ms)
 }
 
 // --- Expiring Token Bucket (过期型令牌桶) ---
@@ -182,6 +232,33 @@ func (rl *ExpiringTokenBucketRateLimit) Consume(key string) bool {
 	return true
 }
 
+// State 返回 key 当前的令牌数 (不消耗)。没有记录或已过期的 key 有 max 个令牌。
+func (rl *ExpiringTokenBucketRateLimit) State(key string) State {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	bucket, ok := rl.storage[key]
+	if !ok || time.Now().UnixMilli() >= bucket.createdAtUnixMilliseconds+rl.expiresInMilliseconds {
+		return State{Limit: rl.max, Remaining: rl.max}
+	}
+	return State{Limit: rl.max, Remaining: bucket.count}
+}
+
+// RetryAfter 返回 key 还要等多久才有可用的令牌，也就是桶过期的时间。
+// 有可用令牌、没有记录或已过期时返回 0。
+func (rl *ExpiringTokenBucketRateLimit) RetryAfter(key string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	bucket, ok := rl.storage[key]
+	if !ok || bucket.count > 0 {
+		return 0
+	}
+	remaining := bucket.createdAtUnixMilliseconds + rl.expiresInMilliseconds - time.Now().UnixMilli()
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(remaining) * time.Millisecond
+}
+
 // AddTokenIfEmpty 如果桶为空 (且理论上未过期)，则将令牌数设置为 1。
 // 注意：原代码逻辑未严格检查是否过期，可能需要审视。
 func (rl *ExpiringTokenBucketRateLimit) AddTokenIfEmpty(key string) {
@@ -211,6 +288,13 @@ func (rl *ExpiringTokenBucketRateLimit) Clear() {
 	rl.mu.Unlock()
 }
 
+// Size 返回当前记录的 key 数量 (包括已过期但还没有被重置的桶)，用于监控 storage 占用的内存。
+func (rl *ExpiringTokenBucketRateLimit) Size() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.storage)
+}
+
 // expiringTokenBucket 过期型令牌桶状态。
 type expiringTokenBucket struct {
 	count                     int   // 当前令牌数
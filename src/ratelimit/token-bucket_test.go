@@ -0,0 +1,242 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock 是测试用的可控时钟。
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// TestTokenBucketRateLimitSteadyRate 测试以小于补充间隔的固定频率持续消耗时，
+// 允许的次数等于初始容量加上每个间隔补充的一个令牌，不足一个间隔的时间不会丢失。
+func TestTokenBucketRateLimitSteadyRate(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	rl := NewTokenBucketRateLimit(5, 100*time.Millisecond)
+	rl.now = clock.Now
+
+	// 每 30ms 尝试一次，持续 100 个补充间隔
+	allowed := 0
+	for elapsed := time.Duration(0); elapsed < 100*100*time.Millisecond; elapsed += 30 * time.Millisecond {
+		if rl.Consume("key") {
+			allowed++
+		}
+		clock.Advance(30 * time.Millisecond)
+	}
+	// 初始的 5 个令牌，加上 100 个间隔补充的 100 个令牌 (允许 1 个的取整误差)
+	expected := 5 + 100
+	if allowed < expected-1 || allowed > expected {
+		t.Errorf("expected about %d allowed requests, got %d", expected, allowed)
+	}
+}
+
+// TestTokenBucketRateLimitRefillCap 测试令牌数不超过容量，桶满之后经过的时间不会累计。
+func TestTokenBucketRateLimitRefillCap(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	rl := NewTokenBucketRateLimit(3, time.Second)
+	rl.now = clock.Now
+
+	for i := 0; i < 3; i++ {
+		if !rl.Consume("key") {
+			t.Errorf("expected consume %d to succeed", i+1)
+		}
+	}
+	if rl.Consume("key") {
+		t.Errorf("expected consume to fail when the bucket is empty")
+	}
+	if rl.Check("key") {
+		t.Errorf("expected check to fail when the bucket is empty")
+	}
+
+	// 经过很长时间后只补满到容量
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !rl.Consume("key") {
+			t.Errorf("expected consume %d after refill to succeed", i+1)
+		}
+	}
+	if rl.Consume("key") {
+		t.Errorf("expected the bucket to hold at most 3 tokens")
+	}
+
+	// 不足一个间隔时不补充，累计满一个间隔后补充一个
+	clock.Advance(600 * time.Millisecond)
+	if rl.Consume("key") {
+		t.Errorf("expected no token before a full interval")
+	}
+	clock.Advance(400 * time.Millisecond)
+	if !rl.Consume("key") {
+		t.Errorf("expected a token after a full interval")
+	}
+}
+
+// TestTokenBucketRateLimitFastConsumer 是补充时间处理的回归测试。
+// 之前每次成功消耗都把补充时间设为 now，以 70ms 的间隔尝试 (补充间隔 100ms) 时，
+// 每次成功后已经累计的 40ms 被丢弃，实际每 140ms 才得到一个令牌。
+// 现在只推进已计入的整数个间隔，长期速率是每 100ms 一个令牌。
+func TestTokenBucketRateLimitFastConsumer(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	rl := NewTokenBucketRateLimit(1, 100*time.Millisecond)
+	rl.now = clock.Now
+
+	allowed := 0
+	for elapsed := time.Duration(0); elapsed < 50*100*time.Millisecond; elapsed += 70 * time.Millisecond {
+		if rl.Consume("key") {
+			allowed++
+		}
+		clock.Advance(70 * time.Millisecond)
+	}
+	// 初始的 1 个令牌加上 50 个间隔补充的 50 个令牌。旧的实现大约只允许 36 次。
+	if allowed < 50 || allowed > 51 {
+		t.Errorf("expected about 51 allowed requests, got %d", allowed)
+	}
+}
+
+// TestTokenBucketRateLimitAddTokenIfEmpty 测试 AddTokenIfEmpty 添加令牌时不重置补充边界。
+func TestTokenBucketRateLimitAddTokenIfEmpty(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	rl := NewTokenBucketRateLimit(1, 100*time.Millisecond)
+	rl.now = clock.Now
+
+	// 不存在的 key 不做任何事情
+	rl.AddTokenIfEmpty("key")
+	if len(rl.storage) != 0 {
+		t.Errorf("expected AddTokenIfEmpty not to create a bucket")
+	}
+
+	if !rl.Consume("key") {
+		t.Errorf("expected first consume to succeed")
+	}
+	clock.Advance(60 * time.Millisecond)
+	rl.AddTokenIfEmpty("key")
+	if !rl.Consume("key") {
+		t.Errorf("expected the added token to be consumed")
+	}
+	// 距离上次补充边界已经过了 60ms，再过 40ms 就补充下一个令牌
+	clock.Advance(40 * time.Millisecond)
+	if !rl.Consume("key") {
+		t.Errorf("expected a token one interval after the original refill boundary")
+	}
+}
+
+// TestRateLimitSize 测试 Size 返回记录的 key 数量，Clear 之后为 0。
+func TestRateLimitSize(t *testing.T) {
+	t.Parallel()
+
+	tokenBucket := NewTokenBucketRateLimit(5, time.Minute)
+	expiringTokenBucket := NewExpiringTokenBucketRateLimit(5, time.Minute)
+	for i := 0; i < 10; i++ {
+		key := string(rune('a' + i))
+		tokenBucket.Consume(key)
+		expiringTokenBucket.Consume(key)
+		// 同一个 key 不会重复计数
+		tokenBucket.Consume(key)
+		expiringTokenBucket.Consume(key)
+	}
+	if size := tokenBucket.Size(); size != 10 {
+		t.Errorf("expected token bucket size 10, got %d", size)
+	}
+	if size := expiringTokenBucket.Size(); size != 10 {
+		t.Errorf("expected expiring token bucket size 10, got %d", size)
+	}
+
+	tokenBucket.Reset("a")
+	if size := tokenBucket.Size(); size != 9 {
+		t.Errorf("expected token bucket size 9 after reset, got %d", size)
+	}
+
+	tokenBucket.Clear()
+	expiringTokenBucket.Clear()
+	if size := tokenBucket.Size(); size != 0 {
+		t.Errorf("expected token bucket size 0 after clear, got %d", size)
+	}
+	if size := expiringTokenBucket.Size(); size != 0 {
+		t.Errorf("expected expiring token bucket size 0 after clear, got %d", size)
+	}
+}
+
+// TestRateLimitState 测试 State 返回剩余令牌数且不消耗令牌，补充或过期后恢复。
+func TestRateLimitState(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	tokenBucket := NewTokenBucketRateLimit(3, time.Second)
+	tokenBucket.now = clock.Now
+	expiringTokenBucket := NewExpiringTokenBucketRateLimit(3, 50*time.Millisecond)
+
+	if state := tokenBucket.State("key"); state != (State{Limit: 3, Remaining: 3}) {
+		t.Errorf("expected a full bucket for an unknown key, got %+v", state)
+	}
+	if state := expiringTokenBucket.State("key"); state != (State{Limit: 3, Remaining: 3}) {
+		t.Errorf("expected a full bucket for an unknown key, got %+v", state)
+	}
+	for i := 2; i >= 0; i-- {
+		tokenBucket.Consume("key")
+		expiringTokenBucket.Consume("key")
+		if state := tokenBucket.State("key"); state.Remaining != i {
+			t.Errorf("expected %d remaining tokens, got %d", i, state.Remaining)
+		}
+		if state := expiringTokenBucket.State("key"); state.Remaining != i {
+			t.Errorf("expected %d remaining tokens, got %d", i, state.Remaining)
+		}
+	}
+	// State 不消耗令牌
+	if len(tokenBucket.storage) != 1 || tokenBucket.storage["key"].count != 0 {
+		t.Errorf("expected State not to change the bucket")
+	}
+
+	clock.Advance(time.Second)
+	if state := tokenBucket.State("key"); state.Remaining != 1 {
+		t.Errorf("expected 1 remaining token after one refill interval, got %d", state.Remaining)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if state := expiringTokenBucket.State("key"); state.Remaining != 3 {
+		t.Errorf("expected a full bucket after expiration, got %d", state.Remaining)
+	}
+}
+
+// TestExpiringTokenBucketRateLimitRetryAfter 测试 RetryAfter 只在令牌用完时返回到桶过期的剩余时间，并随时间减少。
+func TestExpiringTokenBucketRateLimitRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	rl := NewExpiringTokenBucketRateLimit(2, 200*time.Millisecond)
+
+	if retryAfter := rl.RetryAfter("key"); retryAfter != 0 {
+		t.Errorf("expected 0 for an unknown key, got %v", retryAfter)
+	}
+	rl.Consume("key")
+	if retryAfter := rl.RetryAfter("key"); retryAfter != 0 {
+		t.Errorf("expected 0 while tokens remain, got %v", retryAfter)
+	}
+	rl.Consume("key")
+	first := rl.RetryAfter("key")
+	if first <= 0 || first > 200*time.Millisecond {
+		t.Errorf("expected retry after within the expiration, got %v", first)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if second := rl.RetryAfter("key"); second >= first {
+		t.Errorf("expected retry after to shrink, got %v then %v", first, second)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if retryAfter := rl.RetryAfter("key"); retryAfter != 0 {
+		t.Errorf("expected 0 after expiration, got %v", retryAfter)
+	}
+}
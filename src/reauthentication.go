@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sensitive endpoints (e.g. DELETE /users/:user_id, DELETE /users/:user_id/totp-credential,
+// or POST /users/:user_id/email-update-requests) can require the user to have authenticated
+// recently. env.reauthenticationRoutes lists the route identifiers (Route.String(), as in
+// env.routeConfig) that require it. Each successful POST /users/:user_id/verify-password and
+// POST /users/:user_id/verify-2fa/totp records the time in the user_recent_authentication
+// table, and requests to the listed routes are rejected with REAUTHENTICATION_REQUIRED unless
+// that time is within env.reauthenticationWindow. The check happens before the handler runs,
+// so a rejected request has no effect.
+//
+// Only routes with a :user_id parameter can be listed, since the check is per user.
+// Nothing is recorded while the list is empty.
+
+// defaultReauthenticationWindow is used when env.reauthenticationWindow isn't set.
+const defaultReauthenticationWindow = 5 * time.Minute
+
+// ExpectedErrorReauthenticationRequired means the route requires the user to verify their
+// password or second factor again first.
+const ExpectedErrorReauthenticationRequired = "REAUTHENTICATION_REQUIRED"
+
+// reauthenticationWindowDuration returns how recent the last authentication must be.
+// Zero or negative values fall back to defaultReauthenticationWindow.
+func (env *Environment) reauthenticationWindowDuration() time.Duration {
+	if env.reauthenticationWindow <= 0 {
+		return defaultReauthenticationWindow
+	}
+	return env.reauthenticationWindow
+}
+
+// requiresReauthentication reports whether env.reauthenticationRoutes lists route.
+func (env *Environment) requiresReauthentication(route Route) bool {
+	return slices.Contains(env.reauthenticationRoutes, route.String())
+}
+
+// recordRecentAuthentication records that the user just verified their password or second
+// factor. A failure is only logged: the verification itself succeeded, and the user will be
+// asked to authenticate again before a sensitive action.
+func (env *Environment) recordRecentAuthentication(ctx context.Context, userId string) {
+	if len(env.reauthenticationRoutes) == 0 {
+		return
+	}
+	err := setUserRecentAuthentication(env.db, ctx, userId, time.Now())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// setUserRecentAuthentication sets the user's last authentication time, replacing the previous one.
+func setUserRecentAuthentication(db *sql.DB, ctx context.Context, userId string, authenticatedAt time.Time) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO user_recent_authentication (user_id, authenticated_at) VALUES (?, ?)
+ON CONFLICT (user_id) DO UPDATE SET authenticated_at = excluded.authenticated_at`, userId, authenticatedAt.Unix())
+	return err
+}
+
+// getUserRecentAuthentication returns the user's last authentication time.
+//
+// Returns:
+//   time.Time: When the user last verified their password or second factor.
+//   error: ErrRecordNotFound if none was recorded, or a database error.
+func getUserRecentAuthentication(db *sql.DB, ctx context.Context, userId string) (time.Time, error) {
+	var authenticatedAtUnix int64
+	err := db.QueryRowContext(ctx, "SELECT authenticated_at FROM user_recent_authentication WHERE user_id = ?", userId).Scan(&authenticatedAtUnix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrRecordNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(authenticatedAtUnix, 0), nil
+}
+
+// routePathParam returns the value of the :name segment of pattern in path.
+// path must match pattern (see matchRoutePath).
+func routePathParam(pattern string, path string, name string) (string, bool) {
+	pathSegments := strings.Split(path, "/")
+	for i, segment := range strings.Split(pattern, "/") {
+		if segment == ":"+name && i < len(pathSegments) {
+			return pathSegments[i], true
+		}
+	}
+	return "", false
+}
+
+// withReauthentication rejects requests to the routes in env.reauthenticationRoutes with
+// REAUTHENTICATION_REQUIRED unless the user in the :user_id parameter authenticated within
+// env.reauthenticationWindow. Requests without a valid request secret are passed through so
+// the handler rejects them as usual. Listed routes without a :user_id parameter are logged at
+// startup and not checked.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   routes ([]Route): The router's Routes().
+//   handler (http.Handler): The wrapped handler.
+//
+// Returns:
+//   http.Handler: The wrapped handler, or handler itself if no route requires reauthentication.
+func withReauthentication(env *Environment, routes []Route, handler http.Handler) http.Handler {
+	checked := false
+	for _, route := range routes {
+		if !env.requiresReauthentication(route) {
+			continue
+		}
+		if !strings.Contains(route.Path, "/:user_id") {
+			log.Printf("reauthentication: %q has no :user_id parameter", route.String())
+			continue
+		}
+		checked = true
+	}
+	if !checked {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := matchRoute(routes, r.Method, r.URL.Path)
+		if !ok || !env.requiresReauthentication(route) || !verifyRequestSecret(env.secret, r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		userId, ok := routePathParam(route.Path, r.URL.Path, "user_id")
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		authenticatedAt, err := getUserRecentAuthentication(env.db, r.Context(), userId)
+		if errors.Is(err, ErrRecordNotFound) {
+			writeExpectedErrorResponse(w, ExpectedErrorReauthenticationRequired)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		if time.Since(authenticatedAt) > env.reauthenticationWindowDuration() {
+			writeExpectedErrorResponse(w, ExpectedErrorReauthenticationRequired)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"           // 导入 context 包，用于插入测试用户
+	"net/http/httptest" // 导入 httptest 包，用于创建模拟的 HTTP 请求和响应
+	"strings"           // 导入 strings 包，用于创建请求体
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestReauthentication 测试 env.reauthenticationRoutes 中的路由只有在用户近期验证过密码时才会执行，
+// 超出 env.reauthenticationWindow 后被拒绝，直到用户重新验证。
+func TestReauthentication(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:             "1",
+		CreatedAt:      now,
+		PasswordHash:   "$argon2id$v=19$m=19456,t=2,p=1$enc5MDZrSElTSVE0ODdTSw$CS/AV+PQs08MhdeIrHhfmQ",
+		RecoveryCode:   "12345678",
+		TOTPRegistered: false,
+	}
+	err := insertUser(db, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	env.reauthenticationRoutes = []string{"DELETE /users/:user_id"}
+	env.reauthenticationWindow = 5 * time.Minute
+	app := CreateApp(env)
+
+	verifyPassword := func() {
+		r := httptest.NewRequest("POST", "/users/1/verify-password", strings.NewReader(`{"password":"super_secure_password"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 204, w.Result().StatusCode)
+	}
+	deleteUser := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("DELETE", "/users/1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	// 从未验证过
+	assertErrorResponse(t, deleteUser().Result(), 400, ExpectedErrorReauthenticationRequired)
+
+	// 验证过密码，但已经超出时间窗口
+	verifyPassword()
+	err = setUserRecentAuthentication(db, context.Background(), "1", time.Now().Add(-6*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertErrorResponse(t, deleteUser().Result(), 400, ExpectedErrorReauthenticationRequired)
+	userExists, err := checkUserExists(db, context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, userExists)
+
+	// 重新验证后在时间窗口内可以执行
+	verifyPassword()
+	assert.Equal(t, 204, deleteUser().Result().StatusCode)
+
+	// 不在列表中的路由不受影响
+	r := httptest.NewRequest("GET", "/users/1", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assertErrorResponse(t, w.Result(), 404, "NOT_FOUND")
+}
+
+// TestRoutePathParam 测试 routePathParam 从匹配的路径中取出参数。
+func TestRoutePathParam(t *testing.T) {
+	t.Parallel()
+
+	userId, ok := routePathParam("/users/:user_id/totp-credential", "/users/abc/totp-credential", "user_id")
+	assert.True(t, ok)
+	assert.Equal(t, "abc", userId)
+
+	_, ok = routePathParam("/users", "/users", "user_id")
+	assert.False(t, ok)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"        // 导入上下文包
+	"crypto/subtle"  // 导入常量时间比较包，用于比较单个恢复码
+	"database/sql"   // 导入数据库 SQL 包
+	"encoding/json"  // 导入 JSON 编码/解码包
+	"errors"         // 导入 errors 包
+	"faroe/argon2id" // 导入 Argon2id 包，用于哈希和验证恢复码
+	"fmt"            // 导入格式化包
+	"io"             // 导入 io 包，用于读取请求体
+	"log"            // 导入日志包
+	"net/http"       // 导入 HTTP 包
+	"time"           // 导入时间包
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 一次性恢复码 (backup codes) 模式。
+// 默认情况下每个用户只有一个恢复码 (user.recovery_code)，在 reset-2fa 中使用后重新生成。
+// 设置 env.recoveryCodeCount 后，POST /users/:user_id/regenerate-recovery-code 改为生成一组一次性恢复码，
+// 只在响应中返回一次明文，数据库 (recovery_code 表) 中只保存 Argon2id 哈希。
+// 每个恢复码可以通过 POST /users/:user_id/verify-recovery-code 使用一次。
+
+// handleRegenerateUserRecoveryCodesRequest 处理 POST /users/:user_id/regenerate-recovery-code 请求。
+// 没有设置 env.recoveryCodeCount (零值或负数) 时使用原来的单个恢复码处理函数 handleRegenerateUserRecoveryCodeRequest。
+// 否则删除用户所有旧的一次性恢复码，生成 env.recoveryCodeCount 个新的恢复码并返回：
+//
+//	{"recovery_codes": ["...", ...]}
+func handleRegenerateUserRecoveryCodesRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if env.recoveryCodeCount <= 0 {
+		handleRegenerateUserRecoveryCodeRequest(env, w, r, params)
+		return
+	}
+
+	// 1. 验证内部请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Accept 头
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// 3. 检查用户是否存在
+	userId := params.ByName("user_id")
+	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userExists {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	// 4. 生成新的恢复码并替换旧的恢复码
+	codes, err := regenerateUserRecoveryCodes(env.db, r.Context(), env.generateId, userId, env.recoveryCodeCount)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeRecoveryCodesToJSON(codes)))
+}
+
+// handleVerifyUserRecoveryCodeRequest 处理 POST /users/:user_id/verify-recovery-code 请求。
+// 请求体为 {"recovery_code": "..."}。返回用户剩余的第二因素，方便客户端引导用户重新注册第二因素：
+//
+//	{"recovery_code": "...", "totp_registered": true, "second_factors_remaining": 1}
+//
+// 设置了 env.recoveryCodeCount 时，恢复码与用户一个未使用的一次性恢复码匹配时将其标记为已使用，
+// 不生成新的恢复码，所以响应中没有 recovery_code，剩余的恢复码个数随之减少，用完后需要重新生成。
+// 否则 (单个恢复码模式) 恢复码与用户的恢复码相同时生成一个新的恢复码代替它，并在 recovery_code 中返回。
+// 每个恢复码只能使用一次，再次提交会返回 INCORRECT_CODE。
+// 尝试次数使用 env.recoveryCodeUserRateLimit 限制 (与 reset-2fa 相同)。
+// 一次性恢复码模式下一次验证最多要和用户的每个未使用的恢复码做一次 Argon2id 比较，所以和验证密码一样，
+// 提供了 client_ip 时还会消耗 env.passwordHashingIPRateLimit 的令牌，并且在比较期间占用
+// env.passwordHashingConcurrencyLimit 的一个名额。
+func handleVerifyUserRecoveryCodeRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// 1. 验证内部请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Content-Type
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+
+	// 3. 检查用户是否存在
+	userId := params.ByName("user_id")
+	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userExists {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	// 4. 解析请求体
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+	var data struct {
+		RecoveryCode *string `json:"recovery_code"`
+		ClientIP     string  `json:"client_ip"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	if data.RecoveryCode == nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+	code, ok := normalizeCode(*data.RecoveryCode, false)
+	if !ok {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+	// 恢复码由 generateSecureCode 生成，只包含大写字母和数字
+	if env.normalizeRecoveryCodes {
+		code = normalizeAlphanumericCode(code)
+	}
+
+	// 5. 应用针对用户的速率限制，然后在 Argon2id 比较前检查
+	if !env.recoveryCodeUserRateLimit.Consume(userId) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+	setRateLimitHeaders(env, w, &env.recoveryCodeUserRateLimit, userId)
+	if data.ClientIP != "" {
+		if !env.passwordHashingIPRateLimit.Consume(data.ClientIP) {
+			writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+			return
+		}
+		setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
+	}
+
+	// 6. 使用恢复码
+	var newCode string
+	var valid bool
+	if env.recoveryCodeCount > 0 {
+		// 一次性恢复码只标记为已使用，不生成新的恢复码。Argon2id 比较期间占用一个哈希名额
+		if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+			return
+		}
+		valid, err = useUserRecoveryCode(env.db, r.Context(), userId, code, time.Now())
+		env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
+	} else {
+		// 单个恢复码使用后生成新的恢复码代替它
+		newCode, valid, err = replaceUserSingleRecoveryCode(env.db, r.Context(), userId, code)
+		if valid {
+			env.invalidateCachedUser(userId)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !valid {
+		env.delayAuthenticationFailure(r.Context())
+		writeExpectedErrorResponse(w, ExpectedErrorIncorrectCode)
+		return
+	}
+	env.recoveryCodeUserRateLimit.Reset(userId)
+
+	// 7. 查询用户剩余的第二因素
+	totpCredentialCount, secondFactorCount, err := getUserSecondFactorCounts(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeRecoveryCodeVerificationToJSON(newCode, totpCredentialCount > 0, secondFactorCount)))
+}
+
+// encodeRecoveryCodesToJSON 将明文恢复码编码为 {"recovery_codes": [...]}。
+func encodeRecoveryCodesToJSON(codes []string) string {
+	data := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// encodeRecoveryCodeVerificationToJSON 编码 verify-recovery-code 的响应。recoveryCode 为空 (一次性恢复码模式) 时不包含该字段。
+func encodeRecoveryCodeVerificationToJSON(recoveryCode string, totpRegistered bool, secondFactorsRemaining int) string {
+	data := struct {
+		RecoveryCode           string `json:"recovery_code,omitempty"`
+		TOTPRegistered         bool   `json:"totp_registered"`
+		SecondFactorsRemaining int    `json:"second_factors_remaining"`
+	}{
+		RecoveryCode:           recoveryCode,
+		TOTPRegistered:         totpRegistered,
+		SecondFactorsRemaining: secondFactorsRemaining,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// userWithRecoveryCodesRemainingJSON 是加上 recovery_codes_remaining 字段的用户模型，
+// 前面的字段和顺序与 userJSON 相同。
+type userWithRecoveryCodesRemainingJSON struct {
+	userJSON
+	RecoveryCodesRemaining int `json:"recovery_codes_remaining"`
+}
+
+// encodeUserWithRecoveryCodesRemainingToJSON 将用户模型和 recovery_codes_remaining 字段编码为 JSON，
+// 时间戳使用 format 格式。remaining 为 nil 时不加入该字段，直接返回 encodeUserToJSON 的结果。
+func encodeUserWithRecoveryCodesRemainingToJSON(user User, remaining *int, format timeFormat) string {
+	if remaining == nil {
+		return encodeUserToJSON(user, format)
+	}
+	data := userWithRecoveryCodesRemainingJSON{
+		userJSON:               newUserJSON(user, format),
+		RecoveryCodesRemaining: *remaining,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return encodeUserToJSON(user, format)
+	}
+	return string(encoded)
+}
+
+// --- 数据库操作函数 ---
+
+// regenerateUserRecoveryCodes 生成 count 个新的一次性恢复码，在一个事务中删除用户所有旧的恢复码
+// (包括未使用的) 并插入新恢复码的 Argon2id 哈希。
+//
+// 参数:
+//
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   generateId (func() (string, error)): 恢复码记录的 ID 生成器，通常是 env.generateId。
+//   userId (string): 用户 ID。
+//   count (int): 要生成的恢复码个数。
+//
+// 返回值:
+//
+//   []string: 新恢复码的明文，只能在这里获取。
+//   error: 如果生成恢复码、哈希或数据库操作时发生错误，则返回错误。
+func regenerateUserRecoveryCodes(db *sql.DB, ctx context.Context, generateId func() (string, error), userId string, count int) ([]string, error) {
+	// 先在事务外生成和哈希恢复码，Argon2id 比较慢，不应该占用事务
+	codes := make([]string, count)
+	codeHashes := make([]string, count)
+	for i := range codes {
+		code, err := generateSecureCode()
+		if err != nil {
+			return nil, err
+		}
+		// Argon2id 无法中断，请求已经超时或被取消时不再继续哈希
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		codeHash, err := argon2id.Hash(code)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		codeHashes[i] = codeHash
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Commit 成功后 Rollback 不做任何事
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_code WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, codeHash := range codeHashes {
+		_, err = insertWithGeneratedId(generateId, func(id string) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO recovery_code (id, user_id, created_at, code_hash) VALUES (?, ?, ?, ?)", id, userId, now.Unix(), codeHash)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert recovery code: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// useUserRecoveryCode 检查恢复码是否与用户的某个未使用的一次性恢复码匹配，匹配时将其标记为已使用。
+// 标记时检查 used_at 仍然为 NULL，所以两个并发请求使用同一个恢复码时只有一个会成功。
+//
+// 参数:
+//
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   userId (string): 用户 ID。
+//   code (string): 用户提交的恢复码 (已经过 normalizeCode 规范化)。
+//   now (time.Time): 当前时间，记录为使用时间。
+//
+// 返回值:
+//
+//   bool: 恢复码是否有效 (匹配且之前未被使用)。
+//   error: 如果数据库操作或哈希比较时发生错误，则返回错误。
+func useUserRecoveryCode(db *sql.DB, ctx context.Context, userId string, code string, now time.Time) (bool, error) {
+	matchedId, err := findUserRecoveryCode(db, ctx, userId, code)
+	if err != nil || matchedId == "" {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx, "UPDATE recovery_code SET used_at = ? WHERE id = ? AND used_at IS NULL", now.Unix(), matchedId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// replaceUserSingleRecoveryCode 检查恢复码是否与用户的单个恢复码 (user.recovery_code) 相同，相同时生成一个新的恢复码代替它。
+// 更新时检查恢复码没有被修改，所以两个并发请求使用同一个恢复码时只有一个会成功。
+//
+// 参数:
+//
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   userId (string): 用户 ID。
+//   code (string): 用户提交的恢复码 (已经过 normalizeCode 规范化)。
+//
+// 返回值:
+//
+//   string: 新的恢复码。恢复码无效时为空字符串。
+//   bool: 恢复码是否有效。
+//   error: 如果生成恢复码或数据库操作时发生错误，则返回错误。
+func replaceUserSingleRecoveryCode(db *sql.DB, ctx context.Context, userId string, code string) (string, bool, error) {
+	var recoveryCode string
+	err := db.QueryRowContext(ctx, "SELECT recovery_code FROM user WHERE id = ?", userId).Scan(&recoveryCode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if recoveryCode == "" || subtle.ConstantTimeCompare([]byte(code), []byte(recoveryCode)) != 1 {
+		return "", false, nil
+	}
+
+	newCode, err := generateSecureCode()
+	if err != nil {
+		return "", false, err
+	}
+	result, err := db.ExecContext(ctx, "UPDATE user SET recovery_code = ? WHERE id = ? AND recovery_code = ?", newCode, userId, recoveryCode)
+	if err != nil {
+		return "", false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return "", false, err
+	}
+	if affected < 1 {
+		// 并发请求已经使用了这个恢复码
+		return "", false, nil
+	}
+	return newCode, true, nil
+}
+
+// findUserRecoveryCode 返回与恢复码匹配的用户未使用的一次性恢复码的 ID，没有匹配时返回空字符串。
+func findUserRecoveryCode(db *sql.DB, ctx context.Context, userId string, code string) (string, error) {
+	// 长度不符的恢复码不可能匹配，不需要进行 Argon2id 比较
+	if len(code) != secureCodeLength {
+		return "", nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, code_hash FROM recovery_code WHERE user_id = ? AND used_at IS NULL", userId)
+	if err != nil {
+		return "", err
+	}
+	// 先读取所有哈希再比较，避免在 Argon2id 计算期间占用数据库连接
+	var ids, codeHashes []string
+	for rows.Next() {
+		var id, codeHash string
+		err = rows.Scan(&id, &codeHash)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		ids = append(ids, id)
+		codeHashes = append(codeHashes, codeHash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	for i, codeHash := range codeHashes {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		valid, err := argon2id.Verify(codeHash, code)
+		if err != nil {
+			return "", err
+		}
+		if valid {
+			return ids[i], nil
+		}
+	}
+	return "", nil
+}
+
+// getUserRecoveryCodesRemaining 返回用户剩余可用的恢复码个数，用于用户模型的 recovery_codes_remaining 字段。
+// 恢复码只用于重置第二因素，所以用户没有注册 TOTP 时返回 nil (不包含该字段)。
+// recoveryCodeCount 大于 0 (一次性恢复码模式) 时返回 recovery_code 表中未使用的恢复码个数，
+// 否则 (单个恢复码模式) 用户有恢复码时返回 1，没有时返回 0。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   recoveryCodeCount (int): env.recoveryCodeCount。
+//   user (User): 用户。
+//
+// 返回值:
+//   *int: 剩余可用的恢复码个数，不适用时为 nil。
+//   error: 如果查询时发生错误，则返回错误。
+func getUserRecoveryCodesRemaining(db *sql.DB, ctx context.Context, recoveryCodeCount int, user User) (*int, error) {
+	if !user.TOTPRegistered {
+		return nil, nil
+	}
+	remaining := 0
+	if recoveryCodeCount <= 0 {
+		if user.RecoveryCode != "" {
+			remaining = 1
+		}
+		return &remaining, nil
+	}
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM recovery_code WHERE user_id = ? AND used_at IS NULL", user.Id).Scan(&remaining)
+	if err != nil {
+		return nil, err
+	}
+	return &remaining, nil
+}
+
+// getUserSecondFactorCounts 返回用户注册的 TOTP 凭据个数，以及包括安全密钥在内的第二因素总数。
+// passkey 用于代替密码登录，不计入第二因素。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   userId (string): 用户 ID。
+//
+// 返回值:
+//   int: TOTP 凭据个数。
+//   int: 第二因素总数 (TOTP 凭据和安全密钥)。
+//   error: 如果查询时发生错误，则返回错误。
+func getUserSecondFactorCounts(db *sql.DB, ctx context.Context, userId string) (int, int, error) {
+	var totpCredentialCount, securityKeyCount int
+	err := db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM user_totp_credential WHERE user_id = ?), (SELECT count(*) FROM security_key WHERE user_id = ?)", userId, userId).Scan(&totpCredentialCount, &securityKeyCount)
+	if err != nil {
+		return 0, 0, err
+	}
+	return totpCredentialCount, totpCredentialCount + securityKeyCount, nil
+}
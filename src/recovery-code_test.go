@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"           // 导入上下文包
+	"fmt"               // 导入格式化包
+	"net/http"          // 导入 HTTP 包
+	"net/http/httptest" // 导入 HTTP 测试包
+	"strings"           // 导入字符串包
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestUseUserRecoveryCode 测试生成一组一次性恢复码后，每个恢复码只能使用一次，
+// 重新生成后旧的恢复码全部失效。
+func TestUseUserRecoveryCode(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	for _, userId := range []string{"1", "2"} {
+		_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", userId, time.Now().Unix(), "hash", "12345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	codes, err := regenerateUserRecoveryCodes(db, context.Background(), newSequenceIdGenerator("code_"), "1", 5)
+	assert.NoError(t, err)
+	assert.Len(t, codes, 5)
+	for _, code := range codes {
+		assert.Len(t, code, secureCodeLength)
+	}
+
+	// 其他用户不能使用这些恢复码
+	valid, err := useUserRecoveryCode(db, context.Background(), "2", codes[0], time.Now())
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 使用两个不同的恢复码
+	valid, err = useUserRecoveryCode(db, context.Background(), "1", codes[0], time.Now())
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = useUserRecoveryCode(db, context.Background(), "1", codes[3], time.Now())
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// 已经使用的恢复码再次使用会失败
+	valid, err = useUserRecoveryCode(db, context.Background(), "1", codes[0], time.Now())
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	var unused int
+	err = db.QueryRow("SELECT count(*) FROM recovery_code WHERE user_id = ? AND used_at IS NULL", "1").Scan(&unused)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, unused)
+
+	// 重新生成后旧的 (包括未使用的) 恢复码失效
+	newCodes, err := regenerateUserRecoveryCodes(db, context.Background(), newSequenceIdGenerator("new_code_"), "1", 2)
+	assert.NoError(t, err)
+	assert.Len(t, newCodes, 2)
+	valid, err = useUserRecoveryCode(db, context.Background(), "1", codes[1], time.Now())
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	valid, err = useUserRecoveryCode(db, context.Background(), "1", newCodes[1], time.Now())
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+// TestReplaceUserSingleRecoveryCode 测试单个恢复码模式下使用恢复码后会生成新的恢复码代替它，
+// 旧的恢复码不能再次使用，也不会影响一次性恢复码。
+func TestReplaceUserSingleRecoveryCode(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 错误的恢复码和不存在的用户
+	newCode, valid, err := replaceUserSingleRecoveryCode(db, context.Background(), "1", "87654321")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Empty(t, newCode)
+	_, valid, err = replaceUserSingleRecoveryCode(db, context.Background(), "2", "12345678")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	newCode, valid, err = replaceUserSingleRecoveryCode(db, context.Background(), "1", "12345678")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Len(t, newCode, secureCodeLength)
+	assert.NotEqual(t, "12345678", newCode)
+	user, err := getUser(db, context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, newCode, user.RecoveryCode)
+
+	// 旧的恢复码不能再次使用
+	_, valid, err = replaceUserSingleRecoveryCode(db, context.Background(), "1", "12345678")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// 没有插入一次性恢复码
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM recovery_code WHERE user_id = ?", "1").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// TestGetUserRecoveryCodesRemaining 测试剩余恢复码个数随着恢复码的使用减少，重新生成后恢复，
+// 并且用户没有注册 TOTP 时不返回该字段。
+func TestGetUserRecoveryCodesRemaining(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	user := User{
+		Id:             "1",
+		CreatedAt:      time.Unix(time.Now().Unix(), 0),
+		PasswordHash:   "hash",
+		RecoveryCode:   "12345678",
+		TOTPRegistered: true,
+	}
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", user.Id, user.CreatedAt.Unix(), user.PasswordHash, user.RecoveryCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 单个恢复码模式
+	remaining, err := getUserRecoveryCodesRemaining(db, context.Background(), 0, user)
+	assert.NoError(t, err)
+	if assert.NotNil(t, remaining) {
+		assert.Equal(t, 1, *remaining)
+	}
+
+	// 一次性恢复码模式
+	codes, err := regenerateUserRecoveryCodes(db, context.Background(), newSequenceIdGenerator("code_"), user.Id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range codes {
+		remaining, err = getUserRecoveryCodesRemaining(db, context.Background(), 3, user)
+		assert.NoError(t, err)
+		if assert.NotNil(t, remaining) {
+			assert.Equal(t, 3-i, *remaining)
+		}
+		_, err = useUserRecoveryCode(db, context.Background(), user.Id, code, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	remaining, err = getUserRecoveryCodesRemaining(db, context.Background(), 3, user)
+	assert.NoError(t, err)
+	if assert.NotNil(t, remaining) {
+		assert.Equal(t, 0, *remaining)
+	}
+
+	// 重新生成后恢复
+	_, err = regenerateUserRecoveryCodes(db, context.Background(), newSequenceIdGenerator("new_code_"), user.Id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining, err = getUserRecoveryCodesRemaining(db, context.Background(), 3, user)
+	assert.NoError(t, err)
+	if assert.NotNil(t, remaining) {
+		assert.Equal(t, 3, *remaining)
+	}
+	// 字段顺序和其他用户响应一致
+	assert.Equal(t, fmt.Sprintf(`{"id":"1","created_at":%d,"recovery_code":"12345678","totp_registered":true,"recovery_codes_remaining":3}`, user.CreatedAt.Unix()),
+		encodeUserWithRecoveryCodesRemainingToJSON(user, remaining, timeFormatUnix))
+
+	// 没有注册 TOTP 时不包含该字段
+	user.TOTPRegistered = false
+	remaining, err = getUserRecoveryCodesRemaining(db, context.Background(), 3, user)
+	assert.NoError(t, err)
+	assert.Nil(t, remaining)
+	assert.Equal(t, user.EncodeToJSON(), encodeUserWithRecoveryCodesRemainingToJSON(user, remaining, timeFormatUnix))
+}
+
+// TestVerifyUserRecoveryCodeNormalization 测试开启 env.normalizeRecoveryCodes 后，
+// 小写并且带分隔符的恢复码可以通过验证，关闭时验证失败。
+func TestVerifyUserRecoveryCodeNormalization(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := regenerateUserRecoveryCodes(db, context.Background(), newSequenceIdGenerator("code_"), "1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	env.recoveryCodeCount = 2
+	app := CreateApp(env)
+	verifyRecoveryCode := func(code string) *http.Response {
+		data := fmt.Sprintf(`{"recovery_code":"%s"}`, code)
+		r := httptest.NewRequest("POST", "/users/1/verify-recovery-code", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+	variant := strings.ToLower(codes[0][:4]) + "-" + strings.ToLower(codes[0][4:])
+
+	// 关闭时只接受原始的恢复码
+	res := verifyRecoveryCode(variant)
+	assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+
+	env.normalizeRecoveryCodes = true
+	res = verifyRecoveryCode(variant)
+	assert.Equal(t, 200, res.StatusCode)
+
+	// 规范化不影响原始的恢复码
+	res = verifyRecoveryCode(codes[1])
+	assert.Equal(t, 200, res.StatusCode)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// 请求的总时间预算：设置了 env.requestTimeout 时，每个请求的 context 在这段时间后取消，
+// 数据库调用 (见 withDatabaseTimeout) 和 Pwned Passwords 查询 (见 pwnedPasswordsClient) 共用同一个截止时间。
+// 超时后处理函数返回的 500 被改写为 503 和 ExpectedErrorTimeout，调用方可以重试。
+// Argon2id 哈希开始后无法中断，所以处理函数在开始哈希之前检查 requestBudgetExceeded，
+// 预算已经用完时直接返回 503，不再占用 CPU 和内存。默认 (零值) 不限制。
+
+// ExpectedErrorTimeout 表示请求超过了 env.requestTimeout (503)。
+const ExpectedErrorTimeout = "TIMEOUT"
+
+// withRequestTimeout 包装应用的 handler，给请求的 context 加上 env.requestTimeout 的截止时间。
+// 参数：
+//   env *Environment: 应用环境，包含 requestTimeout。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+// 注意：必须放在 withDatabaseTimeout 里面，这样处理函数的 500 响应先在这里被改写为 ExpectedErrorTimeout。
+func withRequestTimeout(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if env.requestTimeout <= 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), env.requestTimeout)
+		defer cancel()
+		handler.ServeHTTP(&requestTimeoutResponseWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// requestBudgetExceeded 返回请求的截止时间是否已经过了。处理函数在开始无法中断的操作 (例如 Argon2id 哈希) 之前调用。
+func requestBudgetExceeded(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+// writeRequestTimeoutErrorResponse 返回 503 和 ExpectedErrorTimeout 错误。
+func writeRequestTimeoutErrorResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, ExpectedErrorTimeout)))
+}
+
+// requestTimeoutResponseWriter 在请求超时后把 500 响应改写为 503 和 ExpectedErrorTimeout，
+// 丢弃处理函数写入的响应体。其他响应直接写入。见 withRequestTimeout。
+type requestTimeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	timedOut    bool // 已经写入了超时响应，丢弃之后的响应体
+}
+
+func (w *requestTimeoutResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if statusCode == http.StatusInternalServerError && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		writeRequestTimeoutErrorResponse(w.ResponseWriter)
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *requestTimeoutResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap 让 http.ResponseController 可以访问底层的 ResponseWriter。
+func (w *requestTimeoutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"          // 导入 HTTP 包
+	"net/http/httptest" // 导入 httptest 包，用于创建模拟的 HTTP 请求对象
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包，用于设置时间预算
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库，用于进行测试断言
+)
+
+// TestWithRequestTimeout 测试 withRequestTimeout 在时间预算用完后返回 503 TIMEOUT，
+// 在预算内完成的请求和没有配置预算时不受影响。
+func TestWithRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	t.Run("slow breach check", func(t *testing.T) {
+		t.Parallel()
+
+		server, _, _ := newPwnedPasswordsStubServer(t, "password123", 500*time.Millisecond)
+		defer server.Close()
+		client := newPwnedPasswordsClient(server.URL, 0, 0)
+
+		env := &Environment{requestTimeout: 20 * time.Millisecond}
+		handler := withRequestTimeout(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := client.isPasswordPwned(r.Context(), "password123")
+			if err != nil {
+				writeUnexpectedErrorResponse(w)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		start := time.Now()
+		r := httptest.NewRequest("POST", "/users", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 503, ExpectedErrorTimeout)
+		// 查询在截止时间被取消，不会等待 API 返回
+		assert.Less(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("budget spent before hashing", func(t *testing.T) {
+		t.Parallel()
+
+		env := &Environment{requestTimeout: 10 * time.Millisecond}
+		hashed := false
+		handler := withRequestTimeout(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			if requestBudgetExceeded(r) {
+				writeRequestTimeoutErrorResponse(w)
+				return
+			}
+			hashed = true
+		}))
+
+		r := httptest.NewRequest("POST", "/users", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertErrorResponse(t, w.Result(), 503, ExpectedErrorTimeout)
+		assert.False(t, hashed)
+	})
+
+	t.Run("within budget", func(t *testing.T) {
+		t.Parallel()
+
+		env := &Environment{requestTimeout: time.Second}
+		handler := withRequestTimeout(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.False(t, requestBudgetExceeded(r))
+			writeUnexpectedErrorResponse(w)
+		}))
+
+		r := httptest.NewRequest("POST", "/users", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		// 没有超时的 500 不被改写
+		assertErrorResponse(t, w.Result(), 500, "UNKNOWN_ERROR")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		env := &Environment{}
+		handler := withRequestTimeout(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Deadline()
+			assert.False(t, ok)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"         // 导入用于处理字节切片的包，用于判断请求体是否为空
+	"context"       // 导入 context 包，用于在请求取消时停止失败延迟
 	"crypto/subtle" // 导入用于执行常量时间比较的包，增强安全性
+	"encoding/json" // 导入 JSON 编码/解码包，用于解析请求体
+	"errors"        // 导入错误包，用于识别请求体超出大小限制的错误
+	"fmt"           // 导入格式化包，用于生成 Link 头
+	"io"            // 导入 I/O 包，用于读取请求体
+	"math/rand/v2"  // 导入随机数包，用于生成失败延迟的随机抖动 (不需要密码学安全)
 	"mime"          // 导入用于解析 MIME 媒体类型的包
 	"net/http"      // 导入处理 HTTP 请求和响应的核心包
+	"net/url"       // 导入 URL 包，用于生成分页链接
+	"strconv"       // 导入字符串转换包，用于把页码写入查询参数
 	"strings"       // 导入处理字符串操作的包
+	"time"          // 导入时间包，用于失败延迟
 )
 
 // verifyRequestSecret 函数用于验证 HTTP 请求头中是否包含正确的服务器密钥。
@@ -38,6 +48,149 @@ func verifyRequestSecret(secret []byte, r *http.Request) bool {
 	return subtle.ConstantTimeCompare(secret, []byte(authorizationHeader[0])) == 1
 }
 
+// decodeOptionalJSON 函数读取请求体，并在请求体不为空时把它解析到 dst 中。
+// 用于所有字段都是可选的端点 (例如只有 client_ip 的请求)：没有请求体、空白请求体、"{}" 和
+// 只包含部分字段的 JSON 都被视为合法，dst 中没有出现的字段保持原来的值 (通常是零值)。
+// 参数：
+//   r *http.Request: 客户端发来的 HTTP 请求。
+//   dst any: 指向用于保存解析结果的结构体的指针。
+// 返回值：
+//   error: 如果读取请求体失败，或者请求体不为空但不是合法的 JSON，返回错误；否则返回 nil。
+//          调用方应该对错误返回 jsonDecodeErrorCode(err)。
+func decodeOptionalJSON(r *http.Request, dst any) error {
+	// 读取整个请求体
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	// 没有请求体或只包含空白字符时，视为没有提供任何字段
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, dst)
+}
+
+// ExpectedErrorMalformedJSON 表示请求体不是合法的 JSON (语法错误或不完整)。
+// 语法正确但缺少字段或字段类型不对的请求体仍然返回 ExpectedErrorInvalidData。
+const ExpectedErrorMalformedJSON = "MALFORMED_JSON"
+
+// jsonDecodeErrorCode 返回 json.Unmarshal (或 decodeOptionalJSON) 失败时应返回的错误码。
+// 参数：
+//   err error: 解析请求体时返回的错误。
+// 返回值：
+//   string: err 是 *json.SyntaxError 时返回 ExpectedErrorMalformedJSON，
+//           其他错误 (例如 *json.UnmarshalTypeError) 返回 ExpectedErrorInvalidData。
+func jsonDecodeErrorCode(err error) string {
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return ExpectedErrorMalformedJSON
+	}
+	return ExpectedErrorInvalidData
+}
+
+// defaultMaxRequestBodySize 是没有配置 env.maxRequestBodySize 时请求体的最大字节数。
+// 所有端点的请求体都是很小的 JSON，1 MiB 已经足够宽松。
+const defaultMaxRequestBodySize = 1 << 20
+
+// ExpectedErrorRequestTooLarge 表示请求体超过了 env.requestBodyLimit() 的限制 (413)。
+const ExpectedErrorRequestTooLarge = "REQUEST_TOO_LARGE"
+
+// requestBodyLimit 返回请求体的最大字节数。
+// 未设置 (零值) 时使用 defaultMaxRequestBodySize；设置为负数时不限制。
+func (env *Environment) requestBodyLimit() int64 {
+	if env.maxRequestBodySize == 0 {
+		return defaultMaxRequestBodySize
+	}
+	return env.maxRequestBodySize
+}
+
+// withRequestBodyLimit 包装应用的 handler，在处理函数读取请求体之前限制请求体的大小。
+// 参数：
+//   env *Environment: 应用环境，提供 requestBodyLimit()。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+// 工作原理：
+// 1. 请求声明了 Content-Length 时，net/http 保证读取到的请求体不会超过这个长度，所以可以信任它：
+//    超过限制时直接返回 413，不读取请求体，避免浪费带宽。没有超过时仍然用 http.MaxBytesReader 包装请求体。
+// 2. 没有 Content-Length (例如 chunked 编码) 时无法提前知道大小，通过 http.MaxBytesReader 读取请求体，
+//    超过限制时在读取过程中停止并返回 413；没有超过时把读到的内容交给处理函数。
+// 这样所有直接调用 io.ReadAll(r.Body) 的处理函数都不需要各自检查大小。
+func withRequestBodyLimit(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := env.requestBodyLimit()
+		if limit < 0 || r.Body == nil || r.Body == http.NoBody {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			writeRequestTooLargeErrorResponse(w)
+			return
+		}
+		if r.ContentLength >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			handler.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeRequestTooLargeErrorResponse(w)
+			return
+		}
+		if err != nil {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// withGETRequestBodies 包装应用的 handler，处理带有请求体的 GET (和 HEAD) 请求。
+// GET 处理函数从不读取请求体，这里读取并丢弃请求体 (连接可以继续复用)，再把 r.Body 换成 http.NoBody 交给处理函数。
+// 设置了 env.rejectGETRequestBodies 时，请求体不为空的 GET 请求返回 400 INVALID_DATA，
+// 部分代理无法正确转发带有请求体的 GET 请求，拒绝它们可以让调用方尽早发现问题。
+// 参数：
+//   env *Environment: 应用环境，包含 rejectGETRequestBodies。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+// 注意：必须放在 withRequestBodyLimit 里面，丢弃的请求体也受大小限制。
+func withGETRequestBodies(env *Environment, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Body == nil || r.Body == http.NoBody {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		size, err := io.Copy(io.Discard, r.Body)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeRequestTooLargeErrorResponse(w)
+			return
+		}
+		if err != nil {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
+		if size > 0 && env.rejectGETRequestBodies {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// writeRequestTooLargeErrorResponse 返回 413 Request Entity Too Large 和 REQUEST_TOO_LARGE 错误。
+func writeRequestTooLargeErrorResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, ExpectedErrorRequestTooLarge)))
+}
+
 // verifyJSONContentTypeHeader 函数检查 HTTP 请求头中的 "Content-Type" 是否表明
 // 请求体的内容是 JSON 格式 (application/json) 或者纯文本 (text/plain)。
 // 这有助于服务器正确解析请求体。
@@ -177,3 +330,141 @@ const (
 	// ContentTypePlainText 代表响应内容应该是纯文本格式。
 	ContentTypePlainText // iota 会自动递增，这里赋值为 1
 )
+
+// defaultPaginationPerPage 是列表端点没有指定 per_page (或值无效) 时每页的条目数。
+const defaultPaginationPerPage = 20
+
+// defaultMaxPaginationPerPage 是没有配置 env.maxPaginationPerPage 时 per_page 的最大值。
+const defaultMaxPaginationPerPage = 100
+
+// paginationPerPageLimit 返回列表端点 per_page 的最大值。
+// 未设置 (零值) 时使用 defaultMaxPaginationPerPage。
+func (env *Environment) paginationPerPageLimit() int {
+	if env.maxPaginationPerPage < 1 {
+		return defaultMaxPaginationPerPage
+	}
+	return env.maxPaginationPerPage
+}
+
+// parsePaginationQuery 解析列表端点的 per_page 和 page 查询参数。
+// 和 GET /users 相同：缺少、不是整数或者不是正数的值会被替换为默认值 (每页 20 条，第 1 页)。
+// 大于 maxPerPage 的 per_page 会被静默地限制为 maxPerPage，防止一次请求返回整张表。
+// 参数：
+//   query url.Values: 请求的查询参数 (r.URL.Query())。
+//   maxPerPage int: per_page 的最大值 (env.paginationPerPageLimit())。
+// 返回值：
+//   int: 每页的条目数 (实际使用的值，应通过 X-Pagination-Per-Page 头返回)。
+//   int: 页码 (从 1 开始)。
+func parsePaginationQuery(query url.Values, maxPerPage int) (int, int) {
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPaginationPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return perPage, page
+}
+
+// createPaginationLinkHeader 生成列表端点的 Link 响应头 (RFC 8288，原 RFC 5988)，
+// 包含 first、prev、next 和 last 四种关系的链接，和 X-Pagination-* 头一起返回。
+// 参数：
+//   requestURL *url.URL: 当前请求的 URL (r.URL)。生成的链接保留它的路径和所有查询参数，只替换 page。
+//   page int: 当前页码 (从 1 开始，已经过规范化)。
+//   totalPages int: 总页数。
+// 返回值：
+//   string: Link 头的值。
+// 工作原理：
+// 1. first 始终指向第 1 页，last 指向最后一页 (没有数据时也是第 1 页)。
+// 2. 只有当前页不是第 1 页时才有 prev；超出范围的页码的 prev 指向最后一页。
+// 3. 只有当前页不是最后一页时才有 next。
+func createPaginationLinkHeader(requestURL *url.URL, page int, totalPages int) string {
+	lastPage := max(totalPages, 1)
+	pageURL := func(page int) string {
+		query := requestURL.Query()
+		query.Set("page", strconv.Itoa(page))
+		return requestURL.Path + "?" + query.Encode()
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(1))}
+	if page > 1 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(min(page-1, lastPage))))
+	}
+	if page < lastPage {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(page+1)))
+	}
+	links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL(lastPage)))
+	return strings.Join(links, ", ")
+}
+
+// DurationRange 是一个时间范围 [Min, Max]。
+type DurationRange struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// nextFailureDelay 返回这次认证失败响应之前要等待的时间：在 env.FailureDelay 的范围内均匀随机。
+// 范围是零值时 (默认) 不延迟；Max 小于 Min 时固定等待 Min。
+// 随机的延迟让攻击者无法通过响应时间区分失败的原因，也降低了撞库攻击的吞吐量。
+func (env *Environment) nextFailureDelay() time.Duration {
+	delay := env.FailureDelay
+	if delay.Max <= delay.Min {
+		return delay.Min
+	}
+	return delay.Min + time.Duration(rand.Int64N(int64(delay.Max-delay.Min)+1))
+}
+
+// delayAuthenticationFailure 在返回密码或验证码错误 (ExpectedErrorIncorrectPassword、ExpectedErrorIncorrectCode)
+// 之前等待 env.nextFailureDelay()。请求被取消 (ctx 结束) 时立即返回，不会继续占用 goroutine。
+// 参数：
+//   ctx context.Context: 请求的 context (r.Context())。
+func (env *Environment) delayAuthenticationFailure(ctx context.Context) {
+	delay := env.nextFailureDelay()
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// withHeadRequests 包装应用的 handler，让每个 GET 路由自动响应 HEAD 请求。
+// 路由器只注册了 GET，HEAD 请求原本会返回 404。监控和缓存验证工具经常发送 HEAD 请求，
+// 所以这里把 HEAD 请求改成 GET 交给原来的处理函数，保留状态码和响应头，丢弃响应体。
+// 参数：
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+// 注意：处理函数在写入响应体之前就写入了响应头，所以响应中没有 GET 响应体对应的 Content-Length。
+func withHeadRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		getRequest := r.Clone(r.Context())
+		getRequest.Method = http.MethodGet
+		handler.ServeHTTP(&headResponseWriter{ResponseWriter: w}, getRequest)
+	})
+}
+
+// headResponseWriter 丢弃写入的响应体，用于响应 HEAD 请求。见 withHeadRequests。
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+// Unwrap 让 http.ResponseController 可以访问底层的 ResponseWriter。
+func (w *headResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
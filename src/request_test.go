@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"           // 导入 context 包，用于测试请求取消
+	"encoding/json"     // 导入 JSON 包，用于产生解析错误
+	"io"                // 导入 io 包，用于读取请求体
+	"net/http"          // 导入 HTTP 包
 	"net/http/httptest" // 导入 httptest 包，用于创建模拟的 HTTP 请求对象
+	"net/url"          // 导入 URL 包，用于解析请求 URL
+	"strings"          // 导入字符串包，用于创建请求体
 	"testing"          // 导入 Go 的测试包
+	"time"             // 导入时间包，用于测试失败延迟
 
 	"github.com/stretchr/testify/assert" // 导入 testify 断言库，用于进行测试断言
 )
@@ -54,3 +61,270 @@ func TestVerifyRequestSecret(t *testing.T) {
 	// 但此测试用例没有显式覆盖 r.Header 本身就是 nil 的场景。
 	// httptest.NewRequest 总是会初始化 Header。
 }
+
+// TestDecodeOptionalJSON 测试 decodeOptionalJSON 函数。
+// 没有请求体、空白请求体和 "{}" 都应该成功并保持零值；有内容的请求体应该被解析；
+// 不合法的 JSON 应该返回错误。
+func TestDecodeOptionalJSON(t *testing.T) {
+	t.Parallel()
+
+	type optionalData struct {
+		ClientIP string `json:"client_ip"`
+	}
+
+	for _, body := range []string{"", "  \n", "{}"} {
+		var data optionalData
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		err := decodeOptionalJSON(r, &data)
+		assert.NoError(t, err, "body: %q", body)
+		assert.Equal(t, optionalData{}, data, "body: %q", body)
+	}
+
+	// 没有请求体 (nil)
+	var data optionalData
+	r := httptest.NewRequest("POST", "/", nil)
+	err := decodeOptionalJSON(r, &data)
+	assert.NoError(t, err)
+	assert.Equal(t, optionalData{}, data)
+
+	// 有内容的请求体
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"client_ip":"0.0.0.0"}`))
+	err = decodeOptionalJSON(r, &data)
+	assert.NoError(t, err)
+	assert.Equal(t, optionalData{ClientIP: "0.0.0.0"}, data)
+
+	// 不合法的 JSON
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"client_ip":`))
+	err = decodeOptionalJSON(r, &data)
+	assert.Error(t, err)
+}
+
+// TestCreatePaginationLinkHeader 测试 createPaginationLinkHeader 在中间页、第一页 (没有 prev)
+// 和最后一页 (没有 next) 时生成的 Link 头，并且保留其他查询参数。
+func TestCreatePaginationLinkHeader(t *testing.T) {
+	t.Parallel()
+
+	requestURL, err := url.Parse("/users?sort_by=id&sort_order=descending&per_page=10&page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 中间页
+	assert.Equal(t, `</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="first", `+
+		`</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="prev", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="next", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="last"`,
+		createPaginationLinkHeader(requestURL, 2, 3))
+
+	// 第一页没有 prev
+	assert.Equal(t, `</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="first", `+
+		`</users?page=2&per_page=10&sort_by=id&sort_order=descending>; rel="next", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="last"`,
+		createPaginationLinkHeader(requestURL, 1, 3))
+
+	// 最后一页没有 next
+	assert.Equal(t, `</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="first", `+
+		`</users?page=2&per_page=10&sort_by=id&sort_order=descending>; rel="prev", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="last"`,
+		createPaginationLinkHeader(requestURL, 3, 3))
+
+	// 超出范围的页码的 prev 指向最后一页；没有数据时只有 first 和 last
+	assert.Equal(t, `</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="first", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="prev", `+
+		`</users?page=3&per_page=10&sort_by=id&sort_order=descending>; rel="last"`,
+		createPaginationLinkHeader(requestURL, 5, 3))
+	assert.Equal(t, `</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="first", `+
+		`</users?page=1&per_page=10&sort_by=id&sort_order=descending>; rel="last"`,
+		createPaginationLinkHeader(requestURL, 1, 0))
+}
+
+// TestParsePaginationQuery 测试 parsePaginationQuery 在参数缺少或无效时使用默认值，并限制 per_page 的最大值。
+func TestParsePaginationQuery(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		PerPage         string
+		Page            string
+		ExpectedPerPage int
+		ExpectedPage    int
+	}{
+		{"10", "2", 10, 2},
+		{"", "", 20, 1},
+		{"a", "a", 20, 1},
+		{"0", "0", 20, 1},
+		{"-1", "-1", 20, 1},
+		{"5", "", 5, 1},
+		{"100", "1", 100, 1},
+		{"101", "1", 100, 1},
+		{"1000000", "1", 100, 1},
+	}
+	for _, testCase := range testCases {
+		query := url.Values{}
+		query.Set("per_page", testCase.PerPage)
+		query.Set("page", testCase.Page)
+		perPage, page := parsePaginationQuery(query, 100)
+		assert.Equal(t, testCase.ExpectedPerPage, perPage, query.Encode())
+		assert.Equal(t, testCase.ExpectedPage, page, query.Encode())
+	}
+}
+
+// TestWithRequestBodyLimit 测试 withRequestBodyLimit 在读取请求体之前拒绝过大的请求。
+func TestWithRequestBodyLimit(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.maxRequestBodySize = 10
+
+	var handled bool
+	var receivedBody string
+	handler := withRequestBodyLimit(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		receivedBody = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// Content-Length 超过限制时直接返回 413，处理函数不会被调用
+	t.Run("content length too large", func(t *testing.T) {
+		handled = false
+		r := httptest.NewRequest("POST", "/", strings.NewReader("12345678901"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.JSONEq(t, `{"error":"REQUEST_TOO_LARGE"}`, w.Body.String())
+		assert.False(t, handled)
+	})
+
+	// 没有 Content-Length 时在读取过程中检查大小
+	t.Run("unknown length too large", func(t *testing.T) {
+		handled = false
+		r := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader("12345678901")))
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.False(t, handled)
+	})
+
+	t.Run("unknown length within limit", func(t *testing.T) {
+		handled = false
+		r := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader("1234567890")))
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.True(t, handled)
+		assert.Equal(t, "1234567890", receivedBody)
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		handled = false
+		r := httptest.NewRequest("POST", "/", strings.NewReader("1234567890"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.True(t, handled)
+		assert.Equal(t, "1234567890", receivedBody)
+	})
+
+	// 负数表示不限制
+	t.Run("unlimited", func(t *testing.T) {
+		unlimitedEnv := createEnvironment(nil, nil)
+		unlimitedEnv.maxRequestBodySize = -1
+		var unlimitedBody string
+		unlimitedHandler := withRequestBodyLimit(unlimitedEnv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			unlimitedBody = string(body)
+		}))
+		r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", defaultMaxRequestBodySize+1)))
+		w := httptest.NewRecorder()
+		unlimitedHandler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, unlimitedBody, defaultMaxRequestBodySize+1)
+	})
+}
+
+// TestJSONDecodeErrorCode 测试 jsonDecodeErrorCode 区分 JSON 语法错误和字段类型错误。
+func TestJSONDecodeErrorCode(t *testing.T) {
+	t.Parallel()
+
+	var data struct {
+		Password string `json:"password"`
+	}
+	for _, body := range []string{`{"password":`, `{"password":"a",}`, `not json`, ``} {
+		err := json.Unmarshal([]byte(body), &data)
+		assert.Equal(t, ExpectedErrorMalformedJSON, jsonDecodeErrorCode(err), body)
+	}
+	err := json.Unmarshal([]byte(`{"password":1}`), &data)
+	assert.Equal(t, ExpectedErrorInvalidData, jsonDecodeErrorCode(err))
+	err = json.Unmarshal([]byte(`[]`), &data)
+	assert.Equal(t, ExpectedErrorInvalidData, jsonDecodeErrorCode(err))
+}
+
+// TestNextFailureDelay 测试 nextFailureDelay 默认不延迟，并且在配置的范围内随机。
+func TestNextFailureDelay(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, time.Duration(0), env.nextFailureDelay())
+
+	env.FailureDelay = DurationRange{Min: 100 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, env.nextFailureDelay())
+
+	env.FailureDelay.Max = 200 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		delay := env.nextFailureDelay()
+		assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		assert.LessOrEqual(t, delay, 200*time.Millisecond)
+	}
+}
+
+// TestDelayAuthenticationFailure 测试 delayAuthenticationFailure 在请求取消时立即返回。
+func TestDelayAuthenticationFailure(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.FailureDelay.Min = 100 * time.Millisecond
+
+	start := time.Now()
+	env.delayAuthenticationFailure(context.Background())
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	env.FailureDelay.Min = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	env.delayAuthenticationFailure(ctx)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// TestWithHeadRequests 测试 withHeadRequests 把 HEAD 请求交给 GET 处理函数，保留状态码和响应头并丢弃响应体，
+// 其他请求原样传递。
+func TestWithHeadRequests(t *testing.T) {
+	t.Parallel()
+
+	var methods []string
+	handler := withHeadRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`{}`))
+	}))
+
+	r := httptest.NewRequest("HEAD", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "", w.Body.String())
+	// 原来的请求没有被修改
+	assert.Equal(t, "HEAD", r.Method)
+
+	r = httptest.NewRequest("POST", "/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, `{}`, w.Body.String())
+
+	assert.Equal(t, []string{"GET", "POST"}, methods)
+}
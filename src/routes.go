@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// 路由列表：Router.Handle 注册处理函数时把 (method, path) 按注册顺序追加到 router.registeredRoutes，
+// 运维人员和测试可以通过 Routes() 或 GET /routes 确认注册了哪些路由，不需要阅读 CreateApp 的代码。
+
+// Route 是路由器中注册的一条路由。
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// Routes 返回按注册顺序排列的所有路由。返回的是副本，调用者修改它不会影响路由器。
+func (router *Router) Routes() []Route {
+	return slices.Clone(router.registeredRoutes)
+}
+
+// handleGetRoutesRequest 处理 GET /routes，以 JSON 数组返回已注册的路由。
+// 参数：
+//   env *Environment: 应用环境。
+//   routes []Route: 路由器的 Routes()。
+//   w http.ResponseWriter: HTTP 响应写入器。
+//   r *http.Request: 收到的 HTTP 请求。
+func handleGetRoutesRequest(env *Environment, routes []Route, w http.ResponseWriter, r *http.Request) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	if routes == nil {
+		routes = []Route{}
+	}
+	encoded, err := json.Marshal(routes)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
+
+// ExpectedErrorMethodNotAllowed 表示路径存在，但没有注册请求使用的方法 (405)。
+const ExpectedErrorMethodNotAllowed = "METHOD_NOT_ALLOWED"
+
+// allowedMethods 返回 path 匹配的所有路由的方法，按注册顺序排列并去掉重复的方法。
+// 没有路由匹配 path 时返回 nil。
+// 参数：
+//   routes []Route: 路由器的 Routes()。
+//   path string: 请求的 URL 路径。
+func allowedMethods(routes []Route, path string) []string {
+	var methods []string
+	for _, route := range routes {
+		if matchRoutePath(route.Path, path) && !slices.Contains(methods, route.Method) {
+			methods = append(methods, route.Method)
+		}
+	}
+	return methods
+}
+
+// matchRoutePath 判断 path 是否匹配路由的路径模式。
+// 以 ":" 开头的段是路径参数，匹配任意非空的段，其他段必须完全相同。
+func matchRoutePath(pattern string, path string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, ":") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeMethodNotAllowedErrorResponse 返回 405 和 ExpectedErrorMethodNotAllowed 错误，
+// Allow 头列出路径支持的方法。
+func writeMethodNotAllowedErrorResponse(w http.ResponseWriter, methods []string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, ExpectedErrorMethodNotAllowed)))
+}
+
+// withJSONErrorResponses 保证没有匹配到路由的请求 (404 和 405) 和其他错误一样返回 JSON 错误响应体，
+// 客户端可以用同样的方式解析所有错误。
+// 路由器的默认处理函数已经返回 JSON，但 httprouter 内置的 NotFound 和 MethodNotAllowed 处理
+// (没有设置对应的处理函数时) 返回的是纯文本，这里把它们改写为 {"error":"NOT_FOUND"} 或
+// {"error":"METHOD_NOT_ALLOWED"}。已经是 JSON 的响应保持不变。
+// 参数：
+//   handler http.Handler: 被包装的 handler，通常是 router.Handler()。
+// 返回值：
+//   http.Handler: 包装后的 handler。
+func withJSONErrorResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&jsonErrorResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+// jsonErrorResponseWriter 把非 JSON 的 404 和 405 响应改写为 JSON 错误响应。见 withJSONErrorResponses。
+type jsonErrorResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool // 是否已经写入响应头
+	rewritten   bool // 是否已经改写了响应，改写后丢弃原来的响应体
+}
+
+func (w *jsonErrorResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	var errorCode string
+	switch statusCode {
+	case http.StatusNotFound:
+		errorCode = "NOT_FOUND"
+	case http.StatusMethodNotAllowed:
+		errorCode = ExpectedErrorMethodNotAllowed
+	}
+	if errorCode == "" || strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.rewritten = true
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(statusCode)
+	w.ResponseWriter.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, errorCode)))
+}
+
+func (w *jsonErrorResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rewritten {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap 让 http.ResponseController 可以访问底层的 ResponseWriter。
+func (w *jsonErrorResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 按部署裁剪 API：env.routeConfig 把路由标识 (Route.String()，例如 "POST /users") 映射为是否启用，
+// 例如只读副本可以配置 {"POST /users": false} 关闭用户注册。没有出现在配置中的路由默认启用。
+// CreateApp 用 withDisabledRoutes 拦截被关闭的路由并返回 404，被关闭的路由也不会出现在
+// GET /routes 的结果和 405 响应的 Allow 头中。
+
+// String 返回路由标识，格式为 "<method> <path>"，例如 "GET /users/:user_id"。
+func (route Route) String() string {
+	return route.Method + " " + route.Path
+}
+
+// routeEnabled 报告 env.routeConfig 是否启用了 route。没有配置的路由默认启用。
+func (env *Environment) routeEnabled(route Route) bool {
+	enabled, ok := env.routeConfig[route.String()]
+	return !ok || enabled
+}
+
+// enabledRoutes 返回 routes 中被启用的路由，保持原来的顺序。
+func (env *Environment) enabledRoutes(routes []Route) []Route {
+	var enabled []Route
+	for _, route := range routes {
+		if env.routeEnabled(route) {
+			enabled = append(enabled, route)
+		}
+	}
+	return enabled
+}
+
+// unknownRouteConfigKeys 返回 env.routeConfig 中不对应任何已注册路由的标识 (通常是拼写错误)，按字母顺序排列。
+func unknownRouteConfigKeys(env *Environment, routes []Route) []string {
+	var unknown []string
+	for key := range env.routeConfig {
+		if !slices.ContainsFunc(routes, func(route Route) bool { return route.String() == key }) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// matchRoute 返回 routes 中方法为 method 且匹配 path 的路由。
+// httprouter 不允许同一位置同时有静态段和参数 (例如 /users/bulk-import 和 /users/:user_id)，
+// 注册时会 panic，所以已注册的路由中最多只有一条匹配 path。
+func matchRoute(routes []Route, method string, path string) (Route, bool) {
+	for _, route := range routes {
+		if route.Method == method && matchRoutePath(route.Path, path) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// withDisabledRoutes 拦截匹配到被 env.routeConfig 关闭的路由的请求，返回 404 NOT_FOUND，
+// 就像这条路由没有注册一样。配置中不对应任何路由的标识会在启动时记录警告。
+// 参数：
+//   env *Environment: 应用环境，包含 routeConfig。
+//   routes []Route: 路由器的 Routes()。
+//   handler http.Handler: 被包装的 handler。
+// 返回值：
+//   http.Handler: 包装后的 handler。没有关闭任何路由时直接返回 handler。
+func withDisabledRoutes(env *Environment, routes []Route, handler http.Handler) http.Handler {
+	for _, key := range unknownRouteConfigKeys(env, routes) {
+		log.Printf("route config: %q does not match any route", key)
+	}
+	if len(env.enabledRoutes(routes)) == len(routes) {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := matchRoute(routes, r.Method, r.URL.Path)
+		if ok && !env.routeEnabled(route) {
+			writeNotFoundErrorResponse(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectedRoutes 是 createRouter 应该注册的所有路由 (不包括只在开发模式下注册的 /dev/emails)。
+// 删除或改名一个路由时需要同时修改这里，避免不小心删掉路由。
+var expectedRoutes = []Route{
+	{"GET", "/"},
+	{"POST", "/users"},
+	{"POST", "/user-imports"},
+	{"POST", "/invites"},
+	{"GET", "/users"},
+	{"DELETE", "/users"},
+	{"GET", "/users/:user_id"},
+	{"DELETE", "/users/:user_id"},
+	{"POST", "/users/:user_id/verify-password"},
+	{"POST", "/verify-credentials"},
+	{"POST", "/users/:user_id/update-password"},
+	{"POST", "/users/:user_id/password-reset-requests"},
+	{"GET", "/users/:user_id/password-reset-requests"},
+	{"DELETE", "/users/:user_id/password-reset-requests"},
+	{"GET", "/password-reset-requests/:request_id"},
+	{"GET", "/password-reset-requests/:request_id/user"},
+	{"DELETE", "/password-reset-requests/:request_id"},
+	{"POST", "/password-reset-requests/:request_id/verify-email"},
+	{"POST", "/password-reset-requests/:request_id/extend"},
+	{"POST", "/reset-password"},
+	{"POST", "/password-change-tokens/verify"},
+	{"POST", "/users/:user_id/register-totp"},
+	{"POST", "/users/:user_id/totp-setup"},
+	{"POST", "/totp/preview-verify"},
+	{"GET", "/users/:user_id/totp-credential"},
+	{"DELETE", "/users/:user_id/totp-credential"},
+	{"GET", "/totp-credentials"},
+	{"POST", "/totp-credentials/bulk-delete"},
+	{"POST", "/users/:user_id/verify-2fa/totp"},
+	{"POST", "/step-up-tokens/verify"},
+	{"POST", "/users/:user_id/reset-2fa"},
+	{"POST", "/users/:user_id/regenerate-recovery-code"},
+	{"POST", "/users/:user_id/verify-recovery-code"},
+	{"POST", "/users/:user_id/reset-rate-limits"},
+	{"POST", "/users/:user_id/email-verification-request"},
+	{"GET", "/users/:user_id/email-verification-request"},
+	{"DELETE", "/users/:user_id/email-verification-request"},
+	{"POST", "/users/:user_id/verify-email"},
+	{"POST", "/users/:user_id/email-update-requests"},
+	{"GET", "/users/:user_id/email-update-requests"},
+	{"DELETE", "/users/:user_id/email-update-requests"},
+	{"GET", "/email-update-requests/:request_id"},
+	{"DELETE", "/email-update-requests/:request_id"},
+	{"POST", "/verify-new-email"},
+	{"POST", "/email-update-requests/:request_id/verify"},
+	{"GET", "/audit-log"},
+	{"GET", "/maintenance"},
+	{"POST", "/maintenance"},
+	{"GET", "/healthz"},
+	{"GET", "/auth/check"},
+	{"GET", "/metrics"},
+	{"GET", "/routes"},
+}
+
+// TestCreateRouterRoutes 测试 Routes() 返回 createRouter 注册的所有路由。
+func TestCreateRouterRoutes(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	env := createEnvironment(db, nil)
+	assert.Equal(t, expectedRoutes, createRouter(env).Routes())
+
+	// 开发模式下额外注册 GET /dev/emails
+	env.devEmailSink = NewDevEmailSink(0)
+	assert.Equal(t, append(expectedRoutes, Route{"GET", "/dev/emails"}), createRouter(env).Routes())
+}
+
+// TestRouterRoutesCopy 测试修改 Routes() 返回的切片不会影响路由器。
+func TestRouterRoutesCopy(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	router := createRouter(createEnvironment(db, nil))
+	routes := router.Routes()
+	routes[0] = Route{"DELETE", "/"}
+	assert.Equal(t, expectedRoutes[0], router.Routes()[0])
+}
+
+// TestAllowedMethods 测试 allowedMethods 按注册顺序返回路径支持的方法。
+func TestAllowedMethods(t *testing.T) {
+	t.Parallel()
+
+	routes := []Route{
+		{"POST", "/users"},
+		{"GET", "/users"},
+		{"GET", "/users/:user_id"},
+		{"DELETE", "/users/:user_id"},
+		{"POST", "/users/:user_id/verify-password"},
+		{"GET", "/users"},
+	}
+	assert.Equal(t, []string{"POST", "GET"}, allowedMethods(routes, "/users"))
+	assert.Equal(t, []string{"GET", "DELETE"}, allowedMethods(routes, "/users/1"))
+	assert.Equal(t, []string{"POST"}, allowedMethods(routes, "/users/1/verify-password"))
+	assert.Nil(t, allowedMethods(routes, "/users/"))
+	assert.Nil(t, allowedMethods(routes, "/users/1/verify-password/1"))
+	assert.Nil(t, allowedMethods(routes, "/unknown"))
+}
+
+// assertJSONErrorBody 检查响应是 JSON 错误响应体 {"error": errorCode}。
+func assertJSONErrorBody(t *testing.T, res *http.Response, statusCode int, errorCode string) {
+	t.Helper()
+	assert.Equal(t, statusCode, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var data ErrorJSON
+	err := json.NewDecoder(res.Body).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, errorCode, data.Error)
+}
+
+// TestWithJSONErrorResponses 测试 httprouter 内置的纯文本 404 和 405 响应被改写为 JSON，
+// 其他响应和已经是 JSON 的错误响应保持不变。
+func TestWithJSONErrorResponses(t *testing.T) {
+	t.Parallel()
+
+	router := httprouter.New()
+	router.GET("/users", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte("users"))
+	})
+	router.GET("/users/:user_id", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		writeNotFoundErrorResponse(w)
+	})
+	handler := withJSONErrorResponses(router)
+
+	serve := func(method string, path string) *http.Response {
+		r := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// 完全没有注册的路径
+	assertJSONErrorBody(t, serve("GET", "/unknown"), 404, "NOT_FOUND")
+
+	// 注册了路径但方法不对，保留 Allow 头
+	res := serve("DELETE", "/users")
+	assertJSONErrorBody(t, res, 405, ExpectedErrorMethodNotAllowed)
+	assert.Contains(t, res.Header.Get("Allow"), "GET")
+
+	// 处理函数返回的 JSON 错误不变
+	assertJSONErrorBody(t, serve("GET", "/users/1"), 404, "NOT_FOUND")
+
+	// 成功的响应不变
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "users", w.Body.String())
+}
+
+// TestCreateAppJSONErrorResponses 测试应用对没有注册的路径和方法不对的路径都返回 JSON 错误响应体。
+func TestCreateAppJSONErrorResponses(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	app := CreateApp(createEnvironment(db, nil))
+	serve := func(method string, path string) *http.Response {
+		r := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertJSONErrorBody(t, serve("GET", "/unknown/path"), 404, "NOT_FOUND")
+	assertJSONErrorBody(t, serve("PUT", "/users"), 405, ExpectedErrorMethodNotAllowed)
+}
+
+// TestCreateAppDisabledRoutes 测试 env.routeConfig 关闭的路由返回 404，其他路由不受影响，
+// 被关闭的路由也不出现在 GET /routes 和 405 响应的 Allow 头中。
+func TestCreateAppDisabledRoutes(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	env.routeConfig = map[string]bool{
+		"POST /users":            false,
+		"DELETE /users/:user_id": false,
+		"GET /users":             true,
+	}
+	app := CreateApp(env)
+	serve := func(method string, path string) *http.Response {
+		r := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// 被关闭的路由返回 404，而不是 405
+	assertJSONErrorBody(t, serve("POST", "/users"), 404, "NOT_FOUND")
+	assertJSONErrorBody(t, serve("DELETE", "/users/1"), 404, "NOT_FOUND")
+
+	// 其他路由照常工作，包括同一路径上的其他方法
+	assert.Equal(t, 200, serve("GET", "/users/1").StatusCode)
+	assert.Equal(t, 200, serve("HEAD", "/users/1").StatusCode)
+
+	// Allow 头中不包括被关闭的方法
+	res := serve("PUT", "/users/1")
+	assertJSONErrorBody(t, res, 405, ExpectedErrorMethodNotAllowed)
+	assert.NotContains(t, res.Header.Get("Allow"), "DELETE")
+
+	// GET /routes 不列出被关闭的路由
+	var routes []Route
+	err = json.NewDecoder(serve("GET", "/routes").Body).Decode(&routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, routes, Route{"POST", "/users"})
+	assert.Contains(t, routes, Route{"GET", "/users/:user_id"})
+}
+
+// TestMatchRoute 测试 matchRoute 返回方法和路径都匹配的路由。
+func TestMatchRoute(t *testing.T) {
+	t.Parallel()
+
+	routes := []Route{
+		{"GET", "/users/:user_id"},
+		{"POST", "/users/:user_id"},
+		{"POST", "/user-imports"},
+	}
+	route, ok := matchRoute(routes, "POST", "/user-imports")
+	assert.True(t, ok)
+	assert.Equal(t, Route{"POST", "/user-imports"}, route)
+	route, ok = matchRoute(routes, "POST", "/users/1")
+	assert.True(t, ok)
+	assert.Equal(t, Route{"POST", "/users/:user_id"}, route)
+	_, ok = matchRoute(routes, "DELETE", "/users/1")
+	assert.False(t, ok)
+}
+
+// TestUnknownRouteConfigKeys 测试配置中不对应任何路由的标识被找出来。
+func TestUnknownRouteConfigKeys(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.routeConfig = map[string]bool{
+		"POST /users":         false,
+		"POST /user":          false,
+		"GET /users/:id":      false,
+		"GET /users/:user_id": true,
+	}
+	routes := []Route{{"POST", "/users"}, {"GET", "/users/:user_id"}}
+	assert.Equal(t, []string{"GET /users/:id", "POST /user"}, unknownRouteConfigKeys(env, routes))
+}
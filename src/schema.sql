@@ -1,29 +1,36 @@
 -- This file defines the database schema for the Faroe application using SQLite.
 -- It creates tables to store user information, authentication details,
 -- and various request types like email verification and password resets.
+--
+-- Every column referencing user(id) uses ON DELETE CASCADE, so deleting a user row
+-- removes all of its child rows. New tables referencing user(id) must do the same.
+-- This requires `PRAGMA foreign_keys = ON` on each connection (see openDatabase in db.go).
+-- Databases created before this was added are upgraded by migrateDatabase in db.go.
 
 -- The 'user' table stores the core information for each registered user.
 CREATE TABLE IF NOT EXISTS user (
     id TEXT NOT NULL PRIMARY KEY,           -- Unique identifier for the user (likely a generated string).
     created_at INTEGER NOT NULL,        -- Timestamp (Unix epoch seconds) when the user account was created.
     password_hash TEXT NOT NULL,        -- Securely hashed version of the user's password. NEVER store plain text passwords!
-    recovery_code TEXT NOT NULL         -- A unique code provided to the user for account recovery (e.g., if they lose 2FA).
+    recovery_code TEXT NOT NULL,        -- A unique code provided to the user for account recovery (e.g., if they lose 2FA).
+    email_verified INTEGER NOT NULL DEFAULT 0, -- 1 once the user has verified an email address (verification code, email update, or password reset).
+    email TEXT UNIQUE COLLATE NOCASE    -- The email address given when the user was created or the last verified email update, or NULL. Kept as entered, but compared and unique case-insensitively.
 ) STRICT; -- STRICT mode enforces data types more rigorously (e.g., INTEGER must be an integer).
 
 -- The 'user_email_verification_request' table stores requests sent to users to verify their email address.
 -- This is typically used right after registration.
 CREATE TABLE IF NOT EXISTS user_email_verification_request (
-    user_id TEXT NOT NULL UNIQUE PRIMARY KEY REFERENCES user(id), -- Links to the user who needs verification. UNIQUE ensures only one pending request per user.
+    user_id TEXT NOT NULL UNIQUE PRIMARY KEY REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who needs verification. UNIQUE ensures only one pending request per user.
     created_at INTEGER NOT NULL,        -- Timestamp when the verification request was created.
     expires_at INTEGER NOT NULL,        -- Timestamp when this verification request becomes invalid.
-    code TEXT NOT NULL                  -- The secret code sent to the user's email for verification.
+    code_hash TEXT NOT NULL             -- Argon2id hash of the code sent to the user's email. Like password reset codes, the code itself is never stored.
 ) STRICT;
 
 -- The 'email_update_request' table stores requests made by users to change their registered email address.
 -- This usually involves sending a verification code to the *new* email address.
 CREATE TABLE IF NOT EXISTS email_update_request (
     id TEXT NOT NULL PRIMARY KEY,           -- Unique identifier for this specific update request.
-    user_id TEXT NOT NULL REFERENCES user(id), -- Links to the user requesting the email change.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user requesting the email change.
     created_at INTEGER NOT NULL,        -- Timestamp when the update request was created.
     expires_at INTEGER NOT NULL,        -- Timestamp when this update request becomes invalid.
     email TEXT NOT NULL,                -- The *new* email address the user wants to change to.
@@ -38,10 +45,11 @@ CREATE INDEX IF NOT EXISTS email_update_request_user_id_index ON email_update_re
 -- This typically involves sending a code or link to their verified email address.
 CREATE TABLE IF NOT EXISTS password_reset_request (
     id TEXT NOT NULL PRIMARY KEY,           -- Unique identifier for this specific password reset request.
-    user_id TEXT NOT NULL REFERENCES user(id), -- Links to the user requesting the password reset.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user requesting the password reset.
     created_at INTEGER NOT NULL,        -- Timestamp when the reset request was created.
     expires_at INTEGER NOT NULL,        -- Timestamp when this reset request becomes invalid.
-    code_hash TEXT NOT NULL             -- A securely hashed version of the reset code sent to the user. Hashing prevents attackers from using stolen codes directly if the database is compromised.
+    code_hash TEXT NOT NULL,            -- A securely hashed version of the reset code sent to the user. Hashing prevents attackers from using stolen codes directly if the database is compromised.
+    used_at INTEGER NULL                -- Timestamp when the request was used to reset the password. Only set when used requests are kept for audit; NULL while the request is unused.
 ) STRICT;
 
 -- Creates an index on the 'user_id' column of the 'password_reset_request' table.
@@ -49,17 +57,38 @@ CREATE TABLE IF NOT EXISTS password_reset_request (
 CREATE INDEX IF NOT EXISTS password_reset_request_user_id_index ON password_reset_request(user_id);
 
 -- The 'user_totp_credential' table stores information related to Time-based One-Time Password (TOTP) setup for users (e.g., Google Authenticator).
+-- A user may register more than one TOTP credential (e.g. a phone and a password manager).
 CREATE TABLE IF NOT EXISTS user_totp_credential (
-    user_id TEXT NOT NULL PRIMARY KEY REFERENCES user(id), -- Links to the user who has set up TOTP. PRIMARY KEY ensures only one TOTP setup per user.
+    id TEXT NOT NULL PRIMARY KEY,           -- Unique identifier for this credential.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who has set up TOTP.
     created_at INTEGER NOT NULL,        -- Timestamp when TOTP was set up for this user.
     key BLOB NULL                       -- The secret key shared between the server and the user's TOTP app. Stored as a binary large object (BLOB). NULL might indicate TOTP is not set up or temporarily disabled.
 ) STRICT;
 
+-- Creates an index on the 'user_id' column of the 'user_totp_credential' table.
+-- This speeds up looking up all TOTP credentials registered by a specific user.
+CREATE INDEX IF NOT EXISTS user_totp_credential_user_id_index ON user_totp_credential(user_id);
+
+-- The 'recovery_code' table stores single-use recovery codes (backup codes) when the server is configured
+-- to generate a set of codes instead of the single 'user.recovery_code'.
+-- Only the Argon2id hash of each code is stored; the plaintext is returned once when the set is generated.
+CREATE TABLE IF NOT EXISTS recovery_code (
+    id TEXT NOT NULL PRIMARY KEY,       -- Unique identifier for this recovery code.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who owns this code.
+    created_at INTEGER NOT NULL,        -- Timestamp when the code was generated.
+    code_hash TEXT NOT NULL,            -- Argon2id hash of the code.
+    used_at INTEGER NULL                -- Timestamp when the code was used. NULL if the code is still unused.
+) STRICT;
+
+-- Creates an index on the 'user_id' column of the 'recovery_code' table.
+-- This speeds up looking up a user's recovery codes when one is submitted.
+CREATE INDEX IF NOT EXISTS recovery_code_user_id_index ON recovery_code(user_id);
+
 -- The 'passkey_credential' table stores credentials for passwordless authentication using WebAuthn passkeys.
 -- Passkeys allow users to log in using biometrics (fingerprint, face) or hardware keys, without a password.
 CREATE TABLE IF NOT EXISTS passkey_credential (
     id TEXT NOT NULL,                   -- The unique credential ID provided by the browser/authenticator during registration. This is NOT the primary key for the *table* row itself.
-    user_id TEXT NOT NULL REFERENCES user(id), -- Links to the user who owns this passkey.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who owns this passkey.
     name TEXT NOT NULL,                 -- A user-friendly name for the passkey (e.g., "My Phone", "Work Laptop").
     created_at INTEGER NOT NULL,        -- Timestamp when the passkey was registered.
     cose_algorithm_id INTEGER NOT NULL, -- The COSE (CBOR Object Signing and Encryption) algorithm identifier used by this credential (e.g., ES256).
@@ -76,7 +105,7 @@ CREATE INDEX IF NOT EXISTS passkey_credential_user_id_index ON passkey_credentia
 -- The structure is identical to 'passkey_credential'.
 CREATE TABLE IF NOT EXISTS security_key (
     id TEXT NOT NULL,                   -- The unique credential ID provided by the security key during registration.
-    user_id TEXT NOT NULL REFERENCES user(id), -- Links to the user who owns this security key.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who owns this security key.
     name TEXT NOT NULL,                 -- A user-friendly name for the security key (e.g., "YubiKey").
     created_at INTEGER NOT NULL,        -- Timestamp when the security key was registered.
     cose_algorithm_id INTEGER NOT NULL, -- The COSE algorithm identifier used by this credential.
@@ -86,3 +115,51 @@ CREATE TABLE IF NOT EXISTS security_key (
 -- Creates an index on the 'user_id' column of the 'security_key' table.
 -- This speeds up looking up all security keys registered by a specific user.
 CREATE INDEX IF NOT EXISTS security_key_user_id_index ON security_key(user_id);
+
+-- The 'session' table stores user sessions created after a successful sign-in.
+-- Expired sessions are rejected when validated and removed by cleanUpDatabase (db.go).
+CREATE TABLE IF NOT EXISTS session (
+    id TEXT NOT NULL PRIMARY KEY,           -- Unique identifier for the session.
+    user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE, -- Links to the user who owns this session.
+    created_at INTEGER NOT NULL,        -- Timestamp when the session was created.
+    expires_at INTEGER NOT NULL         -- Timestamp when the session becomes invalid (created_at + the session TTL).
+) STRICT;
+
+-- Creates indexes on the 'user_id' and 'expires_at' columns of the 'session' table.
+-- These speed up looking up a user's sessions and deleting expired sessions.
+CREATE INDEX IF NOT EXISTS session_user_id_index ON session(user_id);
+CREATE INDEX IF NOT EXISTS session_expires_at_index ON session(expires_at);
+
+-- The 'user_recent_authentication' table stores when each user last verified their password or second factor,
+-- for routes that require recent authentication (see reauthentication.go). Only written while such routes are configured.
+CREATE TABLE IF NOT EXISTS user_recent_authentication (
+    user_id TEXT NOT NULL PRIMARY KEY REFERENCES user(id) ON DELETE CASCADE, -- The user who authenticated.
+    authenticated_at INTEGER NOT NULL   -- Timestamp of the last successful password or second factor verification.
+) STRICT;
+
+-- The 'audit_log' table is a durable record of destructive actions (e.g. deleting a user or removing 2FA).
+-- Rows are only ever inserted. user_id intentionally does NOT reference user(id): entries must
+-- outlive the user they are about, including the entry recording the user's deletion.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER NOT NULL PRIMARY KEY,    -- Increasing ID, which also orders entries created in the same second.
+    created_at INTEGER NOT NULL,        -- Timestamp when the action was performed.
+    actor TEXT NOT NULL,                -- Identifies the request secret used (see requestActorId in audit.go). Empty if no secret is configured.
+    action TEXT NOT NULL,               -- What was done, e.g. 'user.delete'.
+    user_id TEXT NOT NULL,              -- The user the action was performed on.
+    client_ip TEXT NOT NULL             -- The client IP address sent with the request, or an empty string.
+) STRICT;
+
+-- Creates indexes on the 'user_id' and 'action' columns of the 'audit_log' table.
+-- These speed up filtering the audit log by user and by action.
+CREATE INDEX IF NOT EXISTS audit_log_user_id_index ON audit_log(user_id);
+CREATE INDEX IF NOT EXISTS audit_log_action_index ON audit_log(action);
+
+-- The 'invite' table stores single-use invite codes for POST /users (see invite.go).
+-- user_id intentionally does NOT reference user(id), so deleting the user doesn't make the invite usable again.
+CREATE TABLE IF NOT EXISTS invite (
+    id TEXT NOT NULL PRIMARY KEY,       -- Unique identifier for the invite.
+    code_hash TEXT NOT NULL UNIQUE,     -- SHA-256 hash of the invite code (hex). The code itself is not stored.
+    created_at INTEGER NOT NULL,        -- Timestamp when the invite was created.
+    used_at INTEGER,                    -- Timestamp when the invite was claimed by POST /users, or NULL if unused.
+    user_id TEXT                        -- The user created with the invite, or NULL.
+) STRICT;
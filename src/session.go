@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql" // 导入数据库 SQL 包
+	"time"         // 导入时间包
+)
+
+// 会话 (session) 保存在 session 表中。这里的端点不创建会话，会话由登录成功后创建它的应用写入，
+// 过期时间 (expires_at) 应该是创建时间加上 env.sessionLifetime()：
+//   - 读取会话时需要拒绝 expires_at 等于或早于当前时间的会话，不依赖清理任务是否已经运行。
+//   - cleanUpDatabase 会批量删除所有已过期的会话，防止它们在数据库中无限累积。
+//   - 修改或重置密码时可以删除用户的所有会话 (见 env.revokeSessionsOnPasswordChange)。
+
+// defaultSessionTTL 是没有配置 env.SessionTTL 时会话的有效期。
+const defaultSessionTTL = 30 * 24 * time.Hour
+
+// sessionLifetime 返回会话的有效期。
+// 未设置 (零值或负数) 时使用 defaultSessionTTL。
+func (env *Environment) sessionLifetime() time.Duration {
+	if env.SessionTTL <= 0 {
+		return defaultSessionTTL
+	}
+	return env.SessionTTL
+}
+
+// deleteUserSessions 在事务 tx 中删除用户的所有会话。修改或重置密码后调用，使已经登录的会话失效
+// (见 env.revokeSessionsOnPasswordChange)。
+// 返回值：
+//   int64: 删除的会话个数。
+//   error: 数据库操作失败时返回错误。
+func deleteUserSessions(tx *sql.Tx, userId string) (int64, error) {
+	result, err := tx.Exec("DELETE FROM session WHERE user_id = ?", userId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// logSessionsRevoked 记录修改或重置密码后删除了用户的会话。reason 是触发的操作 (例如 "password_reset")。
+func (env *Environment) logSessionsRevoked(userId string, reason string) {
+	env.logEvent("user sessions revoked", logStringField("user_id", userId), logStringField("reason", reason))
+}
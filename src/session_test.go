@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Session 表示 session 表中的一行。会话由应用写入，这里只在测试中使用。
+type Session struct {
+	Id        string
+	UserId    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// insertSession 将会话插入 session 表。
+func insertSession(db *sql.DB, ctx context.Context, session *Session) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO session (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)", session.Id, session.UserId, session.CreatedAt.Unix(), session.ExpiresAt.Unix())
+	return err
+}
+
+// TestEnvironmentSessionLifetime 测试未配置 SessionTTL 时使用默认有效期。
+func TestEnvironmentSessionLifetime(t *testing.T) {
+	t.Parallel()
+
+	env := &Environment{}
+	assert.Equal(t, defaultSessionTTL, env.sessionLifetime())
+
+	env.SessionTTL = time.Hour
+	assert.Equal(t, time.Hour, env.sessionLifetime())
+
+	env.SessionTTL = -time.Hour
+	assert.Equal(t, defaultSessionTTL, env.sessionLifetime())
+}
+
+// TestUpdateUserPasswordAndDeleteSessions 测试修改密码时在同一个事务中删除用户的所有会话，其他用户的会话保留。
+func TestUpdateUserPasswordAndDeleteSessions(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	for _, userId := range []string{"1", "2"} {
+		_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", userId, now.Unix(), "HASH", "12345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertSession(db, context.Background(), &Session{Id: userId, UserId: userId, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := updateUserPasswordAndDeleteSessions(db, context.Background(), "1", "NEW_HASH")
+	assert.NoError(t, err)
+
+	var passwordHash string
+	err = db.QueryRow("SELECT password_hash FROM user WHERE id = '1'").Scan(&passwordHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "NEW_HASH", passwordHash)
+	var sessionUserIds []string
+	rows, err := db.Query("SELECT user_id FROM session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId string
+		err = rows.Scan(&userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionUserIds = append(sessionUserIds, userId)
+	}
+	assert.Equal(t, []string{"2"}, sessionUserIds)
+}
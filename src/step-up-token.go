@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json" // 导入 JSON 编码/解码包
+	"fmt"           // 导入格式化包，用于生成令牌的 payload
+	"io"            // 导入 io 包，用于读取请求体
+	"log"           // 导入日志包
+	"net/http"      // 导入 HTTP 包
+	"strconv"       // 导入字符串转换包，用于解析过期时间
+	"strings"       // 导入字符串包，用于拆分 payload
+	"time"          // 导入时间包
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// step-up 令牌 (step-up token) 是用户通过 TOTP 验证后签发的短期令牌。
+// 应用在执行敏感的批量操作时，只需要让用户输入一次 TOTP 验证码，
+// 之后在令牌有效期内调用 POST /step-up-tokens/verify 确认用户刚刚完成过二次验证即可。
+//
+// 令牌用 token.go 中的 createSignedToken 签名，不在数据库中存储，所以在过期前无法单独撤销。
+// 有效期应该保持很短。
+
+// defaultStepUpTokenTTL 是没有配置 env.stepUpTokenTTL 时 step-up 令牌的有效期。
+const defaultStepUpTokenTTL = 5 * time.Minute
+
+// stepUpTokenPayloadPrefix 用来区分 step-up 令牌和将来用同一个密钥签发的其他类型的令牌。
+const stepUpTokenPayloadPrefix = "step_up"
+
+// ExpectedErrorInvalidToken 表示令牌格式错误、签名无效或已经过期。
+const ExpectedErrorInvalidToken = "INVALID_TOKEN"
+
+// stepUpTokenLifetime 返回 step-up 令牌的有效期。
+// 未设置 (零值或负数) 时使用 defaultStepUpTokenTTL。
+func (env *Environment) stepUpTokenLifetime() time.Duration {
+	if env.stepUpTokenTTL <= 0 {
+		return defaultStepUpTokenTTL
+	}
+	return env.stepUpTokenTTL
+}
+
+// createStepUpToken 为用户签发一个 step-up 令牌。
+// payload 格式为 "step_up:<过期时间的 Unix 时间戳>:<用户 ID>"，用户 ID 放在最后，所以其中可以包含任何字符。
+// 参数：
+//   key []byte: 签名密钥，通常是 env.tokenSigningKey()。
+//   userId string: 完成 TOTP 验证的用户 ID。
+//   expiresAt time.Time: 令牌的过期时间。
+// 返回值：
+//   string: 签名后的令牌。
+func createStepUpToken(key []byte, userId string, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%s:%d:%s", stepUpTokenPayloadPrefix, expiresAt.Unix(), userId)
+	return createSignedToken(key, payload)
+}
+
+// verifyStepUpToken 验证 step-up 令牌并返回其中的用户 ID 和过期时间。
+// 参数：
+//   key []byte: 签名密钥，必须与签发令牌时使用的密钥相同。
+//   token string: createStepUpToken 生成的令牌。
+//   now time.Time: 当前时间，用于检查令牌是否过期。
+// 返回值：
+//   string: 令牌对应的用户 ID。
+//   time.Time: 令牌的过期时间。
+//   bool: 如果签名有效、格式正确且没有过期，返回 true；否则返回 false。
+func verifyStepUpToken(key []byte, token string, now time.Time) (string, time.Time, bool) {
+	payload, ok := verifySignedToken(key, token)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 || parts[0] != stepUpTokenPayloadPrefix {
+		return "", time.Time{}, false
+	}
+	expiresAtUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expiresAt := time.Unix(expiresAtUnix, 0)
+	if !now.Before(expiresAt) {
+		return "", time.Time{}, false
+	}
+	return parts[2], expiresAt, true
+}
+
+// encodeStepUpTokenToJSON 把 step-up 令牌编码成 JSON 字符串，
+// 作为 POST /users/:user_id/verify-2fa/totp 成功时的响应。
+func encodeStepUpTokenToJSON(token string, expiresAt time.Time, format timeFormat) string {
+	data := struct {
+		StepUpToken string   `json:"step_up_token"`
+		ExpiresAt   UnixTime `json:"expires_at"`
+	}{
+		StepUpToken: token,
+		ExpiresAt:   newUnixTime(expiresAt, format),
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// encodeVerifiedStepUpTokenToJSON 把验证通过的 step-up 令牌的信息编码成 JSON 字符串，
+// 作为 POST /step-up-tokens/verify 成功时的响应。
+func encodeVerifiedStepUpTokenToJSON(userId string, expiresAt time.Time, format timeFormat) string {
+	data := struct {
+		UserId    string   `json:"user_id"`
+		ExpiresAt UnixTime `json:"expires_at"`
+	}{
+		UserId:    userId,
+		ExpiresAt: newUnixTime(expiresAt, format),
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// handleVerifyStepUpTokenRequest 处理验证 step-up 令牌的 API 请求 (POST /step-up-tokens/verify)。
+// 如果令牌有效，返回令牌对应的用户 ID 和过期时间。
+//
+// 安全检查:
+// 1. Request Secret Verification.
+// 2. Content-Type 和 Accept 头检查。
+// 3. 令牌签名和过期时间检查。
+//
+// 参数:
+//   env (*Environment): 应用环境。
+//   w (http.ResponseWriter): HTTP 响应写入器。
+//   r (*http.Request): 收到的 HTTP 请求。
+//   params (httprouter.Params): URL 参数 (未使用)。
+func handleVerifyStepUpTokenRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// 1. 验证内部请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Content-Type 和 Accept 头
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// 读取并解析请求体
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		Token *string `json:"token"` // POST /users/:user_id/verify-2fa/totp 返回的 step-up 令牌
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if data.Token == nil || *data.Token == "" {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	// 3. 验证令牌
+	userId, expiresAt, valid := verifyStepUpToken(env.tokenSigningKey(), *data.Token, time.Now())
+	if !valid {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidToken)
+		return
+	}
+
+	// 令牌有效，返回用户 ID 和过期时间
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeVerifiedStepUpTokenToJSON(userId, expiresAt, requestTimeFormat(env, r))))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json" // 导入 JSON 编码/解码包
+	"testing"       // 导入 Go 的测试包
+	"time"          // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestStepUpToken 测试 createStepUpToken 和 verifyStepUpToken：
+// 签发的令牌在有效期内可以验证通过并取回用户 ID，过期后、用错误的密钥或被篡改后验证失败。
+func TestStepUpToken(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("signing_key")
+	now := time.Unix(time.Now().Unix(), 0)
+	expiresAt := now.Add(5 * time.Minute)
+	token := createStepUpToken(key, "user:1", expiresAt)
+
+	// 有效期内验证通过 (用户 ID 中可以包含 ":")
+	userId, tokenExpiresAt, valid := verifyStepUpToken(key, token, now)
+	assert.True(t, valid)
+	assert.Equal(t, "user:1", userId)
+	assert.Equal(t, expiresAt, tokenExpiresAt)
+
+	// 过期后验证失败
+	_, _, valid = verifyStepUpToken(key, token, expiresAt)
+	assert.False(t, valid)
+	_, _, valid = verifyStepUpToken(key, token, expiresAt.Add(time.Second))
+	assert.False(t, valid)
+
+	// 错误的密钥
+	_, _, valid = verifyStepUpToken([]byte("other_key"), token, now)
+	assert.False(t, valid)
+
+	// 同一个密钥签发的其他类型的令牌不能当作 step-up 令牌使用
+	_, _, valid = verifyStepUpToken(key, createSignedToken(key, "user:1"), now)
+	assert.False(t, valid)
+}
+
+// TestEnvironmentStepUpTokenLifetime 测试未配置 stepUpTokenTTL 时使用默认有效期。
+func TestEnvironmentStepUpTokenLifetime(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, defaultStepUpTokenTTL, env.stepUpTokenLifetime())
+
+	env.stepUpTokenTTL = time.Minute
+	assert.Equal(t, time.Minute, env.stepUpTokenLifetime())
+
+	env.stepUpTokenTTL = -time.Minute
+	assert.Equal(t, defaultStepUpTokenTTL, env.stepUpTokenLifetime())
+}
+
+// TestEncodeStepUpTokenToJSON 测试 encodeStepUpTokenToJSON 函数的输出。
+func TestEncodeStepUpTokenToJSON(t *testing.T) {
+	t.Parallel()
+
+	expiresAt := time.Unix(time.Now().Unix(), 0)
+	var result struct {
+		StepUpToken string `json:"step_up_token"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}
+	err := json.Unmarshal([]byte(encodeStepUpTokenToJSON("token", expiresAt, timeFormatUnix)), &result)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", result.StepUpToken)
+	assert.Equal(t, expiresAt.Unix(), result.ExpiresAt)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 响应中的时间戳默认是 Unix 时间 (秒)。部分调用方更喜欢 ISO 8601，所以可以通过 env.timeFormat
+// 或者每个请求的 X-Faroe-Time-Format 请求头 ("unix" 或 "rfc3339") 选择 RFC 3339 格式 (UTC)，例如
+// "created_at": 1700000000 变为 "created_at": "2023-11-14T22:13:20Z"。
+// 无效的请求头值被忽略，使用 env.timeFormat。
+//
+// 响应模型的时间戳字段使用 UnixTime 类型，由它的 MarshalJSON 按格式编码。
+// 处理函数用 requestTimeFormat 取得请求的格式，传给编码函数。
+
+// timeFormat 是响应中时间戳的格式。
+type timeFormat int
+
+const (
+	timeFormatUnix    timeFormat = iota // Unix 时间 (秒)，默认值
+	timeFormatRFC3339                   // RFC 3339 字符串 (UTC)
+)
+
+// timeFormatHeader 是按请求选择时间戳格式的请求头。
+const timeFormatHeader = "X-Faroe-Time-Format"
+
+// parseTimeFormat 解析时间戳格式 "unix" 或 "rfc3339" (不区分大小写)。第二个返回值表示是否有效。
+func parseTimeFormat(s string) (timeFormat, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "unix":
+		return timeFormatUnix, true
+	case "rfc3339":
+		return timeFormatRFC3339, true
+	}
+	return timeFormatUnix, false
+}
+
+// requestTimeFormat 返回请求使用的时间戳格式：X-Faroe-Time-Format 有效时使用它，否则使用 env.timeFormat。
+func requestTimeFormat(env *Environment, r *http.Request) timeFormat {
+	if format, ok := parseTimeFormat(r.Header.Get(timeFormatHeader)); ok {
+		return format
+	}
+	return env.timeFormat
+}
+
+// UnixTime 是响应中的时间戳字段。Format 为 timeFormatUnix (零值) 时编码为 Unix 时间 (秒)，
+// 为 timeFormatRFC3339 时编码为 RFC 3339 字符串 (UTC)。
+type UnixTime struct {
+	Time   time.Time
+	Format timeFormat
+}
+
+// newUnixTime 返回按 format 编码的时间戳 t。
+func newUnixTime(t time.Time, format timeFormat) UnixTime {
+	return UnixTime{Time: t, Format: format}
+}
+
+// MarshalJSON 按 t.Format 编码时间戳。
+func (t UnixTime) MarshalJSON() ([]byte, error) {
+	if t.Format == timeFormatRFC3339 {
+		return json.Marshal(t.Time.UTC().Format(time.RFC3339))
+	}
+	return strconv.AppendInt(nil, t.Time.Unix(), 10), nil
+}
+
+// UnmarshalJSON 解析 Unix 时间 (秒) 或 RFC 3339 字符串，并记录对应的格式。
+func (t *UnixTime) UnmarshalJSON(data []byte) error {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case json.Number:
+		seconds, err := value.Int64()
+		if err != nil {
+			return err
+		}
+		*t = UnixTime{Time: time.Unix(seconds, 0), Format: timeFormatUnix}
+		return nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		*t = UnixTime{Time: parsed, Format: timeFormatRFC3339}
+		return nil
+	}
+	return fmt.Errorf("invalid timestamp: %s", data)
+}
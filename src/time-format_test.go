@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTimeFormat 测试 GET /users/:user_id 的时间戳格式：默认是 Unix 时间，
+// 通过 env.timeFormat 或 X-Faroe-Time-Format 请求头可以选择 RFC 3339，无效的请求头值使用默认值。
+func TestTimeFormat(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+	createdAt := time.Unix(1_700_000_000, 0)
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", createdAt.Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getCreatedAt := func(env *Environment, format string) any {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/users/1", nil)
+		if format != "" {
+			r.Header.Set("X-Faroe-Time-Format", format)
+		}
+		w := httptest.NewRecorder()
+		CreateApp(env).ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code)
+		var data map[string]any
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data["created_at"]
+	}
+
+	env := createEnvironment(db, nil)
+	assert.Equal(t, float64(createdAt.Unix()), getCreatedAt(env, ""))
+	assert.Equal(t, "2023-11-14T22:13:20Z", getCreatedAt(env, "rfc3339"))
+	assert.Equal(t, "2023-11-14T22:13:20Z", getCreatedAt(env, "RFC3339"))
+	assert.Equal(t, float64(createdAt.Unix()), getCreatedAt(env, "unix"))
+	assert.Equal(t, float64(createdAt.Unix()), getCreatedAt(env, "iso"))
+
+	// 配置默认使用 RFC 3339，请求头仍然可以选择 Unix 时间，无效的请求头值使用配置的格式
+	env.timeFormat = timeFormatRFC3339
+	assert.Equal(t, "2023-11-14T22:13:20Z", getCreatedAt(env, ""))
+	assert.Equal(t, float64(createdAt.Unix()), getCreatedAt(env, "unix"))
+	assert.Equal(t, "2023-11-14T22:13:20Z", getCreatedAt(env, "iso"))
+}
+
+// TestUnixTime 测试 UnixTime 按格式编码，并且可以解析两种格式。
+func TestUnixTime(t *testing.T) {
+	t.Parallel()
+
+	data := struct {
+		Id        string   `json:"id"`
+		CreatedAt UnixTime `json:"created_at"`
+	}{"1", newUnixTime(time.Unix(60, 0), timeFormatUnix)}
+	encoded, err := json.Marshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1","created_at":60}`, string(encoded))
+
+	data.CreatedAt = newUnixTime(time.Unix(60, 0), timeFormatRFC3339)
+	encoded, err = json.Marshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1","created_at":"1970-01-01T00:01:00Z"}`, string(encoded))
+
+	var decoded UnixTime
+	assert.NoError(t, json.Unmarshal([]byte(`60`), &decoded))
+	assert.Equal(t, int64(60), decoded.Time.Unix())
+	assert.Equal(t, timeFormatUnix, decoded.Format)
+	assert.NoError(t, json.Unmarshal([]byte(`"1970-01-01T00:01:00Z"`), &decoded))
+	assert.Equal(t, int64(60), decoded.Time.Unix())
+	assert.Equal(t, timeFormatRFC3339, decoded.Format)
+	assert.Error(t, json.Unmarshal([]byte(`true`), &decoded))
+	assert.Error(t, json.Unmarshal([]byte(`1.5`), &decoded))
+}
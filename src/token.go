@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"     // 导入 HMAC 包，用于对令牌进行签名
+	"crypto/sha256"   // 导入 SHA-256，作为 HMAC 的哈希函数
+	"encoding/base64" // 导入 Base64 编码包，用于把令牌编码成 URL 安全的字符串
+	"strings"         // 导入字符串包，用于拆分令牌
+)
+
+// tokenSigningKey 返回用于 HMAC 令牌签名的密钥。
+//
+// Faroe 有两个用途不同的密钥：
+//   - env.secret: 用来验证请求是否来自可信的客户端 (见 verifyRequestSecret)。
+//     它由调用 Faroe 的后端持有，泄露或人员变动时需要轮换。
+//   - env.SigningKey: 只用于对 Faroe 签发的令牌进行签名，从不离开服务器。
+//     轮换它会让所有已签发的令牌失效，所以通常只在确认泄露时才轮换。
+//
+// 把两者分开后，轮换 env.secret 不会让用户手中的令牌失效。
+// 为了兼容没有配置 SigningKey 的部署，未设置时退回使用 env.secret。
+func (env *Environment) tokenSigningKey() []byte {
+	if len(env.SigningKey) > 0 {
+		return env.SigningKey
+	}
+	return env.secret
+}
+
+// createSignedToken 生成一个带 HMAC-SHA256 签名的令牌。
+// 令牌格式为 "base64url(payload).base64url(signature)"，payload 是明文可读的，
+// 所以不能放入需要保密的数据，签名只保证它没有被篡改。
+// 参数：
+//   key []byte: 签名密钥，通常是 env.tokenSigningKey()。
+//   payload string: 需要签名的内容。
+// 返回值：
+//   string: 签名后的令牌。
+func createSignedToken(key []byte, payload string) string {
+	encodedPayload := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	signature := signTokenPayload(key, encodedPayload)
+	return encodedPayload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// verifySignedToken 验证令牌的签名并返回其中的 payload。
+// 参数：
+//   key []byte: 签名密钥，必须与签发令牌时使用的密钥相同。
+//   token string: createSignedToken 生成的令牌。
+// 返回值：
+//   string: 令牌中的 payload。
+//   bool: 如果令牌格式正确且签名有效，返回 true；否则返回 false。
+// 工作原理：
+// 1. 按 "." 拆分出 payload 和签名两部分，格式不对直接返回 false。
+// 2. 用同一个密钥重新计算 payload 的签名。
+// 3. 使用 hmac.Equal 进行常量时间比较，防止时序攻击。
+func verifySignedToken(key []byte, token string) (string, bool) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(signature, signTokenPayload(key, encodedPayload)) {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", false
+	}
+	return string(payload), true
+}
+
+// signTokenPayload 计算编码后 payload 的 HMAC-SHA256 签名。
+func signTokenPayload(key []byte, encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing" // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestSignedToken 测试 createSignedToken 和 verifySignedToken。
+// 正确的密钥应该能验证通过并取回 payload；错误的密钥或被篡改的令牌应该验证失败。
+func TestSignedToken(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("signing_key")
+	token := createSignedToken(key, "payload")
+
+	payload, valid := verifySignedToken(key, token)
+	assert.True(t, valid)
+	assert.Equal(t, "payload", payload)
+
+	_, valid = verifySignedToken([]byte("other_key"), token)
+	assert.False(t, valid)
+
+	// 篡改 payload 部分
+	_, valid = verifySignedToken(key, "x"+token)
+	assert.False(t, valid)
+
+	_, valid = verifySignedToken(key, "invalid")
+	assert.False(t, valid)
+}
+
+// TestEnvironmentTokenSigningKey 测试 tokenSigningKey 在配置了 SigningKey 时使用它，
+// 并且只轮换 secret 不会让已签发的令牌失效。
+func TestEnvironmentTokenSigningKey(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, []byte("secret"))
+	env.SigningKey = []byte("signing_key")
+	token := createSignedToken(env.tokenSigningKey(), "payload")
+
+	_, valid := verifySignedToken(env.SigningKey, token)
+	assert.True(t, valid)
+
+	// 轮换 secret
+	env.secret = []byte("rotated_secret")
+	payload, valid := verifySignedToken(env.tokenSigningKey(), token)
+	assert.True(t, valid)
+	assert.Equal(t, "payload", payload)
+
+	// 轮换 SigningKey 会让令牌失效
+	env.SigningKey = []byte("rotated_signing_key")
+	_, valid = verifySignedToken(env.tokenSigningKey(), token)
+	assert.False(t, valid)
+}
+
+// TestEnvironmentTokenSigningKeyFallback 测试没有配置 SigningKey 时退回使用 secret。
+func TestEnvironmentTokenSigningKeyFallback(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, []byte("secret"))
+	assert.Equal(t, []byte("secret"), env.tokenSigningKey())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxBulkDeleteTOTPUsers is the maximum number of users in a single
+// POST /totp-credentials/bulk-delete request.
+const maxBulkDeleteTOTPUsers = 1000
+
+// bulkDeleteTOTPBatchSize is the number of users whose credentials are deleted per database transaction.
+const bulkDeleteTOTPBatchSize = 100
+
+// handleBulkDeleteTOTPCredentialsRequest handles POST /totp-credentials/bulk-delete.
+// It deletes the TOTP credentials of many users at once, for example to force users to
+// register again after their authenticator app was compromised.
+//
+// The request body is:
+//
+//	{"user_ids": string[]}
+//
+// The response is a JSON array with one result per user ID, in the same order:
+// {"user_id": string, "deleted": boolean}. "deleted" is false if the user had no
+// TOTP credentials (including users that don't exist). Each user whose credentials were
+// deleted gets a user.totp_credential.delete audit log entry, as with
+// DELETE /users/:user_id/totp-credential.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleBulkDeleteTOTPCredentialsRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data struct {
+		UserIds []string `json:"user_ids"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if len(data.UserIds) == 0 || len(data.UserIds) > maxBulkDeleteTOTPUsers {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	deleted, err := deleteTOTPCredentialsOfUsers(env.db, r.Context(), data.UserIds)
+	// Batches committed before an error stay deleted, so record them either way.
+	clientIP := resolveClientIP(env, r, "")
+	for i, userId := range data.UserIds {
+		if deleted[i] {
+			env.invalidateCachedUser(userId)
+			writeAuditLog(env, r, AuditActionTOTPCredentialDelete, userId, clientIP)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeBulkDeleteTOTPResultsToJSON(data.UserIds, deleted)))
+}
+
+// encodeBulkDeleteTOTPResultsToJSON encodes the response body of POST /totp-credentials/bulk-delete.
+func encodeBulkDeleteTOTPResultsToJSON(userIds []string, deleted []bool) string {
+	type resultJSON struct {
+		UserId  string `json:"user_id"`
+		Deleted bool   `json:"deleted"`
+	}
+	data := make([]resultJSON, len(userIds))
+	for i, userId := range userIds {
+		data[i] = resultJSON{userId, deleted[i]}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// deleteTOTPCredentialsOfUsers deletes every TOTP credential of the users, in transactions
+// of bulkDeleteTOTPBatchSize users.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   userIds ([]string): The users. Repeated IDs are only reported as deleted the first time.
+//
+// Returns:
+//   []bool: One entry per user ID: whether any credential was deleted. Always has one entry
+//     per user ID, even with an error.
+//   error: An unexpected database error. Batches committed before it stay deleted.
+func deleteTOTPCredentialsOfUsers(db *sql.DB, ctx context.Context, userIds []string) ([]bool, error) {
+	deleted := make([]bool, len(userIds))
+	for start := 0; start < len(userIds); start += bulkDeleteTOTPBatchSize {
+		end := min(start+bulkDeleteTOTPBatchSize, len(userIds))
+		batchDeleted := make([]bool, end-start)
+		err := deleteTOTPCredentialsOfUsersBatch(db, ctx, userIds[start:end], batchDeleted)
+		if err != nil {
+			return deleted, err
+		}
+		copy(deleted[start:end], batchDeleted)
+	}
+	return deleted, nil
+}
+
+// deleteTOTPCredentialsOfUsersBatch deletes the TOTP credentials of the users in a single
+// transaction, recording in deleted whether each user had any.
+func deleteTOTPCredentialsOfUsersBatch(db *sql.DB, ctx context.Context, userIds []string, deleted []bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, userId := range userIds {
+		result, err := tx.ExecContext(ctx, "DELETE FROM user_totp_credential WHERE user_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted[i] = affected > 0
+	}
+	return tx.Commit()
+}
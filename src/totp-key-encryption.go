@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TOTP keys can optionally be encrypted at rest with AES-256-GCM, so a leaked database
+// alone doesn't expose every user's second factor. Encryption is enabled by configuring
+// env.totpKeyEncryptionKeys; the AES key is derived from the configured secret.
+//
+// Encryption keys are versioned so they can be rotated. An encrypted key is stored as
+//
+//	$totpenc$id=<key id>$<12 byte nonce><ciphertext and tag>
+//
+// New credentials always use the first key in env.totpKeyEncryptionKeys. Older keys must be
+// kept in the list until reencryptTOTPKeys has rewritten every credential with the current
+// key. Stored keys without the "$totpenc$" prefix were stored before encryption was enabled
+// and are read as-is. The user ID is authenticated with each key, so an encrypted key copied
+// to another user's row fails to decrypt.
+
+// totpKeyEncryptionPrefix marks an encrypted TOTP key.
+const totpKeyEncryptionPrefix = "$totpenc$id="
+
+// totpKeyEncryptionContext is mixed into the AES key derivation, so the configured secret
+// can't be used directly for anything else.
+const totpKeyEncryptionContext = "faroe totp key encryption"
+
+// ErrUnknownTOTPKeyEncryptionKey is returned when a TOTP key was encrypted with a key that
+// is no longer configured.
+var ErrUnknownTOTPKeyEncryptionKey = errors.New("unknown totp key encryption key")
+
+// ErrTOTPKeyDecryptionFailed is returned when an encrypted TOTP key can't be decrypted,
+// for example because the configured secret for its key ID has changed.
+var ErrTOTPKeyDecryptionFailed = errors.New("failed to decrypt totp key")
+
+// TOTPKeyEncryptionKey is a versioned secret used to encrypt TOTP keys at rest.
+type TOTPKeyEncryptionKey struct {
+	// Id is stored with each encrypted key and identifies which secret to decrypt it with.
+	// It must not be empty or contain "$".
+	Id     string
+	Secret []byte
+}
+
+// aead returns AES-256-GCM keyed with HMAC-SHA256(secret, totpKeyEncryptionContext).
+func (k TOTPKeyEncryptionKey) aead() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(totpKeyEncryptionContext))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTOTPKey encrypts a TOTP key for storage with the first of encryptionKeys.
+// Returns the key unchanged if encryptionKeys is empty.
+func encryptTOTPKey(encryptionKeys []TOTPKeyEncryptionKey, userId string, key []byte) ([]byte, error) {
+	if len(encryptionKeys) == 0 {
+		return key, nil
+	}
+	encryptionKey := encryptionKeys[0]
+	if encryptionKey.Id == "" || strings.Contains(encryptionKey.Id, "$") {
+		return nil, fmt.Errorf("invalid totp key encryption key id %q", encryptionKey.Id)
+	}
+	aead, err := encryptionKey.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	stored := []byte(totpKeyEncryptionPrefix + encryptionKey.Id + "$")
+	stored = append(stored, nonce...)
+	return aead.Seal(stored, nonce, key, []byte(userId)), nil
+}
+
+// decryptTOTPKey returns the TOTP key stored by encryptTOTPKey. Stored keys that aren't
+// encrypted are returned unchanged, even if encryption is now configured.
+// Returns ErrUnknownTOTPKeyEncryptionKey if the stored key references a key that isn't
+// configured, and ErrTOTPKeyDecryptionFailed if decryption fails.
+func decryptTOTPKey(encryptionKeys []TOTPKeyEncryptionKey, userId string, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(totpKeyEncryptionPrefix)) {
+		return stored, nil
+	}
+	keyId, sealed, ok := bytes.Cut(bytes.TrimPrefix(stored, []byte(totpKeyEncryptionPrefix)), []byte("$"))
+	if !ok {
+		return nil, errors.New("invalid encrypted totp key format: missing key id")
+	}
+	for _, encryptionKey := range encryptionKeys {
+		if encryptionKey.Id != string(keyId) {
+			continue
+		}
+		aead, err := encryptionKey.aead()
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrTOTPKeyDecryptionFailed
+		}
+		key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(userId))
+		if err != nil {
+			return nil, ErrTOTPKeyDecryptionFailed
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownTOTPKeyEncryptionKey, keyId)
+}
+
+// reencryptTOTPKeys rewrites every stored TOTP key that isn't encrypted with the first of
+// encryptionKeys, so old encryption keys can be removed after a rotation. Plaintext keys are
+// encrypted as well. Each credential is updated only if its stored key hasn't changed since
+// it was read.
+//
+// Parameters:
+//   db (*sql.DB): The database connection pool.
+//   ctx (context.Context): The context for the queries.
+//   encryptionKeys ([]TOTPKeyEncryptionKey): The configured keys. Must not be empty.
+//
+// Returns:
+//   int: The number of credentials that were rewritten.
+//   error: The first error, including any credential that can't be decrypted.
+func reencryptTOTPKeys(db *sql.DB, ctx context.Context, encryptionKeys []TOTPKeyEncryptionKey) (int, error) {
+	if len(encryptionKeys) == 0 {
+		return 0, errors.New("no totp key encryption key configured")
+	}
+	currentPrefix := []byte(totpKeyEncryptionPrefix + encryptionKeys[0].Id + "$")
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, key FROM user_totp_credential")
+	if err != nil {
+		return 0, err
+	}
+	type storedCredential struct {
+		id     string
+		userId string
+		key    []byte
+	}
+	var credentials []storedCredential
+	for rows.Next() {
+		var credential storedCredential
+		err = rows.Scan(&credential.id, &credential.userId, &credential.key)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !bytes.HasPrefix(credential.key, currentPrefix) {
+			credentials = append(credentials, credential)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, credential := range credentials {
+		key, err := decryptTOTPKey(encryptionKeys, credential.userId, credential.key)
+		if err != nil {
+			return updated, fmt.Errorf("totp credential %s: %w", credential.id, err)
+		}
+		encrypted, err := encryptTOTPKey(encryptionKeys, credential.userId, key)
+		if err != nil {
+			return updated, err
+		}
+		result, err := db.ExecContext(ctx, "UPDATE user_totp_credential SET key = ? WHERE id = ? AND key = ?", encrypted, credential.id, credential.key)
+		if err != nil {
+			return updated, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return updated, err
+		}
+		updated += int(affected)
+	}
+	return updated, nil
+}
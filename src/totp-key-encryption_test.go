@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"   // 导入 bytes 包，用于检查存储的密文
+	"context" // 导入上下文包
+	"testing" // 导入 Go 的测试包
+	"time"    // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestEncryptTOTPKey 测试 TOTP 密钥的加密和解密：
+// 密文带有密钥 ID 前缀、不包含原始密钥，错误的密钥、未知的密钥 ID 和其他用户的密文都无法解密。
+func TestEncryptTOTPKey(t *testing.T) {
+	t.Parallel()
+
+	keys := []TOTPKeyEncryptionKey{{Id: "2", Secret: []byte("new")}, {Id: "1", Secret: []byte("old")}}
+	key := []byte("12345678901234567890")
+
+	encrypted, err := encryptTOTPKey(keys, "1", key)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(encrypted, []byte("$totpenc$id=2$")))
+	assert.False(t, bytes.Contains(encrypted, key))
+
+	decrypted, err := decryptTOTPKey(keys, "1", encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, key, decrypted)
+
+	// 每次加密使用不同的 nonce
+	encrypted2, err := encryptTOTPKey(keys, "1", key)
+	assert.NoError(t, err)
+	assert.NotEqual(t, encrypted, encrypted2)
+
+	// 错误的密钥
+	_, err = decryptTOTPKey([]TOTPKeyEncryptionKey{{Id: "2", Secret: []byte("wrong")}}, "1", encrypted)
+	assert.ErrorIs(t, err, ErrTOTPKeyDecryptionFailed)
+
+	// 密钥 ID 已经不在配置中
+	_, err = decryptTOTPKey(keys[1:], "1", encrypted)
+	assert.ErrorIs(t, err, ErrUnknownTOTPKeyEncryptionKey)
+	_, err = decryptTOTPKey(nil, "1", encrypted)
+	assert.ErrorIs(t, err, ErrUnknownTOTPKeyEncryptionKey)
+
+	// 复制到其他用户的密文无法解密
+	_, err = decryptTOTPKey(keys, "2", encrypted)
+	assert.ErrorIs(t, err, ErrTOTPKeyDecryptionFailed)
+
+	// 没有配置密钥时存储原始字节，启用加密之前存储的密钥原样返回
+	plain, err := encryptTOTPKey(nil, "1", key)
+	assert.NoError(t, err)
+	assert.Equal(t, key, plain)
+	decrypted, err = decryptTOTPKey(keys, "1", plain)
+	assert.NoError(t, err)
+	assert.Equal(t, key, decrypted)
+}
+
+// TestReencryptTOTPKeys 测试轮换密钥后 reencryptTOTPKeys 用新密钥重新加密所有凭据，
+// 包括启用加密之前存储的明文密钥，之后旧密钥可以从配置中移除。
+func TestReencryptTOTPKeys(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	for _, userId := range []string{"1", "2"} {
+		_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", userId, time.Now().Unix(), "hash", "12345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldKeys := []TOTPKeyEncryptionKey{{Id: "1", Secret: []byte("old")}}
+	newKeys := []TOTPKeyEncryptionKey{{Id: "2", Secret: []byte("new")}, {Id: "1", Secret: []byte("old")}}
+
+	_, err := registerUserTOTPCredential(db, context.Background(), newId, "1", []byte{0x01}, oldKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerUserTOTPCredential(db, context.Background(), newId, "2", []byte{0x02}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := reencryptTOTPKeys(db, context.Background(), newKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated)
+
+	// 所有凭据都只需要新密钥
+	credential, err := getUserTOTPCredential(db, context.Background(), "1", newKeys[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01}, credential.Key)
+	credential, err = getUserTOTPCredential(db, context.Background(), "2", newKeys[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, credential.Key)
+
+	// 已经用新密钥加密的凭据不会被重写
+	updated, err = reencryptTOTPKeys(db, context.Background(), newKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, updated)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"faroe/otp"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 服务端生成 TOTP 密钥：客户端调用 POST /users/:user_id/totp-setup 由 Faroe 生成密钥
+// (保证长度和熵正确)，把返回的 otpauth:// URI 显示为二维码，然后调用
+// POST /users/:user_id/register-totp 只提交验证码 (不提交 key) 完成注册。
+// 生成的密钥在确认之前只保存在内存中 (env.pendingTOTPKeys)，不会写入数据库。
+
+// pendingTOTPKeyTTL 是生成的密钥等待确认的时间，过期后需要重新调用 totp-setup。
+const pendingTOTPKeyTTL = 10 * time.Minute
+
+// defaultTOTPIssuer 是 otpauth:// URI 中默认的发行者名称，认证器应用会把它显示在账户旁边。
+const defaultTOTPIssuer = "Faroe"
+
+// pendingTOTPKeyStore 保存每个用户最近一次生成、还没有确认的 TOTP 密钥。
+// 零值可以直接使用。
+type pendingTOTPKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]pendingTOTPKey // user_id -> 密钥
+}
+
+// pendingTOTPKey 是一个等待确认的密钥。
+type pendingTOTPKey struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+// Set 保存用户的密钥，替换之前生成的密钥，并顺便删除已过期的密钥。
+func (s *pendingTOTPKeyStore) Set(userId string, key []byte, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = map[string]pendingTOTPKey{}
+	}
+	now := time.Now()
+	for id, pending := range s.keys {
+		if !now.Before(pending.expiresAt) {
+			delete(s.keys, id)
+		}
+	}
+	s.keys[userId] = pendingTOTPKey{key: key, expiresAt: expiresAt}
+}
+
+// Get 返回用户未过期的密钥。
+func (s *pendingTOTPKeyStore) Get(userId string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.keys[userId]
+	if !ok || !time.Now().Before(pending.expiresAt) {
+		return nil, false
+	}
+	return pending.key, true
+}
+
+// Delete 删除用户的密钥 (注册成功后调用，密钥只能使用一次)。
+func (s *pendingTOTPKeyStore) Delete(userId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, userId)
+}
+
+// handleCreateTOTPSetupRequest 处理 POST /users/:user_id/totp-setup，为用户生成新的 TOTP 密钥。
+// 密钥是 crypto/rand 生成的 totpKeySize 字节随机数，在 pendingTOTPKeyTTL 内等待 register-totp 确认，
+// 每次调用都会替换之前生成的密钥。此时还没有创建凭据。
+//
+// 请求体 (可选)：{"issuer": string, "account_name": string}，用于 otpauth:// URI，
+// 默认分别是 "Faroe" 和用户 ID。
+//
+// 参数:
+//   env (*Environment): 应用环境。
+//   w (http.ResponseWriter): HTTP 响应写入器。
+//   r (*http.Request): 收到的 HTTP 请求。
+//   params (httprouter.Params): URL 参数，包含 'user_id'。
+func handleCreateTOTPSetupRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	userId := params.ByName("user_id")
+	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userExists {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	var data struct {
+		Issuer      string `json:"issuer"`
+		AccountName string `json:"account_name"`
+	}
+	err = decodeOptionalJSON(r, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if data.Issuer == "" {
+		data.Issuer = defaultTOTPIssuer
+	}
+	if data.AccountName == "" {
+		data.AccountName = userId
+	}
+
+	key := make([]byte, totpKeySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	expiresAt := time.Unix(time.Now().Add(pendingTOTPKeyTTL).Unix(), 0)
+	env.pendingTOTPKeys.Set(userId, key, expiresAt)
+
+	encodedKey := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeTOTPSetupToJSON(encodedKey, createTOTPKeyURI(data.Issuer, data.AccountName, encodedKey), expiresAt, requestTimeFormat(env, r))))
+}
+
+// createTOTPKeyURI 生成认证器应用可以扫描的 otpauth:// URI (Key Uri Format)。
+// 参数和 Faroe 验证 TOTP 时使用的一致：SHA-1、6 位数字、30 秒间隔。
+// 参数：
+//   issuer string: 发行者名称。
+//   accountName string: 账户名称。
+//   encodedKey string: Base32 编码 (无填充) 的密钥。
+func createTOTPKeyURI(issuer string, accountName string, encodedKey string) string {
+	query := url.Values{}
+	query.Set("secret", encodedKey)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", "6")
+	query.Set("period", "30")
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(accountName)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// encodeTOTPSetupToJSON 编码 POST /users/:user_id/totp-setup 的响应体。
+func encodeTOTPSetupToJSON(encodedKey string, uri string, expiresAt time.Time, format timeFormat) string {
+	data := struct {
+		Key       string   `json:"key"`
+		URI       string   `json:"uri"`
+		ExpiresAt UnixTime `json:"expires_at"`
+	}{
+		Key:       encodedKey,
+		URI:       uri,
+		ExpiresAt: newUnixTime(expiresAt, format),
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// maxTOTPCodeLength 是 POST /totp/preview-verify 接受的验证码的最大长度，更长的值不可能是 6 位验证码。
+const maxTOTPCodeLength = 16
+
+// previewVerifyTOTPRequest 是 POST /totp/preview-verify 的请求体。
+type previewVerifyTOTPRequest struct {
+	Key      *string `json:"key"`       // Base64 或 Base32 编码的 TOTP 密钥 (见 decodeTOTPKey)
+	Code     *string `json:"code"`      // 用户的认证器应用生成的验证码
+	ClientIP string  `json:"client_ip"` // 可选的客户端 IP，用于速率限制
+}
+
+// validate 检查 key 和 code 都存在，并且 key 能解码出 totpKeySize 字节的密钥。
+func (data *previewVerifyTOTPRequest) validate() []fieldError {
+	var fieldErrors []fieldError
+	if data.Key == nil || *data.Key == "" {
+		fieldErrors = append(fieldErrors, fieldError{"key", FieldErrorRequired})
+	} else if _, ok := decodeTOTPKey(*data.Key); !ok {
+		fieldErrors = append(fieldErrors, fieldError{"key", FieldErrorInvalid})
+	}
+	fieldErrors = validateRequiredString(fieldErrors, "code", data.Code, maxTOTPCodeLength)
+	return fieldErrors
+}
+
+// handlePreviewVerifyTOTPRequest 处理 POST /totp/preview-verify 请求。
+// 注册 TOTP 之前，客户端把密钥显示给用户，可以先用这个端点确认用户的认证器应用生成的验证码和密钥匹配，
+// 然后再调用 register-totp。这个端点不需要用户，也不保存任何数据。
+// 验证方式和 register-totp 相同 (otp.VerifyTOTPWithGracePeriod，允许 env.totpMaxClockSkew() 的时钟偏差)。
+//
+// 请求体：{"key": string, "code": string, "client_ip": string}，client_ip 可选。
+// 响应：200 和 {"valid": bool}。验证码不正确不是错误，返回 {"valid": false}。
+// 提供了 client_ip 时按 IP 限流 (env.totpPreviewIPRateLimit)，超出限制返回 429。
+//
+// 参数:
+//   env (*Environment): 应用环境。
+//   w (http.ResponseWriter): HTTP 响应写入器。
+//   r (*http.Request): 收到的 HTTP 请求。
+//   _ (httprouter.Params): URL 参数 (未使用)。
+func handlePreviewVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	var data previewVerifyTOTPRequest
+	if !decodeAndValidateJSON(w, r, &data) {
+		return
+	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	if data.ClientIP != "" && !env.totpPreviewIPRateLimit.Consume(data.ClientIP) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+	setRateLimitHeaders(env, w, &env.totpPreviewIPRateLimit, data.ClientIP)
+
+	key, _ := decodeTOTPKey(*data.Key)
+	valid := otp.VerifyTOTPWithGracePeriod(time.Now(), key, 30*time.Second, 6, *data.Code, env.totpMaxClockSkew())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"valid":%t}`, valid)))
+}
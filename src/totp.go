@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,21 +12,67 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// ExpectedErrorAccountLocked 表示用户因为反复验证失败被暂时锁定 (见 env.totpUserLockout)。
+const ExpectedErrorAccountLocked = "ACCOUNT_LOCKED"
+
+// ExpectedErrorSecondFactorNotRegistered 表示用户还没有注册 TOTP，客户端可以引导用户先注册。
+// 之前这种情况返回 NOT_ALLOWED，和其他不允许的操作无法区分。仍然依赖 NOT_ALLOWED 的部署可以设置
+// env.legacySecondFactorNotRegisteredError 恢复原来的错误码。
+const ExpectedErrorSecondFactorNotRegistered = "SECOND_FACTOR_NOT_REGISTERED"
+
+// secondFactorNotRegisteredError 返回用户没有注册 TOTP 时的错误码。
+func (env *Environment) secondFactorNotRegisteredError() string {
+	if env.legacySecondFactorNotRegisteredError {
+		return ExpectedErrorNotAllowed
+	}
+	return ExpectedErrorSecondFactorNotRegistered
+}
+
+// defaultTOTPMaxClockSkew 是没有配置 env.totpMaxClockSkew 时允许的最大时钟偏差。
+const defaultTOTPMaxClockSkew = 10 * time.Second
+
+// totpMaxClockSkew 返回验证 TOTP 验证码时允许的最大时钟偏差 (前后各多少时间)。
+// 偏差越大越能容忍客户端时钟不准，但被截获或重放的旧验证码也能在更长时间内使用。
+// 未设置 (零值) 时使用 defaultTOTPMaxClockSkew；设置为负数时不允许任何偏差。
+// 超过 otp.MaxGracePeriod (2 分钟) 的值在验证时会被限制为 otp.MaxGracePeriod。
+func (env *Environment) totpMaxClockSkew() time.Duration {
+	if env.totpClockSkew == 0 {
+		return defaultTOTPMaxClockSkew
+	}
+	if env.totpClockSkew < 0 {
+		return 0
+	}
+	return env.totpClockSkew
+}
+
+// totpMaxFutureClockSkew 返回验证 TOTP 验证码时接受的未来时间范围。
+// 设置了 env.totpRejectFutureCodes 时返回 0，只接受当前和之前的时间步长 (缩小重放窗口)，
+// 否则与 totpMaxClockSkew 相同。
+func (env *Environment) totpMaxFutureClockSkew() time.Duration {
+	if env.totpRejectFutureCodes {
+		return 0
+	}
+	return env.totpMaxClockSkew()
+}
+
 // handleRegisterTOTPRequest 处理用户注册 TOTP 两因素认证的 API 请求。
 // 用户在启用 2FA 时，通常会扫描一个二维码（包含了密钥 Key），然后输入应用生成的当前 TOTP 验证码 (Code)。
-// 此函数接收用户 ID、密钥（Base64 编码）和用户输入的验证码。
+// 此函数接收用户 ID、密钥（Base64 或 Base32 编码）和用户输入的验证码。
+// 省略密钥时使用 POST /users/:user_id/totp-setup 在服务端生成的密钥。
 // 它会验证验证码是否正确，如果正确，则将密钥与用户 ID 关联并存储到数据库。
 //
 // 安全检查:
 // 1. Request Secret Verification: 验证请求是否来自可信源 (内部服务)。
 // 2. Content-Type Header Verification (JSON): 确保请求体是 JSON 格式。
 // 3. User Existence Check: 确保要注册 TOTP 的用户存在。
-// 4. Key Format & Length Check: 验证提供的密钥是否是有效的 Base64 编码，且解码后长度符合预期 (通常是 20 字节)。
+// 4. Key Format & Length Check: 验证提供的密钥是否是有效的 Base64 或 Base32 编码，且解码后长度符合预期 (20 字节)。
 // 5. Code Presence Check: 确保用户提供了验证码。
 // 6. TOTP Code Verification: 使用提供的密钥验证用户输入的验证码是否在允许的时间窗口内有效。
 //
@@ -52,7 +99,7 @@ func handleRegisterTOTPRequest(env *Environment, w http.ResponseWriter, r *http.
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -64,35 +111,37 @@ func handleRegisterTOTPRequest(env *Environment, w http.ResponseWriter, r *http.
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 定义解析 JSON 的结构体
 	var data struct {
-		Key  *string `json:"key"`  // Base64 编码的 TOTP 密钥
+		Key  *string `json:"key"`  // Base64 或 Base32 编码的 TOTP 密钥
 		Code *string `json:"code"` // 用户输入的当前 TOTP 验证码
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
 		return
 	}
-	// 检查密钥是否存在
+	// 4. 获取密钥：没有提供 key 时使用 POST /users/:user_id/totp-setup 生成、还没有过期的密钥 (见 totp-setup.go)
+	var key []byte
 	if data.Key == nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
-	}
-	// 4. 解码 Base64 密钥
-	key, err := base64.StdEncoding.DecodeString(*data.Key)
-	if err != nil {
-		// Base64 解码失败，说明密钥格式无效
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
-	}
-	// 检查解码后的密钥长度是否为 20 字节 (常见的 TOTP 密钥长度)
-	if len(key) != 20 {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
+		var ok bool
+		key, ok = env.pendingTOTPKeys.Get(userId)
+		if !ok {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
+	} else {
+		// 解码密钥 (Base64 或 Base32)，并检查解码后的长度
+		var ok bool
+		key, ok = decodeTOTPKey(*data.Key)
+		if !ok {
+			// 两种编码都无法解码出 20 字节的密钥，说明密钥格式无效
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+			return
+		}
 	}
 
 	// 5. 检查验证码是否存在且不为空
@@ -101,16 +150,18 @@ func handleRegisterTOTPRequest(env *Environment, w http.ResponseWriter, r *http.
 		return
 	}
 	// 6. 验证 TOTP 验证码
-	// 使用 otp 包验证，允许前后 10 秒的容错时间窗口 (grace period)
-	validCode := otp.VerifyTOTPWithGracePeriod(time.Now(), key, 30*time.Second, 6, *data.Code, 10*time.Second)
+	// 使用 otp 包验证，允许前后 env.totpMaxClockSkew() 的容错时间窗口 (grace period)
+	validCode := otp.VerifyTOTPWithGracePeriod(time.Now(), key, 30*time.Second, 6, *data.Code, env.totpMaxClockSkew())
 	if !validCode {
 		// 验证码不正确
+		env.delayAuthenticationFailure(r.Context())
 		writeExpectedErrorResponse(w, ExpectedErrorIncorrectCode)
 		return
 	}
 
 	// 验证码正确，将密钥注册到数据库
-	credential, err := registerUserTOTPCredential(env.db, r.Context(), userId, key)
+	credential, err := registerUserTOTPCredential(env.db, r.Context(), env.generateId, userId, key, env.totpKeyEncryptionKeys)
+	env.invalidateCachedUser(userId)
 	if errors.Is(err, ErrRecordNotFound) {
 		// 这个错误理论上不应该在这里发生，因为前面已经检查过 userExists
 		// 但以防万一，如果 register 函数内部再次检查并发现用户不存在，则返回 404
@@ -120,29 +171,68 @@ func handleRegisterTOTPRequest(env *Environment, w http.ResponseWriter, r *http.
 	if err != nil {
 		// 其他数据库错误
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	// 生成的密钥只能注册一次
+	if data.Key == nil {
+		env.pendingTOTPKeys.Delete(userId)
+	}
 
 	// 注册成功，返回包含凭据信息的 JSON (通常只包含 ID 和创建时间，不含密钥)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(credential.EncodeToJSON()))
+	w.Write([]byte(credential.EncodeToJSON(requestTimeFormat(env, r))))
+}
+
+// totpKeySize 是 TOTP 密钥解码后的长度 (字节)。
+const totpKeySize = 20
+
+// decodeTOTPKey 解码注册 TOTP 时提供的密钥。
+// 认证器应用和二维码 (otpauth:// URI) 通常使用 Base32，而 Faroe 以前只接受 Base64，
+// 所以两种编码都接受：
+//   - Base64: 标准编码 (base64.StdEncoding)，带填充。
+//   - Base32: 标准字母表，不区分大小写，可以省略填充，可以包含空格 (认证器应用常把密钥分组显示)。
+// 20 字节的密钥用 Base64 编码是 28 个字符，用 Base32 编码是 32 个字符，
+// 所以在检查解码后的长度之后，两种编码不会产生歧义。
+// 参数：
+//   encoded string: 编码后的密钥。
+// 返回值：
+//   []byte: 解码后的密钥。
+//   bool: 如果能用其中一种编码解码出 totpKeySize 字节的密钥，返回 true；否则返回 false。
+func decodeTOTPKey(encoded string) ([]byte, bool) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil && len(key) == totpKeySize {
+		return key, true
+	}
+	normalized := strings.ToUpper(strings.ReplaceAll(encoded, " ", ""))
+	normalized = strings.TrimRight(normalized, "=")
+	key, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalized)
+	if err == nil && len(key) == totpKeySize {
+		return key, true
+	}
+	return nil, false
 }
 
 // handleVerifyTOTPRequest 处理用户登录时验证 TOTP 验证码的 API 请求。
 // 当用户启用了 2FA 并已成功输入密码后，需要再输入当前的 TOTP 验证码进行验证。
 // 此函数接收用户 ID 和用户输入的验证码。
-// 它会从数据库获取该用户的 TOTP 密钥，然后使用密钥验证用户输入的验证码。
+// 用户可能注册了多个 TOTP 凭据，此函数会用每一个凭据的密钥验证验证码，任意一个匹配即视为成功，
+// 这样调用方不需要知道凭据 ID。
+// 验证成功后返回一个短期的 step-up 令牌 (见 step-up-token.go)，
+// 应用可以在令牌有效期内执行敏感操作而不需要再次让用户输入验证码。
 //
 // 安全检查:
 // 1. Request Secret Verification.
-// 2. Content-Type Header Verification (JSON).
+// 2. Content-Type and Accept Header Verification (JSON).
 // 3. User Existence Check.
 // 4. TOTP Credential Existence Check: 检查用户是否已注册 TOTP。
 // 5. Code Presence Check.
 // 6. Rate Limiting (per User): 限制单个用户尝试验证 TOTP 的频率，防止暴力猜测。
-// 7. TOTP Code Verification: 使用存储的密钥验证用户输入的验证码。
+//    限制针对用户而不是凭据，所以注册多个凭据不会增加可猜测的次数。
+//    在时间窗口内多次耗尽速率限制的用户会被锁定一段冷却时间 (env.totpUserLockout)，
+//    期间返回 ACCOUNT_LOCKED，即使验证码正确也不能通过。
+// 7. TOTP Code Verification: 使用所有凭据的密钥验证用户输入的验证码。
 //
 // 参数:
 //   env (*Environment): 应用环境。
@@ -155,11 +245,15 @@ func handleVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Re
 		writeNotAuthenticatedErrorResponse(w)
 		return
 	}
-	// 2. 验证 Content-Type
+	// 2. 验证 Content-Type 和 Accept 头
 	if !verifyJSONContentTypeHeader(r) {
 		writeUnsupportedMediaTypeErrorResponse(w)
 		return
 	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
 
 	// 从 URL 获取用户 ID
 	userId := params.ByName("user_id")
@@ -167,7 +261,7 @@ func handleVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Re
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -175,16 +269,16 @@ func handleVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// 4. 获取用户的 TOTP 凭据 (包含密钥)
-	credential, err := getUserTOTPCredential(env.db, r.Context(), userId)
-	if errors.Is(err, ErrRecordNotFound) {
-		// 如果用户没有注册 TOTP，返回不允许操作 (或特定的错误码表明未设置 2FA)
-		writeExpectedErrorResponse(w, ExpectedErrorNotAllowed)
-		return
-	}
+	// 4. 获取用户的所有 TOTP 凭据 (包含密钥)
+	credentials, err := getUserTOTPCredentials(env.db, r.Context(), userId, env.totpKeyEncryptionKeys)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if len(credentials) == 0 {
+		// 如果用户没有注册 TOTP，返回特定的错误码表明未设置 2FA
+		writeExpectedErrorResponse(w, env.secondFactorNotRegisteredError())
 		return
 	}
 
@@ -192,7 +286,7 @@ func handleVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Re
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// 定义解析 JSON 的结构体
@@ -201,31 +295,71 @@ func handleVerifyTOTPRequest(env *Environment, w http.ResponseWriter, r *http.Re
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	// 5. 检查验证码是否存在，去掉其中的空白字符后必须是纯数字
+	if data.Code == nil {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
 		return
 	}
-	// 5. 检查验证码是否存在且不为空
-	if data.Code == nil || *data.Code == "" {
+	code, ok := normalizeCode(*data.Code, true)
+	if !ok {
 		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
 		return
 	}
-	// 6. 应用针对用户的速率限制
+	// 6. 检查用户是否因为反复耗尽速率限制而被锁定，然后应用针对用户的速率限制
+	// 设置了 env.totpRetryAfter 时返回 429 和 Retry-After 头 (见 rate-limit-headers.go)
+	if env.totpUserLockout.Locked(userId) {
+		if env.totpRetryAfter {
+			writeRetryAfterErrorResponse(w, ExpectedErrorAccountLocked, env.totpUserLockout.RetryAfter(userId))
+			return
+		}
+		writeExpectedErrorResponse(w, ExpectedErrorAccountLocked)
+		return
+	}
 	if !env.totpUserRateLimit.Consume(userId) {
+		if env.totpRetryAfter {
+			writeRetryAfterErrorResponse(w, ExpectedErrorTooManyRequests, env.totpUserRateLimit.RetryAfter(userId))
+			return
+		}
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
 		return
 	}
+	setRateLimitHeaders(env, w, &env.totpUserRateLimit, userId)
 	// 7. 验证 TOTP 验证码
-	valid := otp.VerifyTOTPWithGracePeriod(time.Now(), credential.Key, 30*time.Second, 6, *data.Code, 10*time.Second)
+	// 即使已经有凭据匹配也继续检查剩下的凭据，使响应时间不会暴露是哪一个凭据匹配。
+	// 每次比较本身在 otp 包内是常量时间的。
+	now := time.Now()
+	valid := false
+	for _, credential := range credentials {
+		if otp.VerifyTOTPWithWindow(now, credential.Key, 30*time.Second, 6, code, env.totpMaxClockSkew(), env.totpMaxFutureClockSkew()) {
+			valid = true
+		}
+	}
 	if !valid {
-		// 验证码不正确
+		// 验证码不正确。如果这次尝试用掉了最后一个令牌，记录一次耗尽，
+		// 在窗口内耗尽次数达到阈值后锁定该用户 (每个令牌桶只记录一次)。
+		if !env.totpUserRateLimit.Check(userId) {
+			env.totpUserLockout.RecordExhaustion(userId)
+		}
+		env.delayAuthenticationFailure(r.Context())
 		writeExpectedErrorResponse(w, ExpectedErrorIncorrectCode)
 		return
 	}
-	// 验证成功，重置该用户的速率限制计数器
+	// 验证成功，重置该用户的速率限制计数器和耗尽次数
 	env.totpUserRateLimit.Reset(userId)
+	env.totpUserLockout.Reset(userId)
+	// 记录这次验证，供要求近期认证的路由检查 (见 reauthentication.go)
+	env.recordRecentAuthentication(r.Context(), userId)
 
-	// 验证成功，返回 204 No Content
-	w.WriteHeader(http.StatusNoContent)
+	// 验证成功，签发一个短期的 step-up 令牌 (见 step-up-token.go)
+	expiresAt := time.Now().Add(env.stepUpTokenLifetime())
+	stepUpToken := createStepUpToken(env.tokenSigningKey(), userId, expiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeStepUpTokenToJSON(stepUpToken, expiresAt, requestTimeFormat(env, r))))
 }
 
 // handleDeleteUserTOTPCredentialRequest 处理删除用户 TOTP 凭据的 API 请求。
@@ -250,7 +384,7 @@ func handleDeleteUserTOTPCredentialRequest(env *Environment, w http.ResponseWrit
 	// 从 URL 获取用户 ID
 	userId := params.ByName("user_id")
 	// 2. 检查用户的 TOTP 凭据是否存在
-	_, err := getUserTOTPCredential(env.db, r.Context(), userId)
+	_, err := getUserTOTPCredential(env.db, r.Context(), userId, env.totpKeyEncryptionKeys)
 	if errors.Is(err, ErrRecordNotFound) {
 		// 如果凭据本就不存在，返回 404 Not Found
 		writeNotFoundErrorResponse(w)
@@ -258,17 +392,20 @@ func handleDeleteUserTOTPCredentialRequest(env *Environment, w http.ResponseWrit
 	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// 凭据存在，执行删除操作
 	err = deleteUserTOTPCredential(env.db, r.Context(), userId)
+	env.invalidateCachedUser(userId)
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	// 关闭 2FA 是破坏性操作，写入审计日志
+	writeAuditLog(env, r, AuditActionTOTPCredentialDelete, userId, resolveClientIP(env, r, ""))
 
 	// 删除成功，返回 204 No Content
 	w.WriteHeader(http.StatusNoContent)
@@ -301,8 +438,10 @@ func handleGetUserTOTPCredentialRequest(env *Environment, w http.ResponseWriter,
 	}
 	// 从 URL 获取用户 ID
 	userId := params.ByName("user_id")
-	// 3. 获取用户的 TOTP 凭据
-	credential, err := getUserTOTPCredential(env.db, r.Context(), userId)
+	// 3. 获取用户的 TOTP 凭据，暂时性的数据库错误会重试 (见 retryDatabaseRead)
+	credential, err := retryDatabaseRead(env, r.Context(), func() (UserTOTPCredential, error) {
+		return getUserTOTPCredential(env.db, r.Context(), userId, env.totpKeyEncryptionKeys)
+	})
 	if errors.Is(err, ErrRecordNotFound) {
 		// 如果凭据不存在，返回 404 Not Found
 		writeNotFoundErrorResponse(w)
@@ -310,72 +449,243 @@ func handleGetUserTOTPCredentialRequest(env *Environment, w http.ResponseWriter,
 	}
 	if err != nil {
 		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// 凭据存在，返回编码后的 JSON 信息 (不含密钥)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(credential.EncodeToJSON()))
+	w.Write([]byte(credential.EncodeToJSON(requestTimeFormat(env, r))))
+}
+
+// handleGetTOTPCredentialsRequest 处理 GET /totp-credentials 请求，分页列出所有用户的 TOTP 凭据。
+// 用于安全审计 (例如找出异常的注册)，响应中只有凭据的元数据，不包含密钥。
+// 查询参数和分页响应头与 GET /users 相同：
+//   sort_by: created_at (默认) 或 id。
+//   sort_order: ascending (默认) 或 descending。
+//   per_page, page: 见 parsePaginationQuery。
+// 响应头包含 X-Pagination-Total、X-Pagination-Total-Pages、X-Pagination-Per-Page 和 Link。
+func handleGetTOTPCredentialsRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// 1. 验证内部请求密钥
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	// 2. 验证 Accept 头
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// 3. 解析排序和分页参数，无效的值使用默认值
+	query := r.URL.Query()
+	sortBy := "created_at"
+	if query.Get("sort_by") == "id" {
+		sortBy = "id"
+	}
+	sortOrder := "ASC"
+	if query.Get("sort_order") == "descending" {
+		sortOrder = "DESC"
+	}
+	perPage, page := parsePaginationQuery(query, env.paginationPerPageLimit())
+
+	// 4. 查询总数和当前页的凭据
+	total, err := retryDatabaseRead(env, r.Context(), func() (int, error) {
+		return getTOTPCredentialCount(env.db, r.Context())
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	credentials, err := retryDatabaseRead(env, r.Context(), func() ([]UserTOTPCredential, error) {
+		return getTOTPCredentialsPage(env.db, r.Context(), sortBy, sortOrder, perPage, page)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	w.Header().Set("X-Pagination-Total", strconv.Itoa(total))
+	w.Header().Set("X-Pagination-Total-Pages", strconv.Itoa(totalPages))
+	w.Header().Set("X-Pagination-Per-Page", strconv.Itoa(perPage))
+	w.Header().Set("Link", createPaginationLinkHeader(r.URL, page, totalPages))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	format := requestTimeFormat(env, r)
+	array := newJSONArrayWriter(w)
+	for _, credential := range credentials {
+		array.Write(credential.auditJSONValue(format))
+	}
+	err = array.Close()
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 // --- 数据库操作函数 ---
 
 // getUserTOTPCredential 根据用户 ID 从数据库中检索用户的 TOTP 凭据。
+// 如果用户注册了多个凭据，返回最早注册的一个。需要所有凭据时使用 getUserTOTPCredentials。
 //
 // 参数:
 //   db (*sql.DB): 数据库连接池。
 //   ctx (context.Context): 请求上下文。
 //   userId (string): 要检索凭据的用户 ID。
+//   encryptionKeys ([]TOTPKeyEncryptionKey): 解密密钥用的 env.totpKeyEncryptionKeys (见 totp-key-encryption.go)。
 //
 // 返回值:
-//   UserTOTPCredential: 找到的用户 TOTP 凭据对象。
-//   error: 如果查询时发生错误或未找到记录 (ErrRecordNotFound)，则返回错误。
-func getUserTOTPCredential(db *sql.DB, ctx context.Context, userId string) (UserTOTPCredential, error) {
+//   UserTOTPCredential: 找到的用户 TOTP 凭据对象，Key 为解密后的密钥。
+//   error: 如果查询时发生错误、未找到记录 (ErrRecordNotFound) 或密钥无法解密，则返回错误。
+func getUserTOTPCredential(db *sql.DB, ctx context.Context, userId string, encryptionKeys []TOTPKeyEncryptionKey) (UserTOTPCredential, error) {
 	var credential UserTOTPCredential
 	var createdAt int64
 	// 查询 user_totp_credential 表
-	err := db.QueryRowContext(ctx, "SELECT user_id, created_at, key FROM user_totp_credential WHERE user_id = ?", userId).Scan(&credential.UserId, &createdAt, &credential.Key)
+	err := db.QueryRowContext(ctx, "SELECT id, user_id, created_at, key FROM user_totp_credential WHERE user_id = ? ORDER BY created_at, id LIMIT 1", userId).Scan(&credential.Id, &credential.UserId, &createdAt, &credential.Key)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return UserTOTPCredential{}, ErrRecordNotFound
 		}
 		return UserTOTPCredential{}, err
 	}
+	// 解密存储的密钥 (没有加密的密钥原样返回)
+	credential.Key, err = decryptTOTPKey(encryptionKeys, credential.UserId, credential.Key)
+	if err != nil {
+		return UserTOTPCredential{}, fmt.Errorf("totp credential %s: %w", credential.Id, err)
+	}
 	// 转换时间戳
 	credential.CreatedAt = time.Unix(createdAt, 0)
 	return credential, nil
 }
 
+// getUserTOTPCredentials 根据用户 ID 从数据库中检索用户的所有 TOTP 凭据，按注册时间排序。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   userId (string): 要检索凭据的用户 ID。
+//   encryptionKeys ([]TOTPKeyEncryptionKey): 解密密钥用的 env.totpKeyEncryptionKeys (见 totp-key-encryption.go)。
+//
+// 返回值:
+//   []UserTOTPCredential: 用户的所有 TOTP 凭据 (用户没有注册时为空)，Key 为解密后的密钥。
+//   error: 如果查询或扫描数据时发生错误，或者任何一个密钥无法解密，则返回错误。
+func getUserTOTPCredentials(db *sql.DB, ctx context.Context, userId string, encryptionKeys []TOTPKeyEncryptionKey) ([]UserTOTPCredential, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, created_at, key FROM user_totp_credential WHERE user_id = ? ORDER BY created_at, id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []UserTOTPCredential
+	for rows.Next() {
+		var credential UserTOTPCredential
+		var createdAt int64
+		err = rows.Scan(&credential.Id, &credential.UserId, &createdAt, &credential.Key)
+		if err != nil {
+			return nil, err
+		}
+		credential.Key, err = decryptTOTPKey(encryptionKeys, credential.UserId, credential.Key)
+		if err != nil {
+			return nil, fmt.Errorf("totp credential %s: %w", credential.Id, err)
+		}
+		credential.CreatedAt = time.Unix(createdAt, 0)
+		credentials = append(credentials, credential)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// getTOTPCredentialCount 返回所有用户注册的 TOTP 凭据总数。
+func getTOTPCredentialCount(db *sql.DB, ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM user_totp_credential").Scan(&count)
+	return count, err
+}
+
+// getTOTPCredentialsPage 返回所有用户的 TOTP 凭据中的一页。
+// 返回的凭据不包含密钥 (Key 为 nil)，所以只能用于列出元数据。
+//
+// 参数:
+//   db (*sql.DB): 数据库连接池。
+//   ctx (context.Context): 请求上下文。
+//   sortBy (string): 排序字段，必须是 "created_at" 或 "id" (会直接拼接到 SQL 中，不能来自用户输入)。
+//   sortOrder (string): "ASC" 或 "DESC" (同上)。
+//   perPage (int): 每页的条目数。
+//   page (int): 页码 (从 1 开始)。
+//
+// 返回值:
+//   []UserTOTPCredential: 当前页的凭据 (超出范围时为空)。
+//   error: 如果查询或扫描数据时发生错误，则返回错误。
+func getTOTPCredentialsPage(db *sql.DB, ctx context.Context, sortBy string, sortOrder string, perPage int, page int) ([]UserTOTPCredential, error) {
+	// id 作为第二排序字段，保证 created_at 相同的凭据在各页之间的顺序是稳定的
+	query := fmt.Sprintf("SELECT id, user_id, created_at FROM user_totp_credential ORDER BY %s %s, id %s LIMIT ? OFFSET ?", sortBy, sortOrder, sortOrder)
+	rows, err := db.QueryContext(ctx, query, perPage, perPage*(page-1))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []UserTOTPCredential
+	for rows.Next() {
+		var credential UserTOTPCredential
+		var createdAt int64
+		err = rows.Scan(&credential.Id, &credential.UserId, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		credential.CreatedAt = time.Unix(createdAt, 0)
+		credentials = append(credentials, credential)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
 // registerUserTOTPCredential 在数据库中为用户注册（插入）一个新的 TOTP 凭据。
-// 如果用户已存在 TOTP 凭据，此操作可能会失败（取决于数据库约束，通常 user_id 是主键或唯一键）。
+// 用户可以注册多个凭据，每个凭据有自己的 ID。
 //
 // 参数:
 //   db (*sql.DB): 数据库连接池。
 //   ctx (context.Context): 请求上下文。
+//   generateId (func() (string, error)): 凭据 ID 生成器，通常是 env.generateId。
 //   userId (string): 要注册凭据的用户 ID。
 //   key ([]byte): TOTP 密钥（原始字节）。
+//   encryptionKeys ([]TOTPKeyEncryptionKey): env.totpKeyEncryptionKeys。不为空时用第一个加密后存储，为空时存储原始字节。
 //
 // 返回值:
-//   UserTOTPCredential: 创建成功的凭据对象。
-//   error: 如果插入数据库时发生错误（如违反唯一约束），则返回错误。
-func registerUserTOTPCredential(db *sql.DB, ctx context.Context, userId string, key []byte) (UserTOTPCredential, error) {
-	now := time.Now()
+//   UserTOTPCredential: 创建成功的凭据对象 (Key 为原始密钥)。
+//   error: 如果加密、生成 ID 或插入数据库时发生错误，则返回错误。
+func registerUserTOTPCredential(db *sql.DB, ctx context.Context, generateId func() (string, error), userId string, key []byte, encryptionKeys []TOTPKeyEncryptionKey) (UserTOTPCredential, error) {
+	// 截断到整秒，和数据库中存储的 Unix 时间戳一致
+	now := time.Unix(time.Now().Unix(), 0)
 	credential := UserTOTPCredential{
 		UserId:    userId,
 		CreatedAt: now,
-		Key:       key, // 直接存储原始密钥字节
+		Key:       key,
 	}
-	// 插入数据库
-	_, err := db.ExecContext(ctx, "INSERT INTO user_totp_credential (user_id, created_at, key) VALUES (?, ?, ?)", credential.UserId, credential.CreatedAt.Unix(), credential.Key)
+	storedKey, err := encryptTOTPKey(encryptionKeys, userId, key)
 	if err != nil {
-		return UserTOTPCredential{}, err
+		return UserTOTPCredential{}, fmt.Errorf("failed to encrypt totp key: %w", err)
+	}
+	// 生成凭据 ID 并插入数据库，ID 冲突时会重新生成 (见 db.go 中的 insertWithGeneratedId)
+	credentialId, err := insertWithGeneratedId(generateId, func(id string) error {
+		_, err := db.ExecContext(ctx, "INSERT INTO user_totp_credential (id, user_id, created_at, key) VALUES (?, ?, ?, ?)", id, credential.UserId, credential.CreatedAt.Unix(), storedKey)
+		return err
+	})
+	if err != nil {
+		return UserTOTPCredential{}, fmt.Errorf("failed to insert totp credential: %w", err)
 	}
+	credential.Id = credentialId
 	return credential, nil
 }
 
-// deleteUserTOTPCredential 根据用户 ID 从数据库中删除用户的 TOTP 凭据。
+// deleteUserTOTPCredential 根据用户 ID 从数据库中删除用户的所有 TOTP 凭据。
 //
 // 参数:
 //   db (*sql.DB): 数据库连接池。
@@ -391,21 +701,22 @@ func deleteUserTOTPCredential(db *sql.DB, ctx context.Context, userId string) er
 
 // UserTOTPCredential 定义了存储在数据库中的用户 TOTP 凭据结构。
 type UserTOTPCredential struct {
+	Id        string    `json:"id"`         // 凭据 ID
 	UserId    string    `json:"user_id"`    // 关联的用户 ID
 	CreatedAt time.Time `json:"created_at"` // 凭据创建时间
 	Key       []byte    `json:"-"`         // TOTP 密钥 (原始字节), JSON 序列化时忽略此字段 (`json:"-"`) 以防泄露
 }
 
-// EncodeToJSON 将 UserTOTPCredential 对象序列化为 JSON 字符串。
+// EncodeToJSON 将 UserTOTPCredential 对象序列化为 JSON 字符串，时间戳使用 format 格式。
 // 注意：它显式地忽略了 Key 字段，确保密钥不会包含在 API 响应中。
-func (c *UserTOTPCredential) EncodeToJSON() string {
+func (c *UserTOTPCredential) EncodeToJSON(format timeFormat) string {
 	// 创建一个临时结构体，只包含需要暴露的字段
 	data := struct {
-		UserId    string `json:"user_id"`
-		CreatedAt int64  `json:"created_at"` // 返回 Unix 时间戳
+		UserId    string   `json:"user_id"`
+		CreatedAt UnixTime `json:"created_at"`
 	}{
 		UserId:    c.UserId,
-		CreatedAt: c.CreatedAt.Unix(),
+		CreatedAt: newUnixTime(c.CreatedAt, format),
 	}
 	// 编码为 JSON
 	encoded, err := json.Marshal(data)
@@ -415,3 +726,29 @@ func (c *UserTOTPCredential) EncodeToJSON() string {
 	}
 	return string(encoded)
 }
+
+// userTOTPCredentialAuditJSON 是 GET /totp-credentials 返回的凭据的 JSON 表示。
+type userTOTPCredentialAuditJSON struct {
+	Id        string   `json:"id"`
+	UserId    string   `json:"user_id"`
+	CreatedAt UnixTime `json:"created_at"`
+}
+
+// auditJSONValue 返回用于编码的 GET /totp-credentials 的 JSON 表示，不包含密钥。
+func (c *UserTOTPCredential) auditJSONValue(format timeFormat) userTOTPCredentialAuditJSON {
+	return userTOTPCredentialAuditJSON{
+		Id:        c.Id,
+		UserId:    c.UserId,
+		CreatedAt: newUnixTime(c.CreatedAt, format),
+	}
+}
+
+// EncodeToAuditJSON 将凭据编码为 GET /totp-credentials 返回的 JSON，
+// 包含凭据 ID、用户 ID 和创建时间。和 EncodeToJSON 一样不包含密钥。
+func (c *UserTOTPCredential) EncodeToAuditJSON(format timeFormat) string {
+	encoded, err := json.Marshal(c.auditJSONValue(format))
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
-	"database/sql"    // 导入数据库 SQL 包
-	"encoding/base64" // 导入 Base64 编码包，用于处理二进制密钥
-	"encoding/json"   // 导入 JSON 编码/解码包
-	"testing"         // 导入 Go 的测试包
-	"time"            // 导入时间包
+	"context"           // 导入上下文包
+	"database/sql"      // 导入数据库 SQL 包
+	"encoding/base32"   // 导入 Base32 编码包，用于测试 Base32 编码的密钥
+	"encoding/base64"   // 导入 Base64 编码包，用于处理二进制密钥
+	"encoding/json"     // 导入 JSON 编码/解码包
+	"net/http"          // 导入 HTTP 包
+	"net/http/httptest" // 导入 HTTP 测试包
+	"strings"           // 导入字符串包
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
 
 	"github.com/stretchr/testify/assert" // 导入 testify 断言库
 )
@@ -18,9 +23,9 @@ import (
 // 返回值：
 //   error: 如果数据库操作出错，则返回错误信息，否则返回 nil。
 func insertUserTOTPCredential(db *sql.DB, credential *UserTOTPCredential) error {
-	// 执行 SQL INSERT 语句，将用户 ID、创建时间 (Unix 时间戳) 和 TOTP 密钥插入到 user_totp_credential 表中。
+	// 执行 SQL INSERT 语句，将凭据 ID、用户 ID、创建时间 (Unix 时间戳) 和 TOTP 密钥插入到 user_totp_credential 表中。
 	// Key 是 []byte 类型，直接存储在数据库中（具体存储方式取决于数据库和驱动）。
-	_, err := db.Exec("INSERT INTO user_totp_credential (user_id, created_at, key) VALUES (?, ?, ?)", credential.UserId, credential.CreatedAt.Unix(), credential.Key)
+	_, err := db.Exec("INSERT INTO user_totp_credential (id, user_id, created_at, key) VALUES (?, ?, ?, ?)", credential.Id, credential.UserId, credential.CreatedAt.Unix(), credential.Key)
 	return err // 返回执行结果的错误信息 (如果存在)
 }
 
@@ -32,7 +37,7 @@ func insertUserTOTPCredential(db *sql.DB, credential *UserTOTPCredential) error
 // 测试步骤：
 // 1. 创建一个 UserTOTPCredential 实例，包含用户 ID、创建时间和二进制密钥。
 // 2. 定义预期的 JSON 输出结构 (UserTOTPCredentialJSON)，其中密钥字段 (EncodedKey) 应为原始密钥的 Base64 编码字符串。
-// 3. 调用 credential.EncodeToJSON() 获取 JSON 字符串。
+// 3. 调用 credential.EncodeToJSON(timeFormatUnix) 获取 JSON 字符串。
 // 4. 将返回的 JSON 字符串解码回 UserTOTPCredentialJSON 结构体。
 // 5. 使用 assert.Equal 断言解码后的结构体与预期的结构体完全相等。
 func TestUserTOTPCredentialEncodeToJSON(t *testing.T) {
@@ -58,7 +63,7 @@ func TestUserTOTPCredentialEncodeToJSON(t *testing.T) {
 	var result UserTOTPCredentialJSON // 用于存储 JSON 解码后的结果
 
 	// 调用被测试对象的 EncodeToJSON 方法，获取 JSON 字符串
-	jsonString := credential.EncodeToJSON()
+	jsonString := credential.EncodeToJSON(timeFormatUnix)
 	// 将 JSON 字符串解码到 result 结构体中
 	err := json.Unmarshal([]byte(jsonString), &result)
 	assert.NoError(t, err) // 断言解码过程中没有错误发生
@@ -67,6 +72,106 @@ func TestUserTOTPCredentialEncodeToJSON(t *testing.T) {
 	assert.Equal(t, expected, result)
 }
 
+// TestEnvironmentTOTPMaxClockSkew 测试 totpMaxClockSkew 在未配置、配置为正数和负数时的返回值。
+func TestEnvironmentTOTPMaxClockSkew(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, defaultTOTPMaxClockSkew, env.totpMaxClockSkew())
+
+	env.totpClockSkew = 30 * time.Second
+	assert.Equal(t, 30*time.Second, env.totpMaxClockSkew())
+
+	env.totpClockSkew = -1
+	assert.Equal(t, time.Duration(0), env.totpMaxClockSkew())
+}
+
+// TestEnvironmentTOTPMaxFutureClockSkew 测试设置 totpRejectFutureCodes 后不接受未来的验证码，
+// 没有设置时与 totpMaxClockSkew 相同。
+func TestEnvironmentTOTPMaxFutureClockSkew(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	env.totpClockSkew = 30 * time.Second
+	assert.Equal(t, 30*time.Second, env.totpMaxFutureClockSkew())
+
+	env.totpRejectFutureCodes = true
+	assert.Equal(t, time.Duration(0), env.totpMaxFutureClockSkew())
+	assert.Equal(t, 30*time.Second, env.totpMaxClockSkew())
+}
+
+// TestDecodeTOTPKey 测试 decodeTOTPKey 同时接受 Base64 和 Base32 编码的密钥，
+// 并且无论哪种编码都会检查解码后的长度，拒绝格式错误的密钥。
+func TestDecodeTOTPKey(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("12345678901234567890") // 20 字节
+
+	// Base64
+	decoded, ok := decodeTOTPKey(base64.StdEncoding.EncodeToString(key))
+	assert.True(t, ok)
+	assert.Equal(t, key, decoded)
+
+	// Base32 (大写、小写、带空格分组、带填充都可以)
+	encoded := base32.StdEncoding.EncodeToString(key) // GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ
+	for _, input := range []string{
+		encoded,
+		strings.ToLower(encoded),
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		encoded + "====",
+	} {
+		decoded, ok = decodeTOTPKey(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, key, decoded, input)
+	}
+
+	for _, input := range []string{
+		// 格式错误的 Base64：非法字符、缺少填充、长度不对
+		"j1dCsnrWOnKAfyMxShUPZ9AUwe$=",
+		"j1dCsnrWOnKAfyMxShUPZ9AUwes",
+		base64.StdEncoding.EncodeToString(key[:16]),
+		// 格式错误的 Base32：非法字符 (0、1、8、9 不在字母表中)、长度不对
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJ1",
+		base32.StdEncoding.EncodeToString(key[:16]),
+		"",
+	} {
+		_, ok = decodeTOTPKey(input)
+		assert.False(t, ok, input)
+	}
+}
+
+// TestRegisterUserTOTPCredentialIdGenerator 测试 registerUserTOTPCredential 使用注入的 ID 生成器，
+// 创建的凭据的 ID 就是生成器按顺序返回的 ID。
+func TestRegisterUserTOTPCredentialIdGenerator(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	env.IDGenerator = newSequenceIdGenerator("credential_")
+
+	credential1, err := registerUserTOTPCredential(db, context.Background(), env.generateId, "1", []byte{0x01}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "credential_1", credential1.Id)
+	credential2, err := registerUserTOTPCredential(db, context.Background(), env.generateId, "1", []byte{0x02}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "credential_2", credential2.Id)
+
+	// 数据库中保存的也是这两个 ID
+	credentials, err := getUserTOTPCredentials(db, context.Background(), "1", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, credentials, 2) {
+		assert.Equal(t, "credential_1", credentials[0].Id)
+		assert.Equal(t, "credential_2", credentials[1].Id)
+	}
+}
+
 // UserTOTPCredentialJSON 是用于在测试中表示 UserTOTPCredential 编码为 JSON 后的预期结构。
 // 它定义了 JSON 输出应包含的字段及其类型。
 // 特别注意，原始的 []byte 类型的 Key 在这里表示为 Base64 编码的字符串 EncodedKey。
@@ -75,3 +180,75 @@ type UserTOTPCredentialJSON struct {
 	CreatedAtUnix int64  `json:"created_at"` // 创建时间的 Unix 时间戳，对应 JSON 中的 "created_at" 键
 	EncodedKey    string `json:"key"`        // Base64 编码后的密钥字符串，对应 JSON 中的 "key" 键
 }
+
+// TestPendingTOTPKeyStore 测试等待确认的 TOTP 密钥会被替换、删除，并且过期后不能再使用。
+func TestPendingTOTPKeyStore(t *testing.T) {
+	t.Parallel()
+
+	var store pendingTOTPKeyStore
+	_, ok := store.Get("1")
+	assert.False(t, ok)
+
+	store.Set("1", []byte("key1"), time.Now().Add(time.Minute))
+	store.Set("1", []byte("key2"), time.Now().Add(time.Minute))
+	key, ok := store.Get("1")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("key2"), key)
+
+	store.Delete("1")
+	_, ok = store.Get("1")
+	assert.False(t, ok)
+
+	store.Set("2", []byte("key"), time.Now().Add(-time.Second))
+	_, ok = store.Get("2")
+	assert.False(t, ok)
+	// 保存新的密钥时删除已过期的密钥
+	store.Set("3", []byte("key"), time.Now().Add(time.Minute))
+	assert.NotContains(t, store.keys, "2")
+}
+
+// TestCreateTOTPKeyURI 测试 createTOTPKeyURI 生成的 otpauth:// URI。
+func TestCreateTOTPKeyURI(t *testing.T) {
+	t.Parallel()
+
+	uri := createTOTPKeyURI("Faroe", "user 1", "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, "otpauth://totp/Faroe:user%201?algorithm=SHA1&digits=6&issuer=Faroe&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
+
+// TestVerifyTOTPSecondFactorNotRegistered 测试没有注册 TOTP 的用户请求 verify-2fa/totp 时返回
+// SECOND_FACTOR_NOT_REGISTERED，设置 legacySecondFactorNotRegisteredError 后返回 NOT_ALLOWED。
+func TestVerifyTOTPSecondFactorNotRegistered(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO user (id, created_at, password_hash, recovery_code) VALUES (?, ?, ?, ?)", "1", time.Now().Unix(), "hash", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	app := CreateApp(env)
+	verifyTOTP := func() *http.Response {
+		r := httptest.NewRequest("POST", "/users/1/verify-2fa/totp", strings.NewReader(`{"code":"123456"}`))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := verifyTOTP()
+	assertErrorResponse(t, res, 400, ExpectedErrorSecondFactorNotRegistered)
+
+	env.legacySecondFactorNotRegisteredError = true
+	res = verifyTOTP()
+	assertErrorResponse(t, res, 400, ExpectedErrorNotAllowed)
+
+	// 注册 TOTP 后不再返回这个错误
+	err = insertUserTOTPCredential(db, &UserTOTPCredential{Id: "1", UserId: "1", CreatedAt: time.Now(), Key: make([]byte, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = verifyTOTP()
+	assertErrorResponse(t, res, 400, ExpectedErrorIncorrectCode)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Hot paths such as POST /users/:user_id/verify-password read the same user row on every
+// request. env.userCache optionally keeps recently read users in memory for a short time.
+// It is nil (disabled) by default.
+//
+// Every handler that changes a user (password, email verification, TOTP, deletion) calls
+// env.invalidateCachedUser after the change, so a cached password hash is never used after
+// the password was changed through this server. The cache is local to the process: with
+// several instances sharing a database, a change made through one instance is only seen by
+// the others once their entries expire, so keep the TTL short or leave the cache disabled.
+
+// defaultUserCacheMaxEntries is the maximum number of cached users when none is configured.
+const defaultUserCacheMaxEntries = 1000
+
+// userCache is a bounded in-memory cache of users keyed by user ID, with a fixed TTL.
+type userCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]userCacheEntry
+	// version is incremented on every invalidation. A read that started before an
+	// invalidation may have read the old row, so its result is not stored (see set).
+	version uint64
+}
+
+type userCacheEntry struct {
+	user      User
+	expiresAt time.Time
+}
+
+// newUserCache creates a cache that keeps users for ttl and holds at most maxEntries users
+// (defaultUserCacheMaxEntries if maxEntries is not positive).
+func newUserCache(ttl time.Duration, maxEntries int) *userCache {
+	if maxEntries < 1 {
+		maxEntries = defaultUserCacheMaxEntries
+	}
+	return &userCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]userCacheEntry),
+	}
+}
+
+// get returns the cached user if it exists and hasn't expired at now.
+func (c *userCache) get(userId string, now time.Time) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userId]
+	if !ok {
+		return User{}, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, userId)
+		return User{}, false
+	}
+	return entry.user, true
+}
+
+// currentVersion returns the version to pass to set for a read that starts now.
+func (c *userCache) currentVersion() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// set stores a user read from the database. version is the value of currentVersion from
+// before the read; if any user was invalidated since, the user is not stored, since the
+// read may have returned the row from before the change.
+// When the cache is full, expired entries are removed first, then an arbitrary entry.
+func (c *userCache) set(user User, version uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		return
+	}
+	if _, ok := c.entries[user.Id]; !ok && len(c.entries) >= c.maxEntries {
+		for userId, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, userId)
+			}
+		}
+		for userId := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, userId)
+		}
+	}
+	c.entries[user.Id] = userCacheEntry{user: user, expiresAt: now.Add(c.ttl)}
+}
+
+// invalidate removes the user from the cache.
+func (c *userCache) invalidate(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	delete(c.entries, userId)
+}
+
+// getCachedUser returns the user with the ID, from env.userCache if it's enabled and the
+// user was read recently, or from the database otherwise (see getUser).
+func (env *Environment) getCachedUser(ctx context.Context, userId string) (User, error) {
+	if env.userCache == nil {
+		return getUser(env.db, ctx, userId)
+	}
+	if user, ok := env.userCache.get(userId, time.Now()); ok {
+		return user, nil
+	}
+	version := env.userCache.currentVersion()
+	user, err := getUser(env.db, ctx, userId)
+	if err != nil {
+		return User{}, err
+	}
+	env.userCache.set(user, version, time.Now())
+	return user, nil
+}
+
+// invalidateCachedUser removes the user from env.userCache. It must be called after any
+// change to the user, whether or not the change succeeded.
+func (env *Environment) invalidateCachedUser(userId string) {
+	if env.userCache != nil {
+		env.userCache.invalidate(userId)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"           // 导入上下文包
+	"encoding/json"     // 导入 JSON 编码/解码包
+	"net/http/httptest" // 导入 HTTP 测试包
+	"testing"           // 导入 Go 的测试包
+	"time"              // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestUserCache 测试缓存的用户在 TTL 之后过期、失效后被删除、失效之前开始的读取结果不会被缓存，
+// 并且缓存的用户个数有上限。
+func TestUserCache(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cache := newUserCache(time.Minute, 2)
+
+	_, ok := cache.get("1", now)
+	assert.False(t, ok)
+	cache.set(User{Id: "1", PasswordHash: "HASH1"}, cache.currentVersion(), now)
+	user, ok := cache.get("1", now.Add(59*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "HASH1", user.PasswordHash)
+
+	// TTL 之后过期
+	_, ok = cache.get("1", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// 失效
+	cache.set(User{Id: "1", PasswordHash: "HASH1"}, cache.currentVersion(), now)
+	cache.invalidate("1")
+	_, ok = cache.get("1", now)
+	assert.False(t, ok)
+
+	// 失效之前开始的读取可能读到了旧的数据，不会被缓存
+	version := cache.currentVersion()
+	cache.invalidate("1")
+	cache.set(User{Id: "1", PasswordHash: "OLD_HASH"}, version, now)
+	_, ok = cache.get("1", now)
+	assert.False(t, ok)
+
+	// 最多缓存 maxEntries 个用户，优先删除已过期的用户
+	cache.set(User{Id: "1"}, cache.currentVersion(), now.Add(-time.Hour))
+	cache.set(User{Id: "2"}, cache.currentVersion(), now)
+	cache.set(User{Id: "3"}, cache.currentVersion(), now)
+	assert.Len(t, cache.entries, 2)
+	_, ok = cache.get("2", now)
+	assert.True(t, ok)
+	_, ok = cache.get("3", now)
+	assert.True(t, ok)
+	cache.set(User{Id: "4"}, cache.currentVersion(), now)
+	assert.Len(t, cache.entries, 2)
+	_, ok = cache.get("4", now)
+	assert.True(t, ok)
+}
+
+// TestGetCachedUser 测试 getCachedUser 在失效之前返回缓存的用户，并且修改用户的处理函数会使缓存失效。
+func TestGetCachedUser(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	user := User{
+		Id:           "1",
+		CreatedAt:    time.Unix(time.Now().Unix(), 0),
+		PasswordHash: "HASH1",
+		RecoveryCode: "12345678",
+	}
+	err := insertUser(db, context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := createEnvironment(db, nil)
+	env.userCache = newUserCache(time.Minute, 10)
+	app := CreateApp(env)
+
+	cached, err := env.getCachedUser(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "HASH1", cached.PasswordHash)
+
+	// 没有使缓存失效的修改在失效之前不可见
+	_, err = db.Exec("UPDATE user SET password_hash = 'HASH2' WHERE id = '1'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err = env.getCachedUser(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "HASH1", cached.PasswordHash)
+	env.invalidateCachedUser("1")
+	cached, err = env.getCachedUser(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "HASH2", cached.PasswordHash)
+
+	getTOTPRegistered := func() bool {
+		r := httptest.NewRequest("GET", "/users/1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code)
+		var result struct {
+			TOTPRegistered bool `json:"totp_registered"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.TOTPRegistered
+	}
+
+	// 通过 API 删除 TOTP 凭据后缓存失效
+	err = insertUserTOTPCredential(db, &UserTOTPCredential{Id: "1", UserId: "1", CreatedAt: time.Now(), Key: make([]byte, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.invalidateCachedUser("1")
+	assert.True(t, getTOTPRegistered())
+	r := httptest.NewRequest("DELETE", "/users/1/totp-credential", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assert.Equal(t, 204, w.Code)
+	assert.False(t, getTOTPRegistered())
+
+	// 通过 API 删除用户后缓存失效
+	r = httptest.NewRequest("DELETE", "/users/1", nil)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assert.Equal(t, 204, w.Code)
+	_, err = env.getCachedUser(context.Background(), "1")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"faroe/argon2id"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxBulkImportUsers is the maximum number of users in a single POST /user-imports request.
+// Larger migrations are split across multiple requests.
+const maxBulkImportUsers = 1000
+
+// bulkImportBatchSize is the number of users inserted per database transaction.
+const bulkImportBatchSize = 100
+
+// Per-row errors of POST /user-imports. A row can also fail with EMAIL_ALREADY_USED.
+const (
+	ExpectedErrorInvalidPasswordHash = "INVALID_PASSWORD_HASH"
+	ExpectedErrorUserAlreadyExists   = "USER_ALREADY_EXISTS"
+	// A row that wasn't imported because its batch failed gets the code of an unexpected error response.
+	importErrorUnknown = "UNKNOWN_ERROR"
+)
+
+// ErrUserAlreadyExists is returned by importUsers for a row whose ID is already used.
+var ErrUserAlreadyExists = errors.New("user already exists")
+
+// handleBulkImportUsersRequest handles POST /user-imports.
+// It creates users from existing Argon2id password hashes, for migrating users from
+// another system without re-hashing their passwords. It isn't registered under /users,
+// since httprouter doesn't allow a static segment next to /users/:user_id.
+//
+// The request body is a JSON array of:
+//
+//	{"id": string (optional), "email": string (optional), "password_hash": string, "created_at": number (optional)}
+//
+// Each hash must be in the format created by argon2id.Hash. Email addresses are stored
+// as entered and must be unique ignoring case, like in POST /users, but the email domain
+// allow-list and disposable blocklist aren't applied to existing users. Rows are validated
+// and inserted independently, so an invalid or duplicate row doesn't prevent the others
+// from being imported. The response is a JSON array with one result per row, in the
+// same order: {"user": <user model>} on success or {"error": string} on failure.
+// If a batch fails unexpectedly, the rows of earlier batches stay imported and the rows
+// that weren't imported get UNKNOWN_ERROR, so they can be sent again.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Content-Type and Accept Header Verification (JSON).
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleBulkImportUsersRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONContentTypeHeader(r) {
+		writeUnsupportedMediaTypeErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	var data []struct {
+		Id           *string `json:"id"`
+		Email        *string `json:"email"`
+		PasswordHash *string `json:"password_hash"`
+		CreatedAt    *int64  `json:"created_at"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return
+	}
+	if len(data) == 0 || len(data) > maxBulkImportUsers {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+
+	// Validate every row before inserting anything. Rows that fail validation get
+	// an error result and are skipped.
+	now := time.Unix(time.Now().Unix(), 0)
+	results := make([]bulkImportResult, len(data))
+	var users []importedUser
+	var userIndexes []int
+	for i, item := range data {
+		if item.Id != nil && (*item.Id == "" || len(*item.Id) > 255) {
+			results[i].Error = ExpectedErrorInvalidData
+			continue
+		}
+		if item.Email != nil && !verifyEmailAddressInputWithLimits(*item.Email, env.emailAddressLimits) {
+			results[i].Error = ExpectedErrorInvalidData
+			continue
+		}
+		if item.PasswordHash == nil || argon2id.CheckHash(*item.PasswordHash) != nil {
+			results[i].Error = ExpectedErrorInvalidPasswordHash
+			continue
+		}
+		recoveryCode, err := generateSecureCode()
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		user := importedUser{User: User{
+			CreatedAt:      now,
+			PasswordHash:   *item.PasswordHash,
+			RecoveryCode:   recoveryCode,
+			TOTPRegistered: false,
+		}}
+		if item.Email != nil {
+			user.Email = *item.Email
+		}
+		if item.Id != nil {
+			user.Id = *item.Id
+		}
+		if item.CreatedAt != nil {
+			user.CreatedAt = time.Unix(*item.CreatedAt, 0)
+		}
+		users = append(users, user)
+		userIndexes = append(userIndexes, i)
+	}
+
+	// On an unexpected error, the results of the batches committed before it are still returned.
+	importErrors, err := importUsers(env.db, r.Context(), env.generateId, users)
+	if err != nil {
+		log.Println(err)
+	}
+	for j, importErr := range importErrors {
+		i := userIndexes[j]
+		switch {
+		case importErr == nil:
+			results[i].User = &users[j].User
+		case errors.Is(importErr, ErrUserAlreadyExists):
+			results[i].Error = ExpectedErrorUserAlreadyExists
+		case errors.Is(importErr, ErrEmailAlreadyUsed):
+			results[i].Error = ExpectedErrorEmailAlreadyUsed
+		default:
+			results[i].Error = importErrorUnknown
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeBulkImportResultsToJSON(results, requestTimeFormat(env, r))))
+}
+
+// bulkImportResult is the result of importing a single row.
+// Exactly one of User and Error is set.
+type bulkImportResult struct {
+	User  *User
+	Error string
+}
+
+// encodeBulkImportResultsToJSON encodes the response body of POST /user-imports,
+// with timestamps in the given format.
+func encodeBulkImportResultsToJSON(results []bulkImportResult, format timeFormat) string {
+	type resultJSON struct {
+		User  *userJSON `json:"user,omitempty"`
+		Error string    `json:"error,omitempty"`
+	}
+	data := make([]resultJSON, len(results))
+	for i, result := range results {
+		if result.User != nil {
+			user := newUserJSON(*result.User, format)
+			data[i].User = &user
+		} else {
+			data[i].Error = result.Error
+		}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// importedUser is a user created by POST /user-imports, along with its email address.
+type importedUser struct {
+	User
+	Email string // Stored as NULL if empty.
+}
+
+// importUsers inserts users in transactions of bulkImportBatchSize rows.
+// Users with an empty Id get a generated one, which is written back to the slice.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   generateId (func() (string, error)): ID generator for users without an ID.
+//   users ([]importedUser): The users to insert.
+//
+// Returns:
+//   []error: One entry per user: nil if it was inserted, ErrUserAlreadyExists if its ID is already used,
+//            ErrEmailAlreadyUsed if another user has its email address (ignoring case), or the unexpected
+//            error if it wasn't inserted because its batch failed or came after the failed batch.
+//   error: An unexpected database error. Batches committed before it stay imported.
+func importUsers(db *sql.DB, ctx context.Context, generateId func() (string, error), users []importedUser) ([]error, error) {
+	importErrors := make([]error, len(users))
+	for start := 0; start < len(users); start += bulkImportBatchSize {
+		end := min(start+bulkImportBatchSize, len(users))
+		err := importUsersBatch(db, ctx, generateId, users[start:end], importErrors[start:end])
+		if err != nil {
+			for i := start; i < len(users); i++ {
+				importErrors[i] = err
+			}
+			return importErrors, err
+		}
+	}
+	return importErrors, nil
+}
+
+// importUsersBatch inserts users in a single transaction, recording per-user errors in importErrors.
+// A duplicate ID or email address only fails its own INSERT statement, so the rest of the batch
+// is still committed.
+func importUsersBatch(db *sql.DB, ctx context.Context, generateId func() (string, error), users []importedUser, importErrors []error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range users {
+		user := &users[i]
+		var email any // Stored as NULL without an email address.
+		if user.Email != "" {
+			email = user.Email
+		}
+		insert := func(id string) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO user (id, created_at, password_hash, recovery_code, email) VALUES (?, ?, ?, ?, ?)", id, user.CreatedAt.Unix(), user.PasswordHash, user.RecoveryCode, email)
+			return err
+		}
+		id := user.Id
+		if id == "" {
+			id, err = insertWithGeneratedId(generateId, insert)
+		} else {
+			err = insert(id)
+		}
+		if isPrimaryKeyConstraintError(err) {
+			importErrors[i] = ErrUserAlreadyExists
+			continue
+		}
+		if isUniqueConstraintError(err) {
+			importErrors[i] = ErrEmailAlreadyUsed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		user.Id = id
+	}
+	return tx.Commit()
+}
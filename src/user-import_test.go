@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context" // 导入 context 包
+	"errors"  // 导入 errors 包，用于模拟生成 ID 失败
+	"strconv" // 导入 strconv 包，用于生成用户 ID
+	"testing" // 导入 Go 的测试包
+	"time"    // 导入时间包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestImportUsers 测试 importUsers 分多个事务插入用户，重复的 ID 和邮箱只影响对应的行。
+func TestImportUsers(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	existing := User{Id: "user5", CreatedAt: now, PasswordHash: "HASH", RecoveryCode: "12345678"}
+	err := insertUser(db, context.Background(), &existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过一个批次的大小，确保跨多个事务插入
+	var users []importedUser
+	for i := 0; i < bulkImportBatchSize*2+10; i++ {
+		user := User{Id: "user" + strconv.Itoa(i), CreatedAt: now, PasswordHash: "HASH", RecoveryCode: "12345678"}
+		users = append(users, importedUser{User: user, Email: "user" + strconv.Itoa(i) + "@example.com"})
+	}
+	// 第二个批次中有一个邮箱和第一个批次重复 (不区分大小写)
+	users[bulkImportBatchSize+1].Email = "USER1@example.com"
+	importErrors, err := importUsers(db, context.Background(), newSequenceIdGenerator("generated"), users)
+	assert.NoError(t, err)
+	if assert.Len(t, importErrors, len(users)) {
+		for i, importErr := range importErrors {
+			switch i {
+			case 5:
+				assert.ErrorIs(t, importErr, ErrUserAlreadyExists)
+			case bulkImportBatchSize + 1:
+				assert.ErrorIs(t, importErr, ErrEmailAlreadyUsed)
+			default:
+				assert.NoError(t, importErr)
+			}
+		}
+	}
+
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM user").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, len(users)-1, count)
+	email, err := getUserEmail(db, context.Background(), "user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@example.com", email)
+	exists, err := checkUserExists(db, context.Background(), "user"+strconv.Itoa(bulkImportBatchSize+1))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// TestImportUsersBatchFailure 测试后面的批次失败时，前面已经提交的批次保留，
+// 失败的批次和之后的行都返回错误。
+func TestImportUsersBatchFailure(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	var users []importedUser
+	for i := 0; i < bulkImportBatchSize*2; i++ {
+		user := User{Id: "user" + strconv.Itoa(i), CreatedAt: now, PasswordHash: "HASH", RecoveryCode: "12345678"}
+		users = append(users, importedUser{User: user})
+	}
+	// 第二个批次中的用户需要生成 ID，而生成 ID 失败
+	users[bulkImportBatchSize+1].Id = ""
+	generateErr := errors.New("entropy unavailable")
+	importErrors, err := importUsers(db, context.Background(), func() (string, error) {
+		return "", generateErr
+	}, users)
+	assert.ErrorIs(t, err, generateErr)
+	if assert.Len(t, importErrors, len(users)) {
+		for i, importErr := range importErrors {
+			if i < bulkImportBatchSize {
+				assert.NoError(t, importErr)
+			} else {
+				assert.ErrorIs(t, importErr, generateErr)
+			}
+		}
+	}
+
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM user").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, bulkImportBatchSize, count)
+}
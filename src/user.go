@@ -9,16 +9,16 @@ import (
 	"encoding/hex"  // Provides hex encoding and decoding.
 	"encoding/json" // Provides functionality for encoding and decoding JSON data.
 	"errors"        // Provides functions to manipulate errors.
-	"faroe/argon2id" // Custom package likely containing Argon2id password hashing functions.
 	"fmt"           // Provides functions for formatted I/O.
-	"io"            // Provides basic I/O primitives.
 	"log"           // Provides simple logging capabilities.
 	"math"          // Provides basic mathematical constants and functions.
 	"net/http"      // Provides HTTP client and server implementations.
+	"net/url"       // Provides URL parsing, used here for list query parameters.
 	"regexp"        // Provides regular expression searching.
 	"strconv"       // Provides conversions to and from string representations of basic data types.
 	"strings"       // Provides functions for string manipulation.
 	"time"          // Provides functionality for measuring and displaying time.
+	"unicode"       // Provides character classes, used here to reject control characters in email addresses.
 
 	"github.com/julienschmidt/httprouter" // High-performance HTTP request router.
 )
@@ -30,9 +30,27 @@ import (
 // Security Checks:
 // 1. Request Secret Verification.
 // 2. Content-Type and Accept Header Verification (JSON).
-// 3. Password Validation: Checks if the password is provided, not empty, and within length limits (<= 127 chars).
+// 3. Request Body Validation (createUserRequest): Checks if the password is provided, not empty,
+//    and within length limits (<= 127 chars), and that the email address, if provided, is well-formed.
 // 4. Password Strength Check: Verifies the password against common patterns and potentially a database of breached passwords (like Pwned Passwords via Have I Been Pwned API, though the check here seems simpler based on `verifyPasswordStrength` implementation).
 // 5. Rate Limiting: Limits password hashing attempts per IP address.
+// 6. Email Validation: If an email address is provided, checks that it is well-formed and,
+//    if env.disposableEmailDomains is set, that its domain is not on the blocklist.
+//    If env.allowedEmailDomains is set, an email address with an allowed domain is required.
+//    No other user may have the email address, ignoring case (see checkEmailAvailability).
+// 7. Invite: If env.requireInvite is set, requires an unused invite code, which is used up
+//    by the new user (see invite.go).
+// 8. Code Delivery Rate Limiting: If an email address is provided, consumes a code delivery
+//    token for the new user and the client IP (see codeDeliveryRateLimit).
+//
+// If env.afterUserCreate is set, it is called right after the user is inserted
+// (see runAfterUserCreateHook).
+//
+// New users never have a verified email address. If an email address is provided, it is stored
+// on the user and an email verification request is created for it, in the same transaction as
+// the user (see createUser). The response only includes the request's metadata and the masked
+// email address, not its code. To send a code to the user, create a new request with
+// POST /users/:user_id/email-verification-request, which replaces this one.
 //
 // Parameters:
 //   env (*Environment): Application environment.
@@ -54,41 +72,48 @@ func handleCreateUserRequest(env *Environment, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// Read request body.
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+	// Read and validate the request body (see validation.go).
+	data := createUserRequest{emailLimits: env.emailAddressLimits}
+	if !decodeAndValidateJSON(w, r, &data) {
 		return
 	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
 
-	// Define struct for JSON request body.
-	var data struct {
-		Password *string `json:"password"` // User's chosen password.
-		ClientIP string  `json:"client_ip"` // Client's IP for rate limiting.
-	}
-	// Unmarshal JSON data.
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+	// Check the email domain. With an allow-list, an email address is required, since it could
+	// otherwise be left out here and added later.
+	if data.Email == nil && len(env.allowedEmailDomains) > 0 {
+		env.logEvent("user creation rejected: email address required")
+		writeExpectedErrorResponse(w, ExpectedErrorEmailDomainNotAllowed)
 		return
 	}
-
-	// Validate password presence and basic constraints.
-	if data.Password == nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+	if data.Email != nil && !verifyEmailDomainAllowed(env.allowedEmailDomains, *data.Email) {
+		env.logEvent("user creation rejected: email domain not allowed", logEmailField("email", *data.Email))
+		writeExpectedErrorResponse(w, ExpectedErrorEmailDomainNotAllowed)
 		return
 	}
-	if *data.Password == "" || len(*data.Password) > 127 { // Check for empty or overly long password.
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+	if data.Email != nil && !verifyEmailNotDisposable(env.disposableEmailDomains, *data.Email) {
+		env.logEvent("user creation rejected: disposable email", logEmailField("email", *data.Email))
+		writeExpectedErrorResponse(w, ExpectedErrorDisposableEmail)
 		return
 	}
+	if data.Email != nil {
+		emailAvailable, err := checkEmailAvailability(env.db, r.Context(), *data.Email)
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		if !emailAvailable {
+			writeExpectedErrorResponse(w, ExpectedErrorEmailAlreadyUsed)
+			return
+		}
+	}
 
 	// Verify password strength.
-	strongPassword, err := verifyPasswordStrength(*data.Password)
+	strongPassword, err := env.verifyPasswordStrength(r.Context(), *data.Password)
 	if err != nil {
 		log.Println(err) // Log errors during strength check.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !strongPassword {
@@ -101,27 +126,431 @@ func handleCreateUserRequest(env *Environment, w http.ResponseWriter, r *http.Re
 		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
 		return
 	}
+	setRateLimitHeaders(env, w, &env.passwordHashingIPRateLimit, data.ClientIP)
 
-	// Hash the password using Argon2id.
-	passwordHash, err := argon2id.Hash(*data.Password)
+	// In invite mode, claim the invite before hashing (see invite.go). Guesses are
+	// rate limited by the token consumed above. The invite is released again if the
+	// user isn't created.
+	createdUserId := "" // Set once the user is created and kept.
+	inviteId := ""
+	if env.requireInvite {
+		if data.InviteCode == nil {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidInvite)
+			return
+		}
+		inviteId, err = claimInvite(env.db, r.Context(), *data.InviteCode)
+		if errors.Is(err, ErrRecordNotFound) {
+			writeExpectedErrorResponse(w, ExpectedErrorInvalidInvite)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		defer func() {
+			if createdUserId != "" {
+				return
+			}
+			// Release the invite even if the request was cancelled in the meantime.
+			err := releaseInvite(env.db, context.WithoutCancel(r.Context()), inviteId)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// Hash the password using Argon2id (with the configured pepper, if any).
+	// Limit how many hashes run at once, since each one allocates a lot of memory.
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	passwordHash, err := env.hashPassword(*data.Password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		log.Println(err) // Log errors during hashing.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
-	// Create the user record in the database.
-	user, err := createUser(env.db, r.Context(), passwordHash)
+	// If an email address was provided, start verifying it right away. The code is hashed
+	// before the transaction that creates the user, so the transaction stays short.
+	options := createUserOptions{inviteId: inviteId}
+	codeDeliveryUserId := "" // Set once a code delivery token is consumed, to refund it on failure.
+	if data.Email != nil {
+		options.email = *data.Email
+		options.emailVerificationCode, options.emailVerificationCodeHash, err = generateEmailVerificationCode(r.Context(), env.emailVerificationCodeFormat)
+		if err != nil {
+			log.Println(err)
+			writeUnexpectedErrorResponseWithDetail(env, w, err)
+			return
+		}
+		options.consumeCodeDelivery = func(userId string) bool {
+			if !env.codeDeliveryRateLimit.consume(codeDeliveryFlowEmailVerification, userId, data.ClientIP) {
+				return false
+			}
+			codeDeliveryUserId = userId
+			return true
+		}
+	}
+
+	// Create the user, assign the invite, and create the email verification request in one transaction.
+	user, verificationRequest, err := createUser(env.db, r.Context(), env.generateId, passwordHash, options)
+	if errors.Is(err, ErrCodeDeliveryRateLimited) {
+		writeExpectedErrorResponse(w, ExpectedErrorTooManyRequests)
+		return
+	}
+	if errors.Is(err, ErrEmailAlreadyUsed) {
+		// Another user was created with the email address since it was checked above.
+		writeExpectedErrorResponse(w, ExpectedErrorEmailAlreadyUsed)
+		return
+	}
 	if err != nil {
+		if codeDeliveryUserId != "" {
+			env.codeDeliveryRateLimit.refund(codeDeliveryFlowEmailVerification, codeDeliveryUserId, data.ClientIP)
+		}
 		log.Println(err) // Log errors during database insertion.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	// Run the configured after-create hook, if any (e.g. to start onboarding).
+	err = runAfterUserCreateHook(env, r.Context(), user)
+	if err != nil {
+		if codeDeliveryUserId != "" {
+			env.codeDeliveryRateLimit.refund(codeDeliveryFlowEmailVerification, codeDeliveryUserId, data.ClientIP)
+		}
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	createdUserId = user.Id
+	if verificationRequest != nil {
+		env.depositDevEmail(DevEmailTypeUserEmailVerification, user.Id, *data.Email, verificationRequest.Code)
+	}
 
 	// Respond with the newly created user's details (encoded as JSON).
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // Use http.StatusOK for clarity.
-	w.Write([]byte(user.EncodeToJSON()))
+	w.Write([]byte(encodeCreatedUserToJSON(user, verificationRequest, options.email, requestTimeFormat(env, r))))
+}
+
+// runAfterUserCreateHook runs env.afterUserCreate, if set, right after a user (along with its
+// email verification request) is created through POST /users.
+// If the hook returns an error, the error is logged. If env.rollBackUserOnHookError
+// is true, the user is also deleted again and the error is returned so the request
+// fails; otherwise the user is kept and nil is returned.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   ctx (context.Context): Request context, passed on to the hook.
+//   user (User): The user that was just created.
+//
+// Returns:
+//   error: The hook's error if the user creation was rolled back, nil otherwise.
+func runAfterUserCreateHook(env *Environment, ctx context.Context, user User) error {
+	if env.afterUserCreate == nil {
+		return nil
+	}
+	err := env.afterUserCreate(ctx, user)
+	if err == nil {
+		return nil
+	}
+	if !env.rollBackUserOnHookError {
+		env.logEvent("after user create hook failed", logStringField("user_id", user.Id), logStringField("error", err.Error()))
+		return nil
+	}
+	env.logEvent("after user create hook failed, rolling back user creation", logStringField("user_id", user.Id), logStringField("error", err.Error()))
+	// Delete the user even if the request was cancelled in the meantime.
+	deleteErr := deleteUser(env.db, context.WithoutCancel(ctx), user.Id)
+	env.invalidateCachedUser(user.Id)
+	if deleteErr != nil {
+		log.Println(deleteErr)
+	}
+	return err
+}
+
+// ErrCodeDeliveryRateLimited is returned by createUser when the code delivery rate limit
+// doesn't allow sending the new user's email verification code.
+var ErrCodeDeliveryRateLimited = errors.New("code delivery rate limited")
+
+// createUserOptions holds what createUser stores along with the user, if anything.
+type createUserOptions struct {
+	// email is stored on the user, and an email verification request is created for it.
+	// An empty string means the user has no email address.
+	email string
+	// emailVerificationCode and its hash are the code of the email verification request
+	// (see generateEmailVerificationCode). Only the hash is stored. Required with email.
+	emailVerificationCode     string
+	emailVerificationCodeHash string
+	// consumeCodeDelivery is called with the user's ID before the email verification request
+	// is inserted. If it returns false, nothing is created. Required with email.
+	consumeCodeDelivery func(userId string) bool
+	// inviteId is the claimed invite to assign to the user (see claimInvite), or empty.
+	inviteId string
+}
+
+// createUser generates a recovery code and inserts a new user with the given password hash.
+// If the generated ID is already taken, a new one is generated (see insertWithGeneratedId).
+// The user, the invite assignment, and the email verification request are created in a
+// single transaction, so either all of them exist or none do.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context.
+//   generateId (func() (string, error)): Generates the user ID, usually env.generateId.
+//   passwordHash (string): The Argon2id hash of the user's password.
+//   options (createUserOptions): The email address and invite of the user, if any.
+//
+// Returns:
+//   User: The created user.
+//   *UserEmailVerificationRequest: The created email verification request, including its
+//                                  code, or nil if options.email is empty.
+//   error: ErrEmailAlreadyUsed if another user has options.email, ignoring case,
+//          ErrCodeDeliveryRateLimited if options.consumeCodeDelivery returned false, or an
+//          error if generating the recovery code or ID, or a database operation, failed.
+//          It never returns an empty user with a nil error.
+func createUser(db *sql.DB, ctx context.Context, generateId func() (string, error), passwordHash string, options createUserOptions) (User, *UserEmailVerificationRequest, error) {
+	recoveryCode, err := generateSecureCode()
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	user := User{
+		CreatedAt:    time.Unix(time.Now().Unix(), 0),
+		PasswordHash: passwordHash,
+		RecoveryCode: recoveryCode,
+	}
+	var email any // Stored as NULL without an email address.
+	if options.email != "" {
+		email = options.email
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, nil, err
+	}
+	defer tx.Rollback()
+
+	userId, err := insertWithGeneratedId(generateId, func(id string) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO user (id, created_at, password_hash, recovery_code, email) VALUES (?, ?, ?, ?, ?)", id, user.CreatedAt.Unix(), user.PasswordHash, user.RecoveryCode, email)
+		return err
+	})
+	if isUniqueConstraintError(err) {
+		return User{}, nil, ErrEmailAlreadyUsed
+	}
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to insert user: %w", err)
+	}
+	user.Id = userId
+
+	if options.inviteId != "" {
+		err = setInviteUser(tx, ctx, options.inviteId, user.Id)
+		if err != nil {
+			return User{}, nil, fmt.Errorf("failed to assign invite: %w", err)
+		}
+	}
+
+	var verificationRequest *UserEmailVerificationRequest
+	if options.email != "" {
+		if !options.consumeCodeDelivery(user.Id) {
+			return User{}, nil, ErrCodeDeliveryRateLimited
+		}
+		verificationRequest = &UserEmailVerificationRequest{
+			UserId:    user.Id,
+			CreatedAt: user.CreatedAt,
+			ExpiresAt: user.CreatedAt.Add(10 * time.Minute),
+			Code:      options.emailVerificationCode,
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO user_email_verification_request (user_id, created_at, expires_at, code_hash) VALUES (?, ?, ?, ?)",
+			verificationRequest.UserId, verificationRequest.CreatedAt.Unix(), verificationRequest.ExpiresAt.Unix(), options.emailVerificationCodeHash)
+		if err != nil {
+			return User{}, nil, fmt.Errorf("failed to insert email verification request: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, nil, err
+	}
+	return user, verificationRequest, nil
+}
+
+// createUserRequest is the request body of POST /users.
+type createUserRequest struct {
+	Password   *string `json:"password"`    // User's chosen password.
+	Email      *string `json:"email"`       // Optional email address to verify.
+	InviteCode *string `json:"invite_code"` // Invite code from POST /invites, required if env.requireInvite is set.
+	ClientIP   string  `json:"client_ip"`   // Client's IP for rate limiting.
+
+	emailLimits emailAddressLimits // Set by the handler from env.emailAddressLimits; not part of the body.
+}
+
+// validate checks that the password is provided and at most maxPasswordLength bytes long,
+// and that the email address, if provided, is well-formed and within data.emailLimits.
+func (data *createUserRequest) validate() []fieldError {
+	var fieldErrors []fieldError
+	fieldErrors = validateRequiredString(fieldErrors, "password", data.Password, maxPasswordLength)
+	if data.Email != nil && !verifyEmailAddressInputWithLimits(*data.Email, data.emailLimits) {
+		fieldErrors = append(fieldErrors, fieldError{"email", FieldErrorInvalid})
+	}
+	return fieldErrors
+}
+
+// userJSON is the JSON representation of the user model, with the same fields and order as
+// User.EncodeToJSON but with timestamps in a configurable format.
+type userJSON struct {
+	Id             string   `json:"id"`
+	CreatedAt      UnixTime `json:"created_at"`
+	RecoveryCode   string   `json:"recovery_code"`
+	TOTPRegistered bool     `json:"totp_registered"`
+}
+
+// newUserJSON returns the JSON representation of user with timestamps in the given format.
+func newUserJSON(user User, format timeFormat) userJSON {
+	return userJSON{user.Id, newUnixTime(user.CreatedAt, format), user.RecoveryCode, user.TOTPRegistered}
+}
+
+// encodeUserToJSON encodes the user model with timestamps in the given format.
+func encodeUserToJSON(user User, format timeFormat) string {
+	encoded, err := json.Marshal(newUserJSON(user, format))
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// encodeCreatedUserToJSON encodes the response body of POST /users.
+// It contains the fields of the user model along with:
+//   - email_verified: Always false, since a new user has not verified an email address yet.
+//   - requires_verification: true if an email address was provided and still needs to be verified.
+//   - email_verification_request: The created email verification request without its code,
+//     along with the masked email address (see maskEmailAddress), only present if an email
+//     address was provided.
+//
+// Parameters:
+//   user (User): The created user.
+//   verificationRequest (*UserEmailVerificationRequest): The created email verification request, or nil.
+//   email (string): The email address the verification request was created for.
+//
+// Returns:
+//   string: The JSON-encoded response body.
+func encodeCreatedUserToJSON(user User, verificationRequest *UserEmailVerificationRequest, email string, format timeFormat) string {
+	type verificationRequestJSON struct {
+		userEmailVerificationRequestJSON
+		Email string `json:"email"`
+	}
+	data := struct {
+		userJSON
+		EmailVerified            bool                     `json:"email_verified"`
+		RequiresVerification     bool                     `json:"requires_verification"`
+		EmailVerificationRequest *verificationRequestJSON `json:"email_verification_request,omitempty"`
+	}{
+		userJSON:             newUserJSON(user, format),
+		EmailVerified:        false,
+		RequiresVerification: verificationRequest != nil,
+	}
+	if verificationRequest != nil {
+		data.EmailVerificationRequest = &verificationRequestJSON{
+			userEmailVerificationRequestJSON: userEmailVerificationRequestJSON{
+				UserId:    verificationRequest.UserId,
+				CreatedAt: newUnixTime(verificationRequest.CreatedAt, format),
+				ExpiresAt: newUnixTime(verificationRequest.ExpiresAt, format),
+			},
+			Email: maskEmailAddress(email),
+		}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		// Marshalling this struct cannot fail, but fall back to the plain user model just in case.
+		return encodeUserToJSON(user, format)
+	}
+	return string(encoded)
+}
+
+// emailAddressPattern loosely matches an email address: a local part, an "@", and a domain with a dot.
+var emailAddressPattern = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+
+// emailAddressLimits holds the maximum lengths, in bytes, of an email address and its parts.
+// Zero fields fall back to defaultEmailAddressLimits.
+//
+// Fields:
+//   LocalPart (int): Maximum length of the part before the "@".
+//   Domain (int): Maximum length of the part after the "@".
+//   Total (int): Maximum length of the whole address.
+type emailAddressLimits struct {
+	LocalPart int
+	Domain    int
+	Total     int
+}
+
+// defaultEmailAddressLimits are the limits from RFC 5321 (section 4.5.3.1). The whole address
+// may be at most 254 bytes, since a path is limited to 256 bytes including the angle brackets.
+var defaultEmailAddressLimits = emailAddressLimits{
+	LocalPart: 64,
+	Domain:    255,
+	Total:     254,
+}
+
+// withDefaults returns limits with every zero field replaced by its value in defaultEmailAddressLimits.
+func (limits emailAddressLimits) withDefaults() emailAddressLimits {
+	if limits.LocalPart == 0 {
+		limits.LocalPart = defaultEmailAddressLimits.LocalPart
+	}
+	if limits.Domain == 0 {
+		limits.Domain = defaultEmailAddressLimits.Domain
+	}
+	if limits.Total == 0 {
+		limits.Total = defaultEmailAddressLimits.Total
+	}
+	return limits
+}
+
+// verifyEmailAddressInput reports whether the provided email address is well-formed
+// and within defaultEmailAddressLimits. It does not check whether the address exists.
+//
+// Parameters:
+//   email (string): The email address to check.
+//
+// Returns:
+//   bool: true if the email address is valid, false otherwise.
+func verifyEmailAddressInput(email string) bool {
+	return verifyEmailAddressInputWithLimits(email, defaultEmailAddressLimits)
+}
+
+// verifyEmailAddressInputWithLimits is verifyEmailAddressInput with configurable length limits.
+// Besides matching emailAddressPattern, the address must not contain control characters,
+// the local part must not start or end with a dot or contain two dots in a row, and every
+// domain label must be 1 to 63 bytes long and must not start or end with a hyphen.
+//
+// Parameters:
+//   email (string): The email address to check.
+//   limits (emailAddressLimits): The length limits. Zero fields use defaultEmailAddressLimits.
+//
+// Returns:
+//   bool: true if the email address is valid, false otherwise.
+func verifyEmailAddressInputWithLimits(email string, limits emailAddressLimits) bool {
+	limits = limits.withDefaults()
+	if len(email) > limits.Total || !emailAddressPattern.MatchString(email) {
+		return false
+	}
+	for _, r := range email {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	// The pattern guarantees exactly one "@".
+	localPart, domain, _ := strings.Cut(email, "@")
+	if len(localPart) > limits.LocalPart || len(domain) > limits.Domain {
+		return false
+	}
+	if strings.HasPrefix(localPart, ".") || strings.HasSuffix(localPart, ".") || strings.Contains(localPart, "..") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+	}
+	return true
 }
 
 // handleGetUserRequest handles requests to retrieve details for a specific user.
@@ -149,22 +578,108 @@ func handleGetUserRequest(env *Environment, w http.ResponseWriter, r *http.Reque
 
 	// Get user ID from URL parameters.
 	userId := params.ByName("user_id")
-	// Fetch user from the database.
-	user, err := getUser(env.db, r.Context(), userId)
+	// Fetch user from the cache or the database, retrying transient failures (see retryDatabaseRead).
+	user, err := retryDatabaseRead(env, r.Context(), func() (User, error) {
+		return env.getCachedUser(r.Context(), userId)
+	})
 	if errors.Is(err, ErrRecordNotFound) {
 		writeNotFoundErrorResponse(w) // Respond 404 if user not found.
 		return
 	}
 	if err != nil {
 		log.Println(err) // Log other database errors.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	// Count the user's remaining recovery codes (omitted if the user has no second factor).
+	recoveryCodesRemaining, err := retryDatabaseRead(env, r.Context(), func() (*int, error) {
+		return getUserRecoveryCodesRemaining(env.db, r.Context(), env.recoveryCodeCount, user)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// Respond with the user's details (encoded as JSON).
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK) // Use http.StatusOK.
-	w.Write([]byte(user.EncodeToJSON()))
+	w.Write([]byte(encodeUserWithRecoveryCodesRemainingToJSON(user, recoveryCodesRemaining, requestTimeFormat(env, r))))
+}
+
+// handleGetUsersRouteRequest handles GET /users. With an 'email' query parameter it
+// looks up a single user (see handleGetUserByEmailRequest), with count_only=true it
+// counts users (see handleGetUserCountRequest), and otherwise it lists users
+// (see handleGetUsersRequest). httprouter can't register a static segment such as
+// /users/by-email or /users/count next to /users/:user_id, so these are query
+// parameters of GET /users.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   params (httprouter.Params): URL parameters (not used).
+func handleGetUsersRouteRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	query := r.URL.Query()
+	if query.Has("email") {
+		handleGetUserByEmailRequest(env, w, r, params)
+		return
+	}
+	if countOnly, err := strconv.ParseBool(query.Get("count_only")); err == nil && countOnly {
+		handleGetUserCountRequest(env, w, r, params)
+		return
+	}
+	handleGetUsersRequest(env, w, r, params)
+}
+
+// handleGetUserByEmailRequest handles GET /users?email=, which returns the user with the
+// email address for support tooling that only knows the address. Surrounding whitespace
+// is ignored and the address is matched ignoring case (see getUserFromEmail).
+//
+// The endpoint requires the request secret, but it is still rate limited per IP address
+// (env.userEmailLookupIPRateLimit) so a leaked secret can't be used to enumerate addresses quickly.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request, with the email address in the 'email' query parameter.
+//   _ (httprouter.Params): URL parameters (not used).
+func handleGetUserByEmailRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	// GET requests have no body, so the connection IP stands in for client_ip.
+	clientIP := resolveClientIP(env, r, remoteAddrIP(r))
+	if clientIP != "" && !env.userEmailLookupIPRateLimit.Consume(clientIP) {
+		writeTooManyRequestsErrorResponse(w)
+		return
+	}
+	setRateLimitHeaders(env, w, &env.userEmailLookupIPRateLimit, clientIP)
+
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	user, err := retryDatabaseRead(env, r.Context(), func() (User, error) {
+		return getUserFromEmail(env.db, r.Context(), email)
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(encodeUserToJSON(user, requestTimeFormat(env, r))))
 }
 
 // handleDeleteUserRequest handles requests to delete a specific user account.
@@ -192,7 +707,7 @@ func handleDeleteUserRequest(env *Environment, w http.ResponseWriter, r *http.Re
 	userExists, err := checkUserExists(env.db, r.Context(), userId)
 	if err != nil {
 		log.Println(err) // Log database errors during check.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !userExists {
@@ -202,16 +717,67 @@ func handleDeleteUserRequest(env *Environment, w http.ResponseWriter, r *http.Re
 
 	// Attempt to delete the user from the database.
 	err = deleteUser(env.db, r.Context(), userId)
+	env.invalidateCachedUser(userId)
 	if err != nil {
 		log.Println(err) // Log errors during deletion.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	writeAuditLog(env, r, AuditActionUserDelete, userId, resolveClientIP(env, r, ""))
 
 	// Respond with 204 No Content on successful deletion.
 	w.WriteHeader(http.StatusNoContent) // Use http.StatusNoContent.
 }
 
+// handleResetUserRateLimitsRequest handles requests to clear a user's rate limit and
+// lockout state, so support agents can help a locked-out legitimate user without
+// restarting the server. Only per-user limiters are reset; limits keyed by client IP
+// or by request ID are left alone. Every reset is written to the log as an audit event.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. User Existence Check.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request.
+//   params (httprouter.Params): URL parameters, containing 'user_id'.
+func handleResetUserRateLimitsRequest(env *Environment, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Standard request verification (secret).
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+
+	// Get user ID from URL parameters.
+	userId := params.ByName("user_id")
+	userExists, err := checkUserExists(env.db, r.Context(), userId)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	if !userExists {
+		writeNotFoundErrorResponse(w)
+		return
+	}
+
+	// Clear every limiter keyed by user ID.
+	env.totpUserRateLimit.Reset(userId)
+	env.totpUserLockout.Reset(userId)
+	env.recoveryCodeUserRateLimit.Reset(userId)
+	env.verifyUserEmailRateLimit.Reset(userId)
+	env.createEmailRequestUserRateLimit.Reset(userId)
+	env.codeDeliveryRateLimit.resetUser(userId)
+	env.emailUpdateRequestRateLimit.user.Reset(userId)
+
+	// Audit event.
+	env.logEvent("user rate limits reset", logStringField("user_id", userId))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // handleUpdateUserPasswordRequest handles requests to update a user's password.
 // It requires the current password for verification before updating to the new password.
 // It performs strength checks on the new password and applies rate limiting.
@@ -221,7 +787,8 @@ func handleDeleteUserRequest(env *Environment, w http.ResponseWriter, r *http.Re
 // 2. Content-Type Header Verification (JSON).
 // 3. User Existence Check.
 // 4. Current Password Verification (using Argon2id).
-// 5. New Password Validation: Checks presence, constraints (not empty, <= 127 chars).
+// 5. Request Body Validation (updateUserPasswordRequest): Checks presence and constraints of
+//    both passwords (not empty, <= 127 chars).
 // 6. New Password Strength Check.
 // 7. Rate Limiting: Limits password hashing attempts per IP.
 //
@@ -250,63 +817,34 @@ func handleUpdateUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 	}
 	if err != nil {
 		log.Println(err) // Log other database errors.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
-	// Read request body.
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err)
-		writeUnexpectedErrorResponse(w)
+	// Read and validate the request body (see validation.go).
+	var data updateUserPasswordRequest
+	if !decodeAndValidateJSON(w, r, &data) {
 		return
 	}
+	data.ClientIP = resolveClientIP(env, r, data.ClientIP)
+	password := *data.Password
+	newPassword := *data.NewPassword
 
-	// Define struct for JSON request body.
-	var data struct {
-		Password    *string `json:"password"`     // Current password for verification.
-		NewPassword *string `json:"new_password"` // The desired new password.
-		ClientIP    string  `json:"client_ip"`    // Client's IP for rate limiting.
-	}
-	// Unmarshal JSON data.
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
-	}
-
-	// Validate presence of current password.
-	if data.Password == nil {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
-	}
-	// Assign pointers to local variables for easier use (handle potential nil dereference if NewPassword is nil below).
-	password := *data.Password // Note: Potential panic if data.Password was nil, but checked above.
-	var newPassword string
-	if data.NewPassword != nil { // Check if NewPassword was provided before dereferencing.
-		newPassword = *data.NewPassword
-	} else {
-		// If NewPassword is nil (not provided in JSON), treat it as an invalid request.
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+	// A user without a password has no current password to verify.
+	if !userHasPassword(user.PasswordHash) {
+		writeExpectedErrorResponse(w, ExpectedErrorPasswordNotSet)
 		return
 	}
 
-	// Validate password constraints.
-	if password == "" || len(password) > 127 {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
-		return
-	}
-	if newPassword == "" || len(newPassword) > 127 {
-		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+	// Verify the current password provided by the user against the stored hash.
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
 		return
 	}
-
-	// Verify the current password provided by the user against the stored hash.
-	// This uses the argon2id.ComparePasswordAndHash function for secure comparison.
-	match, err := argon2id.ComparePasswordAndHash(password, user.PasswordHash)
+	match, err := env.verifyPassword(user.PasswordHash, password)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		log.Println(err) // Log errors during password comparison.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	// If the current password doesn't match the stored hash, return an authentication error.
@@ -317,10 +855,10 @@ func handleUpdateUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 
 	// Check the strength of the new password using the verifyPasswordStrength function.
 	// This helps prevent users from choosing weak or easily guessable passwords.
-	strongPassword, err := verifyPasswordStrength(newPassword)
+	strongPassword, err := env.verifyPasswordStrength(r.Context(), newPassword)
 	if err != nil {
 		log.Println(err) // Log errors during strength check.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 	if !strongPassword {
@@ -338,21 +876,424 @@ func handleUpdateUserPasswordRequest(env *Environment, w http.ResponseWriter, r
 
 	// Hash the new password using Argon2id before storing it.
 	// Argon2id is a secure, memory-hard hashing algorithm recommended for password storage.
-	newPasswordHash, err := argon2id.CreateHash(newPassword, argon2id.DefaultParams)
+	if !env.acquirePasswordHashing(w, r, data.ClientIP) {
+		return
+	}
+	newPasswordHash, err := env.hashPassword(newPassword)
+	env.passwordHashingConcurrencyLimit.Release(data.ClientIP)
 	if err != nil {
 		log.Println(err) // Log errors during hashing.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
 
 	// Update the user's password hash in the database with the new hash.
-	err = updateUserPassword(env.db, r.Context(), userId, newPasswordHash)
+	// With env.revokeSessionsOnPasswordChange, the user's sessions are deleted in the same transaction.
+	if env.revokeSessionsOnPasswordChange {
+		err = updateUserPasswordAndDeleteSessions(env.db, r.Context(), userId, newPasswordHash)
+	} else {
+		err = updateUserPassword(env.db, r.Context(), userId, newPasswordHash)
+	}
+	env.invalidateCachedUser(userId)
 	if err != nil {
 		log.Println(err) // Log errors during the database update.
-		writeUnexpectedErrorResponse(w)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
 		return
 	}
+	if env.revokeSessionsOnPasswordChange {
+		env.logSessionsRevoked(userId, "password_update")
+	}
+	// Let the application tell the user about the change (see password-change-notification.go).
+	notifyPasswordChange(env, r.Context(), userId, PasswordChangeMethodUpdate, data.ClientIP)
 
 	// Respond with 204 No Content to indicate successful password update.
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// updateUserPasswordAndDeleteSessions updates the user's password hash and deletes all of the
+// user's sessions in a single transaction, so sessions signed in with the old password can't
+// outlive the change.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user.
+//   passwordHash (string): The hash of the new password.
+//
+// Returns:
+//   (error): Any database error. Nothing is changed if an error is returned.
+func updateUserPasswordAndDeleteSessions(db *sql.DB, ctx context.Context, userId string, passwordHash string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE user SET password_hash = ? WHERE id = ?", passwordHash, userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = deleteUserSessions(tx, userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateUserPasswordRequest is the request body of POST /users/:user_id/update-password.
+type updateUserPasswordRequest struct {
+	Password    *string `json:"password"`     // Current password for verification.
+	NewPassword *string `json:"new_password"` // The desired new password.
+	ClientIP    string  `json:"client_ip"`    // Client's IP for rate limiting.
+}
+
+// validate checks that both passwords are provided and at most maxPasswordLength bytes long.
+func (data *updateUserPasswordRequest) validate() []fieldError {
+	var fieldErrors []fieldError
+	fieldErrors = validateRequiredString(fieldErrors, "password", data.Password, maxPasswordLength)
+	fieldErrors = validateRequiredString(fieldErrors, "new_password", data.NewPassword, maxPasswordLength)
+	return fieldErrors
+}
+
+// deleteUser deletes a user from the database.
+// Every table referencing user(id) declares ON DELETE CASCADE (see schema.sql), so the
+// user's TOTP credential, email verification request, email update requests, and
+// password reset requests are removed by SQLite along with the user row.
+// This relies on foreign keys being enabled on the connection (see openDatabase).
+// The delete still runs in a transaction, so anything that must happen together with
+// it (such as recording a deletion event) can be added before the commit.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   userId (string): The ID of the user to delete.
+//
+// Returns:
+//   error: Any database error encountered during the deletion.
+func deleteUser(db *sql.DB, ctx context.Context, userId string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM user WHERE id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExpectedErrorEmailDomainNotAllowed is returned when an email address is well-formed
+// but its domain is not in env.allowedEmailDomains.
+const ExpectedErrorEmailDomainNotAllowed = "EMAIL_DOMAIN_NOT_ALLOWED"
+
+// verifyEmailDomainAllowed reports whether the domain of the email address matches one
+// of the allowed domains. Matching is case-insensitive. An entry like "*.example.com"
+// matches any subdomain of example.com (but not example.com itself), while
+// "example.com" only matches example.com. If no domains are configured, every domain
+// is allowed.
+//
+// Parameters:
+//   allowedDomains ([]string): The allowed domains, usually env.allowedEmailDomains.
+//   email (string): A well-formed email address (see verifyEmailAddressInput).
+//
+// Returns:
+//   bool: true if the domain is allowed, false otherwise.
+func verifyEmailDomainAllowed(allowedDomains []string, email string) bool {
+	if len(allowedDomains) == 0 {
+		return true
+	}
+	atIndex := strings.LastIndex(email, "@")
+	if atIndex < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[atIndex+1:])
+	for _, allowedDomain := range allowedDomains {
+		allowedDomain = strings.ToLower(strings.TrimSpace(allowedDomain))
+		if suffix, ok := strings.CutPrefix(allowedDomain, "*."); ok {
+			if strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if domain == allowedDomain {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetUsersRequest handles GET /users, which returns one page of users as a JSON array.
+// The filter, sort and pagination query parameters are parsed by parseUserListFilter,
+// parseUserListSort and parsePaginationQuery. The total count and the page are computed
+// from the same filter, so X-Pagination-Total matches GET /users?count_only=true for the same query.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Accept Header Verification (JSON).
+//
+// Response headers: X-Pagination-Total, X-Pagination-Total-Pages, X-Pagination-Per-Page
+// (per_page after it is clamped to env.paginationPerPageLimit()) and Link.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request, with the filter, sort and pagination in the query parameters.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleGetUsersRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := parseUserListFilter(query)
+	sort := parseUserListSort(env, query)
+	perPage, page := parsePaginationQuery(query, env.paginationPerPageLimit())
+
+	total, err := retryDatabaseRead(env, r.Context(), func() (int, error) {
+		return getUserCount(env.db, r.Context(), filter)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+	users, err := retryDatabaseRead(env, r.Context(), func() ([]User, error) {
+		return getUsersPage(env.db, r.Context(), filter, sort, perPage, page)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	w.Header().Set("X-Pagination-Total", strconv.Itoa(total))
+	w.Header().Set("X-Pagination-Total-Pages", strconv.Itoa(totalPages))
+	w.Header().Set("X-Pagination-Per-Page", strconv.Itoa(perPage))
+	w.Header().Set("Link", createPaginationLinkHeader(r.URL, page, totalPages))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	format := requestTimeFormat(env, r)
+	array := newJSONArrayWriter(w)
+	for _, user := range users {
+		array.Write(newUserJSON(user, format))
+	}
+	err = array.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// getUsersPage returns one page of the users matching the filter, using userListPageQuery.
+//
+// Parameters:
+//   db (*sql.DB): Database connection pool.
+//   ctx (context.Context): Request context for cancellation propagation.
+//   filter (userListFilter): The filter, see parseUserListFilter.
+//   sort (userListSort): The sort order, see parseUserListSort.
+//   perPage (int): The number of users in a page.
+//   page (int): The page number (starting from 1).
+//
+// Returns:
+//   ([]User): The users in the page. Empty if the page is past the last one.
+//   (error): Any database error.
+func getUsersPage(db *sql.DB, ctx context.Context, filter userListFilter, sort userListSort, perPage int, page int) ([]User, error) {
+	columns := "id, created_at, password_hash, recovery_code, EXISTS (SELECT 1 FROM user_totp_credential WHERE user_totp_credential.user_id = user.id)"
+	query, args := userListPageQuery(columns, filter, sort, perPage, page)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		var createdAtUnix int64
+		err = rows.Scan(&user.Id, &createdAtUnix, &user.PasswordHash, &user.RecoveryCode, &user.TOTPRegistered)
+		if err != nil {
+			return nil, err
+		}
+		user.CreatedAt = time.Unix(createdAtUnix, 0)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// handleGetUserCountRequest handles GET /users?count_only=true, which returns the number of users
+// matching the same filters as GET /users (see parseUserListFilter) without listing them.
+//
+// Security Checks:
+// 1. Request Secret Verification.
+// 2. Accept Header Verification (JSON).
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   w (http.ResponseWriter): HTTP response writer.
+//   r (*http.Request): HTTP request, with the filter in the query parameters.
+//   _ (httprouter.Params): URL parameters (unused).
+func handleGetUserCountRequest(env *Environment, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !verifyRequestSecret(env.secret, r) {
+		writeNotAuthenticatedErrorResponse(w)
+		return
+	}
+	if !verifyJSONAcceptHeader(r) {
+		writeNotAcceptableErrorResponse(w)
+		return
+	}
+
+	filter := parseUserListFilter(r.URL.Query())
+	count, err := retryDatabaseRead(env, r.Context(), func() (int, error) {
+		return getUserCount(env.db, r.Context(), filter)
+	})
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponseWithDetail(env, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"count":%d}`, count)))
+}
+
+// userListFilter restricts the users listed by GET /users. The total count and every
+// page must be computed from the same filter (see getUserCount and userListPageQuery),
+// so X-Pagination-Total always matches the filtered list. Zero fields match every user.
+type userListFilter struct {
+	EmailVerified  *bool
+	TOTPRegistered *bool
+	CreatedAfter  time.Time // Inclusive.
+	CreatedBefore time.Time // Exclusive.
+}
+
+// parseUserListFilter parses the filter query parameters of GET /users:
+// email_verified and totp_registered ("true" or "false") and created_after / created_before (UNIX seconds).
+// Missing or invalid values are ignored, like invalid pagination parameters.
+//
+// Parameters:
+//   query (url.Values): The request's query parameters (r.URL.Query()).
+//
+// Returns:
+//   userListFilter: The parsed filter.
+func parseUserListFilter(query url.Values) userListFilter {
+	var filter userListFilter
+	if emailVerified, err := strconv.ParseBool(query.Get("email_verified")); err == nil {
+		filter.EmailVerified = &emailVerified
+	}
+	if totpRegistered, err := strconv.ParseBool(query.Get("totp_registered")); err == nil {
+		filter.TOTPRegistered = &totpRegistered
+	}
+	if createdAfter, err := strconv.ParseInt(query.Get("created_after"), 10, 64); err == nil {
+		filter.CreatedAfter = time.Unix(createdAfter, 0)
+	}
+	if createdBefore, err := strconv.ParseInt(query.Get("created_before"), 10, 64); err == nil {
+		filter.CreatedBefore = time.Unix(createdBefore, 0)
+	}
+	return filter
+}
+
+// where returns the WHERE clause (possibly empty) and its arguments for the filter.
+func (f userListFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if f.EmailVerified != nil {
+		conditions = append(conditions, "email_verified = ?")
+		args = append(args, *f.EmailVerified)
+	}
+	if f.TOTPRegistered != nil {
+		condition := "EXISTS (SELECT 1 FROM user_totp_credential WHERE user_totp_credential.user_id = user.id)"
+		if !*f.TOTPRegistered {
+			condition = "NOT " + condition
+		}
+		conditions = append(conditions, condition)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.CreatedAfter.Unix())
+	}
+	if !f.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.CreatedBefore.Unix())
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// getUserCount returns the number of users matching the filter, used for X-Pagination-Total
+// and GET /users?count_only=true.
+func getUserCount(db *sql.DB, ctx context.Context, filter userListFilter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM user"+where, args...).Scan(&count)
+	return count, err
+}
+
+// userListSort is the sort order of GET /users.
+type userListSort struct {
+	By    string // "created_at" or "id". Inserted into the SQL directly, never from user input.
+	Order string // "ASC" or "DESC". Same as above.
+}
+
+// defaultUserListSort is the sort order of GET /users if env.defaultUserListSort isn't set.
+var defaultUserListSort = userListSort{By: "created_at", Order: "ASC"}
+
+// parseUserListSort parses the sort_by and sort_order query parameters of GET /users.
+// A missing or invalid parameter falls back to env.defaultUserListSort (or
+// defaultUserListSort if that isn't set), so the default can be configured.
+//
+// Parameters:
+//   env (*Environment): Application environment.
+//   query (url.Values): The request's query parameters (r.URL.Query()).
+//
+// Returns:
+//   userListSort: The sort order to use.
+func parseUserListSort(env *Environment, query url.Values) userListSort {
+	sort := defaultUserListSort
+	if env.defaultUserListSort.By != "" {
+		sort.By = env.defaultUserListSort.By
+	}
+	if env.defaultUserListSort.Order != "" {
+		sort.Order = env.defaultUserListSort.Order
+	}
+	switch query.Get("sort_by") {
+	case "created_at", "id":
+		sort.By = query.Get("sort_by")
+	}
+	switch query.Get("sort_order") {
+	case "ascending":
+		sort.Order = "ASC"
+	case "descending":
+		sort.Order = "DESC"
+	}
+	return sort
+}
+
+// userListPageQuery returns the SQL query and its arguments for one page of GET /users.
+// It uses the same WHERE clause as getUserCount, so the page data and the total count
+// always agree.
+//
+// Parameters:
+//   columns (string): The selected columns, e.g. "id, created_at".
+//   filter (userListFilter): The filter, see parseUserListFilter.
+//   sort (userListSort): The sort order, see parseUserListSort.
+//   perPage (int): The number of users in a page.
+//   page (int): The page number (starting from 1).
+//
+// Returns:
+//   string: The SQL query.
+//   []any: The query arguments.
+func userListPageQuery(columns string, filter userListFilter, sort userListSort, perPage int, page int) (string, []any) {
+	where, args := filter.where()
+	// id is the second sort key so that users created at the same second keep a stable order across pages.
+	query := fmt.Sprintf("SELECT %s FROM user%s ORDER BY %s %s, id %s LIMIT ? OFFSET ?", columns, where, sort.By, sort.Order, sort.Order)
+	args = append(args, perPage, perPage*(page-1))
+	return query, args
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"         // 导入上下文包，数据库操作函数需要它
 	"encoding/json" // 导入 JSON 编码/解码包
+	"fmt"             // 导入格式化包，用于拼接查询语句
+	"net/http/httptest" // 导入 HTTP 测试包，用于测试 GET /users?count_only=true
+	"net/url"         // 导入 URL 包，用于构造列表的查询参数
+	"strings"         // 导入字符串包，用于生成过长的邮箱地址
 	"testing"         // 导入 Go 的测试包
 	"time"            // 导入时间包
 
@@ -54,6 +59,143 @@ func TestUserEncodeToJSON(t *testing.T) {
 	assert.Equal(t, expected, result)
 }
 
+// TestEncodeCreatedUserToJSON 测试 encodeCreatedUserToJSON 函数。
+// 没有邮箱验证请求时，email_verified 和 requires_verification 都为 false，且不包含 email_verification_request；
+// 有邮箱验证请求时，requires_verification 为 true，且包含脱敏邮箱和不带验证码的请求信息。
+func TestEncodeCreatedUserToJSON(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	user := User{
+		Id:             "1",
+		CreatedAt:      now,
+		PasswordHash:   "HASH1",
+		RecoveryCode:   "12345678",
+		TOTPRegistered: false,
+	}
+
+	var result CreatedUserJSON
+	err := json.Unmarshal([]byte(encodeCreatedUserToJSON(user, nil, "", timeFormatUnix)), &result)
+	assert.NoError(t, err)
+	expected := CreatedUserJSON{
+		Id:                   user.Id,
+		CreatedAtUnix:        user.CreatedAt.Unix(),
+		RecoveryCode:         user.RecoveryCode,
+		TOTPRegistered:       false,
+		EmailVerified:        false,
+		RequiresVerification: false,
+	}
+	assert.Equal(t, expected, result)
+
+	verificationRequest := UserEmailVerificationRequest{
+		UserId:    user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(10 * time.Minute),
+		Code:      "12345678",
+	}
+	result = CreatedUserJSON{}
+	err = json.Unmarshal([]byte(encodeCreatedUserToJSON(user, &verificationRequest, "user@example.com", timeFormatUnix)), &result)
+	assert.NoError(t, err)
+	expected.RequiresVerification = true
+	expected.EmailVerificationRequest = &CreatedUserEmailVerificationRequestJSON{
+		UserEmailVerificationRequestJSON: UserEmailVerificationRequestJSON{
+			UserId:        verificationRequest.UserId,
+			CreatedAtUnix: verificationRequest.CreatedAt.Unix(),
+			ExpiresAtUnix: verificationRequest.ExpiresAt.Unix(),
+		},
+		Email: "u***@example.com",
+	}
+	assert.Equal(t, expected, result)
+}
+
+// TestVerifyEmailAddressInput 测试 verifyEmailAddressInput 函数对各种邮箱地址的判断。
+func TestVerifyEmailAddressInput(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, verifyEmailAddressInput("user@example.com"))
+	assert.True(t, verifyEmailAddressInput("user+tag@mail.example.com"))
+	assert.False(t, verifyEmailAddressInput(""))
+	assert.False(t, verifyEmailAddressInput("email"))
+	assert.False(t, verifyEmailAddressInput("user@example"))
+	assert.False(t, verifyEmailAddressInput("user @example.com"))
+	assert.False(t, verifyEmailAddressInput(" user@example.com"))
+	assert.False(t, verifyEmailAddressInput(strings.Repeat("a", 250)+"@example.com"))
+	// 结构无效的地址
+	assert.False(t, verifyEmailAddressInput(".user@example.com"))
+	assert.False(t, verifyEmailAddressInput("user.@example.com"))
+	assert.False(t, verifyEmailAddressInput("us..er@example.com"))
+	assert.False(t, verifyEmailAddressInput("user@example..com"))
+	assert.False(t, verifyEmailAddressInput("user@-example.com"))
+	assert.False(t, verifyEmailAddressInput("user@example-.com"))
+	assert.False(t, verifyEmailAddressInput("user@"+strings.Repeat("a", 64)+".com"))
+	assert.False(t, verifyEmailAddressInput("us\x00er@example.com"))
+	assert.True(t, verifyEmailAddressInput("first.last@my-mail.example.com"))
+}
+
+// TestVerifyEmailAddressInputLimits 测试 RFC 5321 的长度限制的边界：
+// 本地部分最多 64 个字符，整个地址最多 254 个字符，以及自定义的限制。
+func TestVerifyEmailAddressInputLimits(t *testing.T) {
+	t.Parallel()
+
+	// domainOfLength 返回长度为 n 的域名，由最多 63 个字符的标签组成
+	domainOfLength := func(n int) string {
+		var labels []string
+		for n > 0 {
+			length := min(n, 63)
+			if n-length == 1 {
+				// 避免最后剩下一个点没有标签
+				length--
+			}
+			labels = append(labels, strings.Repeat("b", length))
+			n -= length + 1
+		}
+		return strings.Join(labels, ".")
+	}
+
+	assert.True(t, verifyEmailAddressInput(strings.Repeat("a", 64)+"@example.com"))
+	assert.False(t, verifyEmailAddressInput(strings.Repeat("a", 65)+"@example.com"))
+
+	email := "user@" + domainOfLength(254-len("user@"))
+	assert.Equal(t, 254, len(email))
+	assert.True(t, verifyEmailAddressInput(email))
+	email = "user@" + domainOfLength(255-len("user@"))
+	assert.Equal(t, 255, len(email))
+	assert.False(t, verifyEmailAddressInput(email))
+
+	// 自定义限制，没有设置的字段使用默认值
+	limits := emailAddressLimits{LocalPart: 10, Total: 30}
+	assert.True(t, verifyEmailAddressInputWithLimits(strings.Repeat("a", 10)+"@example.com", limits))
+	assert.False(t, verifyEmailAddressInputWithLimits(strings.Repeat("a", 11)+"@example.com", limits))
+	assert.False(t, verifyEmailAddressInputWithLimits("user@"+domainOfLength(26), limits))
+	assert.True(t, verifyEmailAddressInputWithLimits(strings.Repeat("a", 64)+"@example.com", emailAddressLimits{}))
+	assert.False(t, verifyEmailAddressInputWithLimits("user@"+domainOfLength(20), emailAddressLimits{Domain: 19}))
+}
+
+// TestVerifyEmailDomainAllowed 测试 verifyEmailDomainAllowed 函数：
+// 未配置允许的域名时不做限制；配置后只允许列表中的域名 (不区分大小写)，"*.example.com" 匹配所有子域名。
+func TestVerifyEmailDomainAllowed(t *testing.T) {
+	t.Parallel()
+
+	// 未配置时允许所有域名
+	assert.True(t, verifyEmailDomainAllowed(nil, "user@example.com"))
+	assert.True(t, verifyEmailDomainAllowed([]string{}, "user@anything.test"))
+
+	allowedDomains := []string{"example.com", "*.corp.example.org"}
+
+	// 允许的域名
+	assert.True(t, verifyEmailDomainAllowed(allowedDomains, "user@example.com"))
+	assert.True(t, verifyEmailDomainAllowed(allowedDomains, "user@EXAMPLE.com"))
+	// 不允许的域名
+	assert.False(t, verifyEmailDomainAllowed(allowedDomains, "user@example.net"))
+	assert.False(t, verifyEmailDomainAllowed(allowedDomains, "user@mail.example.com"))
+	assert.False(t, verifyEmailDomainAllowed(allowedDomains, "user@notexample.com"))
+	// 通配符匹配子域名，但不匹配域名本身
+	assert.True(t, verifyEmailDomainAllowed(allowedDomains, "user@eu.corp.example.org"))
+	assert.True(t, verifyEmailDomainAllowed(allowedDomains, "user@a.b.Corp.Example.org"))
+	assert.False(t, verifyEmailDomainAllowed(allowedDomains, "user@corp.example.org"))
+	assert.False(t, verifyEmailDomainAllowed(allowedDomains, "user@evilcorp.example.org"))
+}
+
 // TestEncodeRecoveryCodeToJSON 测试 encodeRecoveryCodeToJSON 函数的功能。
 // 这个函数 (推测定义在 user.go 或类似文件中) 专门用于将恢复码编码成一个简单的 JSON 对象。
 //
@@ -85,6 +227,232 @@ func TestEncodeRecoveryCodeToJSON(t *testing.T) {
 	assert.Equal(t, expected, result)
 }
 
+// TestCreateUser 测试 createUser 插入的用户和返回的用户一致，每个用户有自己的 ID 和恢复码；
+// 提供邮箱时邮箱被保存，邀请码和邮箱验证请求在同一个事务中创建；
+// consumeCodeDelivery 拒绝时什么都不会创建。
+func TestCreateUser(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	user1, verificationRequest, err := createUser(db, context.Background(), newId, "HASH1", createUserOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, verificationRequest)
+	assert.NotEmpty(t, user1.Id)
+	assert.NotEmpty(t, user1.RecoveryCode)
+	assert.Equal(t, "HASH1", user1.PasswordHash)
+	storedUser, err := getUser(db, context.Background(), user1.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, user1, storedUser)
+	email, err := getUserEmail(db, context.Background(), user1.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "", email)
+
+	invite, err := createInvite(db, context.Background(), newId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inviteId, err := claimInvite(db, context.Background(), invite.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := createUserOptions{
+		email:                     "user@example.com",
+		emailVerificationCode:     "CODE",
+		emailVerificationCodeHash: "CODE_HASH",
+		inviteId:                  inviteId,
+	}
+
+	// 没有发送令牌时不创建用户，也不分配邀请码
+	var consumedUserIds []string
+	options.consumeCodeDelivery = func(userId string) bool {
+		consumedUserIds = append(consumedUserIds, userId)
+		return false
+	}
+	_, _, err = createUser(db, context.Background(), newSequenceIdGenerator("limited"), "HASH2", options)
+	assert.ErrorIs(t, err, ErrCodeDeliveryRateLimited)
+	assert.Equal(t, []string{"limited1"}, consumedUserIds)
+	_, err = getUser(db, context.Background(), "limited1")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	var inviteUserId *string
+	err = db.QueryRow("SELECT user_id FROM invite WHERE id = ?", inviteId).Scan(&inviteUserId)
+	assert.NoError(t, err)
+	assert.Nil(t, inviteUserId)
+
+	options.consumeCodeDelivery = func(userId string) bool { return true }
+	user2, verificationRequest, err := createUser(db, context.Background(), newId, "HASH2", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, user1.Id, user2.Id)
+	assert.NotEqual(t, user1.RecoveryCode, user2.RecoveryCode)
+	email, err = getUserEmail(db, context.Background(), user2.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", email)
+	err = db.QueryRow("SELECT user_id FROM invite WHERE id = ?", inviteId).Scan(&inviteUserId)
+	assert.NoError(t, err)
+	assert.Equal(t, &user2.Id, inviteUserId)
+	if !assert.NotNil(t, verificationRequest) {
+		return
+	}
+	assert.Equal(t, "CODE", verificationRequest.Code)
+	assert.Equal(t, user2.CreatedAt.Add(10*time.Minute), verificationRequest.ExpiresAt)
+	storedVerificationRequest, err := getUserEmailVerificationRequest(db, context.Background(), user2.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, verificationRequest.ExpiresAt, storedVerificationRequest.ExpiresAt)
+}
+
+// TestGetUserFromEmail 测试邮箱地址按原样保存，但查找和唯一性都不区分大小写：
+// Foo@example.com 和 foo@example.com 是同一个账号。
+func TestGetUserFromEmail(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	options := createUserOptions{
+		email:                     "Foo@Example.com",
+		emailVerificationCode:     "CODE",
+		emailVerificationCodeHash: "CODE_HASH",
+		consumeCodeDelivery:       func(userId string) bool { return true },
+	}
+	user, _, err := createUser(db, context.Background(), newId, "HASH", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存的邮箱保留原来的大小写
+	email, err := getUserEmail(db, context.Background(), user.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo@Example.com", email)
+
+	for _, email := range []string{"Foo@Example.com", "foo@example.com", "FOO@EXAMPLE.COM"} {
+		result, err := getUserFromEmail(db, context.Background(), email)
+		assert.NoError(t, err, email)
+		assert.Equal(t, user, result, email)
+		available, err := checkEmailAvailability(db, context.Background(), email)
+		assert.NoError(t, err)
+		assert.False(t, available, email)
+	}
+
+	_, err = getUserFromEmail(db, context.Background(), "bar@example.com")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	available, err := checkEmailAvailability(db, context.Background(), "bar@example.com")
+	assert.NoError(t, err)
+	assert.True(t, available)
+
+	// 大小写不同的同一个邮箱不能用于另一个用户
+	options.email = "foo@example.COM"
+	_, _, err = createUser(db, context.Background(), newId, "HASH", options)
+	assert.ErrorIs(t, err, ErrEmailAlreadyUsed)
+}
+
+// TestDeleteUser 测试 deleteUser 函数删除用户时，是否通过 ON DELETE CASCADE 一并删除了所有子表中的数据。
+// 最后的检查遍历数据库中所有引用 user(id) 的表，而不是只检查已知的几个表，
+// 这样以后新增的子表如果没有级联删除，也会在这里暴露出来。
+func TestDeleteUser(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+
+	user1 := User{
+		Id:           "1",
+		CreatedAt:    now,
+		PasswordHash: "HASH1",
+		RecoveryCode: "12345678",
+	}
+	err := insertUser(db, context.Background(), &user1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 另一个用户，用来确认只删除了目标用户的数据
+	user2 := User{
+		Id:           "2",
+		CreatedAt:    now,
+		PasswordHash: "HASH2",
+		RecoveryCode: "12345678",
+	}
+	err = insertUser(db, context.Background(), &user2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 为每个用户在各个子表中插入数据
+	for _, userId := range []string{user1.Id, user2.Id} {
+		err = insertUserTOTPCredential(db, &UserTOTPCredential{
+			Id:        userId,
+			UserId:    userId,
+			CreatedAt: now,
+			Key:       []byte{0x01, 0x02, 0x03},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertUserEmailVerificationRequest(db, &UserEmailVerificationRequest{
+			UserId:    userId,
+			CreatedAt: now,
+			ExpiresAt: now.Add(10 * time.Minute),
+			Code:      "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertEmailUpdateRequest(db, context.Background(), &EmailUpdateRequest{
+			Id:        userId,
+			UserId:    userId,
+			CreatedAt: now,
+			ExpiresAt: now.Add(10 * time.Minute),
+			Email:     "user@example.com",
+			Code:      "12345678",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO password_reset_request (id, user_id, created_at, expires_at, code_hash) VALUES (?, ?, ?, ?, ?)", userId, userId, now.Unix(), now.Add(10*time.Minute).Unix(), "HASH")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = deleteUser(db, context.Background(), user1.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userExists, err := checkUserExists(db, context.Background(), user1.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, userExists)
+
+	// 检查所有引用 user(id) 的表：user1 的数据应该被删除，user2 的数据应该保留
+	references, err := getUserForeignKeyReferences(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reference := range references {
+		query := fmt.Sprintf(`SELECT count(*) FROM "%s" WHERE "%s" = ?`, reference.Table, reference.Column)
+		var count int
+		err = db.QueryRow(query, user1.Id).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, count, reference.Table)
+	}
+	var remaining int
+	err = db.QueryRow("SELECT count(*) FROM user_totp_credential WHERE user_id = ?", user2.Id).Scan(&remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, remaining)
+}
+
 // UserJSON 是用于测试 User.EncodeToJSON() 方法的辅助结构体。
 // 它定义了 User 对象在编码为 JSON 时应包含的公共字段及其格式。
 // - Id: 用户唯一标识符。
@@ -99,9 +467,220 @@ type UserJSON struct {
 	TOTPRegistered bool   `json:"totp_registered"`// TOTP 注册状态，对应 JSON 中的 "totp_registered" 键
 }
 
+// CreatedUserJSON 是用于测试 encodeCreatedUserToJSON() 函数的辅助结构体。
+// 它在 UserJSON 的基础上增加了邮箱验证相关的字段。
+type CreatedUserJSON struct {
+	Id                       string                            `json:"id"`
+	CreatedAtUnix            int64                             `json:"created_at"`
+	RecoveryCode             string                            `json:"recovery_code"`
+	TOTPRegistered           bool                              `json:"totp_registered"`
+	EmailVerified            bool                              `json:"email_verified"`
+	RequiresVerification     bool                              `json:"requires_verification"`
+	EmailVerificationRequest *CreatedUserEmailVerificationRequestJSON `json:"email_verification_request"`
+}
+
+// CreatedUserEmailVerificationRequestJSON 是 CreatedUserJSON 中的邮箱验证请求，
+// 在 UserEmailVerificationRequestJSON 的基础上增加了脱敏的邮箱地址。
+type CreatedUserEmailVerificationRequestJSON struct {
+	UserEmailVerificationRequestJSON
+	Email string `json:"email"`
+}
+
 // RecoveryCodeJSON 是用于测试 encodeRecoveryCodeToJSON() 函数的辅助结构体。
 // 它定义了一个非常简单的 JSON 结构，仅包含用户的恢复码。
 // 这可能用于只需要返回恢复码的特定 API 端点。
 type RecoveryCodeJSON struct {
 	RecoveryCode string `json:"recovery_code"` // 恢复码，对应 JSON 中的 "recovery_code" 键
 }
+
+// TestUserListFilterPagination 测试带过滤条件分页时，总数和每一页都来自同一个 WHERE 条件：
+// getUserCount 返回过滤后的数量 (而不是整张表的数量)，各页拼起来正好是所有匹配的用户。
+func TestUserListFilterPagination(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	// 30 个用户，每秒创建一个，ID 为奇数的用户已验证邮箱
+	var expectedIds []string
+	for i := 1; i <= 30; i++ {
+		user := User{
+			Id:           fmt.Sprintf("%02d", i),
+			CreatedAt:    now.Add(time.Duration(i) * time.Second),
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			err = setUserEmailVerified(db, context.Background(), user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 10 {
+				expectedIds = append(expectedIds, user.Id)
+			}
+		}
+	}
+
+	query := url.Values{}
+	query.Set("email_verified", "true")
+	query.Set("created_after", fmt.Sprint(now.Add(11*time.Second).Unix()))
+	filter := parseUserListFilter(query)
+
+	total, err := getUserCount(db, context.Background(), filter)
+	assert.NoError(t, err)
+	assert.Equal(t, len(expectedIds), total)
+	allTotal, err := getUserCount(db, context.Background(), userListFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 30, allTotal)
+
+	sort := parseUserListSort(createEnvironment(db, nil), query)
+	perPage := 4
+	totalPages := (total + perPage - 1) / perPage
+	var ids []string
+	for page := 1; page <= totalPages+1; page++ {
+		sqlQuery, args := userListPageQuery("id", filter, sort, perPage, page)
+		rows, err := db.Query(sqlQuery, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pageIds []string
+		for rows.Next() {
+			var id string
+			err = rows.Scan(&id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pageIds = append(pageIds, id)
+		}
+		rows.Close()
+		if page <= totalPages {
+			assert.NotEmpty(t, pageIds)
+			assert.LessOrEqual(t, len(pageIds), perPage)
+		} else {
+			// 超出总页数的页是空的
+			assert.Empty(t, pageIds)
+		}
+		ids = append(ids, pageIds...)
+	}
+	assert.Equal(t, expectedIds, ids)
+
+	// created_before 不包含边界
+	query = url.Values{}
+	query.Set("email_verified", "false")
+	query.Set("created_before", fmt.Sprint(now.Add(6*time.Second).Unix()))
+	total, err = getUserCount(db, context.Background(), parseUserListFilter(query))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+
+	// 无效的过滤参数被忽略
+	query = url.Values{}
+	query.Set("email_verified", "maybe")
+	query.Set("created_after", "yesterday")
+	assert.Equal(t, userListFilter{}, parseUserListFilter(query))
+}
+
+// TestGetUserCountRequest 测试 GET /users?count_only=true 对各种过滤条件的组合返回的数量和插入的数据一致。
+func TestGetUserCountRequest(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	// 12 个用户，每秒创建一个：ID 为偶数的用户已验证邮箱，ID 是 3 的倍数的用户注册了 TOTP
+	for i := 1; i <= 12; i++ {
+		user := User{
+			Id:           fmt.Sprintf("%02d", i),
+			CreatedAt:    now.Add(time.Duration(i) * time.Second),
+			PasswordHash: "HASH",
+			RecoveryCode: "12345678",
+		}
+		err := insertUser(db, context.Background(), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			err = setUserEmailVerified(db, context.Background(), user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%3 == 0 {
+			err = insertUserTOTPCredential(db, &UserTOTPCredential{Id: "totp" + user.Id, UserId: user.Id, CreatedAt: now, Key: make([]byte, 20)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	app := CreateApp(createEnvironment(db, nil))
+	count := func(query string) int {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/users?count_only=true&"+query, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var data struct {
+			Count *int `json:"count"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil || data.Count == nil {
+			t.Fatalf("invalid response body: %s", w.Body.String())
+		}
+		return *data.Count
+	}
+	after := func(i int) string { return fmt.Sprint(now.Add(time.Duration(i) * time.Second).Unix()) }
+
+	assert.Equal(t, 12, count(""))
+	assert.Equal(t, 6, count("email_verified=true"))
+	assert.Equal(t, 6, count("email_verified=false"))
+	assert.Equal(t, 4, count("totp_registered=true"))
+	assert.Equal(t, 8, count("totp_registered=false"))
+	// 偶数且是 3 的倍数: 6, 12
+	assert.Equal(t, 2, count("email_verified=true&totp_registered=true"))
+	// 创建时间在 [4, 10) 之间: 4 到 9
+	assert.Equal(t, 6, count("created_after="+after(4)+"&created_before="+after(10)))
+	// 其中已验证邮箱的: 4, 6, 8；没有注册 TOTP 的: 4, 8
+	assert.Equal(t, 3, count("email_verified=true&created_after="+after(4)+"&created_before="+after(10)))
+	assert.Equal(t, 2, count("email_verified=true&totp_registered=false&created_after="+after(4)+"&created_before="+after(10)))
+	assert.Equal(t, 0, count("created_after="+after(13)))
+	// 无效的过滤参数被忽略
+	assert.Equal(t, 12, count("email_verified=maybe&totp_registered=sometimes"))
+
+	// count_only 不是 true 时和没有这个参数一样返回用户列表
+	r := httptest.NewRequest("GET", "/users?count_only=false&per_page=100", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	var users []UserJSON
+	err := json.Unmarshal(w.Body.Bytes(), &users)
+	assert.NoError(t, err)
+	assert.Len(t, users, 12)
+}
+
+// TestParseUserListSort 测试 parseUserListSort 在没有排序参数或参数无效时使用配置的默认排序。
+func TestParseUserListSort(t *testing.T) {
+	t.Parallel()
+
+	env := createEnvironment(nil, nil)
+	assert.Equal(t, userListSort{By: "created_at", Order: "ASC"}, parseUserListSort(env, url.Values{}))
+
+	query := url.Values{}
+	query.Set("sort_by", "id")
+	query.Set("sort_order", "descending")
+	assert.Equal(t, userListSort{By: "id", Order: "DESC"}, parseUserListSort(env, query))
+
+	// 配置了默认排序时，缺少或无效的参数使用配置的值
+	env.defaultUserListSort = userListSort{By: "id", Order: "DESC"}
+	assert.Equal(t, userListSort{By: "id", Order: "DESC"}, parseUserListSort(env, url.Values{}))
+	query = url.Values{}
+	query.Set("sort_by", "password_hash")
+	query.Set("sort_order", "ascending")
+	assert.Equal(t, userListSort{By: "id", Order: "ASC"}, parseUserListSort(env, query))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json" // 导入 JSON 编码/解码包，用于解析请求体和编码字段错误
+	"io"            // 导入 I/O 包，用于读取请求体
+	"log"           // 导入日志包
+	"net/http"      // 导入 HTTP 包
+)
+
+// 请求体校验。
+// 每个端点把请求体定义为一个实现了 requestValidator 的结构体 (DTO)，在 validate 中检查字段约束，
+// 处理函数调用 decodeAndValidateJSON 解析并校验请求体。校验失败时返回 400 和 INVALID_DATA，
+// 并在 fields 中列出每个字段的错误，例如：
+//
+//	{"error": "INVALID_DATA", "fields": [{"field": "password", "error": "REQUIRED"}]}
+//
+// validate 只检查请求体本身的格式，依赖数据库或配置的检查 (例如邮箱域名、密码强度) 仍然在处理函数中进行。
+
+// 字段错误码。
+const (
+	FieldErrorRequired = "REQUIRED" // 字段缺少、为 null 或者为空字符串
+	FieldErrorTooLong  = "TOO_LONG" // 字段超过最大长度
+	FieldErrorInvalid  = "INVALID"  // 字段格式错误
+)
+
+// maxPasswordLength 是密码的最大长度 (字节)。
+const maxPasswordLength = 127
+
+// fieldError 是请求体中一个字段的校验错误。
+type fieldError struct {
+	Field string `json:"field"` // JSON 中的字段名
+	Error string `json:"error"` // 字段错误码
+}
+
+// requestValidator 由请求体结构体实现，返回所有字段的校验错误，没有错误时返回空切片。
+type requestValidator interface {
+	validate() []fieldError
+}
+
+// decodeAndValidateJSON 读取请求体，解析到 dst 并调用 dst.validate()。
+// 失败时写入错误响应并返回 false，处理函数应直接返回：
+//   - 读取请求体失败时返回 500。
+//   - 请求体不是合法的 JSON 或字段类型不对时返回 jsonDecodeErrorCode 的错误码。
+//   - 校验失败时返回 INVALID_DATA 和字段错误。
+func decodeAndValidateJSON(w http.ResponseWriter, r *http.Request, dst requestValidator) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeUnexpectedErrorResponse(w)
+		return false
+	}
+	err = json.Unmarshal(body, dst)
+	if err != nil {
+		writeExpectedErrorResponse(w, jsonDecodeErrorCode(err))
+		return false
+	}
+	fieldErrors := dst.validate()
+	if len(fieldErrors) > 0 {
+		writeInvalidFieldsErrorResponse(w, fieldErrors)
+		return false
+	}
+	return true
+}
+
+// validateRequiredString 检查必填的字符串字段不为 nil、不为空字符串，并且不超过 maxLength 字节。
+// 有错误时把错误追加到 fieldErrors 并返回。
+func validateRequiredString(fieldErrors []fieldError, field string, value *string, maxLength int) []fieldError {
+	if value == nil || *value == "" {
+		return append(fieldErrors, fieldError{field, FieldErrorRequired})
+	}
+	if len(*value) > maxLength {
+		return append(fieldErrors, fieldError{field, FieldErrorTooLong})
+	}
+	return fieldErrors
+}
+
+// writeInvalidFieldsErrorResponse 返回 400、INVALID_DATA 错误和字段错误。
+func writeInvalidFieldsErrorResponse(w http.ResponseWriter, fieldErrors []fieldError) {
+	data := struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}{
+		Error:  ExpectedErrorInvalidData,
+		Fields: fieldErrors,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		writeExpectedErrorResponse(w, ExpectedErrorInvalidData)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(encoded)
+}
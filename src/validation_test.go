@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeFieldErrors 解析校验失败时的响应体，返回错误码和字段错误。
+func decodeFieldErrors(t *testing.T, body io.Reader) (string, []fieldError) {
+	var data struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}
+	err := json.NewDecoder(body).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.Error, data.Fields
+}
+
+// TestDecodeAndValidateJSON 测试 decodeAndValidateJSON 解析请求体，校验失败时返回字段错误。
+func TestDecodeAndValidateJSON(t *testing.T) {
+	t.Parallel()
+
+	longPassword := strings.Repeat("a", maxPasswordLength+1)
+	tests := []struct {
+		body        string
+		fieldErrors []fieldError
+	}{
+		{`{}`, []fieldError{{"password", FieldErrorRequired}}},
+		{`{"password":null}`, []fieldError{{"password", FieldErrorRequired}}},
+		{`{"password":""}`, []fieldError{{"password", FieldErrorRequired}}},
+		{`{"password":"` + longPassword + `"}`, []fieldError{{"password", FieldErrorTooLong}}},
+		{`{"email":"email"}`, []fieldError{{"password", FieldErrorRequired}, {"email", FieldErrorInvalid}}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		var data createUserRequest
+		assert.False(t, decodeAndValidateJSON(w, r, &data), test.body)
+		res := w.Result()
+		assert.Equal(t, 400, res.StatusCode)
+		errorCode, fieldErrors := decodeFieldErrors(t, res.Body)
+		assert.Equal(t, ExpectedErrorInvalidData, errorCode)
+		assert.Equal(t, test.fieldErrors, fieldErrors, test.body)
+	}
+
+	// 格式正确的请求体通过校验，不写入响应
+	r := httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"super_secure_password","email":"user@example.com"}`))
+	w := httptest.NewRecorder()
+	var data createUserRequest
+	assert.True(t, decodeAndValidateJSON(w, r, &data))
+	assert.Equal(t, "super_secure_password", *data.Password)
+	assert.Equal(t, "user@example.com", *data.Email)
+	assert.Equal(t, 0, w.Body.Len())
+
+	// 不是合法 JSON 的请求体不进行字段校验
+	r = httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":`))
+	w = httptest.NewRecorder()
+	assert.False(t, decodeAndValidateJSON(w, r, &createUserRequest{}))
+	errorCode, fieldErrors := decodeFieldErrors(t, w.Result().Body)
+	assert.Equal(t, ExpectedErrorMalformedJSON, errorCode)
+	assert.Empty(t, fieldErrors)
+}
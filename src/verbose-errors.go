@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 设置了 env.VerboseErrors 时，500 UNKNOWN_ERROR 响应包含 detail 字段，内容是内部错误的字符串，
+// 方便开发时调试。内部错误可能包含 SQL 语句、文件路径等信息，所以只能在开发环境中开启，默认不返回。
+// 无论是否开启，错误都由调用方写入日志。
+
+// writeUnexpectedErrorResponseWithDetail 和 writeUnexpectedErrorResponse 一样返回 500 UNKNOWN_ERROR，
+// 设置了 env.VerboseErrors 时响应中还包含 err 的字符串。不会写入日志。
+// 参数：
+//   env *Environment: 应用环境，包含 VerboseErrors。
+//   w http.ResponseWriter: HTTP 响应写入器。
+//   err error: 导致 500 的内部错误，可以为 nil。
+func writeUnexpectedErrorResponseWithDetail(env *Environment, w http.ResponseWriter, err error) {
+	if !env.VerboseErrors || err == nil {
+		writeUnexpectedErrorResponse(w)
+		return
+	}
+	encoded, marshalErr := json.Marshal(struct {
+		Error  string `json:"error"`
+		Detail string `json:"detail"`
+	}{"UNKNOWN_ERROR", err.Error()})
+	if marshalErr != nil {
+		writeUnexpectedErrorResponse(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(encoded)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"     // 导入 JSON 包，用于解析错误响应
+	"io"                // 导入 io 包，用于读取响应体
+	"net/http/httptest" // 导入 httptest 包，用于创建模拟的 HTTP 请求和响应
+	"testing"           // 导入 Go 的测试包
+
+	"github.com/stretchr/testify/assert" // 导入 testify 断言库
+)
+
+// TestVerboseErrors 测试数据库错误导致的 500 响应只有在设置了 env.VerboseErrors 时才包含 detail 字段。
+func TestVerboseErrors(t *testing.T) {
+	t.Parallel()
+
+	db := initializeTestDB(t)
+	defer db.Close()
+
+	// 删除表，让查询 TOTP 凭据时出错
+	_, err := db.Exec("DROP TABLE user_totp_credential")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getErrorResponse := func(verboseErrors bool) map[string]any {
+		env := createEnvironment(db, nil)
+		env.VerboseErrors = verboseErrors
+		app := CreateApp(env)
+
+		r := httptest.NewRequest("GET", "/users/1/totp-credential", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		res := w.Result()
+		assert.Equal(t, 500, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data map[string]any
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// 默认不返回内部错误
+	data := getErrorResponse(false)
+	assert.Equal(t, "UNKNOWN_ERROR", data["error"])
+	assert.NotContains(t, data, "detail")
+
+	data = getErrorResponse(true)
+	assert.Equal(t, "UNKNOWN_ERROR", data["error"])
+	assert.Contains(t, data["detail"], "no such table")
+}